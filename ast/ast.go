@@ -3,6 +3,7 @@ package ast
 import (
 	"bytes"
 	"go_interpreter/token"
+	"reflect"
 	"strings"
 )
 
@@ -10,6 +11,7 @@ import (
 type Node interface {
 	TokenLiteral() string // for debugging
 	String() string       // for debugging
+	Span() token.Span     // source code covered by node, for error messages
 }
 
 // Statement type for Node
@@ -37,6 +39,14 @@ func (p *Program) TokenLiteral() string {
 	}
 }
 
+func (p *Program) Span() token.Span {
+	if len(p.Statements) == 0 {
+		return token.Span{}
+	}
+
+	return p.Statements[0].Span().To(p.Statements[len(p.Statements)-1].Span())
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 
@@ -47,6 +57,15 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+// Helper function for spans of child nodes that may be missing after parse errors
+func spanOf(node Node) token.Span {
+	if node == nil || reflect.ValueOf(node).IsNil() {
+		return token.Span{}
+	}
+
+	return node.Span()
+}
+
 // Let Statement Node
 type LetStatement struct {
 	Token token.Token // token.LET
@@ -60,6 +79,10 @@ func (ls *LetStatement) TokenLiteral() string {
 	return ls.Token.Literal
 }
 
+func (ls *LetStatement) Span() token.Span {
+	return ls.Token.Span.To(spanOf(ls.Value))
+}
+
 func (ls *LetStatement) String() string {
 	var out bytes.Buffer
 
@@ -87,6 +110,10 @@ func (rs *ReturnStatement) TokenLiteral() string {
 	return rs.Token.Literal
 }
 
+func (rs *ReturnStatement) Span() token.Span {
+	return rs.Token.Span.To(spanOf(rs.Value))
+}
+
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 
@@ -100,6 +127,104 @@ func (rs *ReturnStatement) String() string {
 	return out.String()
 }
 
+// While Statement Node
+type WhileStatement struct {
+	Token     token.Token // token.WHILE
+	Condition Expression
+	Body      *BlockStatement
+}
+
+func (ws *WhileStatement) statementNode() {}
+
+func (ws *WhileStatement) TokenLiteral() string {
+	return ws.Token.Literal
+}
+
+func (ws *WhileStatement) Span() token.Span {
+	return ws.Token.Span.To(spanOf(ws.Body))
+}
+
+func (ws *WhileStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("while")
+	out.WriteString(ws.Condition.String())
+	out.WriteString(" ")
+	out.WriteString(ws.Body.String())
+
+	return out.String()
+}
+
+// For Statement Node
+// e.g. "for (x in [1, 2, 3]) { print(x); }"
+type ForStatement struct {
+	Token    token.Token // token.FOR
+	Variable *Identifier // bound to each element in turn
+	Iterable Expression  // array or hash (hash yields its keys)
+	Body     *BlockStatement
+}
+
+func (fs *ForStatement) statementNode() {}
+
+func (fs *ForStatement) TokenLiteral() string {
+	return fs.Token.Literal
+}
+
+func (fs *ForStatement) Span() token.Span {
+	return fs.Token.Span.To(spanOf(fs.Body))
+}
+
+func (fs *ForStatement) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("for (")
+	out.WriteString(fs.Variable.String())
+	out.WriteString(" in ")
+	out.WriteString(fs.Iterable.String())
+	out.WriteString(") ")
+	out.WriteString(fs.Body.String())
+
+	return out.String()
+}
+
+// Break Statement Node
+type BreakStatement struct {
+	Token token.Token // token.BREAK
+}
+
+func (bs *BreakStatement) statementNode() {}
+
+func (bs *BreakStatement) TokenLiteral() string {
+	return bs.Token.Literal
+}
+
+func (bs *BreakStatement) Span() token.Span {
+	return bs.Token.Span
+}
+
+func (bs *BreakStatement) String() string {
+	return bs.TokenLiteral() + ";"
+}
+
+// Continue Statement Node
+type ContinueStatement struct {
+	Token token.Token // token.CONTINUE
+}
+
+func (cs *ContinueStatement) statementNode() {}
+
+func (cs *ContinueStatement) TokenLiteral() string {
+	return cs.Token.Literal
+}
+
+func (cs *ContinueStatement) Span() token.Span {
+	return cs.Token.Span
+}
+
+func (cs *ContinueStatement) String() string {
+	return cs.TokenLiteral() + ";"
+}
+
 // Expression Statement Node
 // Wrapper: Statement consists of 1 Expression
 // e.g. "x + 5;" is valid
@@ -114,6 +239,10 @@ func (es *ExpressionStatement) TokenLiteral() string {
 	return es.Token.Literal
 }
 
+func (es *ExpressionStatement) Span() token.Span {
+	return es.Token.Span.To(spanOf(es.Expression))
+}
+
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String()
@@ -126,6 +255,7 @@ func (es *ExpressionStatement) String() string {
 type BlockStatement struct {
 	Token      token.Token // { token
 	Statements []Statement
+	Rbrace     token.Token // } token
 }
 
 func (bs *BlockStatement) statementNode() {}
@@ -134,6 +264,10 @@ func (bs *BlockStatement) TokenLiteral() string {
 	return bs.Token.Literal
 }
 
+func (bs *BlockStatement) Span() token.Span {
+	return bs.Token.Span.To(bs.Rbrace.Span)
+}
+
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 
@@ -156,6 +290,10 @@ func (i *Identifier) TokenLiteral() string {
 	return i.Token.Literal
 }
 
+func (i *Identifier) Span() token.Span {
+	return i.Token.Span
+}
+
 func (i *Identifier) String() string {
 	return i.Value
 }
@@ -172,10 +310,34 @@ func (il *IntegerLiteral) TokenLiteral() string {
 	return il.Token.Literal
 }
 
+func (il *IntegerLiteral) Span() token.Span {
+	return il.Token.Span
+}
+
 func (il *IntegerLiteral) String() string {
 	return il.Token.Literal
 }
 
+// Float Literal Expression Node
+type FloatLiteral struct {
+	Token token.Token // token.FLOAT
+	Value float64
+}
+
+func (fl *FloatLiteral) expressionNode() {}
+
+func (fl *FloatLiteral) TokenLiteral() string {
+	return fl.Token.Literal
+}
+
+func (fl *FloatLiteral) Span() token.Span {
+	return fl.Token.Span
+}
+
+func (fl *FloatLiteral) String() string {
+	return fl.Token.Literal
+}
+
 // Prefix Expression Node
 type Prefix struct {
 	Token    token.Token // prefix token e.g. "!"
@@ -189,6 +351,10 @@ func (p *Prefix) TokenLiteral() string {
 	return p.Token.Literal
 }
 
+func (p *Prefix) Span() token.Span {
+	return p.Token.Span.To(spanOf(p.Value))
+}
+
 func (p *Prefix) String() string {
 	var out bytes.Buffer
 
@@ -214,6 +380,10 @@ func (i *Infix) TokenLiteral() string {
 	return i.Token.Literal
 }
 
+func (i *Infix) Span() token.Span {
+	return spanOf(i.Left).To(i.Token.Span).To(spanOf(i.Right))
+}
+
 func (i *Infix) String() string {
 	var out bytes.Buffer
 
@@ -226,6 +396,36 @@ func (i *Infix) String() string {
 	return out.String()
 }
 
+// Assign Expression Node
+// e.g. "x = 5", "arr[0] = 5", "h["k"] = 5"
+type Assign struct {
+	Token  token.Token // token.ASSIGN
+	Target Expression  // Identifier or Index Node
+	Value  Expression
+}
+
+func (a *Assign) expressionNode() {}
+
+func (a *Assign) TokenLiteral() string {
+	return a.Token.Literal
+}
+
+func (a *Assign) Span() token.Span {
+	return spanOf(a.Target).To(a.Token.Span).To(spanOf(a.Value))
+}
+
+func (a *Assign) String() string {
+	var out bytes.Buffer
+
+	out.WriteString("(")
+	out.WriteString(a.Target.String())
+	out.WriteString(" = ")
+	out.WriteString(a.Value.String())
+	out.WriteString(")")
+
+	return out.String()
+}
+
 // Boolean Expression Node
 type Boolean struct {
 	Token token.Token // token.TRUE, token.FALSE
@@ -238,6 +438,10 @@ func (b *Boolean) TokenLiteral() string {
 	return b.Token.Literal
 }
 
+func (b *Boolean) Span() token.Span {
+	return b.Token.Span
+}
+
 func (b *Boolean) String() string {
 	return b.Token.Literal
 }
@@ -256,6 +460,14 @@ func (i *If) TokenLiteral() string {
 	return i.Token.Literal
 }
 
+func (i *If) Span() token.Span {
+	if i.Alternative != nil {
+		return i.Token.Span.To(i.Alternative.Span())
+	}
+
+	return i.Token.Span.To(spanOf(i.Consequence))
+}
+
 func (i *If) String() string {
 	var out bytes.Buffer
 
@@ -277,6 +489,7 @@ type Function struct {
 	Token      token.Token // token.FUNCTION
 	Parameters []*Identifier
 	Body       *BlockStatement
+	Name       string // name the function is bound to by let, if any
 }
 
 func (f *Function) expressionNode() {}
@@ -285,6 +498,10 @@ func (f *Function) TokenLiteral() string {
 	return f.Token.Literal
 }
 
+func (f *Function) Span() token.Span {
+	return f.Token.Span.To(spanOf(f.Body))
+}
+
 func (f *Function) String() string {
 	var out bytes.Buffer
 
@@ -308,6 +525,8 @@ type Call struct {
 	Token     token.Token // token.LPAREN
 	Function  Expression  // Identifier or Function Node
 	Arguments []Expression
+	Rparen    token.Token // token.RPAREN
+	Tail      bool        // Value is returned by the enclosing function, see MarkTailCalls
 }
 
 func (c *Call) expressionNode() {}
@@ -316,6 +535,10 @@ func (c *Call) TokenLiteral() string {
 	return c.Token.Literal
 }
 
+func (c *Call) Span() token.Span {
+	return spanOf(c.Function).To(c.Token.Span).To(c.Rparen.Span)
+}
+
 func (c *Call) String() string {
 	var out bytes.Buffer
 
@@ -344,6 +567,10 @@ func (s *String) TokenLiteral() string {
 	return s.Token.Literal
 }
 
+func (s *String) Span() token.Span {
+	return s.Token.Span
+}
+
 func (s *String) String() string {
 	return s.Token.Literal
 }
@@ -352,6 +579,7 @@ func (s *String) String() string {
 type Array struct {
 	Token    token.Token // token.LSQUARE
 	Elements []Expression
+	Rsquare  token.Token // token.RSQUARE
 }
 
 func (a *Array) expressionNode() {}
@@ -360,6 +588,10 @@ func (a *Array) TokenLiteral() string {
 	return a.Token.Literal
 }
 
+func (a *Array) Span() token.Span {
+	return a.Token.Span.To(a.Rsquare.Span)
+}
+
 func (a *Array) String() string {
 	var out bytes.Buffer
 
@@ -377,9 +609,10 @@ func (a *Array) String() string {
 
 // Index Expression Node
 type Index struct {
-	Token token.Token // token.LSQUARE
-	Array Expression  // item being accessed
-	Index Expression
+	Token   token.Token // token.LSQUARE
+	Array   Expression  // item being accessed
+	Index   Expression
+	Rsquare token.Token // token.RSQUARE
 }
 
 func (i *Index) expressionNode() {}
@@ -388,6 +621,10 @@ func (i *Index) TokenLiteral() string {
 	return i.Token.Literal
 }
 
+func (i *Index) Span() token.Span {
+	return spanOf(i.Array).To(i.Token.Span).To(i.Rsquare.Span)
+}
+
 func (i *Index) String() string {
 	var out bytes.Buffer
 
@@ -402,8 +639,9 @@ func (i *Index) String() string {
 
 // Hash Expression Node
 type Hash struct {
-	Token token.Token // token.LBRACE
-	Pairs map[Expression]Expression
+	Token  token.Token // token.LBRACE
+	Pairs  map[Expression]Expression
+	Rbrace token.Token // token.RBRACE
 }
 
 func (h *Hash) expressionNode() {}
@@ -412,6 +650,10 @@ func (h *Hash) TokenLiteral() string {
 	return h.Token.Literal
 }
 
+func (h *Hash) Span() token.Span {
+	return h.Token.Span.To(h.Rbrace.Span)
+}
+
 func (h *Hash) String() string {
 	var out bytes.Buffer
 
@@ -426,3 +668,62 @@ func (h *Hash) String() string {
 
 	return out.String()
 }
+
+// Marks the calls in a function body whose value the function returns directly,
+// so engines can run them without growing the call stack
+// These are "return f(x)" and calls that are the last expression of the body (or of a branch of an if there)
+// Nested functions are marked when they are parsed
+func MarkTailCalls(body *BlockStatement) {
+	markReturnCalls(body)
+	markTailExpression(lastExpression(body))
+}
+
+// Helper method to mark calls in return statements anywhere in a block, except inside nested functions
+func markReturnCalls(block *BlockStatement) {
+	if block == nil {
+		return
+	}
+
+	for _, statement := range block.Statements {
+		switch statement := statement.(type) {
+		case *ReturnStatement:
+			markTailExpression(statement.Value)
+		case *WhileStatement:
+			markReturnCalls(statement.Body)
+		case *ForStatement:
+			markReturnCalls(statement.Body)
+		case *BlockStatement:
+			markReturnCalls(statement)
+		case *ExpressionStatement:
+			if ifNode, ok := statement.Expression.(*If); ok {
+				markReturnCalls(ifNode.Consequence)
+				markReturnCalls(ifNode.Alternative)
+			}
+		}
+	}
+}
+
+// Helper method to mark an expression whose value is returned
+func markTailExpression(expression Expression) {
+	switch expression := expression.(type) {
+	case *Call:
+		expression.Tail = true
+	case *If:
+		markTailExpression(lastExpression(expression.Consequence))
+		markTailExpression(lastExpression(expression.Alternative))
+	}
+}
+
+// Helper method to get the expression giving a block its value, if any
+func lastExpression(block *BlockStatement) Expression {
+	if block == nil || len(block.Statements) == 0 {
+		return nil
+	}
+
+	statement, ok := block.Statements[len(block.Statements)-1].(*ExpressionStatement)
+	if !ok {
+		return nil
+	}
+
+	return statement.Expression
+}
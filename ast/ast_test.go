@@ -9,9 +9,9 @@ import (
 func TestString(t *testing.T) {
 	prog := &Program{
 		Statements: []Statement{
-			&LetStatement{token.Token{token.LET, "let"},
-				&Identifier{token.Token{token.IDENT, "v1"}, "v1"},
-				&Identifier{token.Token{token.IDENT, "v2"}, "v2"},
+			&LetStatement{token.Token{Type: token.LET, Literal: "let"},
+				&Identifier{token.Token{Type: token.IDENT, Literal: "v1"}, "v1"},
+				&Identifier{token.Token{Type: token.IDENT, Literal: "v2"}, "v2"},
 			},
 		},
 	}
@@ -3,16 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
+	"go_interpreter/ast"
 	"go_interpreter/compiler"
 	"go_interpreter/evaluator"
 	"go_interpreter/lexer"
 	"go_interpreter/object"
 	"go_interpreter/parser"
+	"go_interpreter/regvm"
 	"go_interpreter/vm"
 	"time"
 )
 
-var engine = flag.String("engine", "vm", "use 'vm' or 'eval'")
+var engine = flag.String("engine", "all", "use 'vm', 'vm-O' (optimized bytecode), 'regvm', 'eval' or 'all' to compare them")
 
 var input = `
 let fibonacci = fn(x) {
@@ -29,46 +31,106 @@ let fibonacci = fn(x) {
 fibonacci(35);
 `
 
+// Runs the program on one engine, timing only the run (not parsing or compiling)
+type runner func(program *ast.Program) (object.Object, time.Duration, error)
+
+var engines = map[string]runner{
+	"vm":    runVM,
+	"vm-O":  runOptimizedVM,
+	"regvm": runRegisterVM,
+	"eval":  runEvaluator,
+}
+
 func main() {
 	flag.Parse()
 
-	var duration time.Duration
-	var result object.Object
+	names := []string{*engine}
+	if *engine == "all" {
+		names = []string{"vm", "vm-O", "regvm", "eval"}
+	}
 
 	l := lexer.BuildLexer(input)
 	p := parser.BuildParser(l)
 	program := p.ParseProgram()
 
-	if *engine == "vm" {
-		comp := compiler.BuildCompiler()
-		err := comp.Compile(program)
-		if err != nil {
-			fmt.Printf("compiler error: %s", err)
+	for _, name := range names {
+		run, ok := engines[name]
+		if !ok {
+			fmt.Printf("unknown engine %q\n", name)
 			return
 		}
 
-		machine := vm.BuildVM(comp.Bytecode())
-
-		start := time.Now()
-
-		err = machine.Run()
+		result, duration, err := run(program)
 		if err != nil {
-			fmt.Printf("vm error: %s", err)
+			fmt.Printf("%s error: %s\n", name, err)
 			return
 		}
 
-		duration = time.Since(start)
-		result = machine.LastPopped()
-	} else {
-		env := object.BuildEnvironment()
-		start := time.Now()
-		result = evaluator.Eval(program, env)
-		duration = time.Since(start)
+		fmt.Printf(
+			"engine=%s, result=%s, duration=%s\n",
+			name,
+			result.Inspect(),
+			duration)
+	}
+}
+
+func runVM(program *ast.Program) (object.Object, time.Duration, error) {
+	return runCompiledVM(program, false)
+}
+
+// Like runVM, with the optimizer's constant folding and specialised opcodes
+func runOptimizedVM(program *ast.Program) (object.Object, time.Duration, error) {
+	return runCompiledVM(program, true)
+}
+
+// Helper method to compile the program, optimizing it if asked, and time running it on the VM
+func runCompiledVM(program *ast.Program, optimize bool) (object.Object, time.Duration, error) {
+	comp := compiler.BuildCompiler()
+	comp.SetOptimize(optimize)
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	machine := vm.BuildVM(comp.Bytecode())
+
+	start := time.Now()
+	err = machine.Run()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return machine.LastPopped(), time.Since(start), nil
+}
+
+func runRegisterVM(program *ast.Program) (object.Object, time.Duration, error) {
+	comp := regvm.BuildCompiler()
+	err := comp.Compile(program)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	machine := regvm.BuildVM(comp.Bytecode())
+
+	start := time.Now()
+	err = machine.Run()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return machine.LastPopped(), time.Since(start), nil
+}
+
+func runEvaluator(program *ast.Program) (object.Object, time.Duration, error) {
+	env := object.BuildEnvironment()
+
+	start := time.Now()
+	result := evaluator.Eval(program, env)
+	duration := time.Since(start)
+
+	if err, ok := result.(*object.Error); ok {
+		return nil, 0, err
 	}
 
-	fmt.Printf(
-		"engine=%s, result=%s, duration=%s\n",
-		*engine,
-		result.Inspect(),
-		duration)
+	return result, duration, nil
 }
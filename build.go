@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extension of bytecode files written by the build command
+const BYTECODE_EXTENSION = ".mkc"
+
+// toy build a.mk b.mk ... [-O] [-o out.mkc]
+func buildCommand(arguments []string, optimize bool) int {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	output := flags.String("o", "", "bytecode file to write (default: first file with a "+BYTECODE_EXTENSION+" extension)")
+	flags.BoolVar(&optimize, "O", optimize, "optimize compiled bytecode")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: toy build a.mk b.mk ... [-o out"+BYTECODE_EXTENSION+"]")
+		flags.PrintDefaults()
+	}
+	// Flags may come after the files, as in "toy build foo.mk -o foo.mkc"
+	paths := []string{}
+	for {
+		if err := flags.Parse(arguments); err != nil {
+			return EXIT_USAGE_ERROR
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		paths = append(paths, flags.Arg(0))
+		arguments = flags.Args()[1:]
+	}
+	if len(paths) == 0 {
+		flags.Usage()
+		return EXIT_USAGE_ERROR
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(paths[0], filepath.Ext(paths[0])) + BYTECODE_EXTENSION
+	}
+
+	prog, code := parseFiles(paths, nil, os.Stderr)
+	if code != EXIT_OK {
+		return code
+	}
+
+	bytecode, err := compileScript(prog, nil, optimize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Compile-time error: %s\n", err)
+		return EXIT_SOURCE_ERROR
+	}
+
+	data, err := bytecode.Encode()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_SOURCE_ERROR
+	}
+
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE_ERROR
+	}
+
+	return EXIT_OK
+}
@@ -20,6 +20,7 @@ const (
 	OpEqual                       // 0 operands
 	OpNotEqual                    // 0 operands
 	OpGreater                     // 0 operands
+	OpLess                        // 0 operands
 	OpMinus                       // 0 operands
 	OpBang                        // 0 operands
 	OpJumpNotTruthy               // 1 operand: jump offset if stack top is false, not null
@@ -36,6 +37,29 @@ const (
 	OpSetLocal                    // 1 operand: unique index of local binding
 	OpGetLocal                    // 1 operand: unique index of local binding
 	OpGetBuiltin                  // 1 operand: index of builtin function
+	OpClosure                     // 2 operands: constant index of function, number of free variables
+	OpGetFree                     // 1 operand: index of free variable
+	OpIter                        // 0 operands: replace collection at stack top with an iterator
+	OpIterNext                    // 1 operand: jump offset once iterator at stack top is exhausted
+	OpSetFree                     // 1 operand: index of free variable
+	OpSetIndex                    // 0 operands: store value at stack top into collection[index] below it
+	OpTailCall                    // 1 operand: number of arguments in call (reuses the current frame)
+	OpGetCell                     // 1 operand: index of local kept in a cell, push its value
+	OpSetCell                     // 1 operand: index of local kept in a cell, set its value
+	OpCaptureLocal                // 1 operand: index of local kept in a cell, push the cell for OpClosure
+	OpCaptureFree                 // 1 operand: index of free variable, push its cell for OpClosure
+
+	// Specialised opcodes, only generated by the optimizer
+	OpGetLocal0             // 0 operands: OpGetLocal 0
+	OpGetLocal1             // 0 operands: OpGetLocal 1
+	OpGetLocal2             // 0 operands: OpGetLocal 2
+	OpSmallInteger          // 1 operand: integer from 0 to 255 to push
+	OpAddConstant           // 1 operand: constant index, same as OpConstant then OpAdd
+	OpSubConstant           // 1 operand: constant index, same as OpConstant then OpSub
+	OpGreaterJumpNotTruthy  // 1 operand: jump offset, same as OpGreater then OpJumpNotTruthy
+	OpLessJumpNotTruthy     // 1 operand: jump offset, same as OpLess then OpJumpNotTruthy
+	OpEqualJumpNotTruthy    // 1 operand: jump offset, same as OpEqual then OpJumpNotTruthy
+	OpNotEqualJumpNotTruthy // 1 operand: jump offset, same as OpNotEqual then OpJumpNotTruthy
 )
 
 type Definition struct {
@@ -55,6 +79,7 @@ var definitions = map[Opcode]*Definition{
 	OpEqual:         {"OpEqual", []int{}},
 	OpNotEqual:      {"OpNotEqual", []int{}},
 	OpGreater:       {"OpGreater", []int{}},
+	OpLess:          {"OpLess", []int{}},
 	OpMinus:         {"OpMinus", []int{}},
 	OpBang:          {"OpBang", []int{}},
 	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
@@ -71,6 +96,28 @@ var definitions = map[Opcode]*Definition{
 	OpGetLocal:      {"OpGetLocal", []int{1}},
 	OpSetLocal:      {"OpSetLocal", []int{1}},
 	OpGetBuiltin:    {"OpGetBuiltin", []int{1}},
+	OpClosure:       {"OpClosure", []int{2, 1}},
+	OpGetFree:       {"OpGetFree", []int{1}},
+	OpIter:          {"OpIter", []int{}},
+	OpIterNext:      {"OpIterNext", []int{2}},
+	OpSetFree:       {"OpSetFree", []int{1}},
+	OpSetIndex:      {"OpSetIndex", []int{}},
+	OpTailCall:      {"OpTailCall", []int{1}},
+	OpGetCell:       {"OpGetCell", []int{1}},
+	OpSetCell:       {"OpSetCell", []int{1}},
+	OpCaptureLocal:  {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:   {"OpCaptureFree", []int{1}},
+
+	OpGetLocal0:             {"OpGetLocal0", []int{}},
+	OpGetLocal1:             {"OpGetLocal1", []int{}},
+	OpGetLocal2:             {"OpGetLocal2", []int{}},
+	OpSmallInteger:          {"OpSmallInteger", []int{1}},
+	OpAddConstant:           {"OpAddConstant", []int{2}},
+	OpSubConstant:           {"OpSubConstant", []int{2}},
+	OpGreaterJumpNotTruthy:  {"OpGreaterJumpNotTruthy", []int{2}},
+	OpLessJumpNotTruthy:     {"OpLessJumpNotTruthy", []int{2}},
+	OpEqualJumpNotTruthy:    {"OpEqualJumpNotTruthy", []int{2}},
+	OpNotEqualJumpNotTruthy: {"OpNotEqualJumpNotTruthy", []int{2}},
 }
 
 // Make instruction from op and operands (Big Endian)
@@ -108,6 +155,23 @@ func Make(op Opcode, operands ...int) []byte {
 	return instruction
 }
 
+// Checks that operands fit in the bytes op has for them, since Make cuts off what doesn't fit
+func CheckOperands(op Opcode, operands ...int) error {
+	definition, ok := definitions[op]
+	if !ok {
+		return fmt.Errorf("Opcode %d undefined", op)
+	}
+
+	for i, o := range operands {
+		max := 1<<(8*definition.OperandWidths[i]) - 1
+		if o < 0 || o > max {
+			return fmt.Errorf("%s operand %d is out of range (0 to %d)", definition.Name, o, max)
+		}
+	}
+
+	return nil
+}
+
 func ReadUint16(i Instructions) uint16 {
 	return binary.BigEndian.Uint16(i)
 }
@@ -125,3 +189,22 @@ func Lookup(op byte) (*Definition, error) {
 
 	return definition, nil
 }
+
+// Decode the operands of an instruction, returning them and the number of bytes read
+func ReadOperands(definition *Definition, ins Instructions) ([]int, int) {
+	operands := make([]int, len(definition.OperandWidths))
+	offset := 0
+
+	for i, width := range definition.OperandWidths {
+		switch width {
+		case 1:
+			operands[i] = int(ReadUint8(ins[offset:]))
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		}
+
+		offset += width
+	}
+
+	return operands, offset
+}
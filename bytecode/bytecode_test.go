@@ -2,6 +2,7 @@ package bytecode
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go_interpreter/token"
 	"testing"
 )
 
@@ -26,6 +27,11 @@ func TestMake(t *testing.T) {
 			[]int{255},
 			[]byte{byte(OpGetLocal), 255},
 		},
+		{
+			OpClosure,
+			[]int{65534, 255},
+			[]byte{byte(OpClosure), 255, 254, 255},
+		},
 	}
 
 	for _, test := range tests {
@@ -38,3 +44,134 @@ func TestMake(t *testing.T) {
 		}
 	}
 }
+
+func TestLineTable(t *testing.T) {
+	first := token.Span{Start: token.Position{Line: 1, Column: 1}}
+	second := token.Span{Start: token.Position{Line: 2, Column: 1}}
+
+	lines := LineTable{}
+	lines.Add(0, first)
+	lines.Add(3, first)
+	lines.Add(4, second)
+	lines.Add(6, second)
+	assert.Equal(t, 2, len(lines), "Repeated spans share an entry")
+
+	assert.Equal(t, token.Span{}, LineTable{}.Lookup(0), "Empty table")
+	assert.Equal(t, first, lines.Lookup(0))
+	assert.Equal(t, first, lines.Lookup(3))
+	assert.Equal(t, second, lines.Lookup(4))
+	assert.Equal(t, second, lines.Lookup(100))
+
+	// Instructions from offset 4 onwards were removed and replaced
+	lines.Add(4, first)
+	assert.Equal(t, 1, len(lines), "Removed instructions drop their entries")
+	assert.Equal(t, first, lines.Lookup(5))
+}
+
+func TestReadOperands(t *testing.T) {
+	instruction := Make(OpClosure, 65535, 255)
+	definition, err := Lookup(byte(OpClosure))
+	assert.Nil(t, err)
+
+	operands, read := ReadOperands(definition, instruction[1:])
+	assert.Equal(t, 3, read)
+	assert.Equal(t, []int{65535, 255}, operands)
+}
+
+func TestValidate(t *testing.T) {
+	ins := Instructions{}
+	ins = append(ins, Make(OpTrue)...)
+	ins = append(ins, Make(OpJumpNotTruthy, 7)...)
+	ins = append(ins, Make(OpConstant, 0)...)
+	ins = append(ins, Make(OpPop)...)
+
+	decoded, err := Validate(ins)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(decoded))
+	assert.Equal(t, Instruction{Offset: 1, Op: OpJumpNotTruthy, Operands: []int{7}}, decoded[1])
+
+	_, err = Validate(append(Instructions{}, Make(OpJump, 2)...))
+	assert.NotNil(t, err, "Jump into own operand")
+
+	_, err = Validate(Make(OpConstant, 1)[:2])
+	assert.NotNil(t, err, "Truncated operand")
+}
+
+func TestStackDepth(t *testing.T) {
+	// [1, 2] then a for-in loop over it popping each item
+	ins := Instructions{}
+	ins = append(ins, Make(OpConstant, 0)...)
+	ins = append(ins, Make(OpConstant, 1)...)
+	ins = append(ins, Make(OpArray, 2)...)
+	ins = append(ins, Make(OpIter)...)
+	ins = append(ins, Make(OpIterNext, 17)...)
+	ins = append(ins, Make(OpPop)...)
+	ins = append(ins, Make(OpJump, 10)...)
+
+	decoded, err := Validate(ins)
+	assert.Nil(t, err)
+	depth, err := StackDepth(decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, depth)
+
+	decoded, _ = Validate(append(ins, Make(OpPop)...))
+	_, err = StackDepth(decoded)
+	assert.NotNil(t, err, "Pop after the loop dropped the iterator")
+}
+
+// Minimal constants for the disassembler
+type testConstant string
+
+func (c testConstant) Inspect() string { return string(c) }
+
+type testFunction struct{ body Instructions }
+
+func (f testFunction) Inspect() string    { return "fn" }
+func (f testFunction) Body() Instructions { return f.body }
+func (f testFunction) Signature() string  { return "fn inc(1 params, 1 locals)" }
+
+func TestInstructionsString(t *testing.T) {
+	ins := Instructions{}
+	ins = append(ins, Make(OpAdd)...)
+	ins = append(ins, Make(OpGetLocal, 1)...)
+	ins = append(ins, Make(OpConstant, 2)...)
+	ins = append(ins, Make(OpConstant, 65535)...)
+	ins = append(ins, Make(OpClosure, 65535, 255)...)
+
+	expected := `0000 OpAdd
+0001 OpGetLocal 1
+0003 OpConstant 2
+0006 OpConstant 65535
+0009 OpClosure 65535 255
+`
+
+	assert.Equal(t, expected, ins.String())
+}
+
+func TestDisassemble(t *testing.T) {
+	body := Instructions{}
+	body = append(body, Make(OpGetLocal, 0)...)
+	body = append(body, Make(OpConstant, 0)...)
+	body = append(body, Make(OpAdd)...)
+	body = append(body, Make(OpReturnValue)...)
+
+	ins := Instructions{}
+	ins = append(ins, Make(OpConstant, 0)...)
+	ins = append(ins, Make(OpClosure, 1, 0)...)
+	ins = append(ins, Make(OpPop)...)
+	ins = append(ins, 255)
+
+	constants := []Constant{testConstant("1"), testFunction{body}}
+
+	expected := `0000 OpConstant 0 (1)
+0003 OpClosure 1 0 (fn inc(1 params, 1 locals))
+    0000 OpGetLocal 0
+    0002 OpConstant 0 (1)
+    0005 OpAdd
+    0006 OpReturnValue
+0007 OpPop
+0008 ERROR: Opcode 255 undefined
+`
+
+	assert.Equal(t, expected, Disassemble(ins, constants))
+}
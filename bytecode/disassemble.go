@@ -0,0 +1,95 @@
+package bytecode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constant pool entries as seen by the disassembler (object.Object satisfies this)
+type Constant interface {
+	Inspect() string
+}
+
+// Constants with instructions of their own, such as compiled functions
+type FunctionConstant interface {
+	Constant
+	Body() Instructions
+	Signature() string // e.g. "fn add(2 params, 3 locals)"
+}
+
+// Lists instructions one per line as offset, opcode name and operands
+// e.g.
+//
+//	0000 OpConstant 1
+//	0003 OpPop
+func (ins Instructions) String() string {
+	return Disassemble(ins, nil)
+}
+
+// Like Instructions.String, but resolves constant operands using the constant pool
+// and lists the body of each compiled function below the instruction that loads it
+func Disassemble(ins Instructions, constants []Constant) string {
+	var out strings.Builder
+	disassemble(&out, ins, constants, "")
+	return out.String()
+}
+
+// Opcodes whose first operand is a constant index
+var takesConstant = map[Opcode]bool{
+	OpConstant:    true,
+	OpClosure:     true,
+	OpAddConstant: true,
+	OpSubConstant: true,
+}
+
+// Helper method to write instructions with indent before each line
+func disassemble(out *strings.Builder, ins Instructions, constants []Constant, indent string) {
+	for i := 0; i < len(ins); {
+		definition, err := Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(out, "%s%04d ERROR: %s\n", indent, i, err)
+			i++
+			continue
+		}
+
+		width := 0
+		for _, w := range definition.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			fmt.Fprintf(out, "%s%04d ERROR: %s is missing operands\n", indent, i, definition.Name)
+			return
+		}
+
+		operands, read := ReadOperands(definition, ins[i+1:])
+		fmt.Fprintf(out, "%s%04d %s", indent, i, formatInstruction(definition, operands))
+
+		// Constant index is the first operand of every opcode that takes one
+		var function FunctionConstant
+		if takesConstant[Opcode(ins[i])] && operands[0] < len(constants) {
+			constant := constants[operands[0]]
+			if f, ok := constant.(FunctionConstant); ok {
+				function = f
+				fmt.Fprintf(out, " (%s)", f.Signature())
+			} else {
+				fmt.Fprintf(out, " (%s)", constant.Inspect())
+			}
+		}
+		out.WriteString("\n")
+
+		if function != nil {
+			disassemble(out, function.Body(), constants, indent+"    ")
+		}
+
+		i += 1 + read
+	}
+}
+
+// Helper method to render an opcode name followed by its operands
+func formatInstruction(definition *Definition, operands []int) string {
+	parts := []string{definition.Name}
+	for _, operand := range operands {
+		parts = append(parts, fmt.Sprint(operand))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,45 @@
+package bytecode
+
+import (
+	"go_interpreter/token"
+	"sort"
+)
+
+// Maps instruction offsets to the source code they were compiled from
+// Only records offsets where the source changes, so straight-line code for one node costs one entry
+type LineTable []LineEntry
+
+type LineEntry struct {
+	Offset int        // First instruction compiled from Span
+	Span   token.Span // Source code of node being compiled
+}
+
+// Records that instructions from offset onwards come from span
+// Entries at or after offset belong to instructions that were removed, so they are dropped
+func (lt *LineTable) Add(offset int, span token.Span) {
+	entries := *lt
+	for len(entries) > 0 && entries[len(entries)-1].Offset >= offset {
+		entries = entries[:len(entries)-1]
+	}
+
+	if len(entries) > 0 && entries[len(entries)-1].Span == span {
+		*lt = entries
+		return
+	}
+
+	*lt = append(entries, LineEntry{Offset: offset, Span: span})
+}
+
+// Source code of the instruction at offset, or an invalid span if unknown
+func (lt LineTable) Lookup(offset int) token.Span {
+	// Index of first entry after offset
+	i := sort.Search(len(lt), func(i int) bool {
+		return lt[i].Offset > offset
+	})
+
+	if i == 0 {
+		return token.Span{}
+	}
+
+	return lt[i-1].Span
+}
@@ -0,0 +1,183 @@
+package bytecode
+
+import "fmt"
+
+// Opcodes whose first operand is an absolute jump target
+var jumps = map[Opcode]bool{
+	OpJump:          true,
+	OpJumpNotTruthy: true,
+	OpIterNext:      true,
+
+	OpGreaterJumpNotTruthy:  true,
+	OpLessJumpNotTruthy:     true,
+	OpEqualJumpNotTruthy:    true,
+	OpNotEqualJumpNotTruthy: true,
+}
+
+// An instruction as found by Validate
+type Instruction struct {
+	Offset   int    // Position of the opcode
+	Op       Opcode // Opcode of instruction
+	Operands []int  // Decoded operands
+}
+
+// Checks that every opcode is defined, every operand fits in the instructions,
+// and every jump lands on the start of an instruction (or just past the end)
+// Returns the decoded instructions so callers can check operands against their own bounds
+func Validate(ins Instructions) ([]Instruction, error) {
+	decoded := []Instruction{}
+	starts := map[int]bool{}
+
+	for i := 0; i < len(ins); {
+		definition, err := Lookup(ins[i])
+		if err != nil {
+			return nil, fmt.Errorf("offset %d: %s", i, err)
+		}
+
+		width := 0
+		for _, w := range definition.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			return nil, fmt.Errorf("offset %d: %s is missing operands", i, definition.Name)
+		}
+
+		operands, read := ReadOperands(definition, ins[i+1:])
+		decoded = append(decoded, Instruction{Offset: i, Op: Opcode(ins[i]), Operands: operands})
+		starts[i] = true
+		i += 1 + read
+	}
+
+	for _, instruction := range decoded {
+		if !jumps[instruction.Op] {
+			continue
+		}
+
+		target := instruction.Operands[0]
+		if target != len(ins) && !starts[target] {
+			return nil, fmt.Errorf("offset %d: %s jumps to %d, which is not the start of an instruction",
+				instruction.Offset, definitions[instruction.Op].Name, target)
+		}
+	}
+
+	return decoded, nil
+}
+
+// Helper method to get how many values an instruction takes off the stack and puts on it
+// OpIterNext is left to StackDepth, since what it leaves depends on whether it jumps
+func stackEffect(instruction Instruction) (int, int) {
+	switch instruction.Op {
+	case OpConstant, OpTrue, OpFalse, OpNull, OpGetGlobal, OpGetLocal, OpGetBuiltin, OpGetFree,
+		OpGetCell, OpCaptureLocal, OpCaptureFree, OpGetLocal0, OpGetLocal1, OpGetLocal2, OpSmallInteger:
+		return 0, 1
+	case OpAdd, OpSub, OpMul, OpDiv, OpEqual, OpNotEqual, OpGreater, OpLess, OpIndex:
+		return 2, 1
+	case OpMinus, OpBang, OpIter, OpAddConstant, OpSubConstant:
+		return 1, 1
+	case OpPop, OpSetGlobal, OpSetLocal, OpSetFree, OpSetCell, OpJumpNotTruthy, OpReturnValue:
+		return 1, 0
+	case OpGreaterJumpNotTruthy, OpLessJumpNotTruthy, OpEqualJumpNotTruthy, OpNotEqualJumpNotTruthy:
+		return 2, 0
+	case OpArray, OpHash:
+		return instruction.Operands[0], 1
+	case OpCall, OpTailCall:
+		// Callee and arguments, replaced by the result
+		return instruction.Operands[0] + 1, 1
+	case OpClosure:
+		// Cells of the captured variables
+		return instruction.Operands[1], 1
+	case OpSetIndex:
+		// Collection, index and value, leaving the value
+		return 3, 1
+	default:
+		return 0, 0
+	}
+}
+
+// Checks that no instruction takes more values off the stack than are on it,
+// and that every path to an instruction leaves the same number of values on the stack
+// Returns the most values on the stack at once, so callers can check it against their own limits
+func StackDepth(decoded []Instruction) (int, error) {
+	if len(decoded) == 0 {
+		return 0, nil
+	}
+
+	indexes := make(map[int]int, len(decoded))
+	depths := make([]int, len(decoded))
+	for i, instruction := range decoded {
+		indexes[instruction.Offset] = i
+		depths[i] = -1
+	}
+
+	depths[0] = 0
+	pending := []int{0}
+	maxDepth := 0
+
+	// Helper method to record the depth a path reaches the instruction at offset with, and visit it if it's new
+	reach := func(from Instruction, offset int, depth int) error {
+		i, ok := indexes[offset]
+		if !ok {
+			// Just past the end
+			return nil
+		}
+
+		if depths[i] == -1 {
+			depths[i] = depth
+			pending = append(pending, i)
+		} else if depths[i] != depth {
+			return fmt.Errorf("offset %d: %s reaches offset %d with %d values on the stack instead of %d",
+				from.Offset, definitions[from.Op].Name, offset, depth, depths[i])
+		}
+		return nil
+	}
+
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		instruction := decoded[i]
+		depth := depths[i]
+
+		pops, pushes := stackEffect(instruction)
+		if instruction.Op == OpIterNext {
+			// Iterator stays for the next item, or is dropped when the loop ends
+			pops, pushes = 1, 2
+		}
+		if depth < pops {
+			return 0, fmt.Errorf("offset %d: stack underflow (%s takes %d values, %d on the stack)",
+				instruction.Offset, definitions[instruction.Op].Name, pops, depth)
+		}
+		after := depth - pops + pushes
+		if after > maxDepth {
+			maxDepth = after
+		}
+
+		next := -1
+		if i+1 < len(decoded) {
+			next = decoded[i+1].Offset
+		}
+
+		var err error
+		switch {
+		case instruction.Op == OpReturnValue || instruction.Op == OpReturnNothing:
+		case instruction.Op == OpJump:
+			err = reach(instruction, instruction.Operands[0], after)
+		case instruction.Op == OpIterNext:
+			err = reach(instruction, instruction.Operands[0], depth-1)
+			if err == nil {
+				err = reach(instruction, next, after)
+			}
+		case jumps[instruction.Op]:
+			err = reach(instruction, instruction.Operands[0], after)
+			if err == nil {
+				err = reach(instruction, next, after)
+			}
+		default:
+			err = reach(instruction, next, after)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return maxDepth, nil
+}
@@ -0,0 +1,91 @@
+package compiler
+
+import "go_interpreter/ast"
+
+// Names that function literals nested in body refer to
+// Locals of the function with these names may be captured by closures, so they're kept in cells the closures share
+// Names a nested function defines itself are included too; keeping those in cells is only a little slower
+func CapturedNames(body *ast.BlockStatement) map[string]bool {
+	names := map[string]bool{}
+	collectNames(body, false, names)
+	return names
+}
+
+// Helper method to add the identifiers in node to names, if node is inside a nested function
+func collectNames(node ast.Node, nested bool, names map[string]bool) {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		for _, statement := range node.Statements {
+			collectNames(statement, nested, names)
+		}
+	case *ast.ExpressionStatement:
+		collectNames(node.Expression, nested, names)
+	case *ast.LetStatement:
+		collectNames(node.Name, nested, names)
+		collectNames(node.Value, nested, names)
+	case *ast.ReturnStatement:
+		collectNames(node.Value, nested, names)
+	case *ast.WhileStatement:
+		collectNames(node.Condition, nested, names)
+		collectNames(node.Body, nested, names)
+	case *ast.ForStatement:
+		collectNames(node.Variable, nested, names)
+		collectNames(node.Iterable, nested, names)
+		collectNames(node.Body, nested, names)
+	case *ast.Identifier:
+		if nested {
+			names[node.Value] = true
+		}
+	case *ast.Function:
+		collectNames(node.Body, true, names)
+	case *ast.Prefix:
+		collectNames(node.Value, nested, names)
+	case *ast.Infix:
+		collectNames(node.Left, nested, names)
+		collectNames(node.Right, nested, names)
+	case *ast.Assign:
+		collectNames(node.Target, nested, names)
+		collectNames(node.Value, nested, names)
+	case *ast.If:
+		collectNames(node.Condition, nested, names)
+		collectNames(node.Consequence, nested, names)
+		if node.Alternative != nil {
+			collectNames(node.Alternative, nested, names)
+		}
+	case *ast.Call:
+		collectNames(node.Function, nested, names)
+		for _, argument := range node.Arguments {
+			collectNames(argument, nested, names)
+		}
+	case *ast.Array:
+		for _, element := range node.Elements {
+			collectNames(element, nested, names)
+		}
+	case *ast.Hash:
+		for key, value := range node.Pairs {
+			collectNames(key, nested, names)
+			collectNames(value, nested, names)
+		}
+	case *ast.Index:
+		collectNames(node.Array, nested, names)
+		collectNames(node.Index, nested, names)
+	}
+}
+
+// Names that let statements in statements bind to function literals
+// These are defined before the statements are compiled, like the evaluator finds them when the functions are called
+func HoistedNames(statements []ast.Statement) []string {
+	names := []string{}
+	for _, statement := range statements {
+		let, ok := statement.(*ast.LetStatement)
+		if !ok {
+			continue
+		}
+
+		_, ok = let.Value.(*ast.Function)
+		if ok {
+			names = append(names, let.Name.Value)
+		}
+	}
+	return names
+}
@@ -1,19 +1,18 @@
 package compiler
 
 import (
-	"fmt"
-	"github.com/fatih/color"
 	"go_interpreter/ast"
 	"go_interpreter/bytecode"
 	"go_interpreter/object"
+	"go_interpreter/token"
+	"go_interpreter/trace"
 	"sort"
 )
 
-var PRINT_COMPILER = false
-
 type Bytecode struct {
 	Instructions bytecode.Instructions // Instructions generated by compiler
 	Constants    []object.Object       // Constants evaluated by compiler
+	Lines        bytecode.LineTable    // Source code of main program instructions
 }
 
 type EmittedInstruction struct {
@@ -21,6 +20,13 @@ type EmittedInstruction struct {
 	Position int             // Position the instruction was emitted to
 }
 
+// Jump targets of a loop being compiled
+type EnclosingLoop struct {
+	startPosition  int   // Position continue jumps back to
+	breakPositions []int // Positions of OpJump emitted for break (will backpatch)
+	hasIterator    bool  // For-in loops keep an iterator on the stack
+}
+
 // Before entering new scope, push new CompilationScope onto scope stack
 // When compiling inside scope, emit() only modifies current CompilationScope
 // After leaving scope, pop it off scope stack and add instructions to *object.CompiledFunction
@@ -28,6 +34,8 @@ type CompilationScope struct {
 	instructions            bytecode.Instructions // Generated bytecode
 	lastInstruction         EmittedInstruction    // Last instruction emitted
 	secondToLastInstruction EmittedInstruction    // Second to last instruction emitted
+	loops                   []*EnclosingLoop      // Loops enclosing the current instruction (innermost last)
+	lines                   bytecode.LineTable    // Source code of generated bytecode
 }
 
 // Translates AST to bytecode
@@ -36,6 +44,10 @@ type Compiler struct {
 	scopes      []CompilationScope // Scope stack
 	scopeIndex  int                // Top of scope stack
 	symbolTable *SymbolTable       // Store info about each identifier
+	span        token.Span         // Source code of node being compiled
+	tracer      trace.Tracer       // Told about every node compiled and instruction emitted, nil for none
+	optimize    bool               // Fold constants, share equal constants and clean up the bytecode
+	operandErr  error              // First operand too big for its instruction, nil for none
 }
 
 func BuildCompiler() *Compiler {
@@ -65,6 +77,26 @@ func BuildStatefulCompiler(s *SymbolTable, constants []object.Object) *Compiler
 	return compiler
 }
 
+// Reports the nodes compiled and instructions emitted from now on to tracer
+// Instructions are reported as emitted, before -O rewrites them
+func (c *Compiler) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+}
+
+// Folds constant expressions, shares equal constants and cleans up the bytecode compiled from now on
+// Optimized programs give the same results (and run-time errors) as unoptimized ones
+func (c *Compiler) SetOptimize(optimize bool) {
+	c.optimize = optimize
+}
+
+// Helper function for compile-time errors, reported as "file:line:col: msg" followed by the offending source line
+// Errors are of the kind the evaluator reports for the same program, e.g. NAME_ERROR for an unknown identifier
+func errorAt(node ast.Node, kind object.ErrorKind, format string, a ...interface{}) error {
+	err := object.BuildError(kind, format, a...)
+	err.Span = node.Span()
+	return err
+}
+
 // Helper method to get instructions in current scope
 func (c *Compiler) currentInstructions() bytecode.Instructions {
 	return c.scopes[c.scopeIndex].instructions
@@ -92,17 +124,51 @@ func (c *Compiler) leaveScope() bytecode.Instructions {
 	return instructions
 }
 
+func (c *Compiler) enterLoop(startPosition int, hasIterator bool) {
+	loop := &EnclosingLoop{startPosition: startPosition, hasIterator: hasIterator}
+	c.scopes[c.scopeIndex].loops = append(c.scopes[c.scopeIndex].loops, loop)
+}
+
+// Backpatch every break of the innermost loop to jump to afterLoopPosition
+func (c *Compiler) leaveLoop(afterLoopPosition int) {
+	loops := c.scopes[c.scopeIndex].loops
+	loop := loops[len(loops)-1]
+
+	for _, position := range loop.breakPositions {
+		c.replaceInstructionOperand(position, afterLoopPosition)
+	}
+
+	c.scopes[c.scopeIndex].loops = loops[:len(loops)-1]
+}
+
+// Innermost loop of the current function, or nil
+// Loops never reach across function boundaries
+func (c *Compiler) currentLoop() *EnclosingLoop {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+
+	return loops[len(loops)-1]
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
-	if PRINT_COMPILER {
-		color.Green("Compile %T: %s", node, node.String())
+	if c.tracer != nil && node != nil {
+		c.tracer.NodeCompiled(node)
 	}
+
+	// Instructions emitted while compiling node are attributed to it
+	if node != nil {
+		outerSpan := c.span
+		c.span = node.Span()
+		defer func() { c.span = outerSpan }()
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
-		for _, statement := range node.Statements {
-			err := c.Compile(statement)
-			if err != nil {
-				return err
-			}
+		err := c.compileStatements(node.Statements)
+		if err != nil {
+			return err
 		}
 	case *ast.Call:
 		err := c.Compile(node.Function)
@@ -117,7 +183,12 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 
-		c.emit(bytecode.OpCall, len(node.Arguments))
+		// Function returns the value of a tail call, so the callee can take over its frame
+		if node.Tail && c.scopeIndex > 0 {
+			c.emit(bytecode.OpTailCall, len(node.Arguments))
+		} else {
+			c.emit(bytecode.OpCall, len(node.Arguments))
+		}
 	case *ast.ReturnStatement:
 		err := c.Compile(node.Value)
 		if err != nil {
@@ -125,32 +196,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(bytecode.OpReturnValue)
 	case *ast.Function:
-		c.enterScope()
-
-		for _, p := range node.Parameters {
-			c.symbolTable.Define(p.Value)
-		}
-
-		err := c.Compile(node.Body)
+		err := c.compileFunction(node)
 		if err != nil {
 			return err
 		}
-		// Replace last pop with return
-		if c.scopes[c.scopeIndex].lastInstruction.Opcode == bytecode.OpPop {
-			lastPosition := c.scopes[c.scopeIndex].lastInstruction.Position
-			c.replaceInstruction(lastPosition, bytecode.Make(bytecode.OpReturnValue))
-			c.scopes[c.scopeIndex].lastInstruction.Opcode = bytecode.OpReturnValue
-		}
-		// Handle empty function bodies
-		if c.scopes[c.scopeIndex].lastInstruction.Opcode != bytecode.OpReturnValue {
-			c.emit(bytecode.OpReturnNothing)
-		}
-		// Get number of local bindings
-		numLocals := c.symbolTable.numDefinitions
-		instructions := c.leaveScope()
-
-		compiledFunction := &object.CompiledFunction{instructions, numLocals, len(node.Parameters)}
-		c.emit(bytecode.OpConstant, c.addConstant(compiledFunction))
 	case *ast.Index:
 		err := c.Compile(node.Array)
 		if err != nil {
@@ -197,32 +246,29 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(bytecode.OpArray, len(node.Elements))
 	case *ast.LetStatement:
-		symbol := c.symbolTable.Define(node.Name.Value)
+		// Compile value first so "let x = x + 1" reads the previous binding
+		// (a function's name was hoisted by compileStatements, so the function can call itself)
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(bytecode.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(bytecode.OpSetLocal, symbol.Index)
+		symbol := c.symbolTable.Define(node.Name.Value)
+		c.storeSymbol(symbol)
+	case *ast.Assign:
+		err := c.compileAssign(node)
+		if err != nil {
+			return err
 		}
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 
 		// Throw a compile-time error if identifier doesn't exist
 		if !ok {
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return errorAt(node, object.NAME_ERROR, "identifier not found: %s", node.Value)
 		}
 
-		if symbol.Scope == GlobalScope {
-			c.emit(bytecode.OpGetGlobal, symbol.Index)
-		} else if symbol.Scope == LocalScope {
-			c.emit(bytecode.OpGetLocal, symbol.Index)
-		} else if symbol.Scope == BuiltinScope {
-			c.emit(bytecode.OpGetBuiltin, symbol.Index)
-		}
+		c.loadSymbol(symbol)
 	case *ast.ExpressionStatement:
 		err := c.Compile(node.Expression)
 		if err != nil {
@@ -230,11 +276,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(bytecode.OpPop)
 	case *ast.BlockStatement:
-		for _, statement := range node.Statements {
-			err := c.Compile(statement)
-			if err != nil {
-				return err
-			}
+		err := c.compileStatements(node.Statements)
+		if err != nil {
+			return err
 		}
 	case *ast.If:
 		err := c.Compile(node.Condition)
@@ -260,6 +304,9 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 			c.scopes[c.scopeIndex].instructions = newInstructions
 			c.scopes[c.scopeIndex].lastInstruction = c.scopes[c.scopeIndex].secondToLastInstruction
+		} else {
+			// Consequence ended in a statement (e.g. let, loop), so it has no value
+			c.emit(bytecode.OpNull)
 		}
 
 		// 9999 is a placeholder offset (will backpatch)
@@ -286,13 +333,93 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 				c.scopes[c.scopeIndex].instructions = newInstructions
 				c.scopes[c.scopeIndex].lastInstruction = c.scopes[c.scopeIndex].secondToLastInstruction
+			} else {
+				// Alternative ended in a statement (e.g. let, loop), so it has no value
+				c.emit(bytecode.OpNull)
 			}
 		}
 
 		// Replace OpJump operand
 		afterAlternativePosition := len(c.currentInstructions())
 		c.replaceInstructionOperand(jumpPosition, afterAlternativePosition)
+	case *ast.WhileStatement:
+		startPosition := len(c.currentInstructions())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		// 9999 is a placeholder offset (will backpatch)
+		jumpNotTruthyPosition := c.emit(bytecode.OpJumpNotTruthy, 9999)
+
+		c.enterLoop(startPosition, false)
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		// Go back and test the condition again
+		c.emit(bytecode.OpJump, startPosition)
+
+		afterLoopPosition := len(c.currentInstructions())
+		c.replaceInstructionOperand(jumpNotTruthyPosition, afterLoopPosition)
+		c.leaveLoop(afterLoopPosition)
+	case *ast.ForStatement:
+		err := c.Compile(node.Iterable)
+		if err != nil {
+			return err
+		}
+
+		// Iterator stays on the stack for the duration of the loop
+		c.emit(bytecode.OpIter)
+		symbol := c.symbolTable.Define(node.Variable.Value)
+
+		// 9999 is a placeholder offset (will backpatch)
+		iterNextPosition := c.emit(bytecode.OpIterNext, 9999)
+		c.storeSymbol(symbol)
+
+		c.enterLoop(iterNextPosition, true)
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+
+		// Go back and fetch the next item
+		c.emit(bytecode.OpJump, iterNextPosition)
+
+		afterLoopPosition := len(c.currentInstructions())
+		c.replaceInstructionOperand(iterNextPosition, afterLoopPosition)
+		c.leaveLoop(afterLoopPosition)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return errorAt(node, object.RUNTIME_ERROR, "break outside loop")
+		}
+
+		// Leaving a for-in loop early has to drop its iterator
+		if loop.hasIterator {
+			c.emit(bytecode.OpPop)
+		}
+
+		// 9999 is a placeholder offset (will backpatch when loop ends)
+		jumpPosition := c.emit(bytecode.OpJump, 9999)
+		loop.breakPositions = append(loop.breakPositions, jumpPosition)
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return errorAt(node, object.RUNTIME_ERROR, "continue outside loop")
+		}
+
+		c.emit(bytecode.OpJump, loop.startPosition)
 	case *ast.Prefix:
+		if c.optimize {
+			if obj, ok := foldConstant(node); ok {
+				c.emitConstant(obj)
+				return nil
+			}
+		}
+
 		err := c.Compile(node.Value)
 		if err != nil {
 			return err
@@ -304,23 +431,14 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(bytecode.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator: %s", node.Operator)
+			return errorAt(node, object.TYPE_ERROR, "unknown operator: %s", node.Operator)
 		}
 	case *ast.Infix:
-		// Special case for < (turn into >)
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
+		if c.optimize {
+			if obj, ok := foldConstant(node); ok {
+				c.emitConstant(obj)
+				return nil
 			}
-
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-
-			c.emit(bytecode.OpGreater)
-			return nil
 		}
 
 		err := c.Compile(node.Left)
@@ -344,16 +462,21 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(bytecode.OpDiv)
 		case ">":
 			c.emit(bytecode.OpGreater)
+		case "<":
+			c.emit(bytecode.OpLess)
 		case "==":
 			c.emit(bytecode.OpEqual)
 		case "!=":
 			c.emit(bytecode.OpNotEqual)
 		default:
-			return fmt.Errorf("Unknown operator %s", node.Operator)
+			return errorAt(node, object.TYPE_ERROR, "unknown operator: %s", node.Operator)
 		}
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		c.emit(bytecode.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(bytecode.OpConstant, c.addConstant(float))
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(bytecode.OpTrue)
@@ -365,19 +488,195 @@ func (c *Compiler) Compile(node ast.Node) error {
 		c.emit(bytecode.OpConstant, c.addConstant(str))
 	}
 
+	return c.operandErr
+}
+
+// Helper method to compile assignments
+// Leaves the assigned value on the stack, since assignment is an expression
+func (c *Compiler) compileAssign(node *ast.Assign) error {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return errorAt(target, object.NAME_ERROR, "identifier not found: %s", target.Value)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		switch symbol.Scope {
+		case GlobalScope:
+			c.emit(bytecode.OpSetGlobal, symbol.Index)
+		case LocalScope:
+			c.emit(bytecode.OpSetLocal, symbol.Index)
+		case CellScope:
+			c.emit(bytecode.OpSetCell, symbol.Index)
+		case FreeScope:
+			// Closures share the cell, so this updates the variable everywhere
+			c.emit(bytecode.OpSetFree, symbol.Index)
+		default:
+			return errorAt(target, object.RUNTIME_ERROR, "cannot assign to %s", target.Value)
+		}
+
+		c.loadSymbol(symbol)
+	case *ast.Index:
+		err := c.Compile(target.Array)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(bytecode.OpSetIndex)
+	default:
+		return errorAt(node.Target, object.RUNTIME_ERROR, "invalid assignment target: %s", node.Target.String())
+	}
+
+	return nil
+}
+
+// Helper method to compile a sequence of statements
+// Names of let-bound functions are defined first, so functions can call themselves and each other
+// wherever they are defined in the block
+func (c *Compiler) compileStatements(statements []ast.Statement) error {
+	for _, name := range HoistedNames(statements) {
+		c.symbolTable.Define(name)
+	}
+
+	for _, statement := range statements {
+		err := c.Compile(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper method to compile a function literal into a closure
+func (c *Compiler) compileFunction(node *ast.Function) error {
+	c.enterScope()
+	c.symbolTable.CaptureNames(CapturedNames(node.Body))
+
+	for _, p := range node.Parameters {
+		c.symbolTable.Define(p.Value)
+	}
+
+	err := c.Compile(node.Body)
+	if err != nil {
+		return err
+	}
+	// Replace last pop with return
+	if c.scopes[c.scopeIndex].lastInstruction.Opcode == bytecode.OpPop {
+		lastPosition := c.scopes[c.scopeIndex].lastInstruction.Position
+		c.replaceInstruction(lastPosition, bytecode.Make(bytecode.OpReturnValue))
+		c.scopes[c.scopeIndex].lastInstruction.Opcode = bytecode.OpReturnValue
+	}
+	// Handle empty function bodies
+	if c.scopes[c.scopeIndex].lastInstruction.Opcode != bytecode.OpReturnValue {
+		c.emit(bytecode.OpReturnNothing)
+	}
+	// Get number of local bindings and captured variables
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.numDefinitions
+	lines := c.scopes[c.scopeIndex].lines
+	instructions := c.leaveScope()
+	if c.optimize {
+		instructions, lines = optimizeInstructions(instructions, lines, c.constants, true)
+	}
+
+	// Push the cells of captured variables so OpClosure can pick them up
+	for _, s := range freeSymbols {
+		c.captureSymbol(s)
+	}
+
+	compiledFunction := &object.CompiledFunction{
+		Instructions:  instructions,
+		NumLocals:     numLocals,
+		NumParameters: len(node.Parameters),
+		Name:          node.Name,
+		Lines:         lines,
+	}
+	c.emit(bytecode.OpClosure, c.addConstant(compiledFunction), len(freeSymbols))
+
 	return nil
 }
 
 func (c *Compiler) Bytecode() *Bytecode {
+	instructions := c.currentInstructions()
+	lines := c.scopes[c.scopeIndex].lines
+	if c.optimize {
+		instructions, lines = optimizeInstructions(instructions, lines, c.constants, false)
+	}
+
 	return &Bytecode{
-		Instructions: c.currentInstructions(),
+		Instructions: instructions,
 		Constants:    c.constants,
+		Lines:        lines,
+	}
+}
+
+// Disassembly of the main program, with constants and function bodies resolved
+func (b *Bytecode) String() string {
+	constants := make([]bytecode.Constant, len(b.Constants))
+	for i, constant := range b.Constants {
+		constants[i] = constant
+	}
+	return bytecode.Disassemble(b.Instructions, constants)
+}
+
+// Helper method to push the value bound to a symbol
+func (c *Compiler) loadSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(bytecode.OpGetGlobal, s.Index)
+	case LocalScope:
+		c.emit(bytecode.OpGetLocal, s.Index)
+	case CellScope:
+		c.emit(bytecode.OpGetCell, s.Index)
+	case BuiltinScope:
+		c.emit(bytecode.OpGetBuiltin, s.Index)
+	case FreeScope:
+		c.emit(bytecode.OpGetFree, s.Index)
+	}
+}
+
+// Helper method to push the cell a closure captures for a symbol
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case CellScope:
+		c.emit(bytecode.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(bytecode.OpCaptureFree, s.Index)
+	}
+}
+
+// Helper method to bind the value on top of the stack to a symbol
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(bytecode.OpSetGlobal, s.Index)
+	case CellScope:
+		c.emit(bytecode.OpSetCell, s.Index)
+	default:
+		c.emit(bytecode.OpSetLocal, s.Index)
 	}
 }
 
 // Helper method to replace an instruction's operand
 func (c *Compiler) replaceInstructionOperand(opPosition int, operand int) {
 	op := bytecode.Opcode(c.currentInstructions()[opPosition])
+	c.checkOperands(op, operand)
 	newInstruction := bytecode.Make(op, operand)
 	c.replaceInstruction(opPosition, newInstruction)
 }
@@ -392,6 +691,12 @@ func (c *Compiler) replaceInstruction(position int, newInstruction []byte) {
 
 // Helper method for adding constant to constant pool
 func (c *Compiler) addConstant(obj object.Object) int {
+	if c.optimize {
+		if i := c.findConstant(obj); i >= 0 {
+			return i
+		}
+	}
+
 	c.constants = append(c.constants, obj)
 	return len(c.constants) - 1 // Return the constant's index
 }
@@ -406,17 +711,35 @@ func (c *Compiler) addInstruction(instruction []byte) int {
 
 // Helper method to generate an instruction and add it to the results in memory
 func (c *Compiler) emit(op bytecode.Opcode, operands ...int) int {
-	if PRINT_COMPILER {
+	c.checkOperands(op, operands...)
+	instruction := bytecode.Make(op, operands...)
+	position := c.addInstruction(instruction)
+
+	if c.tracer != nil {
 		def, _ := bytecode.Lookup(byte(op))
-		color.Red("Emit opcode %s %v", def.Name, operands)
+		c.tracer.InstructionEmitted(position, def.Name, operands)
 	}
 
-	instruction := bytecode.Make(op, operands...)
-	position := c.addInstruction(instruction)
+	c.scopes[c.scopeIndex].lines.Add(position, c.span)
 	c.setLastInstruction(op, position)
 	return position // Returns starting position of newly emitted instruction
 }
 
+// Helper method to record an error for operands too big for their instruction
+// e.g. a function with more than 256 locals; Compile returns the first one
+func (c *Compiler) checkOperands(op bytecode.Opcode, operands ...int) {
+	if c.operandErr != nil {
+		return
+	}
+
+	err := bytecode.CheckOperands(op, operands...)
+	if err != nil {
+		operandErr := object.BuildError(object.RUNTIME_ERROR, "program too large: %s", err)
+		operandErr.Span = c.span
+		c.operandErr = operandErr
+	}
+}
+
 // Helper method to set last instruction and second to last instruction
 func (c *Compiler) setLastInstruction(op bytecode.Opcode, position int) {
 	c.scopes[c.scopeIndex].secondToLastInstruction = c.scopes[c.scopeIndex].lastInstruction
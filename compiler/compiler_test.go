@@ -1,13 +1,14 @@
 package compiler
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go_interpreter/ast"
 	"go_interpreter/bytecode"
 	"go_interpreter/lexer"
 	"go_interpreter/object"
 	"go_interpreter/parser"
-	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -68,6 +69,16 @@ func TestIntegerArithmetic(t *testing.T) {
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
+		{
+			"1.5 * 2",
+			[]interface{}{1.5, 2},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpMul),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
 	}
 
 	testCompiler(t, tests)
@@ -103,11 +114,11 @@ func TestBoolean(t *testing.T) {
 		},
 		{
 			"1 < 2",
-			[]interface{}{2, 1},
+			[]interface{}{1, 2},
 			[]bytecode.Instructions{
 				bytecode.Make(bytecode.OpConstant, 0),
 				bytecode.Make(bytecode.OpConstant, 1),
-				bytecode.Make(bytecode.OpGreater),
+				bytecode.Make(bytecode.OpLess),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -343,7 +354,7 @@ func TestFunction(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpClosure, 2, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -360,7 +371,7 @@ func TestFunction(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpClosure, 2, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -377,7 +388,7 @@ func TestFunction(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpClosure, 2, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -389,7 +400,7 @@ func TestFunction(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpClosure, 0, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -410,7 +421,7 @@ func TestFunctionCall(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpClosure, 1, 0),
 				bytecode.Make(bytecode.OpCall, 0),
 				bytecode.Make(bytecode.OpPop),
 			},
@@ -424,7 +435,7 @@ func TestFunctionCall(t *testing.T) {
 				24,
 			},
 			[]bytecode.Instructions{
-				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpClosure, 0, 0),
 				bytecode.Make(bytecode.OpSetGlobal, 0),
 				bytecode.Make(bytecode.OpGetGlobal, 0),
 				bytecode.Make(bytecode.OpConstant, 1),
@@ -451,7 +462,264 @@ func TestLocal(t *testing.T) {
 				},
 			},
 			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+	}
+
+	testCompiler(t, tests)
+}
+
+func TestClosure(t *testing.T) {
+	tests := []testCase{
+		{
+			"fn(a) { fn(b) { a + b } }",
+			[]interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 0, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"fn(a) { fn(b) { fn(c) { a + b + c } } }",
+			[]interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpGetFree, 1),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCaptureFree, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 0, 2),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 1, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 2, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"let g = 1; fn() { let a = 2; fn() { g + a } }",
+			[]interface{}{
+				1,
+				2,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetGlobal, 0),
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpSetCell, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 2, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+	}
+
+	testCompiler(t, tests)
+}
+
+func TestRecursiveFunction(t *testing.T) {
+	tests := []testCase{
+		{
+			"let countDown = fn(x) { countDown(x - 1); }; countDown(1);",
+			[]interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetGlobal, 0),
+					bytecode.Make(bytecode.OpGetLocal, 0),
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpSub),
+					bytecode.Make(bytecode.OpTailCall, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				1,
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpCall, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"fn() { let a = fn() { b() }; let b = fn() { a() }; }",
+			[]interface{}{
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpTailCall, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpTailCall, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpCaptureLocal, 1),
+					bytecode.Make(bytecode.OpClosure, 0, 1),
+					bytecode.Make(bytecode.OpSetCell, 0),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 1, 1),
+					bytecode.Make(bytecode.OpSetCell, 1),
+					bytecode.Make(bytecode.OpReturnNothing),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 2, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+	}
+
+	testCompiler(t, tests)
+}
+
+func TestWhile(t *testing.T) {
+	tests := []testCase{
+		{
+			"while (true) { 1; break; continue; }; 2;",
+			[]interface{}{1, 2},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpTrue),              // 0000
+				bytecode.Make(bytecode.OpJumpNotTruthy, 17), // 0001
+				bytecode.Make(bytecode.OpConstant, 0),       // 0004
+				bytecode.Make(bytecode.OpPop),               // 0007
+				bytecode.Make(bytecode.OpJump, 17),          // 0008 (break)
+				bytecode.Make(bytecode.OpJump, 0),           // 0011 (continue)
+				bytecode.Make(bytecode.OpJump, 0),           // 0014
+				bytecode.Make(bytecode.OpConstant, 1),       // 0017
+				bytecode.Make(bytecode.OpPop),               // 0020
+			},
+		},
+	}
+
+	testCompiler(t, tests)
+}
+
+func TestFor(t *testing.T) {
+	tests := []testCase{
+		{
+			"for (x in []) { x; break; }",
+			[]interface{}{},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpArray, 0),     // 0000
+				bytecode.Make(bytecode.OpIter),         // 0003
+				bytecode.Make(bytecode.OpIterNext, 21), // 0004
+				bytecode.Make(bytecode.OpSetGlobal, 0), // 0007
+				bytecode.Make(bytecode.OpGetGlobal, 0), // 0010
+				bytecode.Make(bytecode.OpPop),          // 0013
+				bytecode.Make(bytecode.OpPop),          // 0014 (break drops iterator)
+				bytecode.Make(bytecode.OpJump, 21),     // 0015
+				bytecode.Make(bytecode.OpJump, 4),      // 0018
+			},
+		},
+	}
+
+	testCompiler(t, tests)
+}
+
+func TestLoopErrors(t *testing.T) {
+	inputs := []string{
+		"break;",
+		"continue;",
+		"while (true) { fn() { break; } }",
+		"fn() { continue; }",
+	}
+
+	for _, input := range inputs {
+		compiler := BuildCompiler()
+		err := compiler.Compile(parse(input))
+		if err == nil {
+			t.Fatalf("Expected compiler error for %q", input)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	tests := []testCase{
+		{
+			"let x = 1; x = 2;",
+			[]interface{}{1, 2},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpSetGlobal, 0),
+				bytecode.Make(bytecode.OpGetGlobal, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"fn(a) { a = 1; fn() { a = 2 } }",
+			[]interface{}{
+				1,
+				2,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 1),
+					bytecode.Make(bytecode.OpSetFree, 0),
+					bytecode.Make(bytecode.OpGetFree, 0),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpConstant, 0),
+					bytecode.Make(bytecode.OpSetCell, 0),
+					bytecode.Make(bytecode.OpGetCell, 0),
+					bytecode.Make(bytecode.OpPop),
+					bytecode.Make(bytecode.OpCaptureLocal, 0),
+					bytecode.Make(bytecode.OpClosure, 2, 1),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"[1][0] = 2",
+			[]interface{}{1, 0, 2},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpArray, 1),
 				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpConstant, 2),
+				bytecode.Make(bytecode.OpSetIndex),
 				bytecode.Make(bytecode.OpPop),
 			},
 		},
@@ -460,6 +728,104 @@ func TestLocal(t *testing.T) {
 	testCompiler(t, tests)
 }
 
+func TestAssignErrors(t *testing.T) {
+	inputs := []string{
+		"x = 1;",
+		"len = 1;",
+	}
+
+	for _, input := range inputs {
+		compiler := BuildCompiler()
+		err := compiler.Compile(parse(input))
+		if err == nil {
+			t.Fatalf("Expected compiler error for %q", input)
+		}
+	}
+}
+
+func TestOperandLimits(t *testing.T) {
+	// Helper method to make n let statements for names starting with prefix, and a sum of the names
+	// Identifiers can't have digits, so the names count in letters: prefixaa, prefixab...
+	lets := func(prefix string, n int) (string, string) {
+		var statements, sum strings.Builder
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("%s%c%c", prefix, 'a'+i/26, 'a'+i%26)
+			fmt.Fprintf(&statements, "let %s = %d; ", name, i)
+			if i > 0 {
+				sum.WriteString(" + ")
+			}
+			sum.WriteString(name)
+		}
+		return statements.String(), sum.String()
+	}
+
+	locals, localSum := lets("a", 256)
+	moreLocals, moreLocalSum := lets("a", 257)
+	outer, outerSum := lets("a", 150)
+	inner, innerSum := lets("b", 150)
+
+	tests := []struct {
+		input    string
+		expected string // Error, or "" if the program compiles
+	}{
+		{"fn() { " + locals + localSum + " }", ""},
+		{"fn() { " + moreLocals + moreLocalSum + " }", "OpSetLocal operand 256 is out of range (0 to 255)"},
+		// The innermost function uses 300 free variables from the two functions around it
+		{"fn() { " + outer + "fn() { " + inner + "fn() { " + outerSum + " + " + innerSum + " } } }", "OpGetFree operand 256 is out of range (0 to 255)"},
+		{"fn() { " + outer + "fn() { " + inner + "fn() { " + outerSum + " } } }", ""},
+	}
+
+	for _, test := range tests {
+		compiler := BuildCompiler()
+		err := compiler.Compile(parse(test.input))
+		if test.expected == "" {
+			assert.Nil(t, err)
+			assert.Nil(t, compiler.Bytecode().Validate())
+			continue
+		}
+
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), test.expected)
+		}
+	}
+}
+
+func TestErrorPosition(t *testing.T) {
+	input := "let x = 1;\nx + y;"
+
+	compiler := BuildCompiler()
+	err := compiler.Compile(parse(input))
+
+	expected := "2:5: identifier not found: y\n" +
+		"  x + y;\n" +
+		"      ^"
+	assert.EqualError(t, err, expected)
+}
+
+func TestLineTable(t *testing.T) {
+	input := "let x = 1;\nlet f = fn() {\n  x + 2\n};"
+
+	compiler := BuildCompiler()
+	err := compiler.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("Compiler error: %s", err)
+	}
+
+	// Main program: OpConstant, OpSetGlobal on line 1, OpClosure, OpSetGlobal on line 2
+	lines := compiler.Bytecode().Lines
+	assert.Equal(t, 1, lines.Lookup(0).Start.Line)
+	assert.Equal(t, 1, lines.Lookup(3).Start.Line)
+	assert.Equal(t, 2, lines.Lookup(6).Start.Line)
+	assert.Equal(t, 2, lines.Lookup(10).Start.Line)
+
+	// Function body: OpGetGlobal, OpConstant, OpAdd, OpReturnValue all on line 3
+	fn := compiler.Bytecode().Constants[2].(*object.CompiledFunction)
+	assert.Equal(t, "f", fn.Name)
+	for offset := range fn.Instructions {
+		assert.Equal(t, 3, fn.Lines.Lookup(offset).Start.Line, "Offset %d", offset)
+	}
+}
+
 func TestCompilerScope(t *testing.T) {
 	c := BuildCompiler()
 	assert.Equal(t, 0, c.scopeIndex)
@@ -521,10 +887,16 @@ func parse(input string) *ast.Program {
 
 // Helper method to test compiler
 func testCompiler(t *testing.T, tests []testCase) {
+	testCompiled(t, tests, false)
+}
+
+// Helper method to compile each test, optimizing if asked, and check the bytecode
+func testCompiled(t *testing.T, tests []testCase, optimize bool) {
 	for _, test := range tests {
 		program := parse(test.input)
 
 		compiler := BuildCompiler()
+		compiler.SetOptimize(optimize)
 		err := compiler.Compile(program)
 		if err != nil {
 			t.Fatalf("Compiler error: %s", err)
@@ -540,11 +912,9 @@ func testCompiler(t *testing.T, tests []testCase) {
 func testInstructions(t *testing.T, expectedList []bytecode.Instructions, actual bytecode.Instructions) {
 	expected := joinInstructions(expectedList)
 
-	assert.Equal(t, len(actual), len(expected))
-
-	for i, b := range expected {
-		assert.Equal(t, actual[i], b, strconv.Itoa(i))
-	}
+	// Compare disassembly first, so failures show a readable diff
+	assert.Equal(t, expected.String(), actual.String())
+	assert.Equal(t, expected, actual)
 }
 
 // Helper method to join instructions (needed because input is a slice of slice of bytes)
@@ -566,6 +936,8 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 		switch constant := constant.(type) {
 		case int:
 			testIntegerObject(t, int64(constant), actual[i])
+		case float64:
+			testFloatObject(t, constant, actual[i])
 		case string:
 			testStringObject(t, constant, actual[i])
 		case []bytecode.Instructions:
@@ -584,6 +956,16 @@ func testIntegerObject(t *testing.T, expected int64, actual object.Object) {
 	assert.Equal(t, result.Value, expected)
 }
 
+// Helper method to test float objects
+func testFloatObject(t *testing.T, expected float64, actual object.Object) {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		t.Fatalf("Object is not float")
+	}
+
+	assert.Equal(t, result.Value, expected)
+}
+
 // Helper method to test string objects
 func testStringObject(t *testing.T, expected string, actual object.Object) {
 	result, ok := actual.(*object.String)
@@ -0,0 +1,483 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go_interpreter/bytecode"
+	"go_interpreter/object"
+	"go_interpreter/token"
+	"hash/crc32"
+	"math"
+)
+
+// Layout of a bytecode file (multi-byte numbers are big endian like instructions):
+//
+//	magic       "MKC\x00"
+//	version     uint16
+//	files       uvarint count, then name and source of each file spans refer to
+//	constants   uvarint count, then a tag byte and the encoded value of each constant
+//	main        instructions and line table of the main program
+//	checksum    uint32 CRC-32 (IEEE) of everything before it
+//
+// Strings and instructions are a uvarint length followed by the bytes
+// Line tables are a uvarint count followed by an offset and span for each entry
+const (
+	BYTECODE_MAGIC   = "MKC\x00"
+	BYTECODE_VERSION = 2 // 2: closures share captured variables through cells
+)
+
+// Tags of constants in the constant pool
+// New types get new tags; removing or renumbering one needs a new BYTECODE_VERSION
+const (
+	INTEGER_TAG           byte = 1
+	FLOAT_TAG             byte = 2
+	STRING_TAG            byte = 3
+	COMPILED_FUNCTION_TAG byte = 4
+)
+
+const (
+	headerSize   = len(BYTECODE_MAGIC) + 2
+	checksumSize = 4
+)
+
+// Helper method to check if data looks like an encoded bytecode file
+func IsEncoded(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(BYTECODE_MAGIC))
+}
+
+// Serializes bytecode to the versioned file format
+func (b *Bytecode) Encode() ([]byte, error) {
+	e := &encoder{files: map[*token.File]int{}}
+
+	// Body first, since it finds the files the header lists
+	body := &bytes.Buffer{}
+	e.out = body
+
+	e.uvarint(len(b.Constants))
+	for i, constant := range b.Constants {
+		if err := e.constant(constant); err != nil {
+			return nil, fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+	e.instructions(b.Instructions)
+	e.lines(b.Lines)
+
+	out := &bytes.Buffer{}
+	e.out = out
+
+	out.WriteString(BYTECODE_MAGIC)
+	binary.Write(out, binary.BigEndian, uint16(BYTECODE_VERSION))
+	e.uvarint(len(e.fileList))
+	for _, file := range e.fileList {
+		e.string(file.Name)
+		e.string(file.Source)
+	}
+	out.Write(body.Bytes())
+	binary.Write(out, binary.BigEndian, crc32.ChecksumIEEE(out.Bytes()))
+
+	return out.Bytes(), nil
+}
+
+// Deserializes bytecode from the versioned file format
+// The result is validated, so it is safe to hand to the VM
+func Decode(data []byte) (*Bytecode, error) {
+	if len(data) < headerSize+checksumSize || !IsEncoded(data) {
+		return nil, errors.New("not a bytecode file")
+	}
+
+	version := binary.BigEndian.Uint16(data[len(BYTECODE_MAGIC):])
+	if version != BYTECODE_VERSION {
+		return nil, fmt.Errorf("unsupported bytecode version %d (expected %d)", version, BYTECODE_VERSION)
+	}
+
+	content := data[:len(data)-checksumSize]
+	checksum := binary.BigEndian.Uint32(data[len(content):])
+	if crc32.ChecksumIEEE(content) != checksum {
+		return nil, errors.New("bytecode checksum mismatch")
+	}
+
+	d := &decoder{data: content, offset: headerSize}
+
+	numFiles := d.count()
+	for i := 0; i < numFiles && d.err == nil; i++ {
+		d.files = append(d.files, &token.File{Name: d.string(), Source: d.string()})
+	}
+
+	numConstants := d.count()
+	constants := make([]object.Object, 0, numConstants)
+	for i := 0; i < numConstants && d.err == nil; i++ {
+		constants = append(constants, d.constant())
+	}
+
+	b := &Bytecode{
+		Constants:    constants,
+		Instructions: d.instructions(),
+		Lines:        d.lines(),
+	}
+
+	if d.err == nil && d.offset != len(d.data) {
+		d.fail("%d unexpected bytes after main program", len(d.data)-d.offset)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Checks that instructions only use defined opcodes, that operands stay in bounds
+// of the constant pool, builtins, locals and free variables, and that the stack never runs out,
+// so the VM can run bytecode it didn't compile
+func (b *Bytecode) Validate() error {
+	// Free variables each function uses, so closures can be checked to capture enough of them
+	numFree := map[*object.CompiledFunction]int{}
+	for _, constant := range b.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok {
+			numFree[fn] = freeVariablesUsed(fn.Instructions)
+		}
+	}
+
+	if err := b.validateFunction(b.Instructions, nil, numFree); err != nil {
+		return fmt.Errorf("main program: %s", err)
+	}
+
+	for i, constant := range b.Constants {
+		fn, ok := constant.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+
+		if err := b.validateFunction(fn.Instructions, fn, numFree); err != nil {
+			return fmt.Errorf("constant %d (function %q): %s", i, fn.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Helper method to count the free variables instructions use, from the highest index they use
+// Malformed instructions count as none, since validateFunction reports them
+func freeVariablesUsed(ins bytecode.Instructions) int {
+	decoded, err := bytecode.Validate(ins)
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, instruction := range decoded {
+		switch instruction.Op {
+		case bytecode.OpGetFree, bytecode.OpSetFree, bytecode.OpCaptureFree:
+			if instruction.Operands[0]+1 > count {
+				count = instruction.Operands[0] + 1
+			}
+		}
+	}
+	return count
+}
+
+// Helper method to validate the instructions of fn, or of the main program if fn is nil
+func (b *Bytecode) validateFunction(ins bytecode.Instructions, fn *object.CompiledFunction, numFree map[*object.CompiledFunction]int) error {
+	if fn != nil && (fn.NumParameters > fn.NumLocals || fn.NumLocals > math.MaxUint8+1) {
+		return fmt.Errorf("bad local count %d for %d parameters", fn.NumLocals, fn.NumParameters)
+	}
+
+	decoded, err := bytecode.Validate(ins)
+	if err != nil {
+		return err
+	}
+
+	for _, instruction := range decoded {
+		switch instruction.Op {
+		case bytecode.OpConstant, bytecode.OpAddConstant, bytecode.OpSubConstant:
+			if instruction.Operands[0] >= len(b.Constants) {
+				return fmt.Errorf("offset %d: constant %d out of range", instruction.Offset, instruction.Operands[0])
+			}
+		case bytecode.OpClosure:
+			index := instruction.Operands[0]
+			if index >= len(b.Constants) {
+				return fmt.Errorf("offset %d: constant %d out of range", instruction.Offset, index)
+			}
+			closed, ok := b.Constants[index].(*object.CompiledFunction)
+			if !ok {
+				return fmt.Errorf("offset %d: constant %d is not a function", instruction.Offset, index)
+			}
+			if instruction.Operands[1] < numFree[closed] {
+				return fmt.Errorf("offset %d: closure captures %d free variables, but its function uses %d",
+					instruction.Offset, instruction.Operands[1], numFree[closed])
+			}
+		case bytecode.OpGetBuiltin:
+			if instruction.Operands[0] >= len(object.Builtins) {
+				return fmt.Errorf("offset %d: builtin %d out of range", instruction.Offset, instruction.Operands[0])
+			}
+		case bytecode.OpGetLocal, bytecode.OpSetLocal, bytecode.OpGetCell, bytecode.OpSetCell, bytecode.OpCaptureLocal:
+			if fn == nil {
+				return fmt.Errorf("offset %d: local binding outside of a function", instruction.Offset)
+			}
+			if instruction.Operands[0] >= fn.NumLocals {
+				return fmt.Errorf("offset %d: local %d out of range", instruction.Offset, instruction.Operands[0])
+			}
+		case bytecode.OpGetLocal0, bytecode.OpGetLocal1, bytecode.OpGetLocal2:
+			index := int(instruction.Op - bytecode.OpGetLocal0)
+			if fn == nil {
+				return fmt.Errorf("offset %d: local binding outside of a function", instruction.Offset)
+			}
+			if index >= fn.NumLocals {
+				return fmt.Errorf("offset %d: local %d out of range", instruction.Offset, index)
+			}
+		case bytecode.OpGetFree, bytecode.OpSetFree, bytecode.OpCaptureFree:
+			// Closures of the function are checked to capture this many
+			if fn == nil {
+				return fmt.Errorf("offset %d: free variable outside of a function", instruction.Offset)
+			}
+		case bytecode.OpHash:
+			if instruction.Operands[0]%2 != 0 {
+				return fmt.Errorf("offset %d: hash of %d keys and values", instruction.Offset, instruction.Operands[0])
+			}
+		}
+	}
+
+	_, err = bytecode.StackDepth(decoded)
+	return err
+}
+
+type encoder struct {
+	out      *bytes.Buffer
+	files    map[*token.File]int // 1-based index of each file, 0 means no file
+	fileList []*token.File
+}
+
+func (e *encoder) uvarint(n int) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	e.out.Write(buf[:binary.PutUvarint(buf, uint64(n))])
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(len(s))
+	e.out.WriteString(s)
+}
+
+func (e *encoder) instructions(ins bytecode.Instructions) {
+	e.uvarint(len(ins))
+	e.out.Write(ins)
+}
+
+func (e *encoder) position(p token.Position) {
+	e.uvarint(p.Offset)
+	e.uvarint(p.Line)
+	e.uvarint(p.Column)
+}
+
+func (e *encoder) span(s token.Span) {
+	index := 0
+	if s.Start.File != nil {
+		index = e.files[s.Start.File]
+		if index == 0 {
+			e.fileList = append(e.fileList, s.Start.File)
+			index = len(e.fileList)
+			e.files[s.Start.File] = index
+		}
+	}
+
+	e.uvarint(index)
+	e.position(s.Start)
+	e.position(s.End)
+}
+
+func (e *encoder) lines(lt bytecode.LineTable) {
+	e.uvarint(len(lt))
+	for _, entry := range lt {
+		e.uvarint(entry.Offset)
+		e.span(entry.Span)
+	}
+}
+
+func (e *encoder) constant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.out.WriteByte(INTEGER_TAG)
+		buf := make([]byte, binary.MaxVarintLen64)
+		e.out.Write(buf[:binary.PutVarint(buf, obj.Value)])
+	case *object.Float:
+		e.out.WriteByte(FLOAT_TAG)
+		binary.Write(e.out, binary.BigEndian, math.Float64bits(obj.Value))
+	case *object.String:
+		e.out.WriteByte(STRING_TAG)
+		e.string(obj.Value)
+	case *object.CompiledFunction:
+		e.out.WriteByte(COMPILED_FUNCTION_TAG)
+		e.instructions(obj.Instructions)
+		e.uvarint(obj.NumLocals)
+		e.uvarint(obj.NumParameters)
+		e.string(obj.Name)
+		e.lines(obj.Lines)
+	default:
+		return fmt.Errorf("can't encode constant of type %s", obj.Type())
+	}
+
+	return nil
+}
+
+// Reads the payload of a bytecode file
+// The first error sticks, and later reads return zero values
+type decoder struct {
+	data   []byte
+	offset int
+	files  []*token.File
+	err    error
+}
+
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("malformed bytecode at byte %d: %s", d.offset, fmt.Sprintf(format, a...))
+	}
+}
+
+func (d *decoder) remaining() int {
+	return len(d.data) - d.offset
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if d.remaining() < 1 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+
+	b := d.data[d.offset]
+	d.offset++
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if d.remaining() < n {
+		d.fail("unexpected end of data")
+		return nil
+	}
+
+	b := d.data[d.offset : d.offset+n]
+	d.offset += n
+	return b
+}
+
+func (d *decoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+
+	n, read := binary.Uvarint(d.data[d.offset:])
+	if read <= 0 || n > math.MaxInt32 {
+		d.fail("bad unsigned integer")
+		return 0
+	}
+
+	d.offset += read
+	return int(n)
+}
+
+// Length of a following list or string, which can't be longer than the remaining data
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > d.remaining() {
+		d.fail("length %d exceeds remaining %d bytes", n, d.remaining())
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.count()))
+}
+
+func (d *decoder) instructions() bytecode.Instructions {
+	ins := make(bytecode.Instructions, d.count())
+	copy(ins, d.bytes(len(ins)))
+	return ins
+}
+
+func (d *decoder) position(file *token.File) token.Position {
+	return token.Position{File: file, Offset: d.uvarint(), Line: d.uvarint(), Column: d.uvarint()}
+}
+
+func (d *decoder) span() token.Span {
+	index := d.uvarint()
+	if index > len(d.files) {
+		d.fail("file %d out of range", index)
+		return token.Span{}
+	}
+
+	var file *token.File
+	if index > 0 {
+		file = d.files[index-1]
+	}
+
+	span := token.Span{Start: d.position(file), End: d.position(file)}
+
+	// Excerpts slice the source with these, so they have to agree with it
+	if file != nil && span.IsValid() {
+		start, end := span.Start, span.End
+		if start.Column < 1 || start.Column-1 > start.Offset || start.Offset > len(file.Source) ||
+			end.Offset < start.Offset || end.Offset > len(file.Source) {
+			d.fail("span %s outside of source", start)
+		}
+	}
+
+	return span
+}
+
+func (d *decoder) lines() bytecode.LineTable {
+	n := d.count()
+	if n == 0 {
+		return nil
+	}
+
+	lt := make(bytecode.LineTable, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		lt = append(lt, bytecode.LineEntry{Offset: d.uvarint(), Span: d.span()})
+	}
+	return lt
+}
+
+func (d *decoder) constant() object.Object {
+	switch tag := d.byte(); tag {
+	case INTEGER_TAG:
+		n, read := binary.Varint(d.data[d.offset:])
+		if read <= 0 {
+			d.fail("bad integer")
+			return nil
+		}
+		d.offset += read
+		return &object.Integer{Value: n}
+	case FLOAT_TAG:
+		bits := d.bytes(8)
+		if bits == nil {
+			return nil
+		}
+		return &object.Float{Value: math.Float64frombits(binary.BigEndian.Uint64(bits))}
+	case STRING_TAG:
+		return &object.String{Value: d.string()}
+	case COMPILED_FUNCTION_TAG:
+		return &object.CompiledFunction{
+			Instructions:  d.instructions(),
+			NumLocals:     d.uvarint(),
+			NumParameters: d.uvarint(),
+			Name:          d.string(),
+			Lines:         d.lines(),
+		}
+	default:
+		if d.err == nil {
+			d.fail("unknown constant tag %d", tag)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,266 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/bytecode"
+	"go_interpreter/lexer"
+	"go_interpreter/object"
+	"go_interpreter/parser"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+const encodingInput = `let name = "toy";
+let add = fn(a, b) { a + b };
+let count = fn(xs) {
+  let n = 0;
+  for (x in xs) { n = n + 1; }
+  n
+};
+add(1.5, 2) + count([1, -7, 3]);`
+
+func TestEncodeRoundTrip(t *testing.T) {
+	p := parser.BuildParser(lexer.BuildFileLexer("round.mk", encodingInput))
+	c := BuildCompiler()
+	err := c.Compile(p.ParseProgram())
+	assert.Nil(t, err)
+
+	original := c.Bytecode()
+	data, err := original.Encode()
+	assert.Nil(t, err)
+	assert.True(t, IsEncoded(data))
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
+	}
+
+	assert.Equal(t, original, decoded)
+
+	// Spans still point into the source, so errors keep their excerpts
+	var count *object.CompiledFunction
+	for _, constant := range decoded.Constants {
+		if fn, ok := constant.(*object.CompiledFunction); ok && fn.Name == "count" {
+			count = fn
+		}
+	}
+	span := count.Lines.Lookup(0)
+	assert.Equal(t, "round.mk", span.Start.File.Name)
+	assert.Contains(t, span.Annotate("oops"), "let n = 0;")
+}
+
+func TestDecodeErrors(t *testing.T) {
+	c := BuildCompiler()
+	assert.Nil(t, c.Compile(parse(encodingInput)))
+	data, err := c.Bytecode().Encode()
+	assert.Nil(t, err)
+
+	// Helper method to change a copy of the encoded bytecode and fix up its checksum
+	modify := func(change func([]byte) []byte) []byte {
+		content := change(append([]byte{}, data[:len(data)-checksumSize]...))
+		return binary.BigEndian.AppendUint32(content, crc32.ChecksumIEEE(content))
+	}
+
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("let x = 1;"), "not a bytecode file"},
+		{data[:len(data)-1], "checksum mismatch"},
+		{modify(func(b []byte) []byte { b[len(BYTECODE_MAGIC)+1] = 9; return b }), "unsupported bytecode version 9"},
+		{modify(func(b []byte) []byte { return b[:len(b)-3] }), "malformed bytecode"},
+		{modify(func(b []byte) []byte { return append(b, 0) }), "unexpected bytes"},
+	}
+
+	for _, test := range tests {
+		_, err := Decode(test.data)
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), test.expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	function := func(numLocals int, ins ...bytecode.Instructions) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: joinInstructions(ins), NumLocals: numLocals}
+	}
+
+	tests := []struct {
+		bytecode *Bytecode
+		expected string
+	}{
+		{
+			&Bytecode{Instructions: bytecode.Instructions{255}},
+			"Opcode 255 undefined",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpConstant, 1)[:2]},
+			"OpConstant is missing operands",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpConstant, 0)},
+			"constant 0 out of range",
+		},
+		{
+			&Bytecode{Instructions: joinInstructions([]bytecode.Instructions{
+				bytecode.Make(bytecode.OpJump, 1),
+				bytecode.Make(bytecode.OpNull),
+			})},
+			"not the start of an instruction",
+		},
+		{
+			&Bytecode{
+				Instructions: bytecode.Make(bytecode.OpClosure, 0, 0),
+				Constants:    []object.Object{&object.Integer{Value: 1}},
+			},
+			"constant 0 is not a function",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpGetBuiltin, len(object.Builtins))},
+			"builtin 6 out of range",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpGetLocal, 0)},
+			"local binding outside of a function",
+		},
+		{
+			&Bytecode{Constants: []object.Object{function(1, bytecode.Make(bytecode.OpGetLocal, 1), bytecode.Make(bytecode.OpReturnValue))}},
+			"local 1 out of range",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpGetCell, 0)},
+			"local binding outside of a function",
+		},
+		{
+			&Bytecode{Constants: []object.Object{function(1, bytecode.Make(bytecode.OpGetCell, 1), bytecode.Make(bytecode.OpReturnValue))}},
+			"local 1 out of range",
+		},
+		{
+			&Bytecode{Constants: []object.Object{function(1, bytecode.Make(bytecode.OpNull), bytecode.Make(bytecode.OpSetCell, 2))}},
+			"local 2 out of range",
+		},
+		{
+			&Bytecode{Constants: []object.Object{function(0, bytecode.Make(bytecode.OpCaptureLocal, 0), bytecode.Make(bytecode.OpReturnValue))}},
+			"local 0 out of range",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpGetFree, 0)},
+			"free variable outside of a function",
+		},
+		{
+			&Bytecode{
+				Instructions: bytecode.Make(bytecode.OpClosure, 0, 0),
+				Constants:    []object.Object{function(0, bytecode.Make(bytecode.OpGetFree, 0), bytecode.Make(bytecode.OpReturnValue))},
+			},
+			"closure captures 0 free variables, but its function uses 1",
+		},
+		{
+			&Bytecode{
+				Instructions: joinInstructions([]bytecode.Instructions{bytecode.Make(bytecode.OpGetBuiltin, 0), bytecode.Make(bytecode.OpClosure, 0, 1)}),
+				Constants:    []object.Object{function(0, bytecode.Make(bytecode.OpNull), bytecode.Make(bytecode.OpSetFree, 1), bytecode.Make(bytecode.OpReturnNothing))},
+			},
+			"closure captures 1 free variables, but its function uses 2",
+		},
+		{
+			&Bytecode{
+				Instructions: bytecode.Make(bytecode.OpClosure, 1, 0),
+				Constants: []object.Object{
+					function(0, bytecode.Make(bytecode.OpCaptureFree, 0), bytecode.Make(bytecode.OpReturnValue)),
+					function(0, bytecode.Make(bytecode.OpClosure, 0, 0), bytecode.Make(bytecode.OpReturnValue)),
+				},
+			},
+			"closure captures 0 free variables, but its function uses 1",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpHash, 1)},
+			"hash of 1 keys and values",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpPop)},
+			"stack underflow (OpPop takes 1 values, 0 on the stack)",
+		},
+		{
+			&Bytecode{Instructions: joinInstructions([]bytecode.Instructions{bytecode.Make(bytecode.OpTrue), bytecode.Make(bytecode.OpAdd)})},
+			"stack underflow (OpAdd takes 2 values, 1 on the stack)",
+		},
+		{
+			&Bytecode{Instructions: joinInstructions([]bytecode.Instructions{bytecode.Make(bytecode.OpGetBuiltin, 0), bytecode.Make(bytecode.OpCall, 2)})},
+			"stack underflow (OpCall takes 3 values, 1 on the stack)",
+		},
+		{
+			&Bytecode{
+				Instructions: bytecode.Make(bytecode.OpClosure, 0, 1),
+				Constants:    []object.Object{function(0, bytecode.Make(bytecode.OpReturnNothing))},
+			},
+			"stack underflow (OpClosure takes 1 values, 0 on the stack)",
+		},
+		{
+			&Bytecode{Instructions: joinInstructions([]bytecode.Instructions{bytecode.Make(bytecode.OpTrue), bytecode.Make(bytecode.OpTrue), bytecode.Make(bytecode.OpSetIndex)})},
+			"stack underflow (OpSetIndex takes 3 values, 2 on the stack)",
+		},
+		{
+			&Bytecode{Instructions: bytecode.Make(bytecode.OpIterNext, 3)},
+			"stack underflow (OpIterNext takes 1 values, 0 on the stack)",
+		},
+		{
+			&Bytecode{Constants: []object.Object{function(0, bytecode.Make(bytecode.OpTailCall, 0))}},
+			"stack underflow (OpTailCall takes 1 values, 0 on the stack)",
+		},
+		{
+			// The jump skips a value that the other path pushes
+			&Bytecode{Instructions: joinInstructions([]bytecode.Instructions{
+				bytecode.Make(bytecode.OpTrue),
+				bytecode.Make(bytecode.OpJumpNotTruthy, 5),
+				bytecode.Make(bytecode.OpNull),
+				bytecode.Make(bytecode.OpNull),
+			})},
+			"reaches offset 5 with 1 values on the stack instead of 0",
+		},
+	}
+
+	for _, test := range tests {
+		err := test.bytecode.Validate()
+		if assert.NotNil(t, err, test.expected) {
+			assert.Contains(t, err.Error(), test.expected)
+		}
+
+		// Files are rejected the same way
+		data, err := test.bytecode.Encode()
+		if assert.Nil(t, err, test.expected) {
+			_, err = Decode(data)
+			if assert.NotNil(t, err, test.expected) {
+				assert.Contains(t, err.Error(), test.expected)
+			}
+		}
+	}
+
+	// Everything the compiler produces is valid
+	for _, input := range []string{encodingInput, "", "while (true) { break; }", "if (1 > 2) { 3 }"} {
+		c := BuildCompiler()
+		assert.Nil(t, c.Compile(parse(input)))
+		assert.Nil(t, c.Bytecode().Validate(), input)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, input := range []string{encodingInput, "1 + 2", `"a" + "b"`} {
+		c := BuildCompiler()
+		c.Compile(parse(input))
+		data, _ := c.Bytecode().Encode()
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		b, err := Decode(data)
+		if err != nil {
+			return
+		}
+
+		// Anything accepted must survive being written out again
+		if _, err := b.Encode(); err != nil && !strings.Contains(err.Error(), "can't encode") {
+			t.Fatalf("Encode error: %s", err)
+		}
+	})
+}
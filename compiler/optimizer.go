@@ -0,0 +1,486 @@
+package compiler
+
+import (
+	"go_interpreter/ast"
+	"go_interpreter/bytecode"
+	"go_interpreter/object"
+	"go_interpreter/token"
+	"math"
+)
+
+// Evaluates expressions built only from integer, string and boolean literals
+// Expressions that would fail or overflow at run time are left for the VM to report
+func foldConstant(node ast.Expression) (object.Object, bool) {
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		return &object.Integer{Value: node.Value}, true
+	case *ast.String:
+		return &object.String{Value: node.Value}, true
+	case *ast.Boolean:
+		return &object.Boolean{Value: node.Value}, true
+	case *ast.Prefix:
+		value, ok := foldConstant(node.Value)
+		if !ok {
+			return nil, false
+		}
+		return foldPrefix(node.Operator, value)
+	case *ast.Infix:
+		left, ok := foldConstant(node.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := foldConstant(node.Right)
+		if !ok {
+			return nil, false
+		}
+		return foldInfix(left, node.Operator, right)
+	default:
+		return nil, false
+	}
+}
+
+// Helper method to fold a prefix operator the way the VM runs it
+func foldPrefix(operator string, value object.Object) (object.Object, bool) {
+	switch operator {
+	case "!":
+		// Only false (and null, which has no literal) is falsy
+		if b, ok := value.(*object.Boolean); ok {
+			return &object.Boolean{Value: !b.Value}, true
+		}
+		return &object.Boolean{Value: false}, true
+	case "-":
+		if integer, ok := value.(*object.Integer); ok {
+			result, ok := object.CheckedNeg(integer.Value)
+			return &object.Integer{Value: result}, ok
+		}
+	}
+
+	return nil, false
+}
+
+// Helper method to fold an infix operator the way the VM runs it
+func foldInfix(left object.Object, operator string, right object.Object) (object.Object, bool) {
+	switch left := left.(type) {
+	case *object.Integer:
+		right, ok := right.(*object.Integer)
+		if !ok {
+			return nil, false
+		}
+
+		var result int64
+		switch operator {
+		case "+":
+			result, ok = object.CheckedAdd(left.Value, right.Value)
+		case "-":
+			result, ok = object.CheckedSub(left.Value, right.Value)
+		case "*":
+			result, ok = object.CheckedMul(left.Value, right.Value)
+		case "/":
+			if right.Value == 0 {
+				return nil, false
+			}
+			result, ok = object.CheckedDiv(left.Value, right.Value)
+		case "<":
+			return &object.Boolean{Value: left.Value < right.Value}, true
+		case ">":
+			return &object.Boolean{Value: left.Value > right.Value}, true
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		default:
+			return nil, false
+		}
+		return &object.Integer{Value: result}, ok
+	case *object.String:
+		right, ok := right.(*object.String)
+		if !ok {
+			return nil, false
+		}
+
+		// "+" is left for the VM, which charges the new string to the memory limit
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+	case *object.Boolean:
+		right, ok := right.(*object.Boolean)
+		if !ok {
+			return nil, false
+		}
+
+		switch operator {
+		case "==":
+			return &object.Boolean{Value: left.Value == right.Value}, true
+		case "!=":
+			return &object.Boolean{Value: left.Value != right.Value}, true
+		}
+	}
+
+	return nil, false
+}
+
+// Helper method to push a folded constant
+func (c *Compiler) emitConstant(obj object.Object) {
+	if b, ok := obj.(*object.Boolean); ok {
+		if b.Value {
+			c.emit(bytecode.OpTrue)
+		} else {
+			c.emit(bytecode.OpFalse)
+		}
+		return
+	}
+
+	c.emit(bytecode.OpConstant, c.addConstant(obj))
+}
+
+// Index of a constant equal to obj already in the pool, or -1
+func (c *Compiler) findConstant(obj object.Object) int {
+	for i, constant := range c.constants {
+		switch constant := constant.(type) {
+		case *object.Integer:
+			if other, ok := obj.(*object.Integer); ok && other.Value == constant.Value {
+				return i
+			}
+		case *object.Float:
+			// Compare bits, so 0.0 and -0.0 stay apart
+			if other, ok := obj.(*object.Float); ok && math.Float64bits(other.Value) == math.Float64bits(constant.Value) {
+				return i
+			}
+		case *object.String:
+			if other, ok := obj.(*object.String); ok && other.Value == constant.Value {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// An instruction being optimized
+// Jump targets are kept as indexes into the instruction list, so instructions can be removed
+type optimizedInstruction struct {
+	op       bytecode.Opcode
+	operands []int
+	target   int        // Index of instruction a jump goes to (len of list for the end), or -1
+	span     token.Span // Source code of instruction
+	removed  bool
+}
+
+// Opcodes that push a value without any other effect, so pushing and then popping it does nothing
+var pureOpcodes = map[bytecode.Opcode]bool{
+	bytecode.OpConstant:   true,
+	bytecode.OpTrue:       true,
+	bytecode.OpFalse:      true,
+	bytecode.OpNull:       true,
+	bytecode.OpGetGlobal:  true,
+	bytecode.OpGetLocal:   true,
+	bytecode.OpGetFree:    true,
+	bytecode.OpGetCell:    true,
+	bytecode.OpGetBuiltin: true,
+}
+
+// Opcodes after which execution never continues with the next instruction
+var terminatorOpcodes = map[bytecode.Opcode]bool{
+	bytecode.OpJump:          true,
+	bytecode.OpReturnValue:   true,
+	bytecode.OpReturnNothing: true,
+}
+
+// Peephole optimizations over the instructions of one scope: jump threading, constant conditions,
+// dead code after returns and jumps, jumps to the next instruction, and (in functions) pure values that are popped
+// The main program keeps its OpPops, since the REPL shows the last popped value
+// Finally, common instructions are replaced by specialised opcodes (see specialize)
+func optimizeInstructions(
+	ins bytecode.Instructions,
+	lines bytecode.LineTable,
+	constants []object.Object,
+	inFunction bool,
+) (bytecode.Instructions, bytecode.LineTable) {
+	decoded, err := bytecode.Validate(ins)
+	if err != nil {
+		// Compiler output is always valid, but leave anything else alone
+		return ins, lines
+	}
+
+	indexes := map[int]int{len(ins): len(decoded)}
+	for i, instruction := range decoded {
+		indexes[instruction.Offset] = i
+	}
+
+	list := make([]*optimizedInstruction, len(decoded))
+	for i, instruction := range decoded {
+		target := -1
+		if isJump(instruction.Op) {
+			target = indexes[instruction.Operands[0]]
+		}
+
+		list[i] = &optimizedInstruction{
+			op:       instruction.Op,
+			operands: instruction.Operands,
+			target:   target,
+			span:     lines.Lookup(instruction.Offset),
+		}
+	}
+
+	for changed := true; changed; {
+		changed = threadJumps(list)
+		changed = foldConditions(list) || changed
+		changed = removeDeadCode(list) || changed
+		changed = removeJumpsToNext(list) || changed
+		if inFunction {
+			changed = removePurePops(list) || changed
+		}
+		list = compact(list)
+	}
+
+	return assemble(specialize(list, constants))
+}
+
+func isJump(op bytecode.Opcode) bool {
+	switch op {
+	case bytecode.OpJump, bytecode.OpJumpNotTruthy, bytecode.OpIterNext,
+		bytecode.OpGreaterJumpNotTruthy, bytecode.OpLessJumpNotTruthy, bytecode.OpEqualJumpNotTruthy, bytecode.OpNotEqualJumpNotTruthy:
+		return true
+	default:
+		return false
+	}
+}
+
+// Helper method to find instructions that some jump lands on
+func jumpTargets(list []*optimizedInstruction) map[int]bool {
+	targets := map[int]bool{}
+	for _, instruction := range list {
+		if instruction.target >= 0 {
+			targets[instruction.target] = true
+		}
+	}
+	return targets
+}
+
+// Jumps to an OpJump go straight to where that one goes
+func threadJumps(list []*optimizedInstruction) bool {
+	changed := false
+
+	for _, instruction := range list {
+		if instruction.target < 0 {
+			continue
+		}
+
+		// Stop after len(list) hops in case of a loop made of jumps
+		for hops := 0; hops < len(list); hops++ {
+			target := instruction.target
+			if target >= len(list) || list[target].op != bytecode.OpJump || list[target].target == target {
+				break
+			}
+			instruction.target = list[target].target
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// OpTrue followed by OpJumpNotTruthy never jumps, and OpFalse followed by it always does
+func foldConditions(list []*optimizedInstruction) bool {
+	changed := false
+	targets := jumpTargets(list)
+
+	for i := 0; i+1 < len(list); i++ {
+		value, jump := list[i], list[i+1]
+		if jump.op != bytecode.OpJumpNotTruthy || targets[i+1] {
+			continue
+		}
+
+		switch value.op {
+		case bytecode.OpTrue:
+			value.removed = true
+			jump.removed = true
+			changed = true
+		case bytecode.OpFalse:
+			value.removed = true
+			jump.op = bytecode.OpJump
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Instructions after a return or jump can only run if something jumps to them
+func removeDeadCode(list []*optimizedInstruction) bool {
+	changed := false
+	targets := jumpTargets(list)
+
+	dead := false
+	for i, instruction := range list {
+		if targets[i] {
+			dead = false
+		}
+
+		if dead && !instruction.removed {
+			instruction.removed = true
+			changed = true
+		}
+
+		if terminatorOpcodes[instruction.op] && !instruction.removed {
+			dead = true
+		}
+	}
+
+	return changed
+}
+
+// An OpJump to the instruction right after it does nothing
+func removeJumpsToNext(list []*optimizedInstruction) bool {
+	changed := false
+
+	for i, instruction := range list {
+		if instruction.op == bytecode.OpJump && !instruction.removed &&
+			instruction.target > i && nextLive(list, i+1) >= instruction.target {
+			instruction.removed = true
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Pushing a value with no side effects just to pop it does nothing
+func removePurePops(list []*optimizedInstruction) bool {
+	changed := false
+	targets := jumpTargets(list)
+
+	for i := 0; i+1 < len(list); i++ {
+		value, pop := list[i], list[i+1]
+		if value.removed || pop.removed || !pureOpcodes[value.op] || pop.op != bytecode.OpPop || targets[i+1] {
+			continue
+		}
+
+		value.removed = true
+		pop.removed = true
+		changed = true
+	}
+
+	return changed
+}
+
+// Index of the first instruction at or after i that hasn't been removed
+func nextLive(list []*optimizedInstruction, i int) int {
+	for i < len(list) && list[i].removed {
+		i++
+	}
+	return i
+}
+
+// Drops removed instructions, pointing jumps to removed instructions at the next live one
+func compact(list []*optimizedInstruction) []*optimizedInstruction {
+	newIndexes := make([]int, len(list)+1)
+	result := []*optimizedInstruction{}
+
+	for i, instruction := range list {
+		newIndexes[i] = len(result)
+		if !instruction.removed {
+			result = append(result, instruction)
+		}
+	}
+	newIndexes[len(list)] = len(result)
+
+	for _, instruction := range result {
+		if instruction.target >= 0 {
+			instruction.target = newIndexes[instruction.target]
+		}
+	}
+
+	return result
+}
+
+// Comparisons that fuse with an OpJumpNotTruthy right after them
+var fusedComparisons = map[bytecode.Opcode]bytecode.Opcode{
+	bytecode.OpGreater:  bytecode.OpGreaterJumpNotTruthy,
+	bytecode.OpLess:     bytecode.OpLessJumpNotTruthy,
+	bytecode.OpEqual:    bytecode.OpEqualJumpNotTruthy,
+	bytecode.OpNotEqual: bytecode.OpNotEqualJumpNotTruthy,
+}
+
+// Arithmetic that fuses with an integer OpConstant right before it
+var fusedArithmetic = map[bytecode.Opcode]bytecode.Opcode{
+	bytecode.OpAdd: bytecode.OpAddConstant,
+	bytecode.OpSub: bytecode.OpSubConstant,
+}
+
+// Replaces the instructions of hot paths with opcodes that need less decoding and dispatch:
+// the first three locals, small integer constants, adding or subtracting an integer constant,
+// and comparisons followed by a conditional jump
+// Runs after the other optimizations, which only know the general opcodes
+// Pairs are only fused if nothing jumps to the second instruction
+func specialize(list []*optimizedInstruction, constants []object.Object) []*optimizedInstruction {
+	targets := jumpTargets(list)
+
+	for i, instruction := range list {
+		if instruction.removed {
+			continue
+		}
+
+		var next *optimizedInstruction
+		if i+1 < len(list) && !targets[i+1] {
+			next = list[i+1]
+		}
+
+		switch instruction.op {
+		case bytecode.OpGetLocal:
+			if instruction.operands[0] < 3 {
+				instruction.op = bytecode.OpGetLocal0 + bytecode.Opcode(instruction.operands[0])
+				instruction.operands = []int{}
+			}
+		case bytecode.OpConstant:
+			integer, ok := constants[instruction.operands[0]].(*object.Integer)
+			if !ok {
+				continue
+			}
+
+			if next != nil && fusedArithmetic[next.op] != 0 {
+				// Errors such as overflow are reported at the operator
+				instruction.op = fusedArithmetic[next.op]
+				instruction.span = next.span
+				next.removed = true
+			} else if integer.Value >= 0 && integer.Value <= math.MaxUint8 {
+				instruction.op = bytecode.OpSmallInteger
+				instruction.operands = []int{int(integer.Value)}
+			}
+		case bytecode.OpGreater, bytecode.OpLess, bytecode.OpEqual, bytecode.OpNotEqual:
+			if next != nil && next.op == bytecode.OpJumpNotTruthy {
+				instruction.op = fusedComparisons[instruction.op]
+				instruction.operands = []int{0}
+				instruction.target = next.target
+				next.removed = true
+			}
+		}
+	}
+
+	return compact(list)
+}
+
+// Helper method to encode optimized instructions, with jump targets turned back into offsets
+func assemble(list []*optimizedInstruction) (bytecode.Instructions, bytecode.LineTable) {
+	offsets := make([]int, len(list)+1)
+	for i, instruction := range list {
+		offsets[i+1] = offsets[i] + len(bytecode.Make(instruction.op, instruction.operands...))
+	}
+
+	ins := bytecode.Instructions{}
+	var lines bytecode.LineTable
+
+	for i, instruction := range list {
+		if instruction.target >= 0 {
+			instruction.operands[0] = offsets[instruction.target]
+		}
+
+		lines.Add(offsets[i], instruction.span)
+		ins = append(ins, bytecode.Make(instruction.op, instruction.operands...)...)
+	}
+
+	return ins, lines
+}
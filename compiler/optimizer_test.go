@@ -0,0 +1,186 @@
+package compiler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/bytecode"
+	"testing"
+)
+
+func TestOptimize(t *testing.T) {
+	tests := []testCase{
+		{
+			"1 + 2 * 3",
+			[]interface{}{7},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpSmallInteger, 7),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			`"a" != "b"; !(1 < 2); -5`,
+			[]interface{}{-5},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpTrue),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpFalse),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// Equal constants share one pool entry
+			`1; "a"; 1; "a"`,
+			[]interface{}{1, "a"},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpSmallInteger, 1),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpSmallInteger, 1),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// Concatenation allocates, so the VM does it against the memory limit
+			`"a" + "b"`,
+			[]interface{}{"a", "b"},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpAdd),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// Run-time errors are left for the VM to report
+			"1 / 0",
+			[]interface{}{1, 0},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpSmallInteger, 1),
+				bytecode.Make(bytecode.OpSmallInteger, 0),
+				bytecode.Make(bytecode.OpDiv),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// Constant condition, with the untaken branch removed
+			"if (true) { 10 } else { 20 }",
+			[]interface{}{10, 20},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpSmallInteger, 10),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			"while (false) { 1 }",
+			[]interface{}{1},
+			[]bytecode.Instructions{},
+		},
+		{
+			// Popped values and code after return are dropped from functions
+			"fn() { 1; return 2; 3 }",
+			[]interface{}{
+				1,
+				2,
+				3,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpSmallInteger, 2),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 3, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+	}
+
+	testCompiled(t, tests, true)
+}
+
+func TestSpecialize(t *testing.T) {
+	tests := []testCase{
+		{
+			// Large and negative integers still need the constant pool
+			"256; -1; 255",
+			[]interface{}{256, -1, 255},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpConstant, 0),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpConstant, 1),
+				bytecode.Make(bytecode.OpPop),
+				bytecode.Make(bytecode.OpSmallInteger, 255),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+		{
+			// First locals, arithmetic with a constant and a comparison followed by a jump
+			"fn(a, b, c, d) { if (a > 1) { b - 1 } else { c + d } }",
+			[]interface{}{
+				1,
+				[]bytecode.Instructions{
+					bytecode.Make(bytecode.OpGetLocal0),
+					bytecode.Make(bytecode.OpSmallInteger, 1),
+					bytecode.Make(bytecode.OpGreaterJumpNotTruthy, 13),
+					bytecode.Make(bytecode.OpGetLocal1),
+					bytecode.Make(bytecode.OpSubConstant, 0),
+					bytecode.Make(bytecode.OpJump, 17),
+					bytecode.Make(bytecode.OpGetLocal2),
+					bytecode.Make(bytecode.OpGetLocal, 3),
+					bytecode.Make(bytecode.OpAdd),
+					bytecode.Make(bytecode.OpReturnValue),
+				},
+			},
+			[]bytecode.Instructions{
+				bytecode.Make(bytecode.OpClosure, 1, 0),
+				bytecode.Make(bytecode.OpPop),
+			},
+		},
+	}
+
+	testCompiled(t, tests, true)
+}
+
+func TestJumpThreading(t *testing.T) {
+	// Jump to a jump to the next instruction
+	ins := joinInstructions([]bytecode.Instructions{
+		bytecode.Make(bytecode.OpJump, 3),
+		bytecode.Make(bytecode.OpJump, 6),
+		bytecode.Make(bytecode.OpNull),
+		bytecode.Make(bytecode.OpPop),
+	})
+
+	optimized, _ := optimizeInstructions(ins, nil, nil, false)
+	testInstructions(t, []bytecode.Instructions{
+		bytecode.Make(bytecode.OpNull),
+		bytecode.Make(bytecode.OpPop),
+	}, optimized)
+
+	// No jump in optimized code lands on another jump
+	inputs := []string{
+		"let x = 1; if (x) { if (x > 2) { 1 } else { 2 } } else { 3 }",
+		"let x = 5; while (x > 0) { if (x == 2) { break; } x = x - 1; }",
+		"for (x in [1, 2]) { if (x == 1) { continue; } x }",
+	}
+
+	for _, input := range inputs {
+		c := BuildCompiler()
+		c.SetOptimize(true)
+		err := c.Compile(parse(input))
+		ins := c.Bytecode().Instructions
+		assert.Nil(t, err)
+
+		decoded, err := bytecode.Validate(ins)
+		assert.Nil(t, err)
+
+		for _, instruction := range decoded {
+			if isJump(instruction.Op) && instruction.Operands[0] < len(ins) {
+				target := bytecode.Opcode(ins[instruction.Operands[0]])
+				assert.NotEqual(t, bytecode.OpJump, target, "%s\n%s", input, ins)
+			}
+		}
+	}
+}
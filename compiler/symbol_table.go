@@ -1,12 +1,16 @@
 package compiler
 
+import "go_interpreter/object"
+
 // Differentiate between different scopes for symbols
 type SymbolScope string
 
 const (
 	GlobalScope  SymbolScope = "GLOBAL"
 	LocalScope   SymbolScope = "LOCAL"
+	CellScope    SymbolScope = "CELL" // Local kept in a cell, since closures capture it
 	BuiltinScope SymbolScope = "BUILTIN"
+	FreeScope    SymbolScope = "FREE"
 )
 
 // Stores Name, Scope, and Index for a given symbol
@@ -21,11 +25,23 @@ type SymbolTable struct {
 	Outer          *SymbolTable
 	store          map[string]Symbol
 	numDefinitions int
+	FreeSymbols    []Symbol        // Original symbols of free variables captured from enclosing scopes
+	captured       map[string]bool // Names of locals kept in cells
 }
 
 func BuildSymbolTable() *SymbolTable {
 	s := make(map[string]Symbol)
-	return &SymbolTable{store: s}
+	free := []Symbol{}
+	return &SymbolTable{store: s, FreeSymbols: free}
+}
+
+// Symbol table of a main program, with every builtin of registry defined
+func BuildBuiltinSymbolTable(registry *object.BuiltinRegistry) *SymbolTable {
+	s := BuildSymbolTable()
+	for i, name := range registry.Names() {
+		s.DefineBuiltin(i, name)
+	}
+	return s
 }
 
 func BuildInnerSymbolTable(outer *SymbolTable) *SymbolTable {
@@ -35,6 +51,7 @@ func BuildInnerSymbolTable(outer *SymbolTable) *SymbolTable {
 }
 
 // Create and store a symbol from an identifier
+// Redefining a name in the same table reuses its slot
 func (s *SymbolTable) Define(name string) Symbol {
 	symbol := Symbol{Name: name, Index: s.numDefinitions}
 
@@ -45,6 +62,14 @@ func (s *SymbolTable) Define(name string) Symbol {
 	} else {
 		// Is inner symbol table
 		symbol.Scope = LocalScope
+		if s.captured[name] {
+			symbol.Scope = CellScope
+		}
+	}
+
+	existing, ok := s.store[name]
+	if ok && existing.Scope == symbol.Scope {
+		return existing
 	}
 
 	s.store[name] = symbol
@@ -53,12 +78,48 @@ func (s *SymbolTable) Define(name string) Symbol {
 	return symbol
 }
 
+// Keep locals with these names in cells, so closures capture the variable rather than its value (see CapturedNames)
+// Only affects locals defined from now on
+func (s *SymbolTable) CaptureNames(names map[string]bool) {
+	s.captured = names
+}
+
+// Copy of the table, sharing Outer, to go back to if compiling into the table fails
+func (s *SymbolTable) Copy() *SymbolTable {
+	store := make(map[string]Symbol, len(s.store))
+	for name, symbol := range s.store {
+		store[name] = symbol
+	}
+
+	return &SymbolTable{
+		Outer:          s.Outer,
+		store:          store,
+		numDefinitions: s.numDefinitions,
+		FreeSymbols:    append([]Symbol{}, s.FreeSymbols...),
+		captured:       s.captured,
+	}
+}
+
+// Number of globals (or locals of a function) defined in this table
+func (s *SymbolTable) NumDefinitions() int {
+	return s.numDefinitions
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
 	return symbol
 }
 
+// Mark a symbol from an enclosing scope as a free variable of this scope
+func (s *SymbolTable) defineFree(original Symbol) Symbol {
+	s.FreeSymbols = append(s.FreeSymbols, original)
+
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Scope: FreeScope}
+	s.store[original.Name] = symbol
+	return symbol
+}
+
 // Retrieve a symbol for an identifier
 func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	obj, ok := s.store[name]
@@ -66,7 +127,17 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	// Check outer environment if exists
 	if !ok && s.Outer != nil {
 		obj, ok := s.Outer.Resolve(name)
-		return obj, ok
+		if !ok {
+			return obj, ok
+		}
+
+		// Globals and builtins are reachable from anywhere
+		if obj.Scope == GlobalScope || obj.Scope == BuiltinScope {
+			return obj, ok
+		}
+
+		// Locals of an enclosing function become free variables
+		return s.defineFree(obj), true
 	} else {
 		return obj, ok
 	}
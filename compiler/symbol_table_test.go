@@ -21,6 +21,25 @@ func TestDefine(t *testing.T) {
 	}
 }
 
+func TestRedefine(t *testing.T) {
+	global := BuildSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	a := global.Define("a")
+	if a != (Symbol{"a", GlobalScope, 0}) {
+		t.Fatalf("a is wrong (redefine)")
+	}
+
+	local := BuildInnerSymbolTable(global)
+	local.Define("c")
+
+	shadow := local.Define("a")
+	if shadow != (Symbol{"a", LocalScope, 1}) {
+		t.Fatalf("a is wrong (shadow)")
+	}
+}
+
 func TestResolveGlobal(t *testing.T) {
 	global := BuildSymbolTable()
 	global.Define("a")
@@ -70,3 +89,48 @@ func TestResolveLocal(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveFree(t *testing.T) {
+	global := BuildSymbolTable()
+	global.Define("a")
+
+	first := BuildInnerSymbolTable(global)
+	first.Define("b")
+
+	second := BuildInnerSymbolTable(first)
+	second.Define("c")
+
+	expected := []Symbol{
+		{"a", GlobalScope, 0},
+		{"b", FreeScope, 0},
+		{"c", LocalScope, 0},
+	}
+
+	for _, e := range expected {
+		result, ok := second.Resolve(e.Name)
+		if !ok {
+			t.Fatalf("not resolvable")
+		}
+
+		if result != e {
+			t.Fatalf("resolve error")
+		}
+	}
+
+	if len(second.FreeSymbols) != 1 || second.FreeSymbols[0] != (Symbol{"b", LocalScope, 0}) {
+		t.Fatalf("free symbols error")
+	}
+}
+
+func TestResolveUnresolvableFree(t *testing.T) {
+	global := BuildSymbolTable()
+	global.Define("a")
+
+	local := BuildInnerSymbolTable(global)
+	local.Define("b")
+
+	_, ok := local.Resolve("c")
+	if ok {
+		t.Fatalf("c should not be resolvable")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go_interpreter/compiler"
+	"os"
+)
+
+// toy disasm [-O] a.mk b.mk ...
+// toy disasm foo.mkc
+func disasmCommand(arguments []string, optimize bool) int {
+	flags := flag.NewFlagSet("disasm", flag.ContinueOnError)
+	flags.BoolVar(&optimize, "O", optimize, "optimize compiled bytecode")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: toy disasm [-O] a.mk b.mk ...")
+		fmt.Fprintln(flags.Output(), "       toy disasm foo"+BYTECODE_EXTENSION)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return EXIT_USAGE_ERROR
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		flags.Usage()
+		return EXIT_USAGE_ERROR
+	}
+
+	var bytecode *compiler.Bytecode
+
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE_ERROR
+	}
+
+	if len(paths) == 1 && compiler.IsEncoded(data) {
+		bytecode, err = compiler.Decode(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", paths[0], err)
+			return EXIT_SOURCE_ERROR
+		}
+	} else {
+		prog, code := parseFiles(paths, nil, os.Stderr)
+		if code != EXIT_OK {
+			return code
+		}
+
+		bytecode, err = compileScript(prog, nil, optimize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Compile-time error: %s\n", err)
+			return EXIT_SOURCE_ERROR
+		}
+	}
+
+	fmt.Print(bytecode.String())
+	return EXIT_OK
+}
@@ -1,24 +1,66 @@
 package evaluator
 
 import (
-	"fmt"
-	"github.com/fatih/color"
+	"context"
 	"go_interpreter/ast"
 	"go_interpreter/object"
+	"go_interpreter/token"
+	"go_interpreter/trace"
 )
 
-var PRINT_EVAL = false
+const MaxCallDepth = 1024 // Upper limit on nested function calls, same as the VM
 
 var (
-	NULL  = &object.Null{}
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
+	NULL     = object.NULL
+	TRUE     = object.TRUE
+	FALSE    = object.FALSE
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
 func Eval(node ast.Node, env *object.Environment) object.Object {
-	if PRINT_EVAL {
-		color.Green("EVAL %T: evaluator.Eval(%s)", node, node.String())
+	tracer := env.Tracer()
+	if tracer != nil {
+		tracer.EvalEnter(node)
 	}
+
+	result := evalNode(node, env)
+
+	// Errors point at the innermost node that produced them
+	if err, ok := result.(*object.Error); ok && !err.Span.IsValid() {
+		err.Span = node.Span()
+	}
+
+	if tracer != nil {
+		traceExit(tracer, node, result)
+	}
+	return result
+}
+
+// Helper method to report the result of a node, passing a missing result as a nil trace.Value
+func traceExit(tracer trace.Tracer, node ast.Node, result object.Object) {
+	if result == nil {
+		tracer.EvalExit(node, nil)
+		return
+	}
+	tracer.EvalExit(node, result)
+}
+
+// Like Eval, but stops with an error once ctx is done or the program goes over limits
+// Every node evaluated counts as one step
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits object.Limits) object.Object {
+	previous := env.Budget()
+	env.SetBudget(object.BuildBudget(ctx, limits))
+	defer env.SetBudget(previous)
+
+	return Eval(node, env)
+}
+
+func evalNode(node ast.Node, env *object.Environment) object.Object {
+	if err := env.Budget().Step(); err != nil {
+		return err
+	}
+
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node, env)
@@ -28,6 +70,8 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalBlockStatement(node, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return evalBoolean(node.Value)
 	case *ast.Prefix:
@@ -35,7 +79,7 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(value) {
 			return value
 		}
-		return evalPrefix(node.Operator, value)
+		return evalPrefix(node.Operator, value, env.CheckOverflow())
 	case *ast.Infix:
 		left := Eval(node.Left, env)
 		if isError(left) {
@@ -47,9 +91,21 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return right
 		}
 
-		return evalInfix(left, node.Operator, right)
+		result := evalInfix(left, node.Operator, right, env.CheckOverflow())
+		if _, ok := result.(*object.String); ok {
+			return allocate(result, env)
+		}
+		return result
 	case *ast.If:
 		return evalIf(node, env)
+	case *ast.WhileStatement:
+		return evalWhile(node, env)
+	case *ast.ForStatement:
+		return evalFor(node, env)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.ReturnStatement:
 		value := Eval(node.Value, env)
 		if isError(value) {
@@ -65,8 +121,10 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		env.Set(node.Name.Value, value)
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
+	case *ast.Assign:
+		return evalAssign(node, env)
 	case *ast.Function:
-		return &object.Function{node.Parameters, node.Body, env}
+		return &object.Function{Parameters: node.Parameters, Body: node.Body, Env: env, Name: node.Name}
 	case *ast.Call:
 		f := Eval(node.Function, env)
 		if isError(f) {
@@ -78,16 +136,21 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return args[0]
 		}
 
-		return evalFunction(f, args)
+		// Let the function being evaluated make the call, so its Go stack frame is reused
+		if node.Tail {
+			return &object.TailCall{Function: f, Arguments: args, Call: node}
+		}
+
+		return evalFunction(f, args, node, env)
 	case *ast.String:
-		return &object.String{node.Value}
+		return &object.String{Value: node.Value}
 	case *ast.Array:
 		elements := evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
 
-		return &object.Array{Elements: elements}
+		return allocate(&object.Array{Elements: elements}, env)
 	case *ast.Index:
 		array := Eval(node.Array, env)
 		if isError(array) {
@@ -124,28 +187,93 @@ func evalExpressions(args []ast.Expression, env *object.Environment) []object.Ob
 }
 
 // Helper method for evaluating function
-func evalFunction(fobj object.Object, args []object.Object) object.Object {
-	switch f := fobj.(type) {
-	case *object.Function:
-		outerEnv := extendEnv(f, args)
-		value := Eval(f.Body, outerEnv)
-
-		result, ok := value.(*object.Return)
-		if ok {
-			return result.Value
-		} else {
-			return value
+// Tail calls in the body come back as TailCall and run in the same loop, so they don't add to the call depth
+// They reuse the frame of the function making them, like in the VMs: the tracer sees it pushed for the
+// first function and popped once the last one returns
+func evalFunction(fobj object.Object, args []object.Object, call *ast.Call, env *object.Environment) object.Object {
+	var framed *object.Function
+	for {
+		switch f := fobj.(type) {
+		case *object.Function:
+			if len(args) != len(f.Parameters) {
+				popFrame(framed, env)
+				return errorAtCall(NewError(object.ARITY_ERROR, "wrong number of arguments: expected=%d, actual=%d",
+					len(f.Parameters), len(args)), call)
+			}
+
+			if env.CallDepth() >= MaxCallDepth {
+				popFrame(framed, env)
+				return errorAtCall(NewError(object.STACK_OVERFLOW_ERROR, "stack overflow"), call)
+			}
+
+			if err := env.Budget().Call(env.CallDepth() + 1); err != nil {
+				popFrame(framed, env)
+				return errorAtCall(err, call)
+			}
+
+			outerEnv := extendEnv(f, args, env)
+			tracer := env.Tracer()
+			if tracer != nil && framed == nil {
+				tracer.FramePushed(outerEnv.CallDepth()+1, functionName(f))
+			}
+			framed = f
+
+			value := Eval(f.Body, outerEnv)
+
+			if result, ok := value.(*object.Return); ok {
+				value = result.Value
+			}
+
+			if result, ok := value.(*object.TailCall); ok {
+				fobj, args, call = result.Function, result.Arguments, result.Call
+				continue
+			}
+			popFrame(framed, env)
+
+			switch result := value.(type) {
+			case *object.Error:
+				traceCall(result, f.Name, call.Span())
+				return result
+			case *object.Break:
+				return NewError(object.RUNTIME_ERROR, "break outside loop")
+			case *object.Continue:
+				return NewError(object.RUNTIME_ERROR, "continue outside loop")
+			default:
+				return orNull(value)
+			}
+		case *object.BuiltIn:
+			result := f.Function(args...)
+			if f.Allocates && result != nil && !isError(result) {
+				result = allocate(result, env)
+			}
+			popFrame(framed, env)
+			return errorAtCall(orNull(result), call)
+		default:
+			popFrame(framed, env)
+			return errorAtCall(NewError(object.TYPE_ERROR, "not a function: %s", f.Type()), call)
 		}
-	case *object.BuiltIn:
-		return f.Function(args...)
-	default:
-		return NewError("not a function: %s", f.Type())
 	}
 }
 
+// Helper method to tell the tracer a call of env has returned, if it pushed a frame for function f
+func popFrame(f *object.Function, env *object.Environment) {
+	if f != nil && env.Tracer() != nil {
+		env.Tracer().FramePopped(env.CallDepth()+2, functionName(f))
+	}
+}
+
+// Helper method to point an error without a position at the call that failed
+// For tail calls that isn't the call being evaluated, so Eval can't fill it in
+func errorAtCall(obj object.Object, call *ast.Call) object.Object {
+	if err, ok := obj.(*object.Error); ok && !err.Span.IsValid() {
+		err.Span = call.Span()
+	}
+	return obj
+}
+
 // Helper method for extending environment for evaluating function
-func extendEnv(f *object.Function, args []object.Object) *object.Environment {
-	innerEnv := object.BuildInnerEnvironment(f.Env)
+func extendEnv(f *object.Function, args []object.Object, caller *object.Environment) *object.Environment {
+	innerEnv := object.BuildCallEnvironment(f.Env, caller)
 
 	// Bind arguments to parameter names
 	for i, p := range f.Parameters {
@@ -155,6 +283,14 @@ func extendEnv(f *object.Function, args []object.Object) *object.Environment {
 	return innerEnv
 }
 
+// Helper method to count a new string, array or hash against the memory limit of the run
+func allocate(obj object.Object, env *object.Environment) object.Object {
+	if err := env.Budget().Allocate(obj); err != nil {
+		return err
+	}
+	return obj
+}
+
 // Helper method for evaluating boolean
 func evalBoolean(expression bool) object.Object {
 	if expression {
@@ -165,8 +301,14 @@ func evalBoolean(expression bool) object.Object {
 }
 
 // Helper method for evaluating statements in a program
-func evalProgram(program *ast.Program, env *object.Environment) object.Object {
-	var result object.Object
+// Bugs in the evaluator become INTERNAL_ERROR instead of crashing the host
+func evalProgram(program *ast.Program, env *object.Environment) (result object.Object) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			result = NewError(object.INTERNAL_ERROR, "internal error: %v", r)
+		}
+	}()
 
 	for _, statement := range program.Statements {
 		result = Eval(statement, env)
@@ -175,7 +317,12 @@ func evalProgram(program *ast.Program, env *object.Environment) object.Object {
 		case *object.Return:
 			return result.Value
 		case *object.Error:
+			traceMain(result)
 			return result
+		case *object.Break:
+			return NewError(object.RUNTIME_ERROR, "break outside loop")
+		case *object.Continue:
+			return NewError(object.RUNTIME_ERROR, "continue outside loop")
 		}
 	}
 	return result
@@ -189,7 +336,8 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 		result = Eval(statement, env)
 
 		if result != nil &&
-			(result.Type() == object.RETURN_OBJECT || result.Type() == object.ERROR_OBJECT) {
+			(result.Type() == object.RETURN_OBJECT || result.Type() == object.ERROR_OBJECT ||
+				result.Type() == object.BREAK_OBJECT || result.Type() == object.CONTINUE_OBJECT) {
 			return result
 		}
 	}
@@ -198,14 +346,14 @@ func evalBlockStatement(block *ast.BlockStatement, env *object.Environment) obje
 }
 
 // Helper method for evaluating prefix
-func evalPrefix(operator string, expression object.Object) object.Object {
+func evalPrefix(operator string, expression object.Object, checked bool) object.Object {
 	switch operator {
 	case "!":
 		return evalBangPrefix(expression)
 	case "-":
-		return evalMinusPrefix(expression)
+		return evalMinusPrefix(expression, checked)
 	default:
-		return NewError("unknown operator: %s%s", operator, expression.Type())
+		return NewError(object.TYPE_ERROR, "unknown operator: %s%s", operator, expression.Type())
 	}
 }
 
@@ -224,58 +372,120 @@ func evalBangPrefix(expression object.Object) object.Object {
 }
 
 // Helper method for evaluating prefix -
-func evalMinusPrefix(expression object.Object) object.Object {
-	if expression.Type() != object.INTEGER_OBJECT {
-		return NewError("unknown operator: -%s", expression.Type())
+func evalMinusPrefix(expression object.Object, checked bool) object.Object {
+	switch expression := expression.(type) {
+	case *object.Integer:
+		value, ok := object.CheckedNeg(expression.Value)
+		if !ok && checked {
+			return NewError(object.OVERFLOW_ERROR, "integer overflow: -%d", expression.Value)
+		}
+		return &object.Integer{Value: value}
+	case *object.Float:
+		return &object.Float{Value: -expression.Value}
+	default:
+		return NewError(object.TYPE_ERROR, "unknown operator: -%s", expression.Type())
 	}
-
-	result := expression.(*object.Integer).Value
-	return &object.Integer{Value: -result}
 }
 
 // Helper method for evaluating infix
-func evalInfix(left object.Object, operator string, right object.Object) object.Object {
+func evalInfix(left object.Object, operator string, right object.Object, checked bool) object.Object {
 	switch {
+	case isNumber(left) && isNumber(right) &&
+		(left.Type() == object.FLOAT_OBJECT || right.Type() == object.FLOAT_OBJECT):
+		return evalFloatInfix(toFloat(left), operator, toFloat(right))
+	case operator == "==":
+		return evalBoolean(isEqual(left, right))
+	case operator == "!=":
+		return evalBoolean(!isEqual(left, right))
 	case left.Type() != right.Type():
-		return NewError("type mismatch: %s %s %s", left.Type(), operator, right.Type())
+		return NewError(object.TYPE_ERROR, "type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	case left.Type() == object.INTEGER_OBJECT && right.Type() == object.INTEGER_OBJECT:
 		leftValue := left.(*object.Integer).Value
 		rightValue := right.(*object.Integer).Value
-		return evalIntegerInfix(leftValue, operator, rightValue)
+		return evalIntegerInfix(leftValue, operator, rightValue, checked)
 	case left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT:
 		leftValue := left.(*object.String).Value
 		rightValue := right.(*object.String).Value
 		return evalStringInfix(leftValue, operator, rightValue)
-	case operator == "==":
-		return evalBoolean(left == right)
-	case operator == "!=":
-		return evalBoolean(left != right)
 	default:
-		return NewError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+		return NewError(object.TYPE_ERROR, "unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+}
+
+// Helper method for == and !=, which take any two values
+// Numbers and strings are equal by value, other values by identity, and values of different types are never equal
+func isEqual(left object.Object, right object.Object) bool {
+	switch {
+	case isNumber(left) && isNumber(right):
+		if left.Type() == object.INTEGER_OBJECT && right.Type() == object.INTEGER_OBJECT {
+			return left.(*object.Integer).Value == right.(*object.Integer).Value
+		}
+		return toFloat(left) == toFloat(right)
+	case left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT:
+		return left.(*object.String).Value == right.(*object.String).Value
+	default:
+		return left == right
 	}
 }
 
 // Helper method for evaluating string infix
 func evalStringInfix(left string, operator string, right string) object.Object {
 	if operator != "+" {
-		return NewError("unknown operator: %s %s %s",
+		return NewError(object.TYPE_ERROR, "unknown operator: %s %s %s",
 			object.STRING_OBJECT, operator, object.STRING_OBJECT)
 	}
 
-	return &object.String{left + right}
+	return &object.String{Value: left + right}
 }
 
 // Helper method for evaluating integer infix
-func evalIntegerInfix(left int64, operator string, right int64) object.Object {
+func evalIntegerInfix(left int64, operator string, right int64, checked bool) object.Object {
+	var result int64
+	var ok bool
+
+	switch operator {
+	case "+":
+		result, ok = object.CheckedAdd(left, right)
+	case "-":
+		result, ok = object.CheckedSub(left, right)
+	case "*":
+		result, ok = object.CheckedMul(left, right)
+	case "/":
+		if right == 0 {
+			return NewError(object.DIVISION_BY_ZERO_ERROR, "division by zero")
+		}
+		result, ok = object.CheckedDiv(left, right)
+	case "<":
+		return evalBoolean(left < right)
+	case ">":
+		return evalBoolean(left > right)
+	case "==":
+		return evalBoolean(left == right)
+	case "!=":
+		return evalBoolean(left != right)
+	default:
+		return NewError(object.TYPE_ERROR, "unknown operator: %s %s %s", object.INTEGER_OBJECT, operator, object.INTEGER_OBJECT)
+	}
+
+	// Wrap around like Go unless checked arithmetic is on
+	if !ok && checked {
+		return NewError(object.OVERFLOW_ERROR, "integer overflow: %d %s %d", left, operator, right)
+	}
+
+	return &object.Integer{Value: result}
+}
+
+// Helper method for evaluating float infix (either side may have been an integer)
+func evalFloatInfix(left float64, operator string, right float64) object.Object {
 	switch operator {
 	case "+":
-		return &object.Integer{Value: left + right}
+		return &object.Float{Value: left + right}
 	case "-":
-		return &object.Integer{Value: left - right}
+		return &object.Float{Value: left - right}
 	case "*":
-		return &object.Integer{Value: left * right}
+		return &object.Float{Value: left * right}
 	case "/":
-		return &object.Integer{Value: left / right}
+		return &object.Float{Value: left / right}
 	case "<":
 		return evalBoolean(left < right)
 	case ">":
@@ -285,7 +495,24 @@ func evalIntegerInfix(left int64, operator string, right int64) object.Object {
 	case "!=":
 		return evalBoolean(left != right)
 	default:
-		return NewError("unknown operator: %s %s %s", left, operator, right)
+		return NewError(object.TYPE_ERROR, "unknown operator: %s %s %s", object.FLOAT_OBJECT, operator, object.FLOAT_OBJECT)
+	}
+}
+
+// Helper method for checking numeric objects
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJECT || obj.Type() == object.FLOAT_OBJECT
+}
+
+// Helper method for widening numeric objects to float64
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
 	}
 }
 
@@ -298,14 +525,74 @@ func evalIf(i *ast.If, env *object.Environment) object.Object {
 	}
 
 	if isTrue(condition) {
-		return Eval(i.Consequence, env)
+		return orNull(Eval(i.Consequence, env))
 	} else if i.Alternative != nil {
-		return Eval(i.Alternative, env)
+		return orNull(Eval(i.Alternative, env))
 	} else {
 		return NULL
 	}
 }
 
+// Helper method for evaluating while loops
+func evalWhile(w *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(w.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+
+		if !isTrue(condition) {
+			return NULL
+		}
+
+		result := Eval(w.Body, env)
+		if isLoopExit(result) {
+			return result
+		}
+		if result == BREAK {
+			return NULL
+		}
+	}
+}
+
+// Helper method for evaluating for-in loops
+func evalFor(f *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := Eval(f.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+
+	iterator, ok := object.BuildIterator(iterable)
+	if !ok {
+		return NewError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type())
+	}
+
+	for {
+		item, ok := iterator.Next()
+		if !ok {
+			return NULL
+		}
+
+		env.Set(f.Variable.Value, item)
+
+		result := Eval(f.Body, env)
+		if isLoopExit(result) {
+			return result
+		}
+		if result == BREAK {
+			return NULL
+		}
+	}
+}
+
+// Helper method for results that leave a loop and keep bubbling up
+func isLoopExit(obj object.Object) bool {
+	if obj != nil {
+		return obj.Type() == object.RETURN_OBJECT || obj.Type() == object.ERROR_OBJECT
+	}
+	return false
+}
+
 // Helper method for defining what is true
 func isTrue(obj object.Object) bool {
 	switch obj {
@@ -327,17 +614,134 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 		return value
 	}
 
-	builtin, ok := builtins[node.Value]
+	builtins := env.Builtins()
+	if builtins == nil {
+		builtins = defaultBuiltins
+	}
+
+	builtin, ok := builtins.Lookup(node.Value)
 	if ok {
 		return builtin
 	}
 
-	return NewError("identifier not found: " + node.Value)
+	return NewError(object.NAME_ERROR, "identifier not found: "+node.Value)
+}
+
+// Helper method for evaluating assignments
+func evalAssign(node *ast.Assign, env *object.Environment) object.Object {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		value := Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+
+		_, ok := env.Assign(target.Value, value)
+		if !ok {
+			return NewError(object.NAME_ERROR, "identifier not found: "+target.Value)
+		}
+
+		return value
+	case *ast.Index:
+		collection := Eval(target.Array, env)
+		if isError(collection) {
+			return collection
+		}
+
+		index := Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+
+		value := Eval(node.Value, env)
+		if isError(value) {
+			return value
+		}
+
+		return evalSetIndex(collection, index, value, env)
+	default:
+		return NewError(object.RUNTIME_ERROR, "invalid assignment target: %s", node.Target.String())
+	}
+}
+
+// Helper method for evaluating index assignments
+// New hash keys count against the memory limit of the run
+func evalSetIndex(collection object.Object, indexObj object.Object, value object.Object, env *object.Environment) object.Object {
+	switch {
+	case collection.Type() == object.ARRAY_OBJECT && indexObj.Type() == object.INTEGER_OBJECT:
+		array := collection.(*object.Array)
+		index := indexObj.(*object.Integer).Value
+
+		end := int64(len(array.Elements) - 1)
+		if index < 0 || index > end {
+			return NewError(object.INDEX_ERROR, "index out of range: %d", index)
+		}
+
+		array.Elements[index] = value
+		return value
+	case collection.Type() == object.HASH_OBJECT:
+		hash := collection.(*object.Hash)
+		key, ok := indexObj.(object.Hashable)
+		if !ok {
+			return NewError(object.TYPE_ERROR, "unusable as hash key: %s", indexObj.Type())
+		}
+
+		if _, ok := hash.Pairs[key.HashKey()]; !ok {
+			if err := env.Budget().AllocateHashPair(); err != nil {
+				return err
+			}
+		}
+
+		hash.Pairs[key.HashKey()] = object.HashPair{Key: indexObj, Value: value}
+		return value
+	default:
+		return NewError(object.TYPE_ERROR, "index assignment not supported: %s", collection.Type())
+	}
 }
 
 // Helper method for reporting errors
-func NewError(format string, a ...interface{}) *object.Error {
-	return &object.Error{Message: fmt.Sprintf(format, a...)}
+func NewError(kind object.ErrorKind, format string, a ...interface{}) *object.Error {
+	return object.BuildError(kind, format, a...)
+}
+
+// Helper method to extend the stack trace of an error leaving the body of function, called at call
+// The caller's frame is named once the error leaves the caller too
+func traceCall(err *object.Error, function string, call token.Span) {
+	if len(err.Stack) == 0 {
+		err.Stack = append(err.Stack, object.StackFrame{Span: err.Span})
+	}
+
+	if function == "" {
+		function = "<anonymous>"
+	}
+
+	err.Stack[len(err.Stack)-1].Function = function
+	err.Stack = append(err.Stack, object.StackFrame{Span: call})
+}
+
+// Helper method to name a function the way stack traces do
+func functionName(f *object.Function) string {
+	if f.Name == "" {
+		return "<anonymous>"
+	}
+	return f.Name
+}
+
+// Helper method to name the outermost frame of an error leaving the program
+func traceMain(err *object.Error) {
+	if len(err.Stack) == 0 {
+		err.Stack = append(err.Stack, object.StackFrame{Span: err.Span})
+	}
+
+	err.Stack[len(err.Stack)-1].Function = "<main>"
+}
+
+// Helper method for values of blocks that end in a statement (e.g. "let") or are empty
+func orNull(obj object.Object) object.Object {
+	if obj == nil {
+		return NULL
+	}
+	return obj
 }
 
 // Helper method for stopping errors from bubbling up
@@ -365,7 +769,7 @@ func evalIndex(accessObj object.Object, indexObj object.Object) object.Object {
 		hash := accessObj.(*object.Hash)
 		key, ok := indexObj.(object.Hashable)
 		if !ok {
-			return NewError("unusable as hash key")
+			return NewError(object.TYPE_ERROR, "unusable as hash key: %s", indexObj.Type())
 		}
 
 		pair, ok := hash.Pairs[key.HashKey()]
@@ -375,7 +779,7 @@ func evalIndex(accessObj object.Object, indexObj object.Object) object.Object {
 			return pair.Value
 		}
 	default:
-		return NewError("index operator not supported: %s", accessObj.Type())
+		return NewError(object.TYPE_ERROR, "index operator not supported: %s", accessObj.Type())
 	}
 }
 
@@ -393,7 +797,7 @@ func evalHash(node *ast.Hash, env *object.Environment) object.Object {
 		// Get hashed key
 		hashKey, ok := key.(object.Hashable)
 		if !ok {
-			return NewError("ununsable as hash key")
+			return NewError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
 		}
 
 		// Get value
@@ -405,5 +809,5 @@ func evalHash(node *ast.Hash, env *object.Environment) object.Object {
 		pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
 	}
 
-	return &object.Hash{Pairs: pairs}
+	return allocate(&object.Hash{Pairs: pairs}, env)
 }
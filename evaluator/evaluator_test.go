@@ -1,11 +1,14 @@
 package evaluator
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"go_interpreter/lexer"
 	"go_interpreter/object"
 	"go_interpreter/parser"
+	"math"
 	"testing"
+	"time"
 )
 
 // Testing integer expressions e.g. "5;"
@@ -31,6 +34,46 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+// Testing float expressions e.g. "1.5 * 2;"
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14", 3.14},
+		{"1e-9", 1e-9},
+		{"-2.5", -2.5},
+		{"1.5 * 2", 3},
+		{"2 - 0.5", 1.5},
+		{"7 / 2.0", 3.5},
+		{"-2.5 + 1", -1.5},
+	}
+
+	for _, test := range tests {
+		result := testEval(test.input)
+		testFloat(t, result, test.expected)
+	}
+}
+
+// Testing float formatting e.g. "1.5 * 2" -> "3.0"
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1.5 * 2", "3.0"},
+		{"0.1", "0.1"},
+		{"1e21", "1e+21"},
+		{"1e-9", "1e-09"},
+		{"1.0 / 0", "+Inf"},
+	}
+
+	for _, test := range tests {
+		result := testEval(test.input)
+		assert.Equal(t, test.expected, result.Inspect(), "Expected Inspect()")
+	}
+}
+
 // Testing boolean expressions e.g. "true;"
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
@@ -47,6 +90,22 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"true != false", true},
 		{"(1 < 2) == true", true},
 		{"(1 > 2) == false", true},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1 == 1.0", true},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.5 != 2.5", false},
+		{"1 == true", false},
+		// == and != take any two values, comparing numbers and strings by value and anything else by identity
+		{`"a" == "a"`, true},
+		{`"a" != "b"`, true},
+		{`1 == "a"`, false},
+		{`1 != "a"`, true},
+		{"true == 1", false},
+		{"[1] == [1]", false},
+		{"let a = [1]; a == a", true},
+		// Operands are evaluated left to right
+		{"let x = 0; let f = fn() { x = x + 1; x }; let g = fn() { x = x * 10; x }; f() < g()", true},
 	}
 
 	for _, test := range tests {
@@ -167,6 +226,159 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestErrorPosition(t *testing.T) {
+	input := `let f = fn(x) {
+  x + true
+};
+f(1);`
+
+	errObj, ok := testEval(input).(*object.Error)
+	if !ok {
+		t.Fatalf("Expected object type: Error")
+	}
+
+	// Errors inside functions point at the function body, not the call
+	assert.Equal(t, 2, errObj.Span.Start.Line, "Line")
+	assert.Equal(t, 3, errObj.Span.Start.Column, "Column")
+
+	expected := "ERROR: 2:3: type mismatch: INTEGER + BOOLEAN\n" +
+		"    x + true\n" +
+		"    ^^^^^^^^\n" +
+		"stack trace:\n" +
+		"  at f (2:3)\n" +
+		"  at <main> (4:1)"
+	assert.Equal(t, expected, errObj.Inspect(), "Inspect()")
+}
+
+func TestTailCall(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let loop = fn(n) { if (n == 0) { 0 } else { loop(n - 1) } }; loop(1000000)", 0},
+		{"let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; sum(100000, 0)", 5000050000},
+		{
+			"let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; " +
+				"let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(100001)",
+			false,
+		},
+		{"let f = fn(xs) { len(xs) }; f([1, 2])", 2},
+		{"let f = fn(x) { x * 2 }; let g = fn(x) { f(x + 1) }; g(2) + 1", 7},
+	}
+
+	for _, test := range tests {
+		result := testEval(test.input)
+		switch expected := test.expected.(type) {
+		case int:
+			testInteger(t, result, int64(expected))
+		case bool:
+			testBoolean(t, result, expected)
+		}
+	}
+
+	// Errors in tail calls point at the tail call
+	errObj, ok := testEval("let f = fn(x) { x }; let g = fn() { f() }; g()").(*object.Error)
+	if !ok {
+		t.Fatalf("Expected error")
+	}
+	assert.Equal(t, object.ARITY_ERROR, errObj.Kind)
+	assert.Equal(t, "1:37", errObj.Span.Start.String())
+}
+
+func TestStackTrace(t *testing.T) {
+	input := `let f = fn(x) {
+  x + "a"
+};
+let g = fn() { f(1) + 0 };
+g();`
+
+	errObj, ok := testEval(input).(*object.Error)
+	if !ok {
+		t.Fatalf("Expected object type: Error")
+	}
+
+	expected := []struct {
+		function string
+		line     int
+		column   int
+	}{
+		{"f", 2, 3},
+		{"g", 4, 16},
+		{"<main>", 5, 1},
+	}
+
+	assert.Equal(t, len(expected), len(errObj.Stack), "Stack depth")
+	for i, frame := range errObj.Stack {
+		assert.Equal(t, expected[i].function, frame.Function, "Function")
+		assert.Equal(t, expected[i].line, frame.Span.Start.Line, "Line")
+		assert.Equal(t, expected[i].column, frame.Span.Start.Column, "Column")
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	tests := []struct {
+		input        string
+		expectedKind object.ErrorKind
+	}{
+		{"1 + true", object.TYPE_ERROR},
+		{"5()", object.TYPE_ERROR},
+		{"fn(x) { x }()", object.ARITY_ERROR},
+		{`len(1, 2)`, object.ARITY_ERROR},
+		{"let a = [1]; a[5] = 2", object.INDEX_ERROR},
+		{"foobar", object.NAME_ERROR},
+		{"let f = fn(x) { 1 + f(x) }; f(1)", object.STACK_OVERFLOW_ERROR},
+		{"1 / 0", object.DIVISION_BY_ZERO_ERROR},
+		{"let f = fn(x) { 10 / x }; f(0)", object.DIVISION_BY_ZERO_ERROR},
+	}
+
+	for _, test := range tests {
+		errObj, ok := testEval(test.input).(*object.Error)
+		if !ok {
+			t.Fatalf("Expected object type: Error for %q", test.input)
+		}
+
+		assert.Equal(t, test.expectedKind, errObj.Kind, test.input)
+	}
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	// Wraps around by default
+	testInteger(t, testEval("9223372036854775807 + 1"), math.MinInt64)
+
+	inputs := []string{
+		"9223372036854775807 + 1",
+		"-9223372036854775807 - 2",
+		"4611686018427387904 * 2",
+		"-(-9223372036854775807 - 1)",
+		"(-9223372036854775807 - 1) / -1",
+		"let f = fn(x) { x + 1 }; f(9223372036854775807)",
+	}
+
+	for _, input := range inputs {
+		errObj, ok := testCheckedEval(input).(*object.Error)
+		if !ok {
+			t.Fatalf("Expected object type: Error for %q", input)
+		}
+
+		assert.Equal(t, object.OVERFLOW_ERROR, errObj.Kind, input)
+	}
+
+	testInteger(t, testCheckedEval("9223372036854775806 + 1"), math.MaxInt64)
+}
+
+func TestMissingValues(t *testing.T) {
+	// Builtins and blocks without a value give null, not a Go nil
+	testNull(t, testEval("first([])"))
+	testNull(t, testEval("let x = if (true) { let y = 1 }; x"))
+	testNull(t, testEval("let f = fn() { let y = 1 }; f()"))
+
+	errObj, ok := testEval("first([]) + 1").(*object.Error)
+	if !ok {
+		t.Fatalf("Expected object type: Error")
+	}
+	assert.Equal(t, object.TYPE_ERROR, errObj.Kind)
+}
+
 func TestLetStatement(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -222,6 +434,122 @@ func TestClosure(t *testing.T) {
 	testInteger(t, testEval(input), 5)
 }
 
+func TestRecursiveLocalFunction(t *testing.T) {
+	input := `let parity = fn(n) {
+		let isEven = fn(x) { if (x == 0) { true } else { isOdd(x - 1) } };
+		let isOdd = fn(x) { if (x == 0) { false } else { isEven(x - 1) } };
+		isOdd(n)
+	};
+	parity(7);`
+	testBoolean(t, testEval(input), true)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let i = 0; while (i < 3) { let i = i + 1; } i;", 3},
+		{"let i = 0; while (true) { let i = i + 1; if (i > 9) { break; } } i;", 10},
+		{
+			`let i = 0; let sum = 0;
+			while (i < 10) {
+				let i = i + 1;
+				if (i == 5) { continue; }
+				let sum = sum + i;
+			}
+			sum;`,
+			50,
+		},
+		{"let sum = 0; for (x in [1, 2, 3]) { let sum = sum + x; } sum;", 6},
+		{"let last = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break; } let last = x; } last;", 2},
+		{
+			`let count = 0;
+			for (x in [1, 2, 3]) {
+				for (y in [1, 2, 3]) {
+					if (y > x) { break; }
+					let count = count + 1;
+				}
+			}
+			count;`,
+			6,
+		},
+		{"let f = fn() { while (true) { return 7; } }; f();", 7},
+		{"let first = 0; for (k in {3: 0, 1: 0, 2: 0}) { if (first == 0) { let first = k; } } first;", 1},
+		// The loop variable is one binding per function, so every closure sees its last value
+		{"let f = fn() { let fs = []; for (i in [1, 2, 3]) { let fs = push(fs, fn() { i * 10 }); } fs[0]() + fs[1]() + fs[2](); }; f();", 90},
+	}
+
+	for _, test := range tests {
+		testInteger(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestLoopErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"break;", "break outside loop"},
+		{"while (true) { fn() { continue; }(); }", "continue outside loop"},
+		{"for (x in 5) { x }", "cannot iterate over INTEGER"},
+	}
+
+	for _, test := range tests {
+		result := testEval(test.input)
+
+		errObj, ok := result.(*object.Error)
+		if !ok {
+			t.Fatalf("no error object returned. got=%T(%+v)", result, result)
+		}
+
+		assert.Equal(t, test.expectedMessage, errObj.Message, test.input)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; x = x + 1; x;", 2},
+		{"let x = 1; let y = 1; x = y = 5; x + y;", 10},
+		{"let i = 0; while (i < 10) { i = i + 1; } i;", 10},
+		{"let total = 0; let add = fn(n) { total = total + n; }; add(3); add(4); total;", 7},
+		{"let make = fn() { let c = 0; fn() { c = c + 1; c } }; let inc = make(); inc(); inc(); inc();", 3},
+		{"let arr = [1, 2, 3]; arr[1] = 20; arr[1];", 20},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"];`, 5},
+		{"let u = fn() { let x = 1; let f = fn() { x }; x = 2; f() }; u();", 2},
+		{"let g = fn() { let c = 0; let inc = fn() { c = c + 1 }; inc(); inc(); c }; g();", 2},
+	}
+
+	for _, test := range tests {
+		testInteger(t, testEval(test.input), test.expected)
+	}
+}
+
+func TestAssignErrors(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{"x = 1;", "identifier not found: x"},
+		{"let arr = [1]; arr[5] = 1;", "index out of range: 5"},
+		{"let x = 1; x[0] = 1;", "index assignment not supported: INTEGER"},
+	}
+
+	for _, test := range tests {
+		result := testEval(test.input)
+
+		errObj, ok := result.(*object.Error)
+		if !ok {
+			t.Fatalf("no error object returned. got=%T(%+v)", result, result)
+		}
+
+		assert.Equal(t, test.expectedMessage, errObj.Message, test.input)
+	}
+}
+
 func TestString(t *testing.T) {
 	input := `"Hello world!"`
 	result := testEval(input)
@@ -252,7 +580,7 @@ func TestBuiltin(t *testing.T) {
 		{`len("")`, 0},
 		{`len("hello world")`, 11},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
-		{`len("one", "two")`, "wrong number of arguments (expected = 1)"},
+		{`len("one", "two")`, "wrong number of arguments: expected=1, actual=2"},
 	}
 
 	for _, test := range tests {
@@ -274,6 +602,44 @@ func TestBuiltin(t *testing.T) {
 }
 
 // Helper method for calling eval
+func TestLimits(t *testing.T) {
+	loop := "while (true) { }"
+	tailRecursion := "let f = fn(n) { f(n + 1) }; f(0)"
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		ctx          context.Context
+		input        string
+		limits       object.Limits
+		expectedKind object.ErrorKind
+	}{
+		{context.Background(), loop, object.Limits{MaxSteps: 1000}, object.STEP_LIMIT_ERROR},
+		{context.Background(), tailRecursion, object.Limits{Timeout: 10 * time.Millisecond}, object.TIMEOUT_ERROR},
+		{context.Background(), "let f = fn(n) { 1 + f(n + 1) }; f(0)", object.Limits{MaxCallDepth: 10}, object.CALL_DEPTH_ERROR},
+		{cancelled, loop, object.Limits{}, object.CANCELLED_ERROR},
+		{context.Background(), `let s = "ab"; while (true) { s = s + s }`, object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR},
+		{context.Background(), "let a = []; while (true) { a = push(a, 1) }", object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR},
+		{context.Background(), "while (true) { [1, 2, 3]; {1: 2} }", object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR},
+		{context.Background(), "let h = {}; let i = 0; while (true) { h[i] = i; i = i + 1; }", object.Limits{MaxMemory: 1 << 20}, object.MEMORY_LIMIT_ERROR},
+	}
+
+	for _, test := range tests {
+		env := object.BuildEnvironment()
+		result := EvalContext(test.ctx, parser.BuildParser(lexer.BuildLexer(test.input)).ParseProgram(), env, test.limits)
+
+		errObj, ok := result.(*object.Error)
+		if !ok {
+			t.Fatalf("Expected object type: Error for %q", test.input)
+		}
+		assert.Equal(t, test.expectedKind, errObj.Kind, test.input)
+
+		// The budget only applies to that evaluation, not to later ones in the same environment
+		assert.Nil(t, env.Budget())
+	}
+}
+
 func testEval(input string) object.Object {
 	l := lexer.BuildLexer(input)
 	p := parser.BuildParser(l)
@@ -283,6 +649,14 @@ func testEval(input string) object.Object {
 	return Eval(prog, env)
 }
 
+// Helper method to evaluate input with integer overflow reported as an error
+func testCheckedEval(input string) object.Object {
+	prog := parser.BuildParser(lexer.BuildLexer(input)).ParseProgram()
+	env := object.BuildEnvironment()
+	env.SetCheckOverflow(true)
+	return Eval(prog, env)
+}
+
 // Helper method for checking integer objects
 func testInteger(t *testing.T, obj object.Object, expected int64) {
 	result, ok := obj.(*object.Integer)
@@ -293,6 +667,16 @@ func testInteger(t *testing.T, obj object.Object, expected int64) {
 	assert.Equal(t, result.Value, expected, "Expected value")
 }
 
+// Helper method for checking float objects
+func testFloat(t *testing.T, obj object.Object, expected float64) {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Fatalf("Expected object type: Float, actual: %T", obj)
+	}
+
+	assert.Equal(t, result.Value, expected, "Expected value")
+}
+
 // Helper method for checking boolean objects
 func testBoolean(t *testing.T, obj object.Object, expected bool) {
 	result, ok := obj.(*object.Boolean)
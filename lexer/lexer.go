@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"go_interpreter/token"
+	"go_interpreter/trace"
 )
 
 // Converts source code to tokens
@@ -10,10 +11,21 @@ type Lexer struct {
 	currentPosition int  // position that lexer points to in input
 	nextPosition    int  // next position after current position
 	currentChar     byte // character at current position
+
+	file      *token.File // shared by the positions of all tokens
+	line      int         // line of current position, starting at 1
+	lineStart int         // position of first character in current line
+
+	tracer trace.Tracer // told about every token, nil for none
 }
 
 func BuildLexer(input string) *Lexer {
-	lexer := &Lexer{input: input}
+	return BuildFileLexer("", input)
+}
+
+// Lexer whose token positions are reported as "name:line:col"
+func BuildFileLexer(name string, input string) *Lexer {
+	lexer := &Lexer{input: input, file: &token.File{Name: name, Source: input}, line: 1}
 
 	// Initialize currentPosition, nextPosition, currentChar
 	lexer.advanceCharacter()
@@ -23,6 +35,11 @@ func BuildLexer(input string) *Lexer {
 
 // Read next character and advance lexer
 func (l *Lexer) advanceCharacter() {
+	if l.currentChar == '\n' {
+		l.line += 1
+		l.lineStart = l.nextPosition
+	}
+
 	if l.nextPosition >= len(l.input) {
 		l.currentChar = 0 // ASCII code for null character
 	} else {
@@ -33,6 +50,16 @@ func (l *Lexer) advanceCharacter() {
 	l.nextPosition += 1
 }
 
+// Position of current character
+func (l *Lexer) position() token.Position {
+	offset := l.currentPosition
+	if offset > len(l.input) {
+		offset = len(l.input)
+	}
+
+	return token.Position{File: l.file, Offset: offset, Line: l.line, Column: offset - l.lineStart + 1}
+}
+
 // Read next token and advance lexer
 func (l *Lexer) advanceToken(constraint func(byte) bool) string {
 	startPosition := l.currentPosition
@@ -61,79 +88,132 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
+// Reports the tokens scanned from now on to tracer
+func (l *Lexer) SetTracer(tracer trace.Tracer) {
+	l.tracer = tracer
+}
+
 // Get next token
 func (l *Lexer) NextToken() token.Token {
+	t := l.scanToken()
+	if l.tracer != nil {
+		l.tracer.TokenScanned(t)
+	}
+	return t
+}
+
+// Helper method to read the next token
+func (l *Lexer) scanToken() token.Token {
 	l.skipWhitespace()
 
 	var t token.Token
+	start := l.position()
 
 	switch l.currentChar {
 	case '=':
 		if l.peekCharacter() == '=' {
 			l.advanceCharacter()
-			t = token.Token{token.EQ, string("=" + string(l.currentChar))}
+			t = token.Token{Type: token.EQ, Literal: string("=" + string(l.currentChar))}
 		} else {
-			t = token.Token{token.ASSIGN, string(l.currentChar)}
+			t = token.Token{Type: token.ASSIGN, Literal: string(l.currentChar)}
 		}
 	case '!':
 		if l.peekCharacter() == '=' {
 			l.advanceCharacter()
-			t = token.Token{token.NOT_EQ, string("!" + string(l.currentChar))}
+			t = token.Token{Type: token.NOT_EQ, Literal: string("!" + string(l.currentChar))}
 		} else {
-			t = token.Token{token.BANG, string(l.currentChar)}
+			t = token.Token{Type: token.BANG, Literal: string(l.currentChar)}
 		}
 	case ';':
-		t = token.Token{token.SEMICOLON, string(l.currentChar)}
+		t = token.Token{Type: token.SEMICOLON, Literal: string(l.currentChar)}
 	case '(':
-		t = token.Token{token.LPAREN, string(l.currentChar)}
+		t = token.Token{Type: token.LPAREN, Literal: string(l.currentChar)}
 	case ')':
-		t = token.Token{token.RPAREN, string(l.currentChar)}
+		t = token.Token{Type: token.RPAREN, Literal: string(l.currentChar)}
 	case ',':
-		t = token.Token{token.COMMA, string(l.currentChar)}
+		t = token.Token{Type: token.COMMA, Literal: string(l.currentChar)}
 	case '+':
-		t = token.Token{token.PLUS, string(l.currentChar)}
+		t = token.Token{Type: token.PLUS, Literal: string(l.currentChar)}
 	case '{':
-		t = token.Token{token.LBRACE, string(l.currentChar)}
+		t = token.Token{Type: token.LBRACE, Literal: string(l.currentChar)}
 	case '}':
-		t = token.Token{token.RBRACE, string(l.currentChar)}
+		t = token.Token{Type: token.RBRACE, Literal: string(l.currentChar)}
 	case '-':
-		t = token.Token{token.MINUS, string(l.currentChar)}
+		t = token.Token{Type: token.MINUS, Literal: string(l.currentChar)}
 	case '/':
-		t = token.Token{token.SLASH, string(l.currentChar)}
+		t = token.Token{Type: token.SLASH, Literal: string(l.currentChar)}
 	case '*':
-		t = token.Token{token.ASTERISK, string(l.currentChar)}
+		t = token.Token{Type: token.ASTERISK, Literal: string(l.currentChar)}
 	case '<':
-		t = token.Token{token.LT, string(l.currentChar)}
+		t = token.Token{Type: token.LT, Literal: string(l.currentChar)}
 	case '>':
-		t = token.Token{token.GT, string(l.currentChar)}
+		t = token.Token{Type: token.GT, Literal: string(l.currentChar)}
 	case '"':
-		t = token.Token{token.STRING, l.readString()}
+		t = token.Token{Type: token.STRING, Literal: l.readString()}
 	case '[':
-		t = token.Token{token.LSQUARE, string(l.currentChar)}
+		t = token.Token{Type: token.LSQUARE, Literal: string(l.currentChar)}
 	case ']':
-		t = token.Token{token.RSQUARE, string(l.currentChar)}
+		t = token.Token{Type: token.RSQUARE, Literal: string(l.currentChar)}
 	case ':':
-		t = token.Token{token.COLON, string(l.currentChar)}
+		t = token.Token{Type: token.COLON, Literal: string(l.currentChar)}
 	case 0:
-		t = token.Token{token.EOF, ""}
+		t = token.Token{Type: token.EOF, Literal: ""}
 	default:
 		if isLetter(l.currentChar) {
 			t.Literal = l.advanceToken(isLetter)
 			t.Type = token.GetIdentifier(t.Literal)
+			t.Span = token.Span{Start: start, End: l.position()}
 			return t
 		} else if isDigit(l.currentChar) {
-			t.Literal = l.advanceToken(isDigit)
-			t.Type = token.INT
+			t.Literal, t.Type = l.readNumber()
+			t.Span = token.Span{Start: start, End: l.position()}
 			return t
 		} else {
-			t = token.Token{token.ILLEGAL, string(l.currentChar)}
+			t = token.Token{Type: token.ILLEGAL, Literal: string(l.currentChar)}
 		}
 	}
 
 	l.advanceCharacter()
+	t.Span = token.Span{Start: start, End: l.position()}
 	return t
 }
 
+// Helper function
+// Reads integers (e.g. "42") and floats (e.g. "3.14", "1e-9", "2.5E+3")
+func (l *Lexer) readNumber() (string, token.TokenType) {
+	startPosition := l.currentPosition
+	tokenType := token.TokenType(token.INT)
+
+	l.advanceToken(isDigit)
+
+	// Fraction: "." must be followed by a digit
+	if l.currentChar == '.' && isDigit(l.peekCharacter()) {
+		tokenType = token.FLOAT
+		l.advanceCharacter()
+		l.advanceToken(isDigit)
+	}
+
+	// Exponent: "e" must be followed by a digit, optionally signed
+	if l.currentChar == 'e' || l.currentChar == 'E' {
+		next := l.peekCharacter()
+		afterSign := byte(0)
+		if l.nextPosition+1 < len(l.input) {
+			afterSign = l.input[l.nextPosition+1]
+		}
+
+		if isDigit(next) || ((next == '+' || next == '-') && isDigit(afterSign)) {
+			tokenType = token.FLOAT
+			l.advanceCharacter()
+			if l.currentChar == '+' || l.currentChar == '-' {
+				l.advanceCharacter()
+			}
+			l.advanceToken(isDigit)
+		}
+	}
+
+	return l.input[startPosition:l.currentPosition], tokenType
+}
+
 // Helper function
 func (l *Lexer) readString() string {
 	startPosition := l.currentPosition + 1
@@ -167,6 +167,96 @@ func TestDoubleCharacterTokens(t *testing.T) {
 	testLexer(t, input, expectedTokens)
 }
 
+func TestLoopKeywords(t *testing.T) {
+	input := `while (true) { break; }
+						for (x in xs) { continue; }`
+
+	expectedTokens := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.TRUE, "true"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.BREAK, "break"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.FOR, "for"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.IN, "in"},
+		{token.IDENT, "xs"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.CONTINUE, "continue"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.EOF, ""},
+	}
+
+	testLexer(t, input, expectedTokens)
+}
+
+func TestFloat(t *testing.T) {
+	input := `3.14 1e-9 2.5E+3 1.e 7`
+
+	expectedTokens := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.FLOAT, "3.14"},
+		{token.FLOAT, "1e-9"},
+		{token.FLOAT, "2.5E+3"},
+		{token.INT, "1"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "e"},
+		{token.INT, "7"},
+		{token.EOF, ""},
+	}
+
+	testLexer(t, input, expectedTokens)
+}
+
+func TestPositions(t *testing.T) {
+	input := "let x = 5;\n  x + \"ab\""
+
+	expectedPositions := []struct {
+		literal string
+		line    int
+		column  int
+		offset  int
+		end     int
+	}{
+		{"let", 1, 1, 0, 3},
+		{"x", 1, 5, 4, 5},
+		{"=", 1, 7, 6, 7},
+		{"5", 1, 9, 8, 9},
+		{";", 1, 10, 9, 10},
+		{"x", 2, 3, 13, 14},
+		{"+", 2, 5, 15, 16},
+		{"ab", 2, 7, 17, 21},
+		{"", 2, 11, 21, 21},
+	}
+
+	l := BuildFileLexer("test.mk", input)
+
+	for _, expected := range expectedPositions {
+		actualToken := l.NextToken()
+
+		assert.Equal(t, expected.literal, actualToken.Literal, "Literal")
+		assert.Equal(t, expected.line, actualToken.Span.Start.Line, "Line of %q", expected.literal)
+		assert.Equal(t, expected.column, actualToken.Span.Start.Column, "Column of %q", expected.literal)
+		assert.Equal(t, expected.offset, actualToken.Span.Start.Offset, "Offset of %q", expected.literal)
+		assert.Equal(t, expected.end, actualToken.Span.End.Offset, "End of %q", expected.literal)
+	}
+
+	l = BuildFileLexer("test.mk", input)
+	l.NextToken()
+	assert.Equal(t, "test.mk:1:5", l.NextToken().Span.Start.String(), "String()")
+}
+
 func testLexer(t *testing.T, input string, expectedTokens []struct {
 	expectedType    token.TokenType
 	expectedLiteral string
@@ -10,9 +10,21 @@ import (
 
 func main() {
 	// Interpreter or compiler
-	engine := flag.String("engine", "vm", "use 'vm' or 'eval'")
+	engine := flag.String("engine", "vm", "use 'vm', 'regvm' or 'eval'")
+	checked := flag.Bool("checked", false, "report integer overflow as an error instead of wrapping around")
+	optimize := flag.Bool("O", false, "optimize compiled bytecode")
 	flag.Parse()
 
+	// Commands instead of starting the REPL
+	switch flag.Arg(0) {
+	case "run":
+		os.Exit(runCommand(flag.Args()[1:], *engine, *checked, *optimize))
+	case "build":
+		os.Exit(buildCommand(flag.Args()[1:], *optimize))
+	case "disasm":
+		os.Exit(disasmCommand(flag.Args()[1:], *optimize))
+	}
+
 	// Get user
 	user, err := user.Current()
 	if err != nil {
@@ -24,5 +36,5 @@ func main() {
 	fmt.Printf("Feel free to type in commands. Engine = %s\n", *engine)
 
 	// Start loop
-	repl.StartLoop(engine, os.Stdin, os.Stdout)
+	repl.StartLoop(engine, *checked, *optimize, os.Stdin, os.Stdout)
 }
@@ -2,6 +2,8 @@ package object
 
 import "fmt"
 
+// The language's builtins, in the order compiled code indexes them
+// Shared by everything running, so never changed: hosts add their own to a BuiltinRegistry
 var Builtins = []struct {
 	Name    string
 	Builtin *BuiltIn
@@ -11,7 +13,7 @@ var Builtins = []struct {
 		&BuiltIn{
 			Function: func(args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments (expected = 1)")
+					return BuildError(ARITY_ERROR, "wrong number of arguments: expected=1, actual=%d", len(args))
 				}
 
 				switch arg := args[0].(type) {
@@ -20,7 +22,7 @@ var Builtins = []struct {
 				case *Array:
 					return &Integer{Value: int64(len(arg.Elements))}
 				default:
-					return newError("argument to `len` not supported, got %s", args[0].Type())
+					return BuildError(TYPE_ERROR, "argument to `len` not supported, got %s", args[0].Type())
 				}
 			},
 		},
@@ -30,11 +32,11 @@ var Builtins = []struct {
 		&BuiltIn{
 			Function: func(args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments (expected = 1)")
+					return BuildError(ARITY_ERROR, "wrong number of arguments: expected=1, actual=%d", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJECT {
-					return newError("argument to `first` must be array")
+					return BuildError(TYPE_ERROR, "argument to `first` must be array")
 				}
 
 				array := args[0].(*Array)
@@ -51,11 +53,11 @@ var Builtins = []struct {
 		&BuiltIn{
 			Function: func(args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments (expected = 1)")
+					return BuildError(ARITY_ERROR, "wrong number of arguments: expected=1, actual=%d", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJECT {
-					return newError("argument to `first` must be array")
+					return BuildError(TYPE_ERROR, "argument to `last` must be array")
 				}
 
 				array := args[0].(*Array)
@@ -70,13 +72,14 @@ var Builtins = []struct {
 	{
 		"tail",
 		&BuiltIn{
+			Allocates: true,
 			Function: func(args ...Object) Object {
 				if len(args) != 1 {
-					return newError("wrong number of arguments (expected = 1)")
+					return BuildError(ARITY_ERROR, "wrong number of arguments: expected=1, actual=%d", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJECT {
-					return newError("argument to `first` must be array")
+					return BuildError(TYPE_ERROR, "argument to `tail` must be array")
 				}
 
 				array := args[0].(*Array)
@@ -95,13 +98,14 @@ var Builtins = []struct {
 	{
 		"push",
 		&BuiltIn{
+			Allocates: true,
 			Function: func(args ...Object) Object {
 				if len(args) != 2 {
-					return newError("wrong number of arguments (expected = 2)")
+					return BuildError(ARITY_ERROR, "wrong number of arguments: expected=2, actual=%d", len(args))
 				}
 
 				if args[0].Type() != ARRAY_OBJECT {
-					return newError("argument to `first` must be array")
+					return BuildError(TYPE_ERROR, "argument to `push` must be array")
 				}
 
 				array := args[0].(*Array)
@@ -127,10 +131,6 @@ var Builtins = []struct {
 	},
 }
 
-func newError(format string, a ...interface{}) *Error {
-	return &Error{Message: fmt.Sprintf(format, a...)}
-}
-
 func GetBuiltin(name string) *BuiltIn {
 	for _, def := range Builtins {
 		if def.Name == name {
@@ -1 +1,76 @@
 package object
+
+import "fmt"
+
+// Compiled code refers to builtins by an 8-bit index
+const MaxBuiltins = 256
+
+// Builtin functions available to scripts, by name and by the index compiled code uses
+// Each runtime can have its own, so hosts can add functions without touching global state
+// A registry must not change while scripts are using it
+type BuiltinRegistry struct {
+	names    []string
+	builtins []*BuiltIn
+	indexes  map[string]int
+}
+
+// Registry holding the language's own builtins, in the order of Builtins
+func BuildBuiltinRegistry() *BuiltinRegistry {
+	registry := &BuiltinRegistry{indexes: map[string]int{}}
+	for _, definition := range Builtins {
+		registry.add(definition.Name, definition.Builtin)
+	}
+	return registry
+}
+
+// Adds a host function under name, or replaces the builtin already called that
+// Its results count against memory limits like those of the language's builtins that build new values
+func (r *BuiltinRegistry) Register(name string, function BuiltInFunction) error {
+	if name == "" || function == nil {
+		return fmt.Errorf("builtin needs a name and a function")
+	}
+
+	if _, ok := r.indexes[name]; !ok && len(r.builtins) >= MaxBuiltins {
+		return fmt.Errorf("too many builtins, can't add %q (at most %d)", name, MaxBuiltins)
+	}
+
+	r.add(name, &BuiltIn{Function: function, Allocates: true})
+	return nil
+}
+
+// Helper method to add or replace a builtin, keeping the index of a replaced one
+func (r *BuiltinRegistry) add(name string, builtin *BuiltIn) {
+	if index, ok := r.indexes[name]; ok {
+		r.builtins[index] = builtin
+		return
+	}
+
+	r.indexes[name] = len(r.builtins)
+	r.names = append(r.names, name)
+	r.builtins = append(r.builtins, builtin)
+}
+
+func (r *BuiltinRegistry) Lookup(name string) (*BuiltIn, bool) {
+	index, ok := r.indexes[name]
+	if !ok {
+		return nil, false
+	}
+	return r.builtins[index], true
+}
+
+// Builtin at the index compiled code uses, or nil
+func (r *BuiltinRegistry) Get(index int) *BuiltIn {
+	if index < 0 || index >= len(r.builtins) {
+		return nil
+	}
+	return r.builtins[index]
+}
+
+// Names in index order
+func (r *BuiltinRegistry) Names() []string {
+	return r.names
+}
+
+func (r *BuiltinRegistry) Len() int {
+	return len(r.builtins)
+}
@@ -0,0 +1,504 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Struct field tag naming the hash key of a field, e.g. `toy:"name"`, or `toy:"-"` to leave it out
+const FIELD_TAG = "toy"
+
+// Nesting beyond this is taken to be a cycle, e.g. a struct pointing at itself
+const maxConversionDepth = 1000
+
+var objectType = reflect.TypeOf((*Object)(nil)).Elem()
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Converts a Go value into an object scripts can use:
+//
+//	nil, nil pointers and nil interfaces -> null
+//	bool -> boolean
+//	int, uint (any size) -> integer
+//	float32, float64 -> float
+//	string -> string
+//	slices and arrays -> array
+//	maps with string, integer or bool keys -> hash
+//	structs -> hash with a string key per exported field, see FIELD_TAG
+//
+// Pointers and interfaces are followed, and objects are returned as they are
+func FromGo(value interface{}) (Object, error) {
+	if value == nil {
+		return NULL, nil
+	}
+	return fromGo(reflect.ValueOf(value), 0)
+}
+
+// Helper method to convert a value nested depth levels deep
+func fromGo(value reflect.Value, depth int) (Object, error) {
+	if depth > maxConversionDepth {
+		return nil, fmt.Errorf("value nested too deeply (more than %d levels)", maxConversionDepth)
+	}
+
+	if !value.IsValid() {
+		return NULL, nil
+	}
+
+	if value.Type().Implements(objectType) && value.CanInterface() {
+		if value.Kind() == reflect.Interface || value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				return NULL, nil
+			}
+		}
+		return value.Interface().(Object), nil
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		if value.Bool() {
+			return TRUE, nil
+		}
+		return FALSE, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Integer{Value: value.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if value.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d is too large for an integer", value.Uint())
+		}
+		return &Integer{Value: int64(value.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Float{Value: value.Float()}, nil
+	case reflect.String:
+		return &String{Value: value.String()}, nil
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return NULL, nil
+		}
+		return fromGo(value.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if value.Kind() == reflect.Slice && value.IsNil() {
+			return NULL, nil
+		}
+		return arrayFromGo(value, depth)
+	case reflect.Map:
+		if value.IsNil() {
+			return NULL, nil
+		}
+		return hashFromGo(value, depth)
+	case reflect.Struct:
+		return structFromGo(value, depth)
+	default:
+		return nil, fmt.Errorf("can't convert %s to an object", value.Type())
+	}
+}
+
+// Helper method to convert a slice or array
+func arrayFromGo(value reflect.Value, depth int) (Object, error) {
+	elements := make([]Object, value.Len())
+	for i := range elements {
+		element, err := fromGo(value.Index(i), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %w", i, err)
+		}
+		elements[i] = element
+	}
+	return &Array{Elements: elements}, nil
+}
+
+// Helper method to convert a map
+func hashFromGo(value reflect.Value, depth int) (Object, error) {
+	switch value.Type().Key().Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+	default:
+		return nil, fmt.Errorf("can't convert %s to a hash, keys must be strings, integers or bools", value.Type())
+	}
+
+	pairs := make(map[HashKey]HashPair, value.Len())
+	iter := value.MapRange()
+	for iter.Next() {
+		key, err := fromGo(iter.Key(), depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		element, err := fromGo(iter.Value(), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %w", key.Inspect(), err)
+		}
+
+		pairs[key.(Hashable).HashKey()] = HashPair{Key: key, Value: element}
+	}
+	return &Hash{Pairs: pairs}, nil
+}
+
+// Helper method to convert a struct
+func structFromGo(value reflect.Value, depth int) (Object, error) {
+	pairs := map[HashKey]HashPair{}
+	for i := 0; i < value.NumField(); i++ {
+		name, ok := fieldName(value.Type().Field(i))
+		if !ok {
+			continue
+		}
+
+		element, err := fromGo(value.Field(i), depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		key := &String{Value: name}
+		pairs[key.HashKey()] = HashPair{Key: key, Value: element}
+	}
+	return &Hash{Pairs: pairs}, nil
+}
+
+// Helper method to get the hash key of a struct field, or false if the field is left out
+func fieldName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "", false // Unexported
+	}
+
+	tag := strings.Split(field.Tag.Get(FIELD_TAG), ",")[0]
+	switch tag {
+	case "-":
+		return "", false
+	case "":
+		return field.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// Stores an object into the Go value target points to, converting it the opposite way to FromGo
+// Into an interface{}, objects become int64, float64, bool, string, nil, []interface{},
+// map[string]interface{} (hashes with only string keys) or map[interface{}]interface{}
+// Integers convert to floats, and null to the zero value of any type
+// Hash keys without a struct field are ignored, and fields without a key are left as they are
+func ToGo(obj Object, target interface{}) error {
+	pointer := reflect.ValueOf(target)
+	if pointer.Kind() != reflect.Ptr || pointer.IsNil() {
+		return fmt.Errorf("target must be a non-nil pointer, got %T", target)
+	}
+	return toGo(obj, pointer.Elem(), 0)
+}
+
+// Helper method to store an object nested depth levels deep
+func toGo(obj Object, target reflect.Value, depth int) error {
+	if depth > maxConversionDepth {
+		return fmt.Errorf("value nested too deeply (more than %d levels)", maxConversionDepth)
+	}
+
+	if obj == nil {
+		obj = NULL
+	}
+
+	// Objects stored as they are, e.g. into an Object or *Array
+	if target.Kind() != reflect.Interface || target.NumMethod() > 0 {
+		if reflect.TypeOf(obj).AssignableTo(target.Type()) {
+			target.Set(reflect.ValueOf(obj))
+			return nil
+		}
+	}
+
+	if obj.Type() == NULL_OBJECT {
+		target.Set(reflect.Zero(target.Type()))
+		return nil
+	}
+
+	switch target.Kind() {
+	case reflect.Interface:
+		if target.NumMethod() > 0 {
+			break
+		}
+		value, err := toNative(obj, depth)
+		if err != nil {
+			return err
+		}
+		if value != nil {
+			target.Set(reflect.ValueOf(value))
+		} else {
+			target.Set(reflect.Zero(target.Type()))
+		}
+		return nil
+	case reflect.Bool:
+		if b, ok := obj.(*Boolean); ok {
+			target.SetBool(b.Value)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := obj.(*Integer); ok {
+			if target.OverflowInt(i.Value) {
+				return fmt.Errorf("%d overflows %s", i.Value, target.Type())
+			}
+			target.SetInt(i.Value)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := obj.(*Integer); ok {
+			if i.Value < 0 || target.OverflowUint(uint64(i.Value)) {
+				return fmt.Errorf("%d overflows %s", i.Value, target.Type())
+			}
+			target.SetUint(uint64(i.Value))
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch number := obj.(type) {
+		case *Float:
+			target.SetFloat(number.Value)
+			return nil
+		case *Integer:
+			target.SetFloat(float64(number.Value))
+			return nil
+		}
+	case reflect.String:
+		if s, ok := obj.(*String); ok {
+			target.SetString(s.Value)
+			return nil
+		}
+	case reflect.Ptr:
+		value := reflect.New(target.Type().Elem())
+		err := toGo(obj, value.Elem(), depth+1)
+		if err != nil {
+			return err
+		}
+		target.Set(value)
+		return nil
+	case reflect.Slice:
+		if array, ok := obj.(*Array); ok {
+			slice := reflect.MakeSlice(target.Type(), len(array.Elements), len(array.Elements))
+			err := elementsToGo(array, slice, depth)
+			if err != nil {
+				return err
+			}
+			target.Set(slice)
+			return nil
+		}
+	case reflect.Array:
+		if array, ok := obj.(*Array); ok {
+			if len(array.Elements) != target.Len() {
+				return fmt.Errorf("can't convert an array of %d elements to %s", len(array.Elements), target.Type())
+			}
+			return elementsToGo(array, target, depth)
+		}
+	case reflect.Map:
+		if hash, ok := obj.(*Hash); ok {
+			return hashToGo(hash, target, depth)
+		}
+	case reflect.Struct:
+		if hash, ok := obj.(*Hash); ok {
+			return structToGo(hash, target, depth)
+		}
+	}
+
+	return fmt.Errorf("can't convert %s to %s", obj.Type(), target.Type())
+}
+
+// Helper method to store the elements of an array into a slice or array of the same length
+func elementsToGo(array *Array, target reflect.Value, depth int) error {
+	for i, element := range array.Elements {
+		err := toGo(element, target.Index(i), depth+1)
+		if err != nil {
+			return fmt.Errorf("[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Helper method to store a hash into a map
+func hashToGo(hash *Hash, target reflect.Value, depth int) error {
+	mapType := target.Type()
+	result := reflect.MakeMapWithSize(mapType, len(hash.Pairs))
+
+	for _, pair := range hash.Pairs {
+		key := reflect.New(mapType.Key()).Elem()
+		err := toGo(pair.Key, key, depth+1)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", pair.Key.Inspect(), err)
+		}
+
+		value := reflect.New(mapType.Elem()).Elem()
+		err = toGo(pair.Value, value, depth+1)
+		if err != nil {
+			return fmt.Errorf("[%s]: %w", pair.Key.Inspect(), err)
+		}
+
+		result.SetMapIndex(key, value)
+	}
+
+	target.Set(result)
+	return nil
+}
+
+// Helper method to store a hash into the fields of a struct
+func structToGo(hash *Hash, target reflect.Value, depth int) error {
+	for i := 0; i < target.NumField(); i++ {
+		name, ok := fieldName(target.Type().Field(i))
+		if !ok {
+			continue
+		}
+
+		pair, ok := hash.Pairs[(&String{Value: name}).HashKey()]
+		if !ok {
+			continue
+		}
+
+		err := toGo(pair.Value, target.Field(i), depth+1)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Helper method to convert an object to the Go value it would be stored as in an interface{}
+func toNative(obj Object, depth int) (interface{}, error) {
+	if depth > maxConversionDepth {
+		return nil, fmt.Errorf("value nested too deeply (more than %d levels)", maxConversionDepth)
+	}
+
+	switch obj := obj.(type) {
+	case *Integer:
+		return obj.Value, nil
+	case *Float:
+		return obj.Value, nil
+	case *Boolean:
+		return obj.Value, nil
+	case *String:
+		return obj.Value, nil
+	case *Null:
+		return nil, nil
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, element := range obj.Elements {
+			value, err := toNative(element, depth+1)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			elements[i] = value
+		}
+		return elements, nil
+	case *Hash:
+		return hashToNative(obj, depth)
+	default:
+		return nil, fmt.Errorf("can't convert %s to a Go value", obj.Type())
+	}
+}
+
+// Helper method to convert a hash to a map keyed by strings if it can, or by any key otherwise
+func hashToNative(hash *Hash, depth int) (interface{}, error) {
+	stringKeys := true
+	for _, pair := range hash.Pairs {
+		if pair.Key.Type() != STRING_OBJECT {
+			stringKeys = false
+			break
+		}
+	}
+
+	byString := map[string]interface{}{}
+	byAny := map[interface{}]interface{}{}
+
+	for _, pair := range hash.Pairs {
+		key, err := toNative(pair.Key, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := toNative(pair.Value, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %w", pair.Key.Inspect(), err)
+		}
+
+		if stringKeys {
+			byString[key.(string)] = value
+		} else {
+			byAny[key] = value
+		}
+	}
+
+	if stringKeys {
+		return byString, nil
+	}
+	return byAny, nil
+}
+
+// Adapts a typed Go function into a builtin, converting its arguments with ToGo and its result with FromGo
+// The function can return nothing, a value, an error, or a value and an error, e.g.
+//
+//	func(name string, times int) (string, error)
+//
+// Returned errors and bad arguments become error objects
+func WrapFunction(function interface{}) (BuiltInFunction, error) {
+	value := reflect.ValueOf(function)
+	if value.Kind() != reflect.Func || value.IsNil() {
+		return nil, fmt.Errorf("can't wrap %T, it isn't a function", function)
+	}
+
+	functionType := value.Type()
+	results := functionType.NumOut()
+	returnsError := results > 0 && functionType.Out(results-1) == errorType
+	if results > 2 || (results == 2 && !returnsError) {
+		return nil, fmt.Errorf("can't wrap %s, it must return at most a value and an error", functionType)
+	}
+
+	params := functionType.NumIn()
+	variadic := functionType.IsVariadic()
+
+	return func(args ...Object) Object {
+		if (!variadic && len(args) != params) || (variadic && len(args) < params-1) {
+			if variadic {
+				return BuildError(ARITY_ERROR, "wrong number of arguments: expected>=%d, actual=%d", params-1, len(args))
+			}
+			return BuildError(ARITY_ERROR, "wrong number of arguments: expected=%d, actual=%d", params, len(args))
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var paramType reflect.Type
+			if variadic && i >= params-1 {
+				paramType = functionType.In(params - 1).Elem()
+			} else {
+				paramType = functionType.In(i)
+			}
+
+			param := reflect.New(paramType).Elem()
+			err := toGo(arg, param, 0)
+			if err != nil {
+				return BuildError(TYPE_ERROR, "argument %d: %s", i+1, err)
+			}
+			in[i] = param
+		}
+
+		out := value.Call(in)
+
+		if returnsError {
+			if err, _ := out[len(out)-1].Interface().(error); err != nil {
+				return hostError(err)
+			}
+			out = out[:len(out)-1]
+		}
+
+		if len(out) == 0 {
+			return nil
+		}
+
+		result, err := fromGo(out[0], 0)
+		if err != nil {
+			return BuildError(TYPE_ERROR, "result: %s", err)
+		}
+		return result
+	}, nil
+}
+
+// Helper method to turn an error returned by a host function into an error object, keeping the kind of one that's already an *Error
+// Engines add the span and stack to the error they get, so it's a copy in case the host shares its errors between runs
+func hostError(err error) *Error {
+	var runtimeError *Error
+	if errors.As(err, &runtimeError) {
+		copied := *runtimeError
+		return &copied
+	}
+	return BuildError(RUNTIME_ERROR, "%s", err)
+}
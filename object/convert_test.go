@@ -0,0 +1,197 @@
+package object
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+type user struct {
+	Name    string `toy:"name"`
+	Age     int    `toy:"age"`
+	Admin   bool
+	Secret  string `toy:"-"`
+	private int
+	Manager *user    `toy:"manager"`
+	Tags    []string `toy:"tags"`
+}
+
+func TestFromGo(t *testing.T) {
+	var nilPointer *user
+	var nilObject *Integer
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{nilPointer, "null"},
+		{nilObject, "null"},
+		{true, "true"},
+		{int8(-5), "-5"},
+		{uint32(7), "7"},
+		{1.5, "1.5"},
+		{"toy", "toy"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]bool{true, false}, "[true, false]"},
+		{[]interface{}{1, "a", nil, []string{"b"}}, "[1, a, null, [b]]"},
+		{map[string]int{"a": 1}, "{a: 1}"},
+		{map[int]string{2: "b"}, "{2: b}"},
+		{&Integer{Value: 4}, "4"},
+	}
+
+	for _, test := range tests {
+		result, err := FromGo(test.input)
+		assert.Nil(t, err, test.input)
+		assert.Equal(t, test.expected, result.Inspect(), test.input)
+	}
+
+	// Shared so engines can compare them by identity
+	result, _ := FromGo(false)
+	assert.Same(t, FALSE, result)
+	result, _ = FromGo(nil)
+	assert.Same(t, NULL, result)
+
+	result, err := FromGo(user{Name: "ada", Age: 36, Secret: "x", private: 1, Tags: []string{"a"}})
+	assert.Nil(t, err)
+	hash := result.(*Hash)
+	assert.Equal(t, 5, len(hash.Pairs))
+	for key, expected := range map[string]string{"name": "ada", "age": "36", "Admin": "false", "manager": "null", "tags": "[a]"} {
+		pair, ok := hash.Pairs[(&String{Value: key}).HashKey()]
+		if assert.True(t, ok, key) {
+			assert.Equal(t, expected, pair.Value.Inspect(), key)
+		}
+	}
+
+	failures := []interface{}{
+		uint64(math.MaxUint64),
+		map[float64]int{1.5: 1},
+		[]func(){func() {}},
+		make(chan int),
+	}
+	for _, input := range failures {
+		_, err := FromGo(input)
+		assert.NotNil(t, err, input)
+	}
+
+	cycle := &user{Name: "loop"}
+	cycle.Manager = cycle
+	_, err = FromGo(cycle)
+	assert.NotNil(t, err)
+}
+
+func TestToGo(t *testing.T) {
+	var i int
+	assert.Nil(t, ToGo(&Integer{Value: 5}, &i))
+	assert.Equal(t, 5, i)
+
+	var f float64
+	assert.Nil(t, ToGo(&Integer{Value: 2}, &f))
+	assert.Equal(t, 2.0, f)
+
+	var s []string
+	assert.Nil(t, ToGo(&Array{Elements: []Object{&String{Value: "a"}, &String{Value: "b"}}}, &s))
+	assert.Equal(t, []string{"a", "b"}, s)
+
+	var m map[int]bool
+	assert.Nil(t, ToGo(&Hash{Pairs: map[HashKey]HashPair{
+		(&Integer{Value: 1}).HashKey(): {Key: &Integer{Value: 1}, Value: TRUE},
+	}}, &m))
+	assert.Equal(t, map[int]bool{1: true}, m)
+
+	// Round trip through a hash, with keys of missing fields ignored
+	input := user{Name: "ada", Age: 36, Admin: true, Secret: "x", Manager: &user{Name: "bob"}, Tags: []string{"a"}}
+	obj, err := FromGo(input)
+	assert.Nil(t, err)
+	var output user
+	assert.Nil(t, ToGo(obj, &output))
+	input.Secret = ""
+	assert.Equal(t, input, output)
+
+	var native interface{}
+	assert.Nil(t, ToGo(&Array{Elements: []Object{&Integer{Value: 1}, NULL, &Float{Value: 0.5}}}, &native))
+	assert.Equal(t, []interface{}{int64(1), nil, 0.5}, native)
+	assert.Nil(t, ToGo(obj, &native))
+	assert.Equal(t, "ada", native.(map[string]interface{})["name"])
+
+	var o Object
+	assert.Nil(t, ToGo(NULL, &o))
+	assert.Same(t, NULL, o)
+
+	var pointer *int
+	assert.Nil(t, ToGo(NULL, &pointer))
+	assert.Nil(t, pointer)
+
+	var small int8
+	failures := []struct {
+		obj    Object
+		target interface{}
+	}{
+		{&Integer{Value: 300}, &small},
+		{&Integer{Value: -1}, new(uint)},
+		{&String{Value: "a"}, &i},
+		{&Float{Value: 1.5}, &i},
+		{&Array{Elements: []Object{&Integer{Value: 1}}}, new([2]int)},
+		{&Array{Elements: []Object{&String{Value: "a"}}}, new([]int)},
+		{&Integer{Value: 1}, i},
+		{&BuiltIn{}, &native},
+	}
+	for _, test := range failures {
+		assert.NotNil(t, ToGo(test.obj, test.target), test.obj.Inspect())
+	}
+}
+
+func TestWrapFunction(t *testing.T) {
+	repeat, err := WrapFunction(func(s string, times int) (string, error) {
+		if times < 0 {
+			return "", errors.New("negative count")
+		}
+		result := ""
+		for i := 0; i < times; i++ {
+			result += s
+		}
+		return result, nil
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "abab", repeat(&String{Value: "ab"}, &Integer{Value: 2}).Inspect())
+	assertErrorKind(t, RUNTIME_ERROR, repeat(&String{Value: "ab"}, &Integer{Value: -1}))
+	assertErrorKind(t, ARITY_ERROR, repeat(&String{Value: "ab"}))
+	assertErrorKind(t, TYPE_ERROR, repeat(&Integer{Value: 1}, &Integer{Value: 2}))
+
+	sum, err := WrapFunction(func(numbers ...float64) float64 {
+		total := 0.0
+		for _, n := range numbers {
+			total += n
+		}
+		return total
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "0.0", sum().Inspect())
+	assert.Equal(t, "3.5", sum(&Integer{Value: 1}, &Float{Value: 2.5}).Inspect())
+
+	called := false
+	touch, err := WrapFunction(func() { called = true })
+	assert.Nil(t, err)
+	assert.Nil(t, touch())
+	assert.True(t, called)
+
+	// Errors that are already error objects keep their kind
+	fail, err := WrapFunction(func() error { return BuildError(INDEX_ERROR, "missing") })
+	assert.Nil(t, err)
+	assertErrorKind(t, INDEX_ERROR, fail())
+
+	for _, function := range []interface{}{nil, 5, func() (int, int) { return 1, 2 }} {
+		_, err := WrapFunction(function)
+		assert.NotNil(t, err, function)
+	}
+}
+
+// Helper method to check that a builtin returned an error of the given kind
+func assertErrorKind(t *testing.T, kind ErrorKind, obj Object) {
+	err, ok := obj.(*Error)
+	if assert.True(t, ok, obj) {
+		assert.Equal(t, kind, err.Kind)
+	}
+}
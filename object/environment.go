@@ -1,8 +1,15 @@
 package object
 
+import "go_interpreter/trace"
+
 type Environment struct {
-	store map[string]Object
-	outer *Environment
+	store    map[string]Object
+	outer    *Environment
+	depth    int              // number of function calls being evaluated
+	budget   *Budget          // limits of the run evaluating the environment, nil for none
+	builtins *BuiltinRegistry // builtins visible in the environment, nil for the language's own
+	tracer   trace.Tracer     // told about every node evaluated in the environment, nil for none
+	checked  bool             // report int64 overflow of + - * / as an error instead of wrapping around
 }
 
 func BuildEnvironment() *Environment {
@@ -13,9 +20,64 @@ func BuildEnvironment() *Environment {
 func BuildInnerEnvironment(outer *Environment) *Environment {
 	env := BuildEnvironment()
 	env.outer = outer
+	env.depth = outer.depth
+	env.budget = outer.budget
+	env.builtins = outer.builtins
+	env.tracer = outer.tracer
+	env.checked = outer.checked
+	return env
+}
+
+// Environment for a function body: scoped inside outer, but one call deeper than caller
+// and run within the caller's budget, traced by the caller's tracer, with the caller's overflow checks
+func BuildCallEnvironment(outer *Environment, caller *Environment) *Environment {
+	env := BuildInnerEnvironment(outer)
+	env.depth = caller.depth + 1
+	env.budget = caller.budget
+	env.tracer = caller.tracer
+	env.checked = caller.checked
 	return env
 }
 
+func (e *Environment) CallDepth() int {
+	return e.depth
+}
+
+func (e *Environment) Budget() *Budget {
+	return e.budget
+}
+
+func (e *Environment) SetBudget(budget *Budget) {
+	e.budget = budget
+}
+
+func (e *Environment) Tracer() trace.Tracer {
+	return e.tracer
+}
+
+// Reports the nodes evaluated in the environment and the ones built inside it to tracer
+func (e *Environment) SetTracer(tracer trace.Tracer) {
+	e.tracer = tracer
+}
+
+func (e *Environment) CheckOverflow() bool {
+	return e.checked
+}
+
+// Reports int64 overflow of + - * / as an error, instead of wrapping around, in the environment and the ones built inside it
+func (e *Environment) SetCheckOverflow(checked bool) {
+	e.checked = checked
+}
+
+func (e *Environment) Builtins() *BuiltinRegistry {
+	return e.builtins
+}
+
+// Makes the builtins of registry visible in the environment and the ones built inside it
+func (e *Environment) SetBuiltins(registry *BuiltinRegistry) {
+	e.builtins = registry
+}
+
 func (e *Environment) Get(name string) (Object, bool) {
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
@@ -28,3 +90,18 @@ func (e *Environment) Set(name string, val Object) Object {
 	e.store[name] = val
 	return val
 }
+
+// Rebind an existing name in the environment that defines it
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	_, ok := e.store[name]
+	if ok {
+		e.store[name] = val
+		return val, true
+	}
+
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+
+	return nil, false
+}
@@ -0,0 +1,86 @@
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"go_interpreter/token"
+)
+
+type ErrorKind string
+
+// Categories of run-time errors, shared by the evaluator and the VM
+const (
+	TYPE_ERROR             ErrorKind = "TYPE_ERROR"             // e.g. 1 + "a", calling a non-function
+	ARITY_ERROR            ErrorKind = "ARITY_ERROR"            // wrong number of arguments
+	INDEX_ERROR            ErrorKind = "INDEX_ERROR"            // e.g. index out of range
+	NAME_ERROR             ErrorKind = "NAME_ERROR"             // undefined identifier
+	STACK_OVERFLOW_ERROR   ErrorKind = "STACK_OVERFLOW_ERROR"   // too many nested calls or values
+	DIVISION_BY_ZERO_ERROR ErrorKind = "DIVISION_BY_ZERO_ERROR" // e.g. 1 / 0
+	OVERFLOW_ERROR         ErrorKind = "OVERFLOW_ERROR"         // int64 overflow, only with checked arithmetic
+	RUNTIME_ERROR          ErrorKind = "RUNTIME_ERROR"          // anything else e.g. break outside loop
+	INTERNAL_ERROR         ErrorKind = "INTERNAL_ERROR"         // bug in the interpreter, recovered from a Go panic
+	STEP_LIMIT_ERROR       ErrorKind = "STEP_LIMIT_ERROR"       // ran more steps than Limits.MaxSteps
+	CALL_DEPTH_ERROR       ErrorKind = "CALL_DEPTH_ERROR"       // nested more calls than Limits.MaxCallDepth
+	TIMEOUT_ERROR          ErrorKind = "TIMEOUT_ERROR"          // ran past Limits.Timeout or the context's deadline
+	CANCELLED_ERROR        ErrorKind = "CANCELLED_ERROR"        // context was cancelled
+	MEMORY_LIMIT_ERROR     ErrorKind = "MEMORY_LIMIT_ERROR"     // built more strings, arrays and hashes than Limits.MaxMemory
+)
+
+// Frames shown in a stack trace before the rest are elided
+const maxPrintedFrames = 20
+
+// Error type
+// Evaluator returns it as an Object, VM returns it as an error (use errors.As to get it back)
+type Error struct {
+	Kind    ErrorKind
+	Message string
+	Span    token.Span   // source code that caused the error, if known
+	Stack   []StackFrame // calls active when the error happened, innermost first
+}
+
+// Function being run and the source code it was running
+type StackFrame struct {
+	Function string // "<main>" for top level code, "<anonymous>" for unnamed functions
+	Span     token.Span
+}
+
+func BuildError(kind ErrorKind, format string, a ...interface{}) *Error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+func (e *Error) Type() ObjectType {
+	return ERROR_OBJECT
+}
+
+func (e *Error) Inspect() string {
+	return "ERROR: " + e.Error()
+}
+
+// e.g.
+//
+//	fib.mk:2:3: type mismatch: INTEGER + STRING
+//	  x + "a"
+//	  ^^^^^^^
+//	stack trace:
+//	  at f (fib.mk:2:3)
+//	  at <main> (fib.mk:4:1)
+func (e *Error) Error() string {
+	var out bytes.Buffer
+
+	out.WriteString(e.Span.Annotate(e.Message))
+
+	if len(e.Stack) > 0 {
+		out.WriteString("\nstack trace:")
+	}
+
+	for i, frame := range e.Stack {
+		if i == maxPrintedFrames {
+			out.WriteString(fmt.Sprintf("\n  ... %d more", len(e.Stack)-maxPrintedFrames))
+			break
+		}
+
+		out.WriteString("\n  at " + frame.Function + " (" + frame.Span.Start.String() + ")")
+	}
+
+	return out.String()
+}
@@ -0,0 +1,70 @@
+package object
+
+import "sort"
+
+// Iterator type (walks the elements of an array or the keys of a hash)
+type Iterator struct {
+	items []Object // Snapshot of the items taken when iteration started
+	index int      // Index of next item
+}
+
+func (it *Iterator) Type() ObjectType {
+	return ITERATOR_OBJECT
+}
+
+func (it *Iterator) Inspect() string {
+	return "iterator"
+}
+
+// Build an iterator over an array or hash
+// Hash keys are visited in sorted order so both engines agree on iteration order
+func BuildIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		items := make([]Object, len(obj.Elements))
+		copy(items, obj.Elements)
+		return &Iterator{items: items}, true
+	case *Hash:
+		items := make([]Object, 0, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			items = append(items, pair.Key)
+		}
+		sort.Slice(items, func(i, j int) bool {
+			return keyLess(items[i], items[j])
+		})
+		return &Iterator{items: items}, true
+	default:
+		return nil, false
+	}
+}
+
+// Get next item, or false when exhausted
+func (it *Iterator) Next() (Object, bool) {
+	if it.index >= len(it.items) {
+		return nil, false
+	}
+
+	item := it.items[it.index]
+	it.index++
+	return item, true
+}
+
+// Helper function to order hash keys: by type, then by value
+func keyLess(a, b Object) bool {
+	if a.Type() != b.Type() {
+		return a.Type() < b.Type()
+	}
+
+	switch a := a.(type) {
+	case *Integer:
+		return a.Value < b.(*Integer).Value
+	case *Float:
+		return a.Value < b.(*Float).Value
+	case *String:
+		return a.Value < b.(*String).Value
+	case *Boolean:
+		return !a.Value && b.(*Boolean).Value
+	default:
+		return a.Inspect() < b.Inspect()
+	}
+}
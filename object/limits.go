@@ -0,0 +1,142 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Execution budget of a script, so untrusted code can't hang the host
+// Zero fields mean no limit
+type Limits struct {
+	MaxSteps     int           // Instructions run by a VM, or nodes evaluated by the evaluator
+	MaxCallDepth int           // Nested function calls (tail calls don't nest)
+	Timeout      time.Duration // Wall-clock time of the whole run
+	MaxMemory    int           // Approximate bytes of strings, arrays and hashes built, freed or not
+}
+
+// Steps between checks of the context and the clock
+const budgetCheckInterval = 1024
+
+// Tracks a run against its Limits and context
+// A nil *Budget never runs out
+type Budget struct {
+	ctx       context.Context
+	limits    Limits
+	deadline  time.Time // Zero without a timeout
+	steps     int       // Steps taken so far
+	nextCheck int       // Steps at which Step next looks at the limits
+	memory    int       // Approximate bytes allocated so far
+}
+
+func BuildBudget(ctx context.Context, limits Limits) *Budget {
+	budget := &Budget{ctx: ctx, limits: limits}
+	if limits.Timeout > 0 {
+		budget.deadline = time.Now().Add(limits.Timeout)
+	}
+	budget.scheduleCheck()
+	return budget
+}
+
+// Counts one step, returning an error once the budget has run out or the context is done
+// Cheap enough to call for every instruction: the limits are only checked every few steps
+func (b *Budget) Step() *Error {
+	if b == nil {
+		return nil
+	}
+
+	b.steps++
+	if b.steps < b.nextCheck {
+		return nil
+	}
+	return b.check()
+}
+
+// Checks the depth of a call about to start, where the outermost call has depth 1
+func (b *Budget) Call(depth int) *Error {
+	if b == nil || b.limits.MaxCallDepth <= 0 || depth <= b.limits.MaxCallDepth {
+		return nil
+	}
+	return BuildError(CALL_DEPTH_ERROR, "call depth limit exceeded: %d", b.limits.MaxCallDepth)
+}
+
+// Counts a new string, array or hash against the memory limit
+// Only the object itself counts, since its elements were counted when they were built
+func (b *Budget) Allocate(obj Object) *Error {
+	if b == nil || b.limits.MaxMemory <= 0 {
+		return nil
+	}
+
+	return b.charge(sizeOf(obj))
+}
+
+// Counts a key added to an existing hash against the memory limit
+func (b *Budget) AllocateHashPair() *Error {
+	if b == nil || b.limits.MaxMemory <= 0 {
+		return nil
+	}
+
+	return b.charge(hashPairSize)
+}
+
+// Helper method to add bytes to the memory used, returning an error once it's over the limit
+func (b *Budget) charge(bytes int) *Error {
+	b.memory += bytes
+	if b.memory > b.limits.MaxMemory {
+		return BuildError(MEMORY_LIMIT_ERROR, "memory limit exceeded: %d bytes", b.limits.MaxMemory)
+	}
+	return nil
+}
+
+// Approximate sizes in bytes of what scripts allocate on a 64-bit host
+const (
+	valueSize    = 16 // Interface value, e.g. an array element
+	stringSize   = 24 // *String with its string header, before the bytes
+	arraySize    = 32 // *Array with its slice header, before the elements
+	hashSize     = 56 // *Hash with its map header, before the pairs
+	hashPairSize = 64 // Map entry of a HashKey and its HashPair
+)
+
+// Helper method to estimate the memory taken by one object, not counting what it refers to
+func sizeOf(obj Object) int {
+	switch obj := obj.(type) {
+	case *String:
+		return stringSize + len(obj.Value)
+	case *Array:
+		return arraySize + valueSize*len(obj.Elements)
+	case *Hash:
+		return hashSize + hashPairSize*len(obj.Pairs)
+	default:
+		return valueSize
+	}
+}
+
+// Helper method to check every limit
+func (b *Budget) check() *Error {
+	if b.limits.MaxSteps > 0 && b.steps > b.limits.MaxSteps {
+		return BuildError(STEP_LIMIT_ERROR, "step limit exceeded: %d", b.limits.MaxSteps)
+	}
+
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return BuildError(TIMEOUT_ERROR, "timeout exceeded: %s", b.limits.Timeout)
+	}
+
+	// A deadline set on the context is a timeout too, anything else cancels the run
+	if err := b.ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return BuildError(TIMEOUT_ERROR, "timeout exceeded: %s", err)
+		}
+		return BuildError(CANCELLED_ERROR, "cancelled: %s", err)
+	}
+
+	b.scheduleCheck()
+	return nil
+}
+
+// Helper method to check again after the next interval, or exactly when the steps run out
+func (b *Budget) scheduleCheck() {
+	b.nextCheck = b.steps + budgetCheckInterval
+	if b.limits.MaxSteps > 0 && b.nextCheck > b.limits.MaxSteps+1 {
+		b.nextCheck = b.limits.MaxSteps + 1
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"go_interpreter/ast"
 	"go_interpreter/bytecode"
 	"hash/fnv"
+	"math"
+	"strconv"
 	"strings"
 )
 
@@ -13,16 +15,23 @@ type ObjectType string
 
 const (
 	INTEGER_OBJECT           = "INTEGER"
+	FLOAT_OBJECT             = "FLOAT"
 	BOOLEAN_OBJECT           = "BOOLEAN"
 	NULL_OBJECT              = "NULL"
 	RETURN_OBJECT            = "RETURN"
 	ERROR_OBJECT             = "ERROR"
 	FUNCTION_OBJECT          = "FUNCTION"
 	COMPILED_FUNCTION_OBJECT = "COMPILED_FUNCTION"
+	CLOSURE_OBJECT           = "CLOSURE"
 	STRING_OBJECT            = "STRING"
 	BUILTIN_OBJECT           = "BUILTIN"
 	ARRAY_OBJECT             = "ARRAY"
 	HASH_OBJECT              = "HASH"
+	BREAK_OBJECT             = "BREAK"
+	CONTINUE_OBJECT          = "CONTINUE"
+	ITERATOR_OBJECT          = "ITERATOR"
+	TAIL_CALL_OBJECT         = "TAIL_CALL"
+	CELL_OBJECT              = "CELL"
 )
 
 // Generic object
@@ -44,6 +53,57 @@ func (i *Integer) Inspect() string {
 	return fmt.Sprintf("%d", i.Value)
 }
 
+// Checked int64 arithmetic: ok is false when the result wrapped around
+func CheckedAdd(a, b int64) (int64, bool) {
+	c := a + b
+	return c, (b >= 0 && c >= a) || (b < 0 && c < a)
+}
+
+func CheckedSub(a, b int64) (int64, bool) {
+	c := a - b
+	return c, (b >= 0 && c <= a) || (b < 0 && c > a)
+}
+
+func CheckedMul(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+
+	c := a * b
+	if (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return c, false
+	}
+
+	return c, c/b == a
+}
+
+// Caller must rule out b == 0
+func CheckedDiv(a, b int64) (int64, bool) {
+	return a / b, !(a == math.MinInt64 && b == -1)
+}
+
+func CheckedNeg(a int64) (int64, bool) {
+	return -a, a != math.MinInt64
+}
+
+// Float type
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType {
+	return FLOAT_OBJECT
+}
+
+// Formats so that the output lexes back as a float (e.g. "3.0", not "3")
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if strings.ContainsAny(s, ".eInfNa") {
+		return s
+	}
+	return s + ".0"
+}
+
 // Boolean type
 type Boolean struct {
 	Value bool
@@ -60,6 +120,13 @@ func (b *Boolean) Inspect() string {
 // Null type
 type Null struct{}
 
+// Shared by every engine, which compare booleans and null by identity
+var (
+	TRUE  = &Boolean{Value: true}
+	FALSE = &Boolean{Value: false}
+	NULL  = &Null{}
+)
+
 func (n *Null) Type() ObjectType {
 	return NULL_OBJECT
 }
@@ -81,17 +148,41 @@ func (r *Return) Inspect() string {
 	return r.Value.Inspect()
 }
 
-// Error type
-type Error struct {
-	Message string
+// Break type (signals exit from the innermost loop)
+type Break struct{}
+
+func (b *Break) Type() ObjectType {
+	return BREAK_OBJECT
+}
+
+func (b *Break) Inspect() string {
+	return "break"
+}
+
+// Continue type (signals jump to next iteration of the innermost loop)
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType {
+	return CONTINUE_OBJECT
+}
+
+func (c *Continue) Inspect() string {
+	return "continue"
+}
+
+// Tail call type (signals the function being evaluated to call Function next, instead of returning)
+type TailCall struct {
+	Function  Object
+	Arguments []Object
+	Call      *ast.Call // Call expression, for stack traces
 }
 
-func (e *Error) Type() ObjectType {
-	return ERROR_OBJECT
+func (t *TailCall) Type() ObjectType {
+	return TAIL_CALL_OBJECT
 }
 
-func (e *Error) Inspect() string {
-	return "ERROR: " + e.Message
+func (t *TailCall) Inspect() string {
+	return "tail call"
 }
 
 // Function type (represents evaluated function literals)
@@ -99,6 +190,7 @@ type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string // Name the function is bound to by let, if any
 }
 
 func (f *Function) Type() ObjectType {
@@ -128,6 +220,8 @@ type CompiledFunction struct {
 	Instructions  bytecode.Instructions // Instructions for function body
 	NumLocals     int                   // Number of local bindings this function will create
 	NumParameters int                   // Number of parameters of function
+	Name          string                // Name the function is bound to by let, if any
+	Lines         bytecode.LineTable    // Source code of instructions, for runtime errors
 }
 
 func (c *CompiledFunction) Type() ObjectType {
@@ -138,6 +232,48 @@ func (c *CompiledFunction) Inspect() string {
 	return fmt.Sprintf("CompiledFunction[%p]", c)
 }
 
+// Lets the disassembler list the function body
+func (c *CompiledFunction) Body() bytecode.Instructions {
+	return c.Instructions
+}
+
+func (c *CompiledFunction) Signature() string {
+	name := c.Name
+	if name == "" {
+		name = "<anonymous>"
+	}
+	return fmt.Sprintf("fn %s(%d params, %d locals)", name, c.NumParameters, c.NumLocals)
+}
+
+// Closure type (compiled function plus the free variables it captured)
+type Closure struct {
+	Fn   *CompiledFunction // Compiled function being closed over
+	Free []*Cell           // Free variables captured when closure was built
+}
+
+func (c *Closure) Type() ObjectType {
+	return CLOSURE_OBJECT
+}
+
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
+
+// Variable captured by closures, shared by them and the function that defined it,
+// so an assignment through any of them is seen by all
+// Only compiled engines use cells; scripts never see them
+type Cell struct {
+	Value Object // nil until the variable is set
+}
+
+func (c *Cell) Type() ObjectType {
+	return CELL_OBJECT
+}
+
+func (c *Cell) Inspect() string {
+	return fmt.Sprintf("Cell[%p]", c)
+}
+
 // String type
 type String struct {
 	Value string
@@ -155,7 +291,8 @@ func (s *String) Inspect() string {
 type BuiltInFunction func(args ...Object) Object
 
 type BuiltIn struct {
-	Function BuiltInFunction
+	Function  BuiltInFunction
+	Allocates bool // Returns a new string, array or hash, which counts against memory limits
 }
 
 func (b *BuiltIn) Type() ObjectType {
@@ -176,18 +313,7 @@ func (a *Array) Type() ObjectType {
 }
 
 func (a *Array) Inspect() string {
-	var out bytes.Buffer
-
-	elements := []string{}
-	for _, e := range a.Elements {
-		elements = append(elements, e.Inspect())
-	}
-
-	out.WriteString("[")
-	out.WriteString(strings.Join(elements, ", "))
-	out.WriteString("]")
-
-	return out.String()
+	return inspectNested(a, map[Object]bool{})
 }
 
 // Hash key type
@@ -212,6 +338,15 @@ func (i *Integer) HashKey() HashKey {
 	return HashKey{Type: i.Type(), Value: uint64(i.Value)}
 }
 
+func (f *Float) HashKey() HashKey {
+	value := f.Value
+	if value == 0 {
+		value = 0 // -0.0 and 0.0 are equal, so they must hash the same
+	}
+
+	return HashKey{Type: f.Type(), Value: math.Float64bits(value)}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
@@ -234,17 +369,49 @@ func (h *Hash) Type() ObjectType {
 }
 
 func (h *Hash) Inspect() string {
+	return inspectNested(h, map[Object]bool{})
+}
+
+// Helper method to inspect an array or hash that may contain itself
+// An array or hash inside itself is shown as [...] or {...}, instead of recursing forever
+func inspectNested(obj Object, enclosing map[Object]bool) string {
 	var out bytes.Buffer
 
-	pairs := []string{}
-	for _, pair := range h.Pairs {
-		pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), pair.Value.Inspect()))
+	switch obj := obj.(type) {
+	case *Array:
+		if enclosing[obj] {
+			return "[...]"
+		}
+		enclosing[obj] = true
+		defer delete(enclosing, obj)
+
+		elements := []string{}
+		for _, e := range obj.Elements {
+			elements = append(elements, inspectNested(e, enclosing))
+		}
+
+		out.WriteString("[")
+		out.WriteString(strings.Join(elements, ", "))
+		out.WriteString("]")
+	case *Hash:
+		if enclosing[obj] {
+			return "{...}"
+		}
+		enclosing[obj] = true
+		defer delete(enclosing, obj)
+
+		pairs := []string{}
+		for _, pair := range obj.Pairs {
+			pairs = append(pairs, fmt.Sprintf("%s: %s", pair.Key.Inspect(), inspectNested(pair.Value, enclosing)))
+		}
+
+		out.WriteString("{")
+		out.WriteString(strings.Join(pairs, ", "))
+		out.WriteString("}")
+	default:
+		return obj.Inspect()
 	}
 
-	out.WriteString("{")
-	out.WriteString(strings.Join(pairs, ", "))
-	out.WriteString("}")
-
 	return out.String()
 }
 
@@ -252,3 +419,48 @@ func (h *Hash) Inspect() string {
 type Hashable interface {
 	HashKey() HashKey
 }
+
+// Deep copies of arrays and hashes, so scripts can assign into them without changing the originals
+// Objects appearing more than once (even inside themselves) are copied once, so the copies share them the same way
+// Other objects can't be changed by scripts, so they're returned as they are
+func Copy(objs ...Object) []Object {
+	copies := map[Object]Object{}
+
+	result := make([]Object, len(objs))
+	for i, obj := range objs {
+		result[i] = copyObject(obj, copies)
+	}
+	return result
+}
+
+// Helper method to copy an object, reusing the copies made so far
+func copyObject(obj Object, copies map[Object]Object) Object {
+	switch obj.(type) {
+	case *Array, *Hash:
+	default:
+		return obj
+	}
+
+	if copied, ok := copies[obj]; ok {
+		return copied
+	}
+
+	switch obj := obj.(type) {
+	case *Array:
+		array := &Array{Elements: make([]Object, len(obj.Elements))}
+		copies[obj] = array
+		for i, element := range obj.Elements {
+			array.Elements[i] = copyObject(element, copies)
+		}
+		return array
+	case *Hash:
+		hash := &Hash{Pairs: make(map[HashKey]HashPair, len(obj.Pairs))}
+		copies[obj] = hash
+		for key, pair := range obj.Pairs {
+			hash.Pairs[key] = HashPair{Key: pair.Key, Value: copyObject(pair.Value, copies)}
+		}
+		return hash
+	default:
+		return obj
+	}
+}
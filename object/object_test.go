@@ -0,0 +1,54 @@
+package object
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	inner := &Array{Elements: []Object{&Integer{Value: 1}}}
+	hash := &Hash{Pairs: map[HashKey]HashPair{
+		(&String{Value: "inner"}).HashKey(): {Key: &String{Value: "inner"}, Value: inner},
+	}}
+	outer := &Array{Elements: []Object{inner, hash, TRUE}}
+	outer.Elements = append(outer.Elements, outer)
+	name := &String{Value: "toy"}
+
+	copies := Copy(outer, inner, name, nil)
+	copied := copies[0].(*Array)
+
+	assert.NotSame(t, outer, copied)
+	assert.Equal(t, "[1]", copied.Elements[0].Inspect())
+	assert.NotSame(t, inner, copied.Elements[0])
+	assert.NotSame(t, hash, copied.Elements[1])
+	assert.Same(t, TRUE, copied.Elements[2])
+
+	// Sharing and cycles are kept
+	assert.Same(t, copied, copied.Elements[3])
+	assert.Same(t, copied.Elements[0], copies[1])
+	pair := copied.Elements[1].(*Hash).Pairs[(&String{Value: "inner"}).HashKey()]
+	assert.Same(t, copies[1], pair.Value)
+
+	// Objects scripts can't change aren't copied
+	assert.Same(t, name, copies[2])
+	assert.Nil(t, copies[3])
+
+	copies[1].(*Array).Elements[0] = &Integer{Value: 2}
+	assert.Equal(t, "[1]", inner.Inspect())
+}
+
+func TestInspectCycles(t *testing.T) {
+	array := &Array{Elements: []Object{&Integer{Value: 1}}}
+	array.Elements = append(array.Elements, array)
+	assert.Equal(t, "[1, [...]]", array.Inspect())
+
+	key := &String{Value: "self"}
+	hash := &Hash{Pairs: map[HashKey]HashPair{}}
+	hash.Pairs[key.HashKey()] = HashPair{Key: key, Value: &Array{Elements: []Object{hash}}}
+	assert.Equal(t, "{self: [{...}]}", hash.Inspect())
+
+	// A value appearing twice without containing itself is shown in full
+	inner := &Array{Elements: []Object{&Integer{Value: 2}}}
+	shared := &Array{Elements: []Object{inner, inner}}
+	assert.Equal(t, "[[2], [2]]", shared.Inspect())
+}
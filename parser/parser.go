@@ -2,15 +2,13 @@ package parser
 
 import (
 	"fmt"
-	"github.com/fatih/color"
 	"go_interpreter/ast"
 	"go_interpreter/lexer"
 	"go_interpreter/token"
+	"go_interpreter/trace"
 	"strconv"
 )
 
-var PRINT_PARSE = false
-
 // Top down operator precedence parser builds AST out of tokens
 type Parser struct {
 	l *lexer.Lexer // corresponding lexer
@@ -22,8 +20,15 @@ type Parser struct {
 
 	prefixMap map[token.TokenType]parsePrefix // parse prefix expressions
 	infixMap  map[token.TokenType]parseInfix  // parse infix expressions
+
+	tracer trace.Tracer // told about every node parsed, nil for none
+
+	depth   int  // expressions and blocks being parsed inside each other
+	tooDeep bool // nesting limit was hit, so the rest of the input is skipped
 }
 
+const maxNesting = 1000 // Upper limit on expressions and blocks nested in each other, so deep input can't overflow the Go stack
+
 func BuildParser(l *lexer.Lexer) *Parser {
 	p := &Parser{l: l, errors: []string{}}
 
@@ -35,6 +40,7 @@ func BuildParser(l *lexer.Lexer) *Parser {
 	p.prefixMap = make(map[token.TokenType]parsePrefix)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefix)
 	p.registerPrefix(token.MINUS, p.parsePrefix)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
@@ -58,17 +64,26 @@ func BuildParser(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.GT, p.parseInfix)
 	p.registerInfix(token.LPAREN, p.parseCall)
 	p.registerInfix(token.LSQUARE, p.parseIndex)
+	p.registerInfix(token.ASSIGN, p.parseAssign)
 
 	return p
 }
 
+// Reports the nodes parsed from now on to tracer (scanned tokens are reported by the lexer)
+func (p *Parser) SetTracer(tracer trace.Tracer) {
+	p.tracer = tracer
+}
+
+// Helper method to report a node once it's been parsed
+func (p *Parser) traceNode(node ast.Node) {
+	if p.tracer != nil {
+		p.tracer.NodeParsed(node)
+	}
+}
+
 func (p *Parser) GetNextToken() {
 	p.currentToken = p.nextToken
 	p.nextToken = p.l.NextToken()
-
-	if PRINT_PARSE {
-		color.Red("Current token: %s", p.currentToken)
-	}
 }
 
 func (p *Parser) GetExpectNextToken(t token.TokenType) bool {
@@ -86,14 +101,39 @@ func (p *Parser) Errors() []string {
 	return p.errors
 }
 
+// Errors are reported as "file:line:col: msg" followed by the offending source line
+// Once the input is nested too deeply, the errors of the expressions left unfinished are dropped
+func (p *Parser) reportError(span token.Span, msg string) {
+	if p.tooDeep {
+		return
+	}
+	p.errors = append(p.errors, span.Annotate(msg))
+}
+
+// Helper method to enter one more level of nesting, returning false if that's too many
+// The rest of the input is skipped then, so every unfinished expression ends at EOF
+func (p *Parser) enterNesting() bool {
+	p.depth++
+	if p.depth <= maxNesting {
+		return true
+	}
+
+	p.reportError(p.currentToken.Span, fmt.Sprintf("nested too deeply (more than %d levels)", maxNesting))
+	p.tooDeep = true
+	for p.currentToken.Type != token.EOF {
+		p.GetNextToken()
+	}
+	return false
+}
+
 func (p *Parser) reportExpectedTokenError(t token.TokenType) {
 	msg := fmt.Sprintf("expected next token: %s, actual: %s", t, p.nextToken.Type)
-	p.errors = append(p.errors, msg)
+	p.reportError(p.nextToken.Span, msg)
 }
 
 func (p *Parser) reportMissingPrefixFunctionError(t token.TokenType) {
 	msg := fmt.Sprintf("missing prefix function for %s", t)
-	p.errors = append(p.errors, msg)
+	p.reportError(p.currentToken.Span, msg)
 }
 
 // Parse prefix and infix expressions
@@ -113,17 +153,19 @@ func (p *Parser) registerInfix(t token.TokenType, f parseInfix) {
 const (
 	_           int = iota // 0
 	LOWEST                 // 1
-	EQUALS                 // 2: ==
-	LESSGREATER            // 3: <,>
-	SUM                    // 4: +
-	PRODUCT                // 5: *
-	PREFIX                 // 6: -foo, !foo
-	CALL                   // 7: foo(bar)
-	INDEX                  // 8: array[index]
+	ASSIGN                 // 2: =
+	EQUALS                 // 3: ==
+	LESSGREATER            // 4: <,>
+	SUM                    // 5: +
+	PRODUCT                // 6: *
+	PREFIX                 // 7: -foo, !foo
+	CALL                   // 8: foo(bar)
+	INDEX                  // 9: array[index]
 )
 
 // Maps token types --> precedences
 var precedencesMap = map[token.TokenType]int{
+	token.ASSIGN:   ASSIGN,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
@@ -155,10 +197,6 @@ func (p *Parser) getNextPrecedence() int {
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
-	if PRINT_PARSE {
-		color.Cyan("CALL parser.ParseProgram()")
-	}
-
 	// Construct root Node of AST
 	prog := &ast.Program{}
 	prog.Statements = []ast.Statement{}
@@ -168,35 +206,38 @@ func (p *Parser) ParseProgram() *ast.Program {
 		statement := p.parseStatement()
 
 		if statement != nil {
+			p.traceNode(statement)
 			prog.Statements = append(prog.Statements, statement)
 		}
 
 		p.GetNextToken()
 	}
 
+	p.traceNode(prog)
 	return prog
 }
 
 func (p *Parser) parseStatement() ast.Statement {
-	if PRINT_PARSE {
-		color.Cyan("  CALL parser.parseStatement()")
-	}
-
 	switch p.currentToken.Type {
 	case token.LET:
 		return p.parseLetStatement()
 	case token.RETURN:
 		return p.parseReturnStatement()
+	case token.WHILE:
+		return p.parseWhileStatement()
+	case token.FOR:
+		return p.parseForStatement()
+	case token.BREAK:
+		return p.parseBreakStatement()
+	case token.CONTINUE:
+		return p.parseContinueStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
 // e.g. "let x = 5;"
-func (p *Parser) parseLetStatement() *ast.LetStatement {
-	if PRINT_PARSE {
-		color.Cyan("    CALL parser.parseLetStatement()")
-	}
+func (p *Parser) parseLetStatement() ast.Statement {
 	// "let"
 	statement := &ast.LetStatement{Token: p.currentToken}
 
@@ -204,7 +245,7 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	if !p.GetExpectNextToken(token.IDENT) {
 		return nil
 	}
-	statement.Name = &ast.Identifier{p.currentToken, p.currentToken.Literal}
+	statement.Name = &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
 
 	// "="
 	if !p.GetExpectNextToken(token.ASSIGN) {
@@ -214,132 +255,242 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 	// e.g. "5"
 	p.GetNextToken()
 	statement.Value = p.parseExpression(LOWEST)
+	if statement.Value == nil {
+		return nil
+	}
+
+	// Let functions refer to themselves by name (for recursion)
+	f, ok := statement.Value.(*ast.Function)
+	if ok {
+		f.Name = statement.Name.Value
+	}
 
 	// ";"
 	if p.nextToken.Type == token.SEMICOLON {
 		p.GetNextToken()
 	}
 
-	if PRINT_PARSE {
-		color.Blue("    RET parser.parseLetStatement():%s", statement.String())
-	}
 	return statement
 }
 
 // e.g. "return 5;"
-func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
-	if PRINT_PARSE {
-		color.Cyan("    CALL parser.parseReturnStatement()")
-	}
+func (p *Parser) parseReturnStatement() ast.Statement {
 	// "return"
 	statement := &ast.ReturnStatement{Token: p.currentToken}
 	p.GetNextToken()
 
 	// e.g. "5"
 	statement.Value = p.parseExpression(LOWEST)
+	if statement.Value == nil {
+		return nil
+	}
 
 	// ";"
 	if p.nextToken.Type == token.SEMICOLON {
 		p.GetNextToken()
 	}
 
-	if PRINT_PARSE {
-		color.Blue("    RET parser.parseReturnStatement():%s", statement.String())
+	return statement
+}
+
+// e.g. "while (x < 5) { x; }"
+func (p *Parser) parseWhileStatement() ast.Statement {
+	// "while"
+	statement := &ast.WhileStatement{Token: p.currentToken}
+
+	// "("
+	if !p.GetExpectNextToken(token.LPAREN) {
+		return nil
+	}
+
+	// e.g. "x < 5"
+	p.GetNextToken()
+	statement.Condition = p.parseExpression(LOWEST)
+	if statement.Condition == nil {
+		return nil
+	}
+
+	// ")"
+	if !p.GetExpectNextToken(token.RPAREN) {
+		return nil
+	}
+
+	// "{"
+	if !p.GetExpectNextToken(token.LBRACE) {
+		return nil
+	}
+
+	// e.g. "x;"
+	statement.Body = p.parseBlockStatement()
+
+	// Optional semicolon
+	if p.nextToken.Type == token.SEMICOLON {
+		p.GetNextToken()
 	}
+
 	return statement
 }
 
-// Parse expression statements e.g. "5 + foo"
-func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
-	if PRINT_PARSE {
-		color.Cyan("    CALL parser.parseExpressionStatement()")
+// e.g. "for (x in [1, 2]) { x; }"
+func (p *Parser) parseForStatement() ast.Statement {
+	// "for"
+	statement := &ast.ForStatement{Token: p.currentToken}
+
+	// "("
+	if !p.GetExpectNextToken(token.LPAREN) {
+		return nil
+	}
+
+	// e.g. "x"
+	if !p.GetExpectNextToken(token.IDENT) {
+		return nil
+	}
+	statement.Variable = &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
+
+	// "in"
+	if !p.GetExpectNextToken(token.IN) {
+		return nil
+	}
+
+	// e.g. "[1, 2]"
+	p.GetNextToken()
+	statement.Iterable = p.parseExpression(LOWEST)
+	if statement.Iterable == nil {
+		return nil
+	}
+
+	// ")"
+	if !p.GetExpectNextToken(token.RPAREN) {
+		return nil
+	}
+
+	// "{"
+	if !p.GetExpectNextToken(token.LBRACE) {
+		return nil
+	}
+
+	// e.g. "x;"
+	statement.Body = p.parseBlockStatement()
+
+	// Optional semicolon
+	if p.nextToken.Type == token.SEMICOLON {
+		p.GetNextToken()
+	}
+
+	return statement
+}
+
+// e.g. "break;"
+func (p *Parser) parseBreakStatement() ast.Statement {
+	statement := &ast.BreakStatement{Token: p.currentToken}
+
+	// Optional semicolon
+	if p.nextToken.Type == token.SEMICOLON {
+		p.GetNextToken()
+	}
+
+	return statement
+}
+
+// e.g. "continue;"
+func (p *Parser) parseContinueStatement() ast.Statement {
+	statement := &ast.ContinueStatement{Token: p.currentToken}
+
+	// Optional semicolon
+	if p.nextToken.Type == token.SEMICOLON {
+		p.GetNextToken()
 	}
+
+	return statement
+}
+
+// Parse expression statements e.g. "5 + foo"
+func (p *Parser) parseExpressionStatement() ast.Statement {
 	// e.g. "5"
 	statement := &ast.ExpressionStatement{Token: p.currentToken}
 
 	// Pass the lowest precedence since we didn't parse anything yet
 	statement.Expression = p.parseExpression(LOWEST)
+	if statement.Expression == nil {
+		return nil
+	}
 
 	// Optional semicolon
 	if p.nextToken.Type == token.SEMICOLON {
 		p.GetNextToken()
 	}
 
-	if PRINT_PARSE {
-		color.Blue("    RET parser.parseExpressionStatement():%s", statement.String())
-	}
 	return statement
 }
 
 // Parse block statement
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
-	if PRINT_PARSE {
-		color.Cyan("      CALL parseBlockStatement()")
-	}
 	block := &ast.BlockStatement{Token: p.currentToken}
 	block.Statements = []ast.Statement{}
 
+	defer func() { p.depth-- }()
+	if !p.enterNesting() {
+		block.Rbrace = p.currentToken
+		return block
+	}
+
 	p.GetNextToken()
 	for p.currentToken.Type != token.RBRACE && p.currentToken.Type != token.EOF {
 		statement := p.parseStatement()
 		if statement != nil {
+			p.traceNode(statement)
 			block.Statements = append(block.Statements, statement)
 		}
 
 		p.GetNextToken()
 	}
+	block.Rbrace = p.currentToken
 
-	if PRINT_PARSE {
-		color.Blue("      RET parser.parseBlockStatement(): %s", block.String())
-	}
+	p.traceNode(block)
 	return block
 }
 
 // Parse expressions e.g. "5 + foo"
 func (p *Parser) parseExpression(precedence int) ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL parser.parseExpression(%v)\n", precedence)
+	defer func() { p.depth-- }()
+	if !p.enterNesting() {
+		return nil
 	}
+
 	prefixFunc := p.prefixMap[p.currentToken.Type]
 	if prefixFunc == nil {
 		p.reportMissingPrefixFunctionError(p.currentToken.Type)
 		return nil
 	}
 
-	if PRINT_PARSE {
-		color.Yellow("      EXEC leftExpression: %s %s", p.currentToken.Literal, p.currentToken.Type)
-	}
 	leftExpression := prefixFunc()
+	if leftExpression == nil {
+		return nil
+	}
+	p.traceNode(leftExpression)
 
 	// Tries to find infixFunc for tokens until finds token with lower precedence
 	for (p.nextToken.Type != token.SEMICOLON) && precedence < p.getNextPrecedence() {
 		infixFunc := p.infixMap[p.nextToken.Type]
 		if infixFunc == nil {
-			if PRINT_PARSE {
-				color.Blue("      RET parser.parseExpression(): %s", leftExpression.String())
-			}
 			return leftExpression
 		}
 
 		p.GetNextToken()
 
-		if PRINT_PARSE {
-			color.Yellow("      EXEC is infix function")
-		}
 		leftExpression = infixFunc(leftExpression)
-	}
-
-	if leftExpression != nil {
-		if PRINT_PARSE {
-			color.Blue("      RET parser.parseExpression(): %s", leftExpression.String())
+		if leftExpression == nil {
+			return nil
 		}
+		p.traceNode(leftExpression)
 	}
+
 	return leftExpression
 }
 
 // Parse identifier expressions e.g. "foo"
 func (p *Parser) parseIdentifier() ast.Expression {
-	return &ast.Identifier{p.currentToken, p.currentToken.Literal}
+	return &ast.Identifier{Token: p.currentToken, Value: p.currentToken.Literal}
 }
 
 // Parse integer literal expressions e.g. "5"
@@ -347,18 +498,27 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	value, err := strconv.ParseInt(p.currentToken.Literal, 0, 64)
 	if err != nil {
 		msg := fmt.Sprintf("couldn't parse %q as integer", p.currentToken.Literal)
-		p.errors = append(p.errors, msg)
+		p.reportError(p.currentToken.Span, msg)
+		return nil
+	}
+
+	return &ast.IntegerLiteral{Token: p.currentToken, Value: value}
+}
+
+// Parse float literal expressions e.g. "3.14"
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	value, err := strconv.ParseFloat(p.currentToken.Literal, 64)
+	if err != nil {
+		msg := fmt.Sprintf("couldn't parse %q as float", p.currentToken.Literal)
+		p.reportError(p.currentToken.Span, msg)
 		return nil
 	}
 
-	return &ast.IntegerLiteral{p.currentToken, value}
+	return &ast.FloatLiteral{Token: p.currentToken, Value: value}
 }
 
 // Parse prefix expressions e.g. "-add(1, 2)"
 func (p *Parser) parsePrefix() ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parsePrefix()")
-	}
 	// e.g. "-"
 	expression := &ast.Prefix{Token: p.currentToken, Operator: p.currentToken.Literal}
 
@@ -366,18 +526,15 @@ func (p *Parser) parsePrefix() ast.Expression {
 
 	// e.g. "add(1, 2)"
 	expression.Value = p.parseExpression(PREFIX)
-
-	if PRINT_PARSE {
-		color.Blue("      RET p.parsePrefix(): %s", expression.String())
+	if expression.Value == nil {
+		return nil
 	}
+
 	return expression
 }
 
 // Parse infix expressions e.g. "2+foo"
 func (p *Parser) parseInfix(left ast.Expression) ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parseInfix()")
-	}
 	// e.g. "2" and "+"
 	expression := &ast.Infix{Token: p.currentToken, Operator: p.currentToken.Literal, Left: left}
 
@@ -385,12 +542,34 @@ func (p *Parser) parseInfix(left ast.Expression) ast.Expression {
 	precedence := p.getCurrentPrecedence()
 	p.GetNextToken()
 	expression.Right = p.parseExpression(precedence)
+	if expression.Right == nil {
+		return nil
+	}
 
-	if expression != nil {
-		if PRINT_PARSE {
-			color.Blue("      RET p.parseInfix(): %s", expression.String())
-		}
+	return expression
+}
+
+// Parse assignment expressions e.g. "x = 5" or "arr[0] = 5"
+func (p *Parser) parseAssign(target ast.Expression) ast.Expression {
+	// e.g. "x" and "="
+	expression := &ast.Assign{Token: p.currentToken, Target: target}
+
+	switch target.(type) {
+	case *ast.Identifier, *ast.Index:
+	default:
+		msg := fmt.Sprintf("invalid assignment target: %s", target.String())
+		p.reportError(target.Span(), msg)
+		return nil
+	}
+
+	// e.g. "5"
+	// Parse with lower precedence than "=" so "a = b = 5" groups as "a = (b = 5)"
+	p.GetNextToken()
+	expression.Value = p.parseExpression(LOWEST)
+	if expression.Value == nil {
+		return nil
 	}
+
 	return expression
 }
 
@@ -401,10 +580,6 @@ func (p *Parser) parseBoolean() ast.Expression {
 
 // Parse grouped expressions e.g. "(5+5)*2"
 func (p *Parser) parseGrouped() ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parseGrouped()")
-	}
-
 	// "("
 	p.GetNextToken()
 
@@ -414,18 +589,12 @@ func (p *Parser) parseGrouped() ast.Expression {
 	if !p.GetExpectNextToken(token.RPAREN) {
 		return nil
 	} else {
-		if PRINT_PARSE {
-			color.Blue("      RET p.parseGrouped():", expression.String())
-		}
 		return expression
 	}
 }
 
 // Parse if expressions e.g. "if (4 < 5) { x } else { y }"
 func (p *Parser) parseIf() ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parseIf()")
-	}
 	// "if"
 	expression := &ast.If{Token: p.currentToken}
 
@@ -437,6 +606,9 @@ func (p *Parser) parseIf() ast.Expression {
 	// e.g. "4 < 5"
 	p.GetNextToken()
 	expression.Condition = p.parseExpression(LOWEST)
+	if expression.Condition == nil {
+		return nil
+	}
 
 	// ")"
 	if !p.GetExpectNextToken(token.RPAREN) {
@@ -464,17 +636,11 @@ func (p *Parser) parseIf() ast.Expression {
 		expression.Alternative = p.parseBlockStatement()
 	}
 
-	if PRINT_PARSE {
-		color.Blue("      RET p.parseIf(): %s", expression.String())
-	}
 	return expression
 }
 
 // Parse function expressions e.g. "fn(x, y) { x + y; }"
 func (p *Parser) parseFunction() ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parseFunction()")
-	}
 	// "fn"
 	f := &ast.Function{Token: p.currentToken}
 
@@ -492,18 +658,13 @@ func (p *Parser) parseFunction() ast.Expression {
 	}
 
 	f.Body = p.parseBlockStatement()
+	ast.MarkTailCalls(f.Body)
 
-	if PRINT_PARSE {
-		color.Blue("      RET p.parseFunction(): %s", f.String())
-	}
 	return f
 }
 
 // Helper method to parse function parameters
 func (p *Parser) parseFunctionParameters() []*ast.Identifier {
-	if PRINT_PARSE {
-		color.Cyan("      CALL p.parseFunctionParameters()")
-	}
 	identifiers := []*ast.Identifier{}
 
 	// Empty list of parameters: already ")"
@@ -531,24 +692,18 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 		return nil
 	}
 
-	if PRINT_PARSE {
-		color.Blue("      RET p.parseFunctionParameters()")
-	}
 	return identifiers
 }
 
 // Parse call expressions e.g. "add(1, 2);"
 func (p *Parser) parseCall(function ast.Expression) ast.Expression {
-	if PRINT_PARSE {
-		color.Cyan("      CALL parseCall()")
-	}
-
 	c := &ast.Call{Token: p.currentToken, Function: function}
 	c.Arguments = p.parseExpressionList(token.RPAREN)
-
-	if PRINT_PARSE {
-		color.Blue("      RET parseCall(): %s", c.String())
+	if c.Arguments == nil {
+		return nil
 	}
+	c.Rparen = p.currentToken
+
 	return c
 }
 
@@ -559,7 +714,14 @@ func (p *Parser) parseString() ast.Expression {
 
 // Parse array expressions
 func (p *Parser) parseArray() ast.Expression {
-	return &ast.Array{p.currentToken, p.parseExpressionList(token.RSQUARE)}
+	a := &ast.Array{Token: p.currentToken}
+	a.Elements = p.parseExpressionList(token.RSQUARE)
+	if a.Elements == nil {
+		return nil
+	}
+	a.Rsquare = p.currentToken
+
+	return a
 }
 
 // Helper method to parse expression list
@@ -583,6 +745,13 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 		list = append(list, p.parseExpression(LOWEST))
 	}
 
+	// An element failed to parse (error already reported)
+	for _, e := range list {
+		if e == nil {
+			return nil
+		}
+	}
+
 	if !p.GetExpectNextToken(end) {
 		return nil
 	} else {
@@ -597,10 +766,14 @@ func (p *Parser) parseIndex(array ast.Expression) ast.Expression {
 	p.GetNextToken()
 
 	i.Index = p.parseExpression(LOWEST)
+	if i.Index == nil {
+		return nil
+	}
 
 	if !p.GetExpectNextToken(token.RSQUARE) {
 		return nil
 	} else {
+		i.Rsquare = p.currentToken
 		return i
 	}
 }
@@ -614,6 +787,9 @@ func (p *Parser) parseHash() ast.Expression {
 		// Get key
 		p.GetNextToken()
 		key := p.parseExpression(LOWEST)
+		if key == nil {
+			return nil
+		}
 
 		// ":"
 		if !p.GetExpectNextToken(token.COLON) {
@@ -623,6 +799,9 @@ func (p *Parser) parseHash() ast.Expression {
 		// Get value
 		p.GetNextToken()
 		value := p.parseExpression(LOWEST)
+		if value == nil {
+			return nil
+		}
 
 		hash.Pairs[key] = value
 
@@ -634,6 +813,7 @@ func (p *Parser) parseHash() ast.Expression {
 	if !p.GetExpectNextToken(token.RBRACE) {
 		return nil
 	} else {
+		hash.Rbrace = p.currentToken
 		return hash
 	}
 }
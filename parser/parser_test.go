@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"go_interpreter/ast"
 	"go_interpreter/lexer"
+	"strings"
 	"testing"
 )
 
@@ -115,6 +116,32 @@ func TestIntegerValueExpression(t *testing.T) {
 	assert.Equal(t, literal.TokenLiteral(), "5", "Expected TokenLiteral() of literal")
 }
 
+func TestFloatValueExpression(t *testing.T) {
+	input := "2.5e3;"
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(prog.Statements), "Expected number of statements")
+
+	statement, ok := prog.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: ExpressionStatement, actual: %T", prog.Statements[0])
+	}
+
+	literal, ok := statement.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("Expected expression type: FloatLiteral, actual: %T", statement.Expression)
+	}
+
+	assert.Equal(t, literal.Value, 2500.0, "Expected value of literal")
+	assert.Equal(t, literal.TokenLiteral(), "2.5e3", "Expected TokenLiteral() of literal")
+	assert.Equal(t, literal.String(), "2.5e3", "Expected String() of literal")
+}
+
 func TestPrefixExpressions(t *testing.T) {
 	prefixTests := []struct {
 		input    string
@@ -228,6 +255,14 @@ func TestOperatorPrecedence(t *testing.T) {
 			"!(true == true)",
 			"(!(true == true))",
 		},
+		{
+			"x = y = 1 + 2",
+			"(x = (y = (1 + 2)))",
+		},
+		{
+			"a[0] = b == c",
+			"((a[0]) = (b == c))",
+		},
 	}
 
 	for _, test := range tests {
@@ -355,6 +390,27 @@ func TestFunctionExpression(t *testing.T) {
 	testInfix(t, bodyStatement.Expression, "x", "+", "y")
 }
 
+func TestFunctionName(t *testing.T) {
+	input := `let add = fn(x, y) { x + y; };`
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(prog.Statements), "Expected number of statements")
+	statement, ok := prog.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: LetStatement, actual: %T", prog.Statements[0])
+	}
+	function, ok := statement.Value.(*ast.Function)
+	if !ok {
+		t.Fatalf("Expected Expression type: Function, actual: %T", statement.Value)
+	}
+	assert.Equal(t, "add", function.Name, "Expected function name")
+}
+
 func TestCallExpression(t *testing.T) {
 	input := "add(1, 2*3, 4+5);"
 
@@ -401,6 +457,277 @@ func TestString(t *testing.T) {
 	assert.Equal(t, "hello world", literal.Value, "Expceted value of string")
 }
 
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < y) { x; break; continue; };`
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(prog.Statements), "Expected number of statements")
+
+	statement, ok := prog.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: WhileStatement, actual: %T", prog.Statements[0])
+	}
+
+	testInfix(t, statement.Condition, "x", "<", "y")
+
+	assert.Equal(t, 3, len(statement.Body.Statements), "Expected number of body statements")
+	_, ok = statement.Body.Statements[1].(*ast.BreakStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: BreakStatement, actual: %T", statement.Body.Statements[1])
+	}
+	_, ok = statement.Body.Statements[2].(*ast.ContinueStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: ContinueStatement, actual: %T", statement.Body.Statements[2])
+	}
+}
+
+func TestForStatement(t *testing.T) {
+	input := `for (x in xs) { x }`
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(prog.Statements), "Expected number of statements")
+
+	statement, ok := prog.Statements[0].(*ast.ForStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: ForStatement, actual: %T", prog.Statements[0])
+	}
+
+	testIdentifier(t, statement.Variable, "x")
+	testIdentifier(t, statement.Iterable, "xs")
+	assert.Equal(t, 1, len(statement.Body.Statements), "Expected number of body statements")
+	assert.Equal(t, "for (x in xs) x", statement.String(), "Expected string")
+}
+
+func TestForStatementErrors(t *testing.T) {
+	inputs := []string{
+		"for (1 in xs) { x }",
+		"for (x of xs) { x }",
+		"while x { x }",
+	}
+
+	for _, input := range inputs {
+		l := lexer.BuildLexer(input)
+		p := BuildParser(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Fatalf("Expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestAssignExpression(t *testing.T) {
+	input := `x = 5;`
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	assert.Equal(t, 1, len(prog.Statements), "Expected number of statements")
+	statement, ok := prog.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Expected Statement type: ExpressionStatement, actual: %T", prog.Statements[0])
+	}
+	assign, ok := statement.Expression.(*ast.Assign)
+	if !ok {
+		t.Fatalf("Expected Expression type: Assign, actual: %T", statement.Expression)
+	}
+
+	testIdentifier(t, assign.Target, "x")
+	testLiteral(t, assign.Value, 5)
+}
+
+func TestInvalidAssignTarget(t *testing.T) {
+	inputs := []string{
+		"1 = 2",
+		"f() = 2",
+		"a + b = 2",
+	}
+
+	for _, input := range inputs {
+		l := lexer.BuildLexer(input)
+		p := BuildParser(l)
+		p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Fatalf("Expected parser errors for %q", input)
+		}
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	input := "let add = fn(x, y) { x + y; };\nadd(1, [2, 3][0]) == {\"a\": 1}[\"a\"]"
+
+	l := lexer.BuildLexer(input)
+	p := BuildParser(l)
+	prog := p.ParseProgram()
+
+	checkParserErrors(t, p)
+
+	let := prog.Statements[0].(*ast.LetStatement)
+	assert.Equal(t, "fn(x, y) { x + y; }", spanText(input, let.Value), "Function")
+	assert.Equal(t, "x + y", spanText(input, let.Value.(*ast.Function).Body.Statements[0]), "Infix")
+
+	infix := prog.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.Infix)
+	assert.Equal(t, "add(1, [2, 3][0])", spanText(input, infix.Left), "Call")
+	assert.Equal(t, "[2, 3][0]", spanText(input, infix.Left.(*ast.Call).Arguments[1]), "Index")
+	assert.Equal(t, `{"a": 1}["a"]`, spanText(input, infix.Right), "Hash")
+	assert.Equal(t, 2, infix.Span().Start.Line, "Line")
+	assert.Equal(t, 1, infix.Span().Start.Column, "Column")
+}
+
+func TestErrorPositions(t *testing.T) {
+	input := "let x = 1;\nlet y = (x + ;"
+
+	l := lexer.BuildFileLexer("test.mk", input)
+	p := BuildParser(l)
+	p.ParseProgram()
+
+	expected := "test.mk:2:14: missing prefix function for ;\n" +
+		"  let y = (x + ;\n" +
+		"               ^"
+	assert.Equal(t, expected, p.Errors()[0], "Error")
+}
+
+func TestMalformedInput(t *testing.T) {
+	inputs := []string{
+		"0!#=0",
+		"[(0]=",
+		"let x = ;",
+		"f(1, #)",
+		"{1: }",
+		"if (#) { 1 }",
+		// Nested too deeply to parse without overflowing the stack
+		strings.Repeat("-", 2000000) + "1",
+		strings.Repeat("(", 5000) + "1" + strings.Repeat(")", 5000),
+		strings.Repeat("[", 5000),
+		strings.Repeat("f(", 5000),
+		strings.Repeat("if (true) { ", 5000),
+		strings.Repeat("while (true) { ", 5000),
+		strings.Repeat("fn() { ", 5000),
+	}
+
+	for _, input := range inputs {
+		l := lexer.BuildLexer(input)
+		p := BuildParser(l)
+		prog := p.ParseProgram()
+
+		if len(p.Errors()) == 0 {
+			t.Fatalf("Expected parser errors for %q", input)
+		}
+
+		// Failed statements are dropped rather than kept as nil nodes
+		for _, statement := range prog.Statements {
+			assert.NotNil(t, statement, input)
+			assert.NotPanics(t, func() { _ = statement.String() }, input)
+		}
+	}
+}
+
+func TestNestingLimit(t *testing.T) {
+	// Deep nesting within the limit parses as usual
+	p := BuildParser(lexer.BuildLexer(strings.Repeat("-(", 400) + "1" + strings.Repeat(")", 400)))
+	p.ParseProgram()
+	assert.Empty(t, p.Errors())
+
+	// Past it, the one error is about the nesting, not everything left unfinished
+	p = BuildParser(lexer.BuildLexer(strings.Repeat("[", 5000) + strings.Repeat("]", 5000)))
+	p.ParseProgram()
+	if assert.Len(t, p.Errors(), 1) {
+		assert.Contains(t, p.Errors()[0], "nested too deeply")
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string]bool // whether each call is a tail call
+	}{
+		{"f(1)", map[string]bool{"f(1)": false}},
+		{"fn() { f(1); g(2) }", map[string]bool{"f(1)": false, "g(2)": true}},
+		{"fn() { f(g(1)) }", map[string]bool{"f(g(1))": true, "g(1)": false}},
+		{"fn() { let x = f(1); x }", map[string]bool{"f(1)": false}},
+		{"fn() { 1 + f(1) }", map[string]bool{"f(1)": false}},
+		{
+			"fn(n) { if (n) { f(1) } else { g(2) } }",
+			map[string]bool{"f(1)": true, "g(2)": true},
+		},
+		{
+			"fn(n) { while (n) { return f(1); } if (n) { return g(2); } h(3); }",
+			map[string]bool{"f(1)": true, "g(2)": true, "h(3)": true},
+		},
+		{
+			// Nested functions have their own tail calls
+			"fn() { let g = fn() { f(1) }; g(2); 3 }",
+			map[string]bool{"f(1)": true, "g(2)": false},
+		},
+	}
+
+	for _, test := range tests {
+		p := BuildParser(lexer.BuildLexer(test.input))
+		prog := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		calls := map[string]bool{}
+		collectCalls(prog, calls)
+		assert.Equal(t, test.expected, calls, test.input)
+	}
+}
+
+// Helper method to find every call in the node kinds used by TestTailCalls
+func collectCalls(node ast.Node, calls map[string]bool) {
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, s := range node.Statements {
+			collectCalls(s, calls)
+		}
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			collectCalls(s, calls)
+		}
+	case *ast.ExpressionStatement:
+		collectCalls(node.Expression, calls)
+	case *ast.LetStatement:
+		collectCalls(node.Value, calls)
+	case *ast.ReturnStatement:
+		collectCalls(node.Value, calls)
+	case *ast.WhileStatement:
+		collectCalls(node.Body, calls)
+	case *ast.If:
+		collectCalls(node.Consequence, calls)
+		if node.Alternative != nil {
+			collectCalls(node.Alternative, calls)
+		}
+	case *ast.Function:
+		collectCalls(node.Body, calls)
+	case *ast.Infix:
+		collectCalls(node.Left, calls)
+		collectCalls(node.Right, calls)
+	case *ast.Call:
+		calls[node.String()] = node.Tail
+		for _, a := range node.Arguments {
+			collectCalls(a, calls)
+		}
+	}
+}
+
+// Helper method to get the source code covered by a node
+func spanText(input string, node ast.Node) string {
+	return input[node.Span().Start.Offset:node.Span().End.Offset]
+}
+
 // Helper method for checking parser errors
 func checkParserErrors(t *testing.T, p *Parser) {
 	errors := p.Errors()
@@ -0,0 +1,866 @@
+package regvm
+
+import (
+	"fmt"
+	"go_interpreter/ast"
+	"go_interpreter/bytecode"
+	"go_interpreter/compiler"
+	"go_interpreter/object"
+	"go_interpreter/token"
+	"go_interpreter/trace"
+	"sort"
+)
+
+// Register of the main program holding the value of the last expression statement
+const RESULT_REGISTER = 0
+
+// Destination of an assignment whose value isn't used
+const noRegister = -1 << 30
+
+type Bytecode struct {
+	Instructions Instructions       // Instructions of the main program
+	Constants    []object.Object    // Constants evaluated by compiler
+	Lines        bytecode.LineTable // Source code of main program instructions
+	NumRegisters int                // Registers used by the main program
+}
+
+// Jump targets of a loop being compiled
+type EnclosingLoop struct {
+	startPosition  int   // Position continue jumps back to
+	breakPositions []int // Positions of OpJump emitted for break (will backpatch)
+}
+
+// Instructions of a function (or the main program) being compiled
+// Temporaries are numbered -1, -2, ... while compiling, since the number of locals is only known at the end
+type CompilationScope struct {
+	instructions Instructions
+	lines        bytecode.LineTable // Source code of generated instructions
+	loops        []*EnclosingLoop   // Loops enclosing the current instruction (innermost last)
+	numTemps     int                // Temporaries in use
+	maxTemps     int                // Most temporaries in use at once
+	set          map[int]bool       // Locals that are set wherever the current instruction runs
+}
+
+// Translates AST to register bytecode, sharing the symbol table of the stack compiler
+// Locals of a function live in the registers numbered by their symbol index
+type Compiler struct {
+	constants   []object.Object       // Constant pool
+	scopes      []*CompilationScope   // Scope stack
+	symbolTable *compiler.SymbolTable // Store info about each identifier
+	span        token.Span            // Source code of node being compiled
+	tracer      trace.Tracer          // Told about every node compiled and instruction emitted, nil for none
+}
+
+func BuildCompiler() *Compiler {
+	symbolTable := compiler.BuildSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+
+	return &Compiler{
+		constants:   []object.Object{},
+		scopes:      []*CompilationScope{{set: map[int]bool{}}},
+		symbolTable: symbolTable,
+	}
+}
+
+func BuildStatefulCompiler(s *compiler.SymbolTable, constants []object.Object) *Compiler {
+	c := BuildCompiler()
+	c.symbolTable = s
+	c.constants = constants
+	return c
+}
+
+// Reports the nodes compiled and instructions emitted from now on to tracer
+// Registers are reported as allocated while compiling, before temporaries get their final numbers
+func (c *Compiler) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+}
+
+// Helper function for compile-time errors, reported like the stack compiler's
+func errorAt(node ast.Node, kind object.ErrorKind, format string, a ...interface{}) error {
+	err := object.BuildError(kind, format, a...)
+	err.Span = node.Span()
+	return err
+}
+
+func (c *Compiler) currentScope() *CompilationScope {
+	return c.scopes[len(c.scopes)-1]
+}
+
+// Helper method to check whether a function (rather than the main program) is being compiled
+func (c *Compiler) inFunction() bool {
+	return len(c.scopes) > 1
+}
+
+func (c *Compiler) enterScope() {
+	c.scopes = append(c.scopes, &CompilationScope{set: map[int]bool{}})
+	c.symbolTable = compiler.BuildInnerSymbolTable(c.symbolTable)
+}
+
+func (c *Compiler) leaveScope() *CompilationScope {
+	scope := c.currentScope()
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	c.symbolTable = c.symbolTable.Outer
+	return scope
+}
+
+// Temporaries are freed in reverse order, by going back to a mark
+func (c *Compiler) allocateTemp() int {
+	scope := c.currentScope()
+	scope.numTemps++
+	if scope.numTemps > scope.maxTemps {
+		scope.maxTemps = scope.numTemps
+	}
+	return -scope.numTemps
+}
+
+func (c *Compiler) tempMark() int {
+	return c.currentScope().numTemps
+}
+
+func (c *Compiler) freeTemps(mark int) {
+	c.currentScope().numTemps = mark
+}
+
+func (c *Compiler) enterLoop(startPosition int) {
+	scope := c.currentScope()
+	scope.loops = append(scope.loops, &EnclosingLoop{startPosition: startPosition})
+}
+
+// Backpatch every break of the innermost loop to jump to afterLoopPosition
+func (c *Compiler) leaveLoop(afterLoopPosition int) {
+	scope := c.currentScope()
+	loop := scope.loops[len(scope.loops)-1]
+
+	for _, position := range loop.breakPositions {
+		c.replaceTarget(position, afterLoopPosition)
+	}
+
+	scope.loops = scope.loops[:len(scope.loops)-1]
+}
+
+// Innermost loop of the current function, or nil
+func (c *Compiler) currentLoop() *EnclosingLoop {
+	loops := c.currentScope().loops
+	if len(loops) == 0 {
+		return nil
+	}
+
+	return loops[len(loops)-1]
+}
+
+// Compiles a program (or a statement of one), keeping the value of its last expression statement in RESULT_REGISTER
+func (c *Compiler) Compile(node ast.Node) error {
+	switch node := node.(type) {
+	case *ast.Program:
+		return c.compileStatements(node.Statements)
+	case ast.Statement:
+		return c.compileStatement(node)
+	case ast.Expression:
+		return c.compileExpression(node, RESULT_REGISTER)
+	default:
+		return fmt.Errorf("cannot compile %T", node)
+	}
+}
+
+// Helper method to attribute the instructions emitted for node to its source code
+// and to report it to the tracer
+func (c *Compiler) enterNode(node ast.Node) func() {
+	if c.tracer != nil {
+		c.tracer.NodeCompiled(node)
+	}
+
+	outerSpan := c.span
+	c.span = node.Span()
+	return func() { c.span = outerSpan }
+}
+
+func (c *Compiler) compileStatement(node ast.Statement) error {
+	defer c.enterNode(node)()
+
+	switch node := node.(type) {
+	case *ast.ExpressionStatement:
+		// The main program keeps the value for the REPL, functions throw it away
+		if !c.inFunction() {
+			return c.compileExpression(node.Expression, RESULT_REGISTER)
+		}
+
+		mark := c.tempMark()
+		defer c.freeTemps(mark)
+
+		if assign, ok := node.Expression.(*ast.Assign); ok {
+			return c.compileAssign(assign, noRegister)
+		}
+		return c.compileExpression(node.Expression, c.allocateTemp())
+	case *ast.LetStatement:
+		mark := c.tempMark()
+		defer c.freeTemps(mark)
+
+		// Compile value first so "let x = x + 1" reads the previous binding,
+		// then make the instructions that produced it write the binding directly
+		// (a global is set from RESULT_REGISTER, so the REPL shows its value like the stack VM does)
+		start := len(c.currentScope().instructions)
+		value := RESULT_REGISTER
+		if c.inFunction() {
+			value = c.allocateTemp()
+		}
+		err := c.compileExpression(node.Value, value)
+		if err != nil {
+			return err
+		}
+
+		symbol := c.symbolTable.Define(node.Name.Value)
+		if symbol.Scope == compiler.LocalScope {
+			c.replaceRegister(start, value, symbol.Index)
+		} else {
+			c.storeSymbol(symbol, value)
+		}
+		c.markSet(symbol)
+	case *ast.ReturnStatement:
+		mark := c.tempMark()
+		defer c.freeTemps(mark)
+
+		value, err := c.compileOperand(node.Value, true)
+		if err != nil {
+			return err
+		}
+		c.emit(OpReturnValue, value)
+	case *ast.BlockStatement:
+		return c.compileStatements(node.Statements)
+	case *ast.WhileStatement:
+		startPosition := len(c.currentScope().instructions)
+
+		mark := c.tempMark()
+		condition, err := c.compileOperand(node.Condition, true)
+		if err != nil {
+			return err
+		}
+		// 9999 is a placeholder target (will backpatch)
+		jumpNotTruthyPosition := c.emit(OpJumpNotTruthy, condition, 9999)
+		c.freeTemps(mark)
+
+		c.enterLoop(startPosition)
+		restoreSet := c.enterBranch()
+		err = c.compileStatements(node.Body.Statements)
+		if err != nil {
+			return err
+		}
+		restoreSet()
+
+		// Go back and test the condition again
+		c.emit(OpJump, startPosition)
+
+		afterLoopPosition := len(c.currentScope().instructions)
+		c.replaceTarget(jumpNotTruthyPosition, afterLoopPosition)
+		c.leaveLoop(afterLoopPosition)
+	case *ast.ForStatement:
+		// Iterator keeps its register for the duration of the loop
+		mark := c.tempMark()
+		defer c.freeTemps(mark)
+
+		iterable, err := c.compileOperand(node.Iterable, true)
+		if err != nil {
+			return err
+		}
+		iterator := c.allocateTemp()
+		c.emit(OpIter, iterator, iterable)
+
+		symbol := c.symbolTable.Define(node.Variable.Value)
+		item := symbol.Index
+		if symbol.Scope != compiler.LocalScope {
+			item = c.allocateTemp()
+		}
+
+		// 9999 is a placeholder target (will backpatch)
+		iterNextPosition := c.emit(OpIterNext, iterator, item, 9999)
+		c.storeSymbol(symbol, item)
+
+		c.enterLoop(iterNextPosition)
+		restoreSet := c.enterBranch()
+		c.markSet(symbol)
+		err = c.compileStatements(node.Body.Statements)
+		if err != nil {
+			return err
+		}
+		restoreSet()
+
+		// Go back and fetch the next item
+		c.emit(OpJump, iterNextPosition)
+
+		afterLoopPosition := len(c.currentScope().instructions)
+		c.replaceTarget(iterNextPosition, afterLoopPosition)
+		c.leaveLoop(afterLoopPosition)
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return errorAt(node, object.RUNTIME_ERROR, "break outside loop")
+		}
+
+		// 9999 is a placeholder target (will backpatch when loop ends)
+		jumpPosition := c.emit(OpJump, 9999)
+		loop.breakPositions = append(loop.breakPositions, jumpPosition)
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return errorAt(node, object.RUNTIME_ERROR, "continue outside loop")
+		}
+
+		c.emit(OpJump, loop.startPosition)
+	}
+
+	return nil
+}
+
+// Helper method to compile a sequence of statements
+// Names of let-bound functions are defined first, so functions can call themselves and each other
+// wherever they are defined in the block
+func (c *Compiler) compileStatements(statements []ast.Statement) error {
+	for _, name := range compiler.HoistedNames(statements) {
+		c.symbolTable.Define(name)
+	}
+
+	for _, statement := range statements {
+		err := c.compileStatement(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Helper method to compile a block into the value of its last expression statement, or null
+func (c *Compiler) compileBlock(block *ast.BlockStatement, dest int) error {
+	statements := block.Statements
+	if len(statements) > 0 {
+		last, ok := statements[len(statements)-1].(*ast.ExpressionStatement)
+		if ok {
+			err := c.compileStatements(statements[:len(statements)-1])
+			if err != nil {
+				return err
+			}
+
+			defer c.enterNode(last)()
+			return c.compileExpression(last.Expression, dest)
+		}
+	}
+
+	// Block ended in a statement (e.g. let, loop), so it has no value
+	err := c.compileStatements(statements)
+	if err != nil {
+		return err
+	}
+
+	c.emit(OpLoadNull, dest)
+	return nil
+}
+
+// Compiles an expression, leaving its value in register dest
+func (c *Compiler) compileExpression(node ast.Expression, dest int) error {
+	defer c.enterNode(node)()
+
+	mark := c.tempMark()
+	defer c.freeTemps(mark)
+
+	switch node := node.(type) {
+	case *ast.IntegerLiteral:
+		c.emit(OpLoadConstant, dest, c.addConstant(&object.Integer{Value: node.Value}))
+	case *ast.FloatLiteral:
+		c.emit(OpLoadConstant, dest, c.addConstant(&object.Float{Value: node.Value}))
+	case *ast.String:
+		c.emit(OpLoadConstant, dest, c.addConstant(&object.String{Value: node.Value}))
+	case *ast.Boolean:
+		if node.Value {
+			c.emit(OpLoadTrue, dest)
+		} else {
+			c.emit(OpLoadFalse, dest)
+		}
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(node.Value)
+
+		// Throw a compile-time error if identifier doesn't exist
+		if !ok {
+			return errorAt(node, object.NAME_ERROR, "identifier not found: %s", node.Value)
+		}
+
+		c.loadSymbol(symbol, dest)
+	case *ast.Prefix:
+		value, err := c.compileOperand(node.Value, true)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "!":
+			c.emit(OpBang, dest, value)
+		case "-":
+			c.emit(OpMinus, dest, value)
+		default:
+			return errorAt(node, object.TYPE_ERROR, "unknown operator: %s", node.Operator)
+		}
+	case *ast.Infix:
+		operands, err := c.compileOperands(node.Left, node.Right)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "+":
+			c.emit(OpAdd, dest, operands[0], operands[1])
+		case "-":
+			c.emit(OpSub, dest, operands[0], operands[1])
+		case "*":
+			c.emit(OpMul, dest, operands[0], operands[1])
+		case "/":
+			c.emit(OpDiv, dest, operands[0], operands[1])
+		case ">":
+			c.emit(OpGreater, dest, operands[0], operands[1])
+		case "<":
+			c.emit(OpLess, dest, operands[0], operands[1])
+		case "==":
+			c.emit(OpEqual, dest, operands[0], operands[1])
+		case "!=":
+			c.emit(OpNotEqual, dest, operands[0], operands[1])
+		default:
+			return errorAt(node, object.TYPE_ERROR, "unknown operator: %s", node.Operator)
+		}
+	case *ast.Assign:
+		return c.compileAssign(node, dest)
+	case *ast.If:
+		condition, err := c.compileOperand(node.Condition, true)
+		if err != nil {
+			return err
+		}
+
+		// 9999 is a placeholder target (will backpatch)
+		jumpNotTruthyPosition := c.emit(OpJumpNotTruthy, condition, 9999)
+		c.freeTemps(mark)
+
+		restoreSet := c.enterBranch()
+		err = c.compileBlock(node.Consequence, dest)
+		if err != nil {
+			return err
+		}
+		restoreSet()
+
+		// 9999 is a placeholder target (will backpatch)
+		jumpPosition := c.emit(OpJump, 9999)
+		c.replaceTarget(jumpNotTruthyPosition, len(c.currentScope().instructions))
+
+		if node.Alternative == nil {
+			c.emit(OpLoadNull, dest)
+		} else {
+			restoreSet := c.enterBranch()
+			err := c.compileBlock(node.Alternative, dest)
+			if err != nil {
+				return err
+			}
+			restoreSet()
+		}
+
+		c.replaceTarget(jumpPosition, len(c.currentScope().instructions))
+	case *ast.Array:
+		first, err := c.compileConsecutive(node.Elements)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpArray, dest, first, len(node.Elements))
+	case *ast.Hash:
+		keys := []ast.Expression{}
+		for key := range node.Pairs {
+			keys = append(keys, key)
+		}
+
+		// Sort like the stack compiler, so keys are evaluated in the same order
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+
+		elements := []ast.Expression{}
+		for _, key := range keys {
+			elements = append(elements, key, node.Pairs[key])
+		}
+
+		first, err := c.compileConsecutive(elements)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpHash, dest, first, len(elements))
+	case *ast.Index:
+		operands, err := c.compileOperands(node.Array, node.Index)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpIndex, dest, operands[0], operands[1])
+	case *ast.Function:
+		err := c.compileFunction(node, dest)
+		if err != nil {
+			return err
+		}
+	case *ast.Call:
+		// Callee and arguments go in consecutive registers, which become the callee's parameters
+		callee, err := c.compileConsecutive(append([]ast.Expression{node.Function}, node.Arguments...))
+		if err != nil {
+			return err
+		}
+
+		// Function returns the value of a tail call, so the callee can take over its frame
+		if node.Tail && c.inFunction() {
+			c.emit(OpTailCall, dest, callee, len(node.Arguments))
+		} else {
+			c.emit(OpCall, dest, callee, len(node.Arguments))
+		}
+	default:
+		return errorAt(node, object.RUNTIME_ERROR, "cannot compile %s", node.String())
+	}
+
+	return nil
+}
+
+// Helper method to compile assignments into dest (or noRegister), since assignment is an expression
+func (c *Compiler) compileAssign(node *ast.Assign, dest int) error {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return errorAt(target, object.NAME_ERROR, "identifier not found: %s", target.Value)
+		}
+
+		switch symbol.Scope {
+		case compiler.LocalScope:
+			err := c.compileExpression(node.Value, symbol.Index)
+			if err != nil {
+				return err
+			}
+			c.markSet(symbol)
+			c.move(dest, symbol.Index)
+		case compiler.GlobalScope, compiler.CellScope, compiler.FreeScope:
+			value := dest
+			if dest == noRegister {
+				value = c.allocateTemp()
+			}
+
+			err := c.compileExpression(node.Value, value)
+			if err != nil {
+				return err
+			}
+			c.storeSymbol(symbol, value)
+		default:
+			return errorAt(target, object.RUNTIME_ERROR, "cannot assign to %s", target.Value)
+		}
+	case *ast.Index:
+		operands, err := c.compileOperands(target.Array, target.Index, node.Value)
+		if err != nil {
+			return err
+		}
+
+		c.emit(OpSetIndex, operands[0], operands[1], operands[2])
+		c.move(dest, operands[2])
+	default:
+		return errorAt(node.Target, object.RUNTIME_ERROR, "invalid assignment target: %s", node.Target.String())
+	}
+
+	return nil
+}
+
+// Helper method to compile a function literal into a closure in register dest
+func (c *Compiler) compileFunction(node *ast.Function, dest int) error {
+	c.enterScope()
+	c.symbolTable.CaptureNames(compiler.CapturedNames(node.Body))
+
+	// Parameters are the first locals, so the arguments of a call land in them
+	for _, p := range node.Parameters {
+		c.markSet(c.symbolTable.Define(p.Value))
+	}
+
+	err := c.compileBody(node.Body)
+	if err != nil {
+		return err
+	}
+
+	freeSymbols := c.symbolTable.FreeSymbols
+	numLocals := c.symbolTable.NumDefinitions()
+	scope := c.leaveScope()
+
+	function := &Function{
+		Instructions:  resolveRegisters(scope.instructions, numLocals),
+		NumRegisters:  numLocals + scope.maxTemps,
+		NumParameters: len(node.Parameters),
+		NumFree:       len(freeSymbols),
+		Name:          node.Name,
+		Lines:         scope.lines,
+	}
+
+	// Cells of captured variables go in consecutive registers so OpClosure can pick them up
+	mark := c.tempMark()
+	defer c.freeTemps(mark)
+
+	first := 0
+	for i, s := range freeSymbols {
+		register := c.allocateTemp()
+		if i == 0 {
+			first = register
+		}
+		c.captureSymbol(s, register)
+	}
+
+	c.emit(OpClosure, dest, c.addConstant(function), first)
+	return nil
+}
+
+// Helper method to compile a function body, returning the value of its last expression statement
+func (c *Compiler) compileBody(body *ast.BlockStatement) error {
+	statements := body.Statements
+	if len(statements) > 0 {
+		last, ok := statements[len(statements)-1].(*ast.ExpressionStatement)
+		if ok {
+			err := c.compileStatements(statements[:len(statements)-1])
+			if err != nil {
+				return err
+			}
+
+			defer c.enterNode(last)()
+			value, err := c.compileOperand(last.Expression, true)
+			if err != nil {
+				return err
+			}
+			c.emit(OpReturnValue, value)
+			return nil
+		}
+	}
+
+	err := c.compileStatements(statements)
+	if err != nil {
+		return err
+	}
+
+	// Handle bodies that don't end in a value (a trailing return makes this unreachable)
+	c.emit(OpReturnNothing)
+	return nil
+}
+
+// Helper method to get an expression into some register
+// Locals are used in place if direct is true, anything else is compiled into a new temporary
+func (c *Compiler) compileOperand(node ast.Expression, direct bool) (int, error) {
+	if identifier, ok := node.(*ast.Identifier); ok && direct {
+		symbol, ok := c.symbolTable.Resolve(identifier.Value)
+		if ok && symbol.Scope == compiler.LocalScope {
+			c.checkSet(symbol)
+			return symbol.Index, nil
+		}
+	}
+
+	register := c.allocateTemp()
+	return register, c.compileExpression(node, register)
+}
+
+// Helper method to get the operands of an instruction into registers, in order
+// A local is only used in place when nothing evaluated after it could assign to it
+func (c *Compiler) compileOperands(nodes ...ast.Expression) ([]int, error) {
+	registers := make([]int, len(nodes))
+	for i, node := range nodes {
+		direct := true
+		for _, later := range nodes[i+1:] {
+			if !isSimple(later) {
+				direct = false
+			}
+		}
+
+		register, err := c.compileOperand(node, direct)
+		if err != nil {
+			return nil, err
+		}
+		registers[i] = register
+	}
+
+	return registers, nil
+}
+
+// Helper method to compile expressions into consecutive new temporaries, returning the first
+func (c *Compiler) compileConsecutive(nodes []ast.Expression) (int, error) {
+	registers := make([]int, len(nodes))
+	for i := range nodes {
+		registers[i] = c.allocateTemp()
+	}
+
+	for i, node := range nodes {
+		err := c.compileExpression(node, registers[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if len(registers) == 0 {
+		return 0, nil
+	}
+	return registers[0], nil
+}
+
+// Expressions that can't change any variable
+func isSimple(node ast.Expression) bool {
+	switch node.(type) {
+	case *ast.Identifier, *ast.IntegerLiteral, *ast.FloatLiteral, *ast.String, *ast.Boolean:
+		return true
+	default:
+		return false
+	}
+}
+
+// Helper method to load the value bound to a symbol into register dest
+func (c *Compiler) loadSymbol(s compiler.Symbol, dest int) {
+	switch s.Scope {
+	case compiler.GlobalScope:
+		c.emit(OpGetGlobal, dest, s.Index)
+	case compiler.LocalScope:
+		c.checkSet(s)
+		c.move(dest, s.Index)
+	case compiler.CellScope:
+		c.emit(OpGetCell, dest, s.Index)
+	case compiler.BuiltinScope:
+		c.emit(OpGetBuiltin, dest, s.Index)
+	case compiler.FreeScope:
+		c.emit(OpGetFree, dest, s.Index)
+	}
+}
+
+// Helper method to bind the value in register value to a symbol
+func (c *Compiler) storeSymbol(s compiler.Symbol, value int) {
+	switch s.Scope {
+	case compiler.GlobalScope:
+		c.emit(OpSetGlobal, s.Index, value)
+	case compiler.LocalScope:
+		c.move(s.Index, value)
+	case compiler.CellScope:
+		c.emit(OpSetCell, s.Index, value)
+	case compiler.FreeScope:
+		// Closures share the cell, so this updates the variable everywhere
+		c.emit(OpSetFree, s.Index, value)
+	}
+}
+
+// Helper method to load the cell a closure captures for a symbol into register dest
+func (c *Compiler) captureSymbol(s compiler.Symbol, dest int) {
+	switch s.Scope {
+	case compiler.CellScope:
+		c.emit(OpCaptureLocal, dest, s.Index)
+	case compiler.FreeScope:
+		c.emit(OpCaptureFree, dest, s.Index)
+	}
+}
+
+// Helper method to record that a local has been set, so reading it needs no check
+func (c *Compiler) markSet(s compiler.Symbol) {
+	if s.Scope == compiler.LocalScope {
+		c.currentScope().set[s.Index] = true
+	}
+}
+
+// Helper method to check that a local was set before it is read
+// A local isn't set yet when its let hasn't run, like a function called before its let
+func (c *Compiler) checkSet(s compiler.Symbol) {
+	scope := c.currentScope()
+	if !scope.set[s.Index] {
+		c.emit(OpCheckLocal, s.Index)
+		scope.set[s.Index] = true
+	}
+}
+
+// Helper method to compile code that may not run, like a branch or loop body
+// The returned function forgets the locals it set
+func (c *Compiler) enterBranch() func() {
+	scope := c.currentScope()
+	set := make(map[int]bool, len(scope.set))
+	for index := range scope.set {
+		set[index] = true
+	}
+	return func() { scope.set = set }
+}
+
+// Helper method to copy a register, unless the value isn't wanted or is already there
+func (c *Compiler) move(dest int, source int) {
+	if dest != noRegister && dest != source {
+		c.emit(OpMove, dest, source)
+	}
+}
+
+func (c *Compiler) Bytecode() *Bytecode {
+	scope := c.scopes[0]
+
+	// The main program's only "local" is RESULT_REGISTER, since its bindings are globals
+	return &Bytecode{
+		Instructions: resolveRegisters(scope.instructions, RESULT_REGISTER+1),
+		Constants:    c.constants,
+		Lines:        scope.lines,
+		NumRegisters: RESULT_REGISTER + 1 + scope.maxTemps,
+	}
+}
+
+// Helper method to number temporaries after the locals, once the number of locals is known
+// Registers that are already resolved are left alone
+func resolveRegisters(ins Instructions, numLocals int) Instructions {
+	for i := range ins {
+		def, _ := Lookup(ins[i].Op)
+		operands := ins[i].operands()
+		for j, kind := range def.Operands {
+			if kind == REGISTER && operands[j] < 0 {
+				ins[i].setOperand(j, numLocals-1-operands[j])
+			}
+		}
+	}
+
+	return ins
+}
+
+// Helper method to make instructions from start onwards use register to instead of from
+func (c *Compiler) replaceRegister(start int, from int, to int) {
+	ins := c.currentScope().instructions
+	for i := start; i < len(ins); i++ {
+		def, _ := Lookup(ins[i].Op)
+		operands := ins[i].operands()
+		for j, kind := range def.Operands {
+			if kind == REGISTER && operands[j] == from {
+				ins[i].setOperand(j, to)
+			}
+		}
+	}
+}
+
+// Helper method to replace the jump target of an instruction
+func (c *Compiler) replaceTarget(position int, target int) {
+	instruction := &c.currentScope().instructions[position]
+	def, _ := Lookup(instruction.Op)
+	for j, kind := range def.Operands {
+		if kind == TARGET {
+			instruction.setOperand(j, target)
+		}
+	}
+}
+
+// Helper method for adding constant to constant pool
+func (c *Compiler) addConstant(obj object.Object) int {
+	c.constants = append(c.constants, obj)
+	return len(c.constants) - 1 // Return the constant's index
+}
+
+// Helper method to generate an instruction, returning its position
+func (c *Compiler) emit(op Opcode, operands ...int) int {
+	instruction := Instruction{Op: op}
+	for i, operand := range operands {
+		instruction.setOperand(i, operand)
+	}
+
+	scope := c.currentScope()
+	position := len(scope.instructions)
+	scope.instructions = append(scope.instructions, instruction)
+	scope.lines.Add(position, c.span)
+
+	if c.tracer != nil {
+		def, _ := Lookup(op)
+		c.tracer.InstructionEmitted(position, def.Name, operands)
+	}
+	return position
+}
@@ -0,0 +1,100 @@
+package regvm
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type compilerTestCase struct {
+	input    string
+	expected []string // Instructions of the main program, then of each function constant in order
+}
+
+func TestRegisters(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			// Parameters are registers, so operands need no loads
+			"fn(a, b) { a + b }",
+			[]string{
+				"0000 OpClosure R0 K0 R0\n",
+				"0000 OpAdd R2 R0 R1\n" +
+					"0001 OpReturnValue R2\n",
+			},
+		},
+		{
+			// The value of a let is computed straight into the local's register
+			"fn(a) { let b = a * 2; b }",
+			[]string{
+				"0000 OpClosure R0 K1 R0\n",
+				"0000 OpLoadConstant R3 K0\n" +
+					"0001 OpMul R1 R0 R3\n" +
+					"0002 OpReturnValue R1\n",
+			},
+		},
+		{
+			// Main program bindings are globals, and expression statements end up in RESULT_REGISTER
+			"let x = 1; x = x + 1",
+			[]string{
+				"0000 OpLoadConstant R0 K0\n" +
+					"0001 OpSetGlobal 0 R0\n" +
+					"0002 OpGetGlobal R1 0\n" +
+					"0003 OpLoadConstant R2 K1\n" +
+					"0004 OpAdd R0 R1 R2\n" +
+					"0005 OpSetGlobal 0 R0\n",
+			},
+		},
+		{
+			// Captured variables are copied from consecutive registers
+			"fn(a) { fn() { a } }",
+			[]string{
+				"0000 OpClosure R0 K1 R0\n",
+				"0000 OpGetFree R0 0\n" +
+					"0001 OpReturnValue R0\n",
+				"0000 OpCaptureLocal R2 R0\n" +
+					"0001 OpClosure R1 K0 R2\n" +
+					"0002 OpReturnValue R1\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		c := BuildCompiler()
+		err := c.Compile(parse(test.input))
+		if err != nil {
+			t.Fatalf("Compiler error: %s", err)
+		}
+
+		bytecode := c.Bytecode()
+		actual := []string{bytecode.Instructions.String()}
+		for _, constant := range bytecode.Constants {
+			if function, ok := constant.(*Function); ok {
+				actual = append(actual, function.Instructions.String())
+			}
+		}
+
+		assert.Equal(t, test.expected, actual, test.input)
+	}
+}
+
+func TestTailCallInstruction(t *testing.T) {
+	c := BuildCompiler()
+	err := c.Compile(parse("let f = fn(n) { if (n < 2) { n } else { f(n - 1) } };"))
+	if err != nil {
+		t.Fatalf("Compiler error: %s", err)
+	}
+
+	function := c.Bytecode().Constants[2].(*Function)
+	expected := "0000 OpLoadConstant R3 K0\n" +
+		"0001 OpLess R2 R0 R3\n" +
+		"0002 OpJumpNotTruthy R2 5\n" +
+		"0003 OpMove R1 R0\n" +
+		"0004 OpJump 9\n" +
+		"0005 OpGetGlobal R2 0\n" +
+		"0006 OpLoadConstant R4 K1\n" +
+		"0007 OpSub R3 R0 R4\n" +
+		"0008 OpTailCall R1 R2 1\n" +
+		"0009 OpReturnValue R1\n"
+
+	assert.Equal(t, expected, function.Instructions.String())
+	assert.Equal(t, 5, function.NumRegisters)
+}
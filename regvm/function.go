@@ -0,0 +1,40 @@
+package regvm
+
+import (
+	"fmt"
+	"go_interpreter/bytecode"
+	"go_interpreter/object"
+)
+
+// Compiled function of the register VM
+// Parameters and locals are the first registers of its frame, temporaries come after them
+type Function struct {
+	Instructions  Instructions       // Instructions for function body
+	NumRegisters  int                // Registers used by a call, locals included
+	NumParameters int                // Number of parameters of function
+	NumFree       int                // Number of variables captured from enclosing functions
+	Name          string             // Name the function is bound to by let, if any
+	Lines         bytecode.LineTable // Source code of instructions (indexed by instruction), for runtime errors
+}
+
+func (f *Function) Type() object.ObjectType {
+	return object.COMPILED_FUNCTION_OBJECT
+}
+
+func (f *Function) Inspect() string {
+	return fmt.Sprintf("RegisterFunction[%p]", f)
+}
+
+// Closure type of the register VM (function plus the free variables it captured)
+type Closure struct {
+	Fn   *Function      // Function being closed over
+	Free []*object.Cell // Free variables captured when closure was built
+}
+
+func (c *Closure) Type() object.ObjectType {
+	return object.CLOSURE_OBJECT
+}
+
+func (c *Closure) Inspect() string {
+	return fmt.Sprintf("Closure[%p]", c)
+}
@@ -0,0 +1,200 @@
+package regvm
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Opcode byte
+
+// Three-address instructions: A is usually the destination register, B and C the sources
+const (
+	OpLoadConstant Opcode = iota
+	OpLoadTrue
+	OpLoadFalse
+	OpLoadNull
+	OpMove
+	OpGetGlobal
+	OpSetGlobal
+	OpGetFree
+	OpSetFree
+	OpGetBuiltin
+	OpClosure
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEqual
+	OpNotEqual
+	OpGreater
+	OpLess
+	OpMinus
+	OpBang
+	OpJump
+	OpJumpNotTruthy
+	OpArray
+	OpHash
+	OpIndex
+	OpSetIndex
+	OpIter
+	OpIterNext
+	OpCall
+	OpTailCall
+	OpReturnValue
+	OpReturnNothing
+	OpGetCell
+	OpSetCell
+	OpCaptureLocal
+	OpCaptureFree
+	OpCheckLocal
+)
+
+// What an operand of an instruction refers to
+type OperandKind byte
+
+const (
+	REGISTER OperandKind = iota // Register of the current frame
+	CONSTANT                    // Index into the constant pool
+	INDEX                       // Index of a global, free variable or builtin
+	COUNT                       // Number of consecutive registers
+	TARGET                      // Index of the instruction to jump to
+)
+
+type Definition struct {
+	Name     string        // Readability
+	Operands []OperandKind // Kinds of A, B and C, in order
+}
+
+var definitions = map[Opcode]*Definition{
+	// R(A) = K(B)
+	OpLoadConstant: {"OpLoadConstant", []OperandKind{REGISTER, CONSTANT}},
+	OpLoadTrue:     {"OpLoadTrue", []OperandKind{REGISTER}},
+	OpLoadFalse:    {"OpLoadFalse", []OperandKind{REGISTER}},
+	OpLoadNull:     {"OpLoadNull", []OperandKind{REGISTER}},
+	// R(A) = R(B)
+	OpMove:      {"OpMove", []OperandKind{REGISTER, REGISTER}},
+	OpGetGlobal: {"OpGetGlobal", []OperandKind{REGISTER, INDEX}},
+	// Global(A) = R(B)
+	OpSetGlobal: {"OpSetGlobal", []OperandKind{INDEX, REGISTER}},
+	OpGetFree:   {"OpGetFree", []OperandKind{REGISTER, INDEX}},
+	// Free(A) = R(B), in the cell the closure shares
+	OpSetFree:    {"OpSetFree", []OperandKind{INDEX, REGISTER}},
+	OpGetBuiltin: {"OpGetBuiltin", []OperandKind{REGISTER, INDEX}},
+	// R(A) = closure of function K(B), capturing the cells in R(C) onwards
+	OpClosure: {"OpClosure", []OperandKind{REGISTER, CONSTANT, REGISTER}},
+	// R(A) = R(B) op R(C)
+	OpAdd:      {"OpAdd", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpSub:      {"OpSub", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpMul:      {"OpMul", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpDiv:      {"OpDiv", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpEqual:    {"OpEqual", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpNotEqual: {"OpNotEqual", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpGreater:  {"OpGreater", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	OpLess:     {"OpLess", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	// R(A) = op R(B)
+	OpMinus:         {"OpMinus", []OperandKind{REGISTER, REGISTER}},
+	OpBang:          {"OpBang", []OperandKind{REGISTER, REGISTER}},
+	OpJump:          {"OpJump", []OperandKind{TARGET}},
+	OpJumpNotTruthy: {"OpJumpNotTruthy", []OperandKind{REGISTER, TARGET}},
+	// R(A) = collection of the C registers from R(B) (key, value, key, value... for hashes)
+	OpArray: {"OpArray", []OperandKind{REGISTER, REGISTER, COUNT}},
+	OpHash:  {"OpHash", []OperandKind{REGISTER, REGISTER, COUNT}},
+	// R(A) = R(B)[R(C)]
+	OpIndex: {"OpIndex", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	// R(A)[R(B)] = R(C)
+	OpSetIndex: {"OpSetIndex", []OperandKind{REGISTER, REGISTER, REGISTER}},
+	// R(A) = iterator over R(B)
+	OpIter: {"OpIter", []OperandKind{REGISTER, REGISTER}},
+	// R(B) = next item of iterator R(A), or jump to C when it is exhausted
+	OpIterNext: {"OpIterNext", []OperandKind{REGISTER, REGISTER, TARGET}},
+	// R(A) = R(B)(C arguments from R(B+1))
+	OpCall: {"OpCall", []OperandKind{REGISTER, REGISTER, COUNT}},
+	// Like OpCall, but a closure takes over the current frame
+	OpTailCall:      {"OpTailCall", []OperandKind{REGISTER, REGISTER, COUNT}},
+	OpReturnValue:   {"OpReturnValue", []OperandKind{REGISTER}},
+	OpReturnNothing: {"OpReturnNothing", []OperandKind{}},
+	// R(A) = value of the cell that local R(B) is kept in
+	OpGetCell: {"OpGetCell", []OperandKind{REGISTER, REGISTER}},
+	// Value of the cell that local R(A) is kept in = R(B)
+	OpSetCell: {"OpSetCell", []OperandKind{REGISTER, REGISTER}},
+	// R(A) = cell that local R(B) is kept in, for OpClosure
+	OpCaptureLocal: {"OpCaptureLocal", []OperandKind{REGISTER, REGISTER}},
+	// R(A) = cell of free variable B, for OpClosure
+	OpCaptureFree: {"OpCaptureFree", []OperandKind{REGISTER, INDEX}},
+	// Error if local R(A) was never set, e.g. a function called before its let
+	OpCheckLocal: {"OpCheckLocal", []OperandKind{REGISTER}},
+}
+
+func Lookup(op Opcode) (*Definition, error) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, fmt.Errorf("opcode %d undefined", op)
+	}
+
+	return def, nil
+}
+
+// One decoded instruction; operands a definition doesn't use are 0
+type Instruction struct {
+	Op      Opcode
+	A, B, C int32
+}
+
+type Instructions []Instruction
+
+// Helper method to get operands in order, as ints
+func (ins Instruction) operands() []int {
+	return []int{int(ins.A), int(ins.B), int(ins.C)}
+}
+
+// Helper method to get the opcode's name and the operands its definition uses, for tracing
+func (ins Instruction) describe() (string, []int) {
+	def, err := Lookup(ins.Op)
+	if err != nil {
+		return fmt.Sprintf("Op%d", ins.Op), ins.operands()
+	}
+	return def.Name, ins.operands()[:len(def.Operands)]
+}
+
+// Helper method to set an operand by position
+func (ins *Instruction) setOperand(i int, value int) {
+	switch i {
+	case 0:
+		ins.A = int32(value)
+	case 1:
+		ins.B = int32(value)
+	case 2:
+		ins.C = int32(value)
+	}
+}
+
+func (ins Instruction) String() string {
+	def, err := Lookup(ins.Op)
+	if err != nil {
+		return fmt.Sprintf("ERROR: %s", err)
+	}
+
+	parts := []string{def.Name}
+	operands := ins.operands()
+	for i, kind := range def.Operands {
+		switch kind {
+		case REGISTER:
+			parts = append(parts, fmt.Sprintf("R%d", operands[i]))
+		case CONSTANT:
+			parts = append(parts, fmt.Sprintf("K%d", operands[i]))
+		default:
+			parts = append(parts, fmt.Sprintf("%d", operands[i]))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// One instruction per line, prefixed by its index
+func (ins Instructions) String() string {
+	var out strings.Builder
+	for i, instruction := range ins {
+		fmt.Fprintf(&out, "%04d %s\n", i, instruction)
+	}
+	return out.String()
+}
@@ -0,0 +1,291 @@
+package regvm
+
+import (
+	"go_interpreter/object"
+)
+
+// Source operators of arithmetic and comparison opcodes, for error messages
+var operatorSymbols = map[Opcode]string{
+	OpAdd:      "+",
+	OpSub:      "-",
+	OpMul:      "*",
+	OpDiv:      "/",
+	OpEqual:    "==",
+	OpNotEqual: "!=",
+	OpGreater:  ">",
+	OpLess:     "<",
+}
+
+// Helper method to build the error for operands an operator doesn't support, worded like the evaluator's
+func operatorError(left object.ObjectType, op Opcode, right object.ObjectType) *object.Error {
+	if left != right {
+		return object.BuildError(object.TYPE_ERROR, "type mismatch: %s %s %s", left, operatorSymbols[op], right)
+	}
+	return object.BuildError(object.TYPE_ERROR, "unknown operator: %s %s %s", left, operatorSymbols[op], right)
+}
+
+// Helper method to execute +,-,*,/
+// Integer overflow is an error when checked, and wraps around otherwise
+func executeBinaryOperation(op Opcode, left, right object.Object, checked bool) (object.Object, error) {
+	if left.Type() == object.INTEGER_OBJECT && right.Type() == object.INTEGER_OBJECT {
+		leftValue := left.(*object.Integer).Value
+		rightValue := right.(*object.Integer).Value
+
+		var result int64
+		var ok bool
+
+		switch op {
+		case OpAdd:
+			result, ok = object.CheckedAdd(leftValue, rightValue)
+		case OpSub:
+			result, ok = object.CheckedSub(leftValue, rightValue)
+		case OpMul:
+			result, ok = object.CheckedMul(leftValue, rightValue)
+		case OpDiv:
+			if rightValue == 0 {
+				return nil, object.BuildError(object.DIVISION_BY_ZERO_ERROR, "division by zero")
+			}
+			result, ok = object.CheckedDiv(leftValue, rightValue)
+		default:
+			return nil, operatorError(object.INTEGER_OBJECT, op, object.INTEGER_OBJECT)
+		}
+
+		// Wrap around like Go unless checked arithmetic is on
+		if !ok && checked {
+			return nil, object.BuildError(object.OVERFLOW_ERROR, "integer overflow: %d %s %d",
+				leftValue, operatorSymbols[op], rightValue)
+		}
+
+		return &object.Integer{Value: result}, nil
+	} else if isNumber(left) && isNumber(right) {
+		leftValue := toFloat(left)
+		rightValue := toFloat(right)
+
+		switch op {
+		case OpAdd:
+			return &object.Float{Value: leftValue + rightValue}, nil
+		case OpSub:
+			return &object.Float{Value: leftValue - rightValue}, nil
+		case OpMul:
+			return &object.Float{Value: leftValue * rightValue}, nil
+		case OpDiv:
+			return &object.Float{Value: leftValue / rightValue}, nil
+		default:
+			return nil, operatorError(object.FLOAT_OBJECT, op, object.FLOAT_OBJECT)
+		}
+	} else if left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT {
+		if op != OpAdd {
+			return nil, operatorError(object.STRING_OBJECT, op, object.STRING_OBJECT)
+		}
+
+		leftValue := left.(*object.String).Value
+		rightValue := right.(*object.String).Value
+
+		return &object.String{Value: leftValue + rightValue}, nil
+	} else {
+		return nil, operatorError(left.Type(), op, right.Type())
+	}
+}
+
+// Helper method to execute ==, !=, >, <, comparing values the way the stack VM does
+func executeComparison(op Opcode, left, right object.Object) (object.Object, error) {
+	if left.Type() == object.INTEGER_OBJECT && right.Type() == object.INTEGER_OBJECT {
+		leftValue := left.(*object.Integer).Value
+		rightValue := right.(*object.Integer).Value
+
+		switch op {
+		case OpEqual:
+			return toBooleanObject(leftValue == rightValue), nil
+		case OpNotEqual:
+			return toBooleanObject(leftValue != rightValue), nil
+		case OpLess:
+			return toBooleanObject(leftValue < rightValue), nil
+		default:
+			return toBooleanObject(leftValue > rightValue), nil
+		}
+	}
+
+	if isNumber(left) && isNumber(right) {
+		leftValue := toFloat(left)
+		rightValue := toFloat(right)
+
+		switch op {
+		case OpEqual:
+			return toBooleanObject(leftValue == rightValue), nil
+		case OpNotEqual:
+			return toBooleanObject(leftValue != rightValue), nil
+		case OpLess:
+			return toBooleanObject(leftValue < rightValue), nil
+		default:
+			return toBooleanObject(leftValue > rightValue), nil
+		}
+	}
+
+	// Compare strings by value, like the stack VM
+	if left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT {
+		equal := left.(*object.String).Value == right.(*object.String).Value
+		switch op {
+		case OpEqual:
+			return toBooleanObject(equal), nil
+		case OpNotEqual:
+			return toBooleanObject(!equal), nil
+		}
+	}
+
+	switch op {
+	case OpEqual:
+		return toBooleanObject(right == left), nil
+	case OpNotEqual:
+		return toBooleanObject(right != left), nil
+	default:
+		return nil, operatorError(left.Type(), op, right.Type())
+	}
+}
+
+// Helper method to execute -
+func executeMinus(value object.Object, checked bool) (object.Object, error) {
+	switch value := value.(type) {
+	case *object.Integer:
+		result, ok := object.CheckedNeg(value.Value)
+		if !ok && checked {
+			return nil, object.BuildError(object.OVERFLOW_ERROR, "integer overflow: -%d", value.Value)
+		}
+		return &object.Integer{Value: result}, nil
+	case *object.Float:
+		return &object.Float{Value: -value.Value}, nil
+	default:
+		return nil, object.BuildError(object.TYPE_ERROR, "unknown operator: -%s", value.Type())
+	}
+}
+
+// Helper method to execute !
+func executeBang(value object.Object) object.Object {
+	switch value {
+	case True:
+		return False
+	case False:
+		return True
+	case Null:
+		return True
+	default:
+		return False
+	}
+}
+
+// Helper method for index
+func executeIndex(left, index object.Object) (object.Object, error) {
+	switch {
+	case left.Type() == object.ARRAY_OBJECT && index.Type() == object.INTEGER_OBJECT:
+		elements := left.(*object.Array).Elements
+		i := index.(*object.Integer).Value
+
+		if i < 0 || i > int64(len(elements)-1) {
+			return Null, nil
+		}
+		return elements[i], nil
+	case left.Type() == object.HASH_OBJECT:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return nil, object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		pair, ok := left.(*object.Hash).Pairs[key.HashKey()]
+		if !ok {
+			return Null, nil
+		}
+		return pair.Value, nil
+	default:
+		return nil, object.BuildError(object.TYPE_ERROR, "index operator not supported: %s", left.Type())
+	}
+}
+
+// Helper method for index assignment
+// New hash keys count against budget
+func executeSetIndex(left, index, value object.Object, budget *object.Budget) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJECT && index.Type() == object.INTEGER_OBJECT:
+		arrayObject := left.(*object.Array)
+		i := index.(*object.Integer).Value
+
+		if i < 0 || i > int64(len(arrayObject.Elements)-1) {
+			return object.BuildError(object.INDEX_ERROR, "index out of range: %d", i)
+		}
+
+		arrayObject.Elements[i] = value
+	case left.Type() == object.HASH_OBJECT:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		pairs := left.(*object.Hash).Pairs
+		if _, ok := pairs[key.HashKey()]; !ok {
+			if err := budget.AllocateHashPair(); err != nil {
+				return err
+			}
+		}
+
+		pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+	default:
+		return object.BuildError(object.TYPE_ERROR, "index assignment not supported: %s", left.Type())
+	}
+
+	return nil
+}
+
+// Helper method for hashmaps, from registers holding key, value, key, value...
+func buildHash(registers []object.Object) (object.Object, error) {
+	hashedPairs := make(map[object.HashKey]object.HashPair)
+	for i := 0; i < len(registers); i += 2 {
+		key := registers[i]
+		pair := object.HashPair{Key: key, Value: registers[i+1]}
+
+		// Check if key is hashable
+		hashKey, ok := key.(object.Hashable)
+		if !ok {
+			return nil, object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
+		}
+
+		hashedPairs[hashKey.HashKey()] = pair
+	}
+
+	return &object.Hash{Pairs: hashedPairs}, nil
+}
+
+// Helper method for conditionals
+func isTruthy(obj object.Object) bool {
+	switch obj := obj.(type) {
+	case *object.Boolean:
+		return obj.Value
+	case *object.Null:
+		return false
+	default:
+		return true
+	}
+}
+
+// Helper method for checking numeric objects
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJECT || obj.Type() == object.FLOAT_OBJECT
+}
+
+// Helper method for widening numeric objects to float64
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	default:
+		return 0
+	}
+}
+
+// Helper method to convert bool to boolean objects
+func toBooleanObject(input bool) *object.Boolean {
+	if input {
+		return True
+	} else {
+		return False
+	}
+}
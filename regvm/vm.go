@@ -0,0 +1,438 @@
+package regvm
+
+import (
+	"context"
+	"go_interpreter/object"
+	"go_interpreter/trace"
+)
+
+const registerCapacity = 65536 // Upper limit on registers of all frames together
+const GlobalCapacity = 65536   // Upper limit on number of global bindings
+const frameCapacity = 1024     // Upper limit on number of frames
+
+// Builtins of VMs that aren't given a registry
+var defaultBuiltins = object.BuildBuiltinRegistry()
+
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
+
+// Holds data relevant to execution
+type Frame struct {
+	cl             *Closure // Closure referenced by frame
+	ip             int      // Index of next instruction to run
+	basePointer    int      // First register of frame
+	returnRegister int      // Register of the calling frame that gets the return value
+}
+
+type VM struct {
+	constants   []object.Object // Constants generated by compiler
+	registers   []object.Object // Registers of all frames, each frame a window starting at its base pointer
+	globals     []object.Object // Globals
+	frames      []Frame         // Stack of frames
+	framesIndex int             // Top of stack of frames
+	budget      *object.Budget  // Limits of the current run
+	builtins    *object.BuiltinRegistry
+	tracer      trace.Tracer // Told about every instruction and call, nil for none
+	checked     bool         // Report int64 overflow of + - * / as an error instead of wrapping around
+}
+
+func BuildVM(bytecode *Bytecode) *VM {
+	mainFn := &Function{Instructions: bytecode.Instructions, NumRegisters: bytecode.NumRegisters, Lines: bytecode.Lines}
+	frames := make([]Frame, frameCapacity)
+	frames[0] = Frame{cl: &Closure{Fn: mainFn}}
+
+	return &VM{
+		constants:   bytecode.Constants,
+		registers:   make([]object.Object, registerCapacity),
+		globals:     make([]object.Object, GlobalCapacity),
+		frames:      frames,
+		framesIndex: 1, // Since main frame is already on the frame stack
+		builtins:    defaultBuiltins,
+	}
+}
+
+func BuildStatefulVM(bytecode *Bytecode, g []object.Object) *VM {
+	vm := BuildVM(bytecode)
+	vm.globals = g
+	return vm
+}
+
+// Runs the program with the builtins of registry, which it must have been compiled with
+func (vm *VM) SetBuiltins(registry *object.BuiltinRegistry) {
+	vm.builtins = registry
+}
+
+// Reports every instruction run and every call made from now on to tracer
+func (vm *VM) SetTracer(tracer trace.Tracer) {
+	vm.tracer = tracer
+}
+
+// Reports int64 overflow of + - * / as an error instead of wrapping around
+func (vm *VM) SetCheckOverflow(checked bool) {
+	vm.checked = checked
+}
+
+// Value of the last expression statement (or top level return) of the main program
+func (vm *VM) LastPopped() object.Object {
+	return vm.registers[RESULT_REGISTER]
+}
+
+// Runs the program
+// Errors are *object.Error, pointing at the failing instruction's source code
+// Bugs in the VM become INTERNAL_ERROR instead of crashing the host
+func (vm *VM) Run() error {
+	return vm.RunContext(context.Background(), object.Limits{})
+}
+
+// Like Run, but stops with an error once ctx is done or the program goes over limits
+func (vm *VM) RunContext(ctx context.Context, limits object.Limits) (err error) {
+	vm.budget = object.BuildBudget(ctx, limits)
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = vm.buildRuntimeError(object.BuildError(object.INTERNAL_ERROR, "internal error: %v", r))
+		}
+	}()
+
+	if vm.frames[0].cl.Fn.NumRegisters > registerCapacity {
+		return vm.buildRuntimeError(object.BuildError(object.STACK_OVERFLOW_ERROR, "stack overflow"))
+	}
+
+	err = vm.run()
+	if err != nil {
+		return vm.buildRuntimeError(err)
+	}
+
+	return nil
+}
+
+// Fetch-decode-execute cycle (instruction cycle)
+// The current frame's instructions and registers are cached in locals, and reloaded when calls and returns change frames
+func (vm *VM) run() error {
+	frame := &vm.frames[vm.framesIndex-1]
+	instructions := frame.cl.Fn.Instructions
+	registers := vm.registers[frame.basePointer:]
+
+	for frame.ip < len(instructions) {
+		// Fetch
+		ins := instructions[frame.ip]
+		frame.ip++
+
+		if err := vm.budget.Step(); err != nil {
+			return err
+		}
+
+		if vm.tracer != nil {
+			name, operands := ins.describe()
+			vm.tracer.InstructionExecuted(vm.framesIndex, frame.ip-1, name, operands)
+		}
+
+		// Decode & Execute
+		switch ins.Op {
+		case OpLoadConstant:
+			registers[ins.A] = vm.constants[ins.B]
+		case OpLoadTrue:
+			registers[ins.A] = True
+		case OpLoadFalse:
+			registers[ins.A] = False
+		case OpLoadNull:
+			registers[ins.A] = Null
+		case OpMove:
+			registers[ins.A] = registers[ins.B]
+		case OpGetGlobal:
+			if vm.globals[ins.B] == nil {
+				return vm.undefinedVariable(frame)
+			}
+			registers[ins.A] = vm.globals[ins.B]
+		case OpSetGlobal:
+			vm.globals[ins.A] = registers[ins.B]
+		case OpGetFree:
+			value := frame.cl.Free[ins.B].Value
+			if value == nil {
+				return vm.undefinedVariable(frame)
+			}
+			registers[ins.A] = value
+		case OpSetFree:
+			frame.cl.Free[ins.A].Value = registers[ins.B]
+		case OpCaptureFree:
+			registers[ins.A] = frame.cl.Free[ins.B]
+		case OpGetCell:
+			value := localCell(registers, ins.B).Value
+			if value == nil {
+				return vm.undefinedVariable(frame)
+			}
+			registers[ins.A] = value
+		case OpSetCell:
+			localCell(registers, ins.A).Value = registers[ins.B]
+		case OpCaptureLocal:
+			registers[ins.A] = localCell(registers, ins.B)
+		case OpCheckLocal:
+			if registers[ins.A] == nil {
+				return vm.undefinedVariable(frame)
+			}
+		case OpGetBuiltin:
+			builtin := vm.builtins.Get(int(ins.B))
+			if builtin == nil {
+				return object.BuildError(object.NAME_ERROR, "undefined builtin: %d", ins.B)
+			}
+			registers[ins.A] = builtin
+		case OpClosure:
+			function, ok := vm.constants[ins.B].(*Function)
+			if !ok {
+				return object.BuildError(object.RUNTIME_ERROR, "not a function: %+v", vm.constants[ins.B])
+			}
+
+			free := make([]*object.Cell, function.NumFree)
+			for i, value := range registers[ins.C : int(ins.C)+function.NumFree] {
+				cell, ok := value.(*object.Cell)
+				if !ok {
+					return object.BuildError(object.RUNTIME_ERROR, "captured value is not a cell")
+				}
+				free[i] = cell
+			}
+			registers[ins.A] = &Closure{Fn: function, Free: free}
+		case OpAdd, OpSub, OpMul, OpDiv:
+			result, err := executeBinaryOperation(ins.Op, registers[ins.B], registers[ins.C], vm.checked)
+			if err != nil {
+				return err
+			}
+			if result, ok := result.(*object.String); ok {
+				if err := vm.budget.Allocate(result); err != nil {
+					return err
+				}
+			}
+			registers[ins.A] = result
+		case OpEqual, OpNotEqual, OpGreater, OpLess:
+			result, err := executeComparison(ins.Op, registers[ins.B], registers[ins.C])
+			if err != nil {
+				return err
+			}
+			registers[ins.A] = result
+		case OpMinus:
+			result, err := executeMinus(registers[ins.B], vm.checked)
+			if err != nil {
+				return err
+			}
+			registers[ins.A] = result
+		case OpBang:
+			registers[ins.A] = executeBang(registers[ins.B])
+		case OpJump:
+			frame.ip = int(ins.A)
+		case OpJumpNotTruthy:
+			if !isTruthy(registers[ins.A]) {
+				frame.ip = int(ins.B)
+			}
+		case OpArray:
+			elements := make([]object.Object, ins.C)
+			copy(elements, registers[ins.B:ins.B+ins.C])
+			array := &object.Array{Elements: elements}
+			if err := vm.budget.Allocate(array); err != nil {
+				return err
+			}
+			registers[ins.A] = array
+		case OpHash:
+			hash, err := buildHash(registers[ins.B : ins.B+ins.C])
+			if err != nil {
+				return err
+			}
+			if err := vm.budget.Allocate(hash); err != nil {
+				return err
+			}
+			registers[ins.A] = hash
+		case OpIndex:
+			result, err := executeIndex(registers[ins.B], registers[ins.C])
+			if err != nil {
+				return err
+			}
+			registers[ins.A] = result
+		case OpSetIndex:
+			err := executeSetIndex(registers[ins.A], registers[ins.B], registers[ins.C], vm.budget)
+			if err != nil {
+				return err
+			}
+		case OpIter:
+			iterable := registers[ins.B]
+			iterator, ok := object.BuildIterator(iterable)
+			if !ok {
+				return object.BuildError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type())
+			}
+			registers[ins.A] = iterator
+		case OpIterNext:
+			item, ok := registers[ins.A].(*object.Iterator).Next()
+			if !ok {
+				frame.ip = int(ins.C)
+			} else {
+				registers[ins.B] = item
+			}
+		case OpCall, OpTailCall:
+			err := vm.callFunction(ins)
+			if err != nil {
+				return err
+			}
+
+			frame = &vm.frames[vm.framesIndex-1]
+			instructions = frame.cl.Fn.Instructions
+			registers = vm.registers[frame.basePointer:]
+		case OpReturnValue, OpReturnNothing:
+			var returnValue object.Object = Null
+			if ins.Op == OpReturnValue {
+				returnValue = registers[ins.A]
+			}
+
+			// Top level return ends the program, leaving its value as the result
+			if vm.framesIndex == 1 {
+				registers[RESULT_REGISTER] = returnValue
+				return nil
+			}
+
+			if vm.tracer != nil {
+				vm.tracer.FramePopped(vm.framesIndex, vm.functionName(vm.framesIndex-1))
+			}
+
+			vm.framesIndex--
+			returnRegister := frame.returnRegister
+
+			frame = &vm.frames[vm.framesIndex-1]
+			instructions = frame.cl.Fn.Instructions
+			registers = vm.registers[frame.basePointer:]
+			registers[returnRegister] = returnValue
+		}
+	}
+
+	return nil
+}
+
+// Helper method for calls
+// The arguments already sit in the registers right after the callee, which become the callee's first registers
+func (vm *VM) callFunction(ins Instruction) error {
+	frame := &vm.frames[vm.framesIndex-1]
+	registers := vm.registers[frame.basePointer:]
+	numArgs := int(ins.C)
+
+	callee := registers[ins.B]
+	switch fn := callee.(type) {
+	case *Closure:
+		if numArgs != fn.Fn.NumParameters {
+			return object.BuildError(object.ARITY_ERROR,
+				"wrong number of arguments: expected=%d, actual=%d",
+				fn.Fn.NumParameters,
+				numArgs)
+		}
+
+		// A closure replaces the current frame instead of pushing a new one
+		// (the OpReturnValue after the call returns the result of anything else)
+		if ins.Op == OpTailCall && vm.framesIndex > 1 {
+			if frame.basePointer+fn.Fn.NumRegisters > registerCapacity {
+				return object.BuildError(object.STACK_OVERFLOW_ERROR, "stack overflow")
+			}
+
+			copy(registers, registers[ins.B+1:int(ins.B)+1+numArgs])
+			clearLocals(registers, fn.Fn)
+			frame.cl = fn
+			frame.ip = 0
+			return nil
+		}
+
+		if err := vm.budget.Call(vm.framesIndex); err != nil {
+			return err
+		}
+
+		basePointer := frame.basePointer + int(ins.B) + 1
+		if vm.framesIndex >= frameCapacity || basePointer+fn.Fn.NumRegisters > registerCapacity {
+			return object.BuildError(object.STACK_OVERFLOW_ERROR, "stack overflow")
+		}
+
+		vm.frames[vm.framesIndex] = Frame{cl: fn, basePointer: basePointer, returnRegister: int(ins.A)}
+		vm.framesIndex++
+		clearLocals(vm.registers[basePointer:], fn.Fn)
+
+		if vm.tracer != nil {
+			vm.tracer.FramePushed(vm.framesIndex, vm.functionName(vm.framesIndex-1))
+		}
+		return nil
+	case *object.BuiltIn:
+		result := fn.Function(registers[ins.B+1 : int(ins.B)+1+numArgs]...)
+
+		// Builtins report errors as values, like in the evaluator; they stop the program
+		builtinError, ok := result.(*object.Error)
+		if ok {
+			return builtinError
+		}
+
+		if result != nil && fn.Allocates {
+			if err := vm.budget.Allocate(result); err != nil {
+				return err
+			}
+		}
+
+		if result == nil {
+			result = Null
+		}
+		registers[ins.A] = result
+		return nil
+	default:
+		return object.BuildError(object.TYPE_ERROR, "not a function: %s", callee.Type())
+	}
+}
+
+// Helper method to unset the registers of a new frame after its parameters
+// so OpSetCell doesn't mistake a cell left behind by an earlier frame for its own
+func clearLocals(registers []object.Object, fn *Function) {
+	for i := fn.NumParameters; i < fn.NumRegisters; i++ {
+		registers[i] = nil
+	}
+}
+
+// Helper method to get the cell of a local that closures capture
+// Locals start out as plain values (parameters) or unset, and move into a cell the first time one is needed
+func localCell(registers []object.Object, register int32) *object.Cell {
+	cell, ok := registers[register].(*object.Cell)
+	if !ok {
+		cell = &object.Cell{Value: registers[register]}
+		registers[register] = cell
+	}
+	return cell
+}
+
+// Helper method to attach the frame stack to an error from the instruction cycle
+func (vm *VM) buildRuntimeError(err error) *object.Error {
+	runtimeError, ok := err.(*object.Error)
+	if !ok {
+		runtimeError = object.BuildError(object.RUNTIME_ERROR, "%s", err)
+	}
+
+	stack := []object.StackFrame{}
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		// ip has already moved past the instruction being run
+		stack = append(stack, object.StackFrame{Function: vm.functionName(i), Span: frame.cl.Fn.Lines.Lookup(frame.ip - 1)})
+	}
+
+	runtimeError.Span = stack[0].Span
+	runtimeError.Stack = stack
+	return runtimeError
+}
+
+// Helper method to build the error for a variable that was never set
+// e.g. a global defined by a script that failed before its let ran, or a function called before its let
+func (vm *VM) undefinedVariable(frame *Frame) *object.Error {
+	name := frame.cl.Fn.Lines.Lookup(frame.ip - 1).Text()
+	if name == "" {
+		return object.BuildError(object.NAME_ERROR, "identifier not found")
+	}
+	return object.BuildError(object.NAME_ERROR, "identifier not found: %s", name)
+}
+
+// Helper method to name the function running in the frame at index, as stack traces show it
+func (vm *VM) functionName(index int) string {
+	name := vm.frames[index].cl.Fn.Name
+	if index == 0 {
+		name = "<main>"
+	} else if name == "" {
+		name = "<anonymous>"
+	}
+	return name
+}
@@ -0,0 +1,128 @@
+package regvm
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/ast"
+	"go_interpreter/compiler"
+	"go_interpreter/lexer"
+	"go_interpreter/object"
+	"go_interpreter/parser"
+	"go_interpreter/vm"
+	"go_interpreter/vmtest"
+	"testing"
+)
+
+func TestVM(t *testing.T) {
+	vmtest.Run(t, run)
+}
+
+// Helper method to compile and run a program, for vmtest
+func run(ctx context.Context, input string, limits object.Limits, checked bool) (object.Object, error) {
+	c := BuildCompiler()
+	err := c.Compile(parse(input))
+	if err != nil {
+		return nil, err
+	}
+
+	vm := BuildVM(c.Bytecode())
+	vm.SetCheckOverflow(checked)
+	err = vm.RunContext(ctx, limits)
+	if err != nil {
+		return nil, err
+	}
+	return vm.LastPopped(), nil
+}
+
+// The register VM must give the same results and errors as the stack VM
+// Run with: go test ./regvm -fuzz FuzzRun
+func FuzzRun(f *testing.F) {
+	seeds := []string{
+		"1 + 2 * 3",
+		`let a = [1, "two", 3.0]; a[1] = {true: fn(x) { x }}; a`,
+		"let f = fn(x) { if (x > 1) { f(x - 1) } else { x } }; f(10)",
+		"for (x in {1: 2, 3: 4}) { if (x == 3) { break; } }",
+		"let f = fn(a) { let b = a; b = a + 1; [a, b] }; f(1)",
+		"let x = 1; let y = x + (x = 5); y",
+		"let f = fn(x) { x - (x = 1) }; f(10)",
+		"let f = fn(n) { let isEven = fn(x) { if (x == 0) { true } else { isOdd(x - 1) } }; let isOdd = fn(x) { if (x == 0) { false } else { isEven(x - 1) } }; isOdd(n) }; f(7)",
+		"fn(a, b) { a }(1)",
+		"let = 5; x[",
+		"{[]: 1}",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		p := parser.BuildParser(lexer.BuildLexer(input))
+		prog := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			return
+		}
+
+		stackCompiler := compiler.BuildCompiler()
+		if stackCompiler.Compile(prog) != nil {
+			return
+		}
+
+		c := BuildCompiler()
+		if err := c.Compile(prog); err != nil {
+			t.Fatalf("Only register compile failed for %q: %s", input, err)
+		}
+
+		// Programs can loop forever, so stop them after a while
+		limits := object.Limits{MaxSteps: 100000}
+
+		stackVM := vm.BuildVM(stackCompiler.Bytecode())
+		expectedErr := stackVM.RunContext(context.Background(), limits)
+
+		machine := BuildVM(c.Bytecode())
+		err := machine.RunContext(context.Background(), limits)
+
+		var errObj *object.Error
+		if errors.As(err, &errObj) && errObj.Kind == object.INTERNAL_ERROR {
+			t.Fatalf("Register VM bug for %q: %s", input, errObj.Message)
+		}
+
+		// The engines run different numbers of instructions, so only one may hit the limit
+		var expectedErrObj *object.Error
+		if errors.As(expectedErr, &expectedErrObj) && expectedErrObj.Kind == object.STEP_LIMIT_ERROR ||
+			errObj != nil && errObj.Kind == object.STEP_LIMIT_ERROR {
+			return
+		}
+		if (err == nil) != (expectedErr == nil) {
+			t.Fatalf("Register VM run of %q: error %v, expected %v", input, err, expectedErr)
+		}
+		if err != nil {
+			assert.Equal(t, expectedErr.(*object.Error).Kind, errObj.Kind, input)
+			return
+		}
+
+		// Only expression statements leave the same value behind (the stack VM also leaves iterators and conditions)
+		if len(prog.Statements) == 0 {
+			return
+		}
+		if _, ok := prog.Statements[len(prog.Statements)-1].(*ast.ExpressionStatement); !ok {
+			return
+		}
+
+		expected, actual := stackVM.LastPopped(), machine.LastPopped()
+		if expected == nil || actual == nil {
+			assert.Equal(t, expected == nil, actual == nil, input)
+			return
+		}
+		assert.Equal(t, expected.Type(), actual.Type(), input)
+		switch expected.Type() {
+		case object.INTEGER_OBJECT, object.FLOAT_OBJECT, object.STRING_OBJECT, object.BOOLEAN_OBJECT, object.NULL_OBJECT:
+			assert.Equal(t, expected.Inspect(), actual.Inspect(), input)
+		}
+	})
+}
+
+func parse(input string) *ast.Program {
+	l := lexer.BuildLexer(input)
+	p := parser.BuildParser(l)
+	return p.ParseProgram()
+}
@@ -8,28 +8,34 @@ import (
 	"go_interpreter/lexer"
 	"go_interpreter/object"
 	"go_interpreter/parser"
+	"go_interpreter/regvm"
 	"go_interpreter/vm"
 	"io"
 )
 
 const PROMPT = ">> "
 
-func StartLoop(engine *string, in io.Reader, out io.Writer) {
+// Toggles printing the bytecode of each input before running it
+const DISASM_COMMAND = ":disasm"
+
+// Everything the loop keeps between lines belongs to it, so loops can serve several users at once
+// checked reports integer overflow as an error, and optimize optimizes the bytecode of the vm engine
+func StartLoop(engine *string, checked bool, optimize bool, in io.Reader, out io.Writer) {
 	scanner := bufio.NewScanner(in)
 
 	// Compiler
 	constants := []object.Object{}
 	globals := make([]object.Object, vm.GlobalCapacity)
-	symbolTable := compiler.BuildSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
-	}
+	symbolTable := compiler.BuildBuiltinSymbolTable(object.BuildBuiltinRegistry())
 
 	// Interpreter
 	env := object.BuildEnvironment()
+	env.SetCheckOverflow(checked)
+
+	showBytecode := false
 
 	for {
-		fmt.Printf(PROMPT)
+		io.WriteString(out, PROMPT)
 
 		// Get user input
 		scanned := scanner.Scan()
@@ -39,6 +45,20 @@ func StartLoop(engine *string, in io.Reader, out io.Writer) {
 			return
 		}
 
+		if scanner.Text() == DISASM_COMMAND {
+			if *engine != "vm" {
+				io.WriteString(out, "Disassembly needs the vm engine\n")
+				continue
+			}
+			showBytecode = !showBytecode
+			if showBytecode {
+				io.WriteString(out, "Disassembly on\n")
+			} else {
+				io.WriteString(out, "Disassembly off\n")
+			}
+			continue
+		}
+
 		// Lexer
 		l := lexer.BuildLexer(scanner.Text())
 
@@ -53,22 +73,54 @@ func StartLoop(engine *string, in io.Reader, out io.Writer) {
 		if *engine == "vm" {
 			// Compiler
 			c := compiler.BuildStatefulCompiler(symbolTable, constants)
+			c.SetOptimize(optimize)
 			err := c.Compile(prog)
 			if err != nil {
 				fmt.Fprintf(out, "Compile-time error: %s\n", err)
+				continue
 			}
 
 			// VM
 			bytecode := c.Bytecode()
 			constants = bytecode.Constants
+			if showBytecode {
+				io.WriteString(out, bytecode.String())
+			}
 			machine := vm.BuildStatefulVM(bytecode, globals)
+			machine.SetCheckOverflow(checked)
 			err = machine.Run()
 			if err != nil {
 				fmt.Fprintf(out, "Run-time error: %s\n", err)
+				continue
 			}
 			lastPopped := machine.LastPopped()
 			io.WriteString(out, lastPopped.Inspect())
 			io.WriteString(out, "\n")
+		} else if *engine == "regvm" {
+			// Register compiler
+			c := regvm.BuildStatefulCompiler(symbolTable, constants)
+			err := c.Compile(prog)
+			if err != nil {
+				fmt.Fprintf(out, "Compile-time error: %s\n", err)
+				continue
+			}
+
+			// Register VM
+			bytecode := c.Bytecode()
+			constants = bytecode.Constants
+			machine := regvm.BuildStatefulVM(bytecode, globals)
+			machine.SetCheckOverflow(checked)
+			err = machine.Run()
+			if err != nil {
+				fmt.Fprintf(out, "Run-time error: %s\n", err)
+				continue
+			}
+			// Nothing to show when the input ended in a loop
+			result := machine.LastPopped()
+			if result != nil {
+				io.WriteString(out, result.Inspect())
+				io.WriteString(out, "\n")
+			}
 		} else {
 			// Evaluator
 			result := evaluator.Eval(prog, env)
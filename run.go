@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go_interpreter/ast"
+	"go_interpreter/compiler"
+	"go_interpreter/evaluator"
+	"go_interpreter/lexer"
+	"go_interpreter/object"
+	"go_interpreter/parser"
+	"go_interpreter/regvm"
+	"go_interpreter/trace"
+	"go_interpreter/vm"
+	"io"
+	"os"
+)
+
+// Exit codes of the run command
+const (
+	EXIT_OK            = 0
+	EXIT_RUNTIME_ERROR = 1 // Program failed while running
+	EXIT_USAGE_ERROR   = 2 // Bad flags or unreadable source files
+	EXIT_SOURCE_ERROR  = 3 // Program failed to parse or compile
+)
+
+// Name of the global holding the arguments passed to a script
+const ARGS_NAME = "args"
+
+// How the run command runs scripts
+type runOptions struct {
+	engine   string        // "vm", "regvm" or "eval"
+	limits   object.Limits // Budget of the whole run
+	tracer   trace.Tracer  // Told about every step, nil for none
+	checked  bool          // Report integer overflow as an error instead of wrapping around
+	optimize bool          // Optimize bytecode compiled for the vm engine
+}
+
+// toy run [-engine=vm|regvm|eval] [-checked] [-O] [-timeout=d] [-max-steps=n] [-max-depth=n] [-max-memory=n] [-trace=color|json] script.mk [args...]
+// toy run [flags] a.mk b.mk ... -- [args...]
+func runCommand(arguments []string, engine string, checked bool, optimize bool) int {
+	options := runOptions{engine: engine, checked: checked, optimize: optimize}
+	var traceFormat string
+
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.StringVar(&options.engine, "engine", options.engine, "use 'vm', 'regvm' or 'eval'")
+	flags.BoolVar(&options.checked, "checked", options.checked, "report integer overflow as an error instead of wrapping around")
+	flags.BoolVar(&options.optimize, "O", options.optimize, "optimize compiled bytecode")
+	flags.DurationVar(&options.limits.Timeout, "timeout", 0, "stop the script after this long, e.g. 5s (0 for no limit)")
+	flags.IntVar(&options.limits.MaxSteps, "max-steps", 0, "stop the script after this many instructions or evaluated nodes (0 for no limit)")
+	flags.IntVar(&options.limits.MaxCallDepth, "max-depth", 0, "stop the script at this many nested calls (0 for no limit)")
+	flags.IntVar(&options.limits.MaxMemory, "max-memory", 0, "stop the script once its strings, arrays and hashes add up to this many bytes (0 for no limit)")
+	flags.StringVar(&traceFormat, "trace", "", "write every step of parsing, compiling and running to stderr, as 'color' text or 'json' lines")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: toy run [flags] script.mk [args...]")
+		fmt.Fprintln(flags.Output(), "       toy run [flags] a.mk b.mk ... -- [args...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return EXIT_USAGE_ERROR
+	}
+
+	paths, args := splitRunArguments(flags.Args())
+	if len(paths) == 0 {
+		flags.Usage()
+		return EXIT_USAGE_ERROR
+	}
+
+	if options.engine != "vm" && options.engine != "regvm" && options.engine != "eval" {
+		fmt.Fprintf(os.Stderr, "unknown engine %q\n", options.engine)
+		return EXIT_USAGE_ERROR
+	}
+
+	tracer, err := buildTracer(traceFormat, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return EXIT_USAGE_ERROR
+	}
+	options.tracer = tracer
+
+	return runFiles(paths, args, options, os.Stderr)
+}
+
+// Tracer writing in format ("color" or "json") to out, or nil for no format
+func buildTracer(format string, out io.Writer) (trace.Tracer, error) {
+	switch format {
+	case "":
+		return nil, nil
+	case "color":
+		return trace.BuildColorTracer(out), nil
+	case "json":
+		return trace.BuildJSONTracer(out), nil
+	default:
+		return nil, fmt.Errorf("unknown trace format %q", format)
+	}
+}
+
+// Files come before "--" and arguments after it
+// Without "--", only the first argument is a file
+func splitRunArguments(arguments []string) ([]string, []string) {
+	for i, arg := range arguments {
+		if arg == "--" {
+			return arguments[:i], arguments[i+1:]
+		}
+	}
+
+	if len(arguments) == 0 {
+		return nil, nil
+	}
+
+	return arguments[:1], arguments[1:]
+}
+
+// Parses every file into one program and runs it, returning the exit code
+// A single bytecode file from the build command runs without compiling
+// Errors are written to errOut, while the program prints to stdout itself
+func runFiles(paths []string, args []string, options runOptions, errOut io.Writer) int {
+	if len(paths) == 1 {
+		data, err := os.ReadFile(paths[0])
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return EXIT_USAGE_ERROR
+		}
+
+		if compiler.IsEncoded(data) {
+			return runBytecodeFile(paths[0], data, args, options, errOut)
+		}
+	}
+
+	prog, code := parseFiles(paths, options.tracer, errOut)
+	if code != EXIT_OK {
+		return code
+	}
+
+	if options.engine == "vm" {
+		bytecode, err := compileScript(prog, options.tracer, options.optimize)
+		if err != nil {
+			fmt.Fprintf(errOut, "Compile-time error: %s\n", err)
+			return EXIT_SOURCE_ERROR
+		}
+
+		return runBytecode(bytecode, args, options, errOut)
+	}
+
+	if options.engine == "regvm" {
+		return runRegisterScript(prog, args, options, errOut)
+	}
+
+	// Evaluator
+	env := object.BuildEnvironment()
+	env.Set(ARGS_NAME, buildArgsArray(args))
+	env.SetTracer(options.tracer)
+	env.SetCheckOverflow(options.checked)
+
+	result := evaluator.EvalContext(context.Background(), prog, env, options.limits)
+	if err, ok := result.(*object.Error); ok {
+		fmt.Fprintf(errOut, "Run-time error: %s\n", err)
+		return EXIT_RUNTIME_ERROR
+	}
+
+	return EXIT_OK
+}
+
+// Helper method to parse source files into one program, returning the exit code on failure
+func parseFiles(paths []string, tracer trace.Tracer, errOut io.Writer) (*ast.Program, int) {
+	prog := &ast.Program{Statements: []ast.Statement{}}
+
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(errOut, err)
+			return nil, EXIT_USAGE_ERROR
+		}
+
+		if compiler.IsEncoded(source) {
+			fmt.Fprintf(errOut, "%s: bytecode files can't be combined with other files\n", path)
+			return nil, EXIT_USAGE_ERROR
+		}
+
+		l := lexer.BuildFileLexer(path, string(source))
+		l.SetTracer(tracer)
+		p := parser.BuildParser(l)
+		p.SetTracer(tracer)
+		fileProg := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			printParserErrors(errOut, p.Errors())
+			return nil, EXIT_SOURCE_ERROR
+		}
+
+		prog.Statements = append(prog.Statements, fileProg.Statements...)
+	}
+
+	return prog, EXIT_OK
+}
+
+// Symbol table of a script: builtins, then args as the first global
+func buildScriptSymbolTable() (*compiler.SymbolTable, compiler.Symbol) {
+	symbolTable := compiler.BuildSymbolTable()
+	for i, v := range object.Builtins {
+		symbolTable.DefineBuiltin(i, v.Name)
+	}
+	return symbolTable, symbolTable.Define(ARGS_NAME)
+}
+
+func compileScript(prog *ast.Program, tracer trace.Tracer, optimize bool) (*compiler.Bytecode, error) {
+	symbolTable, _ := buildScriptSymbolTable()
+	c := compiler.BuildStatefulCompiler(symbolTable, []object.Object{})
+	c.SetTracer(tracer)
+	c.SetOptimize(optimize)
+	err := c.Compile(prog)
+	if err != nil {
+		return nil, err
+	}
+	return c.Bytecode(), nil
+}
+
+func runBytecodeFile(path string, data []byte, args []string, options runOptions, errOut io.Writer) int {
+	if options.engine != "vm" {
+		fmt.Fprintf(errOut, "%s: bytecode files only run on the vm engine\n", path)
+		return EXIT_USAGE_ERROR
+	}
+
+	bytecode, err := compiler.Decode(data)
+	if err != nil {
+		fmt.Fprintf(errOut, "%s: %s\n", path, err)
+		return EXIT_SOURCE_ERROR
+	}
+
+	return runBytecode(bytecode, args, options, errOut)
+}
+
+func runBytecode(bytecode *compiler.Bytecode, args []string, options runOptions, errOut io.Writer) int {
+	_, argsSymbol := buildScriptSymbolTable()
+	globals := make([]object.Object, vm.GlobalCapacity)
+	globals[argsSymbol.Index] = buildArgsArray(args)
+
+	machine := vm.BuildStatefulVM(bytecode, globals)
+	machine.SetTracer(options.tracer)
+	machine.SetCheckOverflow(options.checked)
+	err := machine.RunContext(context.Background(), options.limits)
+	if err != nil {
+		fmt.Fprintf(errOut, "Run-time error: %s\n", err)
+		return EXIT_RUNTIME_ERROR
+	}
+
+	return EXIT_OK
+}
+
+// Compiles and runs a program on the register VM, returning the exit code
+func runRegisterScript(prog *ast.Program, args []string, options runOptions, errOut io.Writer) int {
+	symbolTable, argsSymbol := buildScriptSymbolTable()
+	c := regvm.BuildStatefulCompiler(symbolTable, []object.Object{})
+	c.SetTracer(options.tracer)
+	err := c.Compile(prog)
+	if err != nil {
+		fmt.Fprintf(errOut, "Compile-time error: %s\n", err)
+		return EXIT_SOURCE_ERROR
+	}
+
+	globals := make([]object.Object, regvm.GlobalCapacity)
+	globals[argsSymbol.Index] = buildArgsArray(args)
+
+	machine := regvm.BuildStatefulVM(c.Bytecode(), globals)
+	machine.SetTracer(options.tracer)
+	machine.SetCheckOverflow(options.checked)
+	err = machine.RunContext(context.Background(), options.limits)
+	if err != nil {
+		fmt.Fprintf(errOut, "Run-time error: %s\n", err)
+		return EXIT_RUNTIME_ERROR
+	}
+
+	return EXIT_OK
+}
+
+// Helper method to expose command line arguments to a script as an array of strings
+func buildArgsArray(args []string) *object.Array {
+	elements := make([]object.Object, len(args))
+	for i, arg := range args {
+		elements[i] = &object.String{Value: arg}
+	}
+	return &object.Array{Elements: elements}
+}
+
+func printParserErrors(out io.Writer, errors []string) {
+	for _, msg := range errors {
+		io.WriteString(out, msg+"\n")
+	}
+}
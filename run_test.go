@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/lexer"
+	"go_interpreter/object"
+	"go_interpreter/parser"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var engines = []string{"vm", "regvm", "eval"}
+
+func TestSplitRunArguments(t *testing.T) {
+	tests := []struct {
+		arguments     []string
+		expectedPaths []string
+		expectedArgs  []string
+	}{
+		{[]string{}, nil, nil},
+		{[]string{"a.mk"}, []string{"a.mk"}, []string{}},
+		{[]string{"a.mk", "b.mk", "c"}, []string{"a.mk"}, []string{"b.mk", "c"}},
+		{[]string{"a.mk", "b.mk", "--", "c"}, []string{"a.mk", "b.mk"}, []string{"c"}},
+		{[]string{"a.mk", "--"}, []string{"a.mk"}, []string{}},
+		{[]string{"--", "c"}, []string{}, []string{"c"}},
+	}
+
+	for _, test := range tests {
+		paths, args := splitRunArguments(test.arguments)
+		assert.Equal(t, test.expectedPaths, paths, test.arguments)
+		assert.Equal(t, test.expectedArgs, args, test.arguments)
+	}
+}
+
+func TestRunFiles(t *testing.T) {
+	dir := t.TempDir()
+	ok := writeScript(t, dir, "ok.mk", "let x = 1 + 2;")
+	failing := writeScript(t, dir, "failing.mk", "let f = fn(x) { x / 0 };\nf(1);")
+	broken := writeScript(t, dir, "broken.mk", "let = 5;")
+	undefined := writeScript(t, dir, "undefined.mk", "double(1);")
+	missing := filepath.Join(dir, "missing.mk")
+
+	// Scripts divide by zero when what they check doesn't hold, so the exit code tells
+	checkArgs := writeScript(t, dir, "args.mk", `let positions = {"a": 0, "b c": 1};
+if (len(args) != 2) { 1 / 0 }
+if (positions[args[0]] != 0) { 1 / 0 }
+if (positions[args[1]] != 1) { 1 / 0 }`)
+	define := writeScript(t, dir, "define.mk", "let double = fn(x) { x * 2 };")
+	use := writeScript(t, dir, "use.mk", "if (double(21) != 42) { 1 / 0 }")
+
+	tests := []struct {
+		paths        []string
+		args         []string
+		expectedCode int
+		expectedErr  string // part of what's written to errOut
+	}{
+		{[]string{ok}, nil, EXIT_OK, ""},
+		{[]string{failing}, nil, EXIT_RUNTIME_ERROR, "failing.mk:1:17: division by zero"},
+		{[]string{broken}, nil, EXIT_SOURCE_ERROR, "broken.mk:1:5"},
+		{[]string{missing}, nil, EXIT_USAGE_ERROR, "missing.mk"},
+		{[]string{ok, missing}, nil, EXIT_USAGE_ERROR, "missing.mk"},
+		{[]string{checkArgs}, []string{"a", "b c"}, EXIT_OK, ""},
+		{[]string{checkArgs}, []string{"a"}, EXIT_RUNTIME_ERROR, "division by zero"},
+		{[]string{checkArgs}, []string{"b c", "a"}, EXIT_RUNTIME_ERROR, ""},
+		{[]string{define, use}, nil, EXIT_OK, ""},
+		{[]string{ok, broken}, nil, EXIT_SOURCE_ERROR, "broken.mk"},
+	}
+
+	for _, engine := range engines {
+		for _, test := range tests {
+			var errOut bytes.Buffer
+			code := runFiles(test.paths, test.args, runOptions{engine: engine}, &errOut)
+
+			message := fmt.Sprint(engine, test.paths, test.args)
+			assert.Equal(t, test.expectedCode, code, message)
+			assert.Contains(t, errOut.String(), test.expectedErr, message)
+			if test.expectedCode == EXIT_OK {
+				assert.Empty(t, errOut.String(), message)
+			}
+		}
+	}
+
+	// Files run in order, so a function isn't set until the file defining it has run
+	for _, engine := range engines {
+		var errOut bytes.Buffer
+		code := runFiles([]string{undefined, define}, nil, runOptions{engine: engine}, &errOut)
+		assert.Equal(t, EXIT_RUNTIME_ERROR, code, engine)
+		assert.Contains(t, errOut.String(), "identifier not found: double", engine)
+	}
+
+	// Limits stop scripts like any other run-time error
+	loop := writeScript(t, dir, "loop.mk", "while (true) { }")
+	for _, engine := range engines {
+		var errOut bytes.Buffer
+		code := runFiles([]string{loop}, nil, runOptions{engine: engine, limits: object.Limits{MaxSteps: 100}}, &errOut)
+		assert.Equal(t, EXIT_RUNTIME_ERROR, code, engine)
+		assert.Contains(t, errOut.String(), "step limit exceeded", engine)
+	}
+
+	// Overflow wraps around unless checked, optimized or not
+	overflow := writeScript(t, dir, "overflow.mk", "let max = 9223372036854775807;\nif (max + 1 > 0) { 1 / 0 }")
+	for _, engine := range engines {
+		for _, optimize := range []bool{false, true} {
+			var errOut bytes.Buffer
+			code := runFiles([]string{overflow}, nil, runOptions{engine: engine, optimize: optimize}, &errOut)
+			assert.Equal(t, EXIT_OK, code, engine, optimize)
+
+			errOut.Reset()
+			code = runFiles([]string{overflow}, nil, runOptions{engine: engine, checked: true, optimize: optimize}, &errOut)
+			assert.Equal(t, EXIT_RUNTIME_ERROR, code, engine, optimize)
+			assert.Contains(t, errOut.String(), "overflow.mk:2:5: integer overflow", engine, optimize)
+		}
+	}
+}
+
+func TestRunBytecodeFile(t *testing.T) {
+	dir := t.TempDir()
+
+	prog := parser.BuildParser(lexer.BuildFileLexer("args.mk", `if (args[0] != "a") { 1 / 0 }`)).ParseProgram()
+	bytecode, err := compileScript(prog, nil, false)
+	if err != nil {
+		t.Fatalf("Compiler error: %s", err)
+	}
+	data, err := bytecode.Encode()
+	if err != nil {
+		t.Fatalf("Encode error: %s", err)
+	}
+	path := filepath.Join(dir, "args.mkc")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	var errOut bytes.Buffer
+	assert.Equal(t, EXIT_OK, runFiles([]string{path}, []string{"a"}, runOptions{engine: "vm"}, &errOut))
+	assert.Equal(t, EXIT_RUNTIME_ERROR, runFiles([]string{path}, []string{"b"}, runOptions{engine: "vm"}, &errOut))
+	assert.Contains(t, errOut.String(), "args.mk:1:23: division by zero")
+
+	// Bytecode only runs on the vm engine, and on its own
+	errOut.Reset()
+	assert.Equal(t, EXIT_USAGE_ERROR, runFiles([]string{path}, []string{"a"}, runOptions{engine: "eval"}, &errOut))
+	assert.Contains(t, errOut.String(), "only run on the vm engine")
+
+	errOut.Reset()
+	ok := writeScript(t, dir, "ok.mk", "1;")
+	assert.Equal(t, EXIT_USAGE_ERROR, runFiles([]string{ok, path}, nil, runOptions{engine: "vm"}, &errOut))
+	assert.Contains(t, errOut.String(), "can't be combined")
+
+	// Corrupted bytecode is rejected before it runs
+	data[len(data)-1] ^= 0xff
+	corrupted := filepath.Join(dir, "corrupted.mkc")
+	if err := os.WriteFile(corrupted, data, 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	errOut.Reset()
+	assert.Equal(t, EXIT_SOURCE_ERROR, runFiles([]string{corrupted}, nil, runOptions{engine: "vm"}, &errOut))
+}
+
+// Helper method to write a script into dir, returning its path
+func writeScript(t *testing.T, dir string, name string, source string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	return path
+}
@@ -1,5 +1,10 @@
 package token
 
+import (
+	"fmt"
+	"strings"
+)
+
 type TokenType string
 
 // Possible types of tokens
@@ -11,6 +16,7 @@ const (
 	// Function/variable names & values
 	IDENT  = "IDENT"
 	INT    = "INT"
+	FLOAT  = "FLOAT"
 	STRING = "STRING"
 
 	// Operators
@@ -44,23 +50,163 @@ const (
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	IN       = "IN"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
 )
 
 // Small, easily categorizable data structures
 type Token struct {
 	Type    TokenType // Type of token
 	Literal string    // Literal value of token
+	Span    Span      // Where the token appears in source code
+}
+
+// Source code that tokens are read from
+type File struct {
+	Name   string // e.g. "fib.mk", empty for REPL input
+	Source string
+}
+
+// Location of a byte in source code
+type Position struct {
+	File   *File
+	Offset int // byte offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // byte offset within line, starting at 1
+}
+
+// Positions without a line (e.g. the zero value) were never set by the lexer
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// e.g. "fib.mk:3:14", or "3:14" for REPL input
+func (p Position) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+
+	if p.File != nil && p.File.Name != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File.Name, p.Line, p.Column)
+	}
+
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Range of source code covered by a token or AST node
+type Span struct {
+	Start Position
+	End   Position // exclusive
+}
+
+func (s Span) IsValid() bool {
+	return s.Start.IsValid()
+}
+
+// Joins two spans into one covering both e.g. the left and right side of "1 + 2"
+func (s Span) To(end Span) Span {
+	if !s.IsValid() {
+		return end
+	}
+
+	// Programs stitched together from several files can't be covered by one span
+	if !end.IsValid() || end.End.File != s.Start.File {
+		return s
+	}
+
+	return Span{Start: s.Start, End: end.End}
+}
+
+// Prefixes msg with the start position and appends a caret-underlined excerpt of the source
+// e.g.
+//
+//	fib.mk:1:9: type mismatch: INTEGER + BOOLEAN
+//	  let x = 5 + true;
+//	          ^^^^^^^^
+func (s Span) Annotate(msg string) string {
+	if !s.IsValid() {
+		return msg
+	}
+
+	excerpt := s.Excerpt()
+	if excerpt == "" {
+		return fmt.Sprintf("%s: %s", s.Start, msg)
+	}
+
+	return fmt.Sprintf("%s: %s\n%s", s.Start, msg, excerpt)
+}
+
+// Source code covered by the span, or "" when the source isn't known
+func (s Span) Text() string {
+	file := s.Start.File
+	if file == nil || s.Start.Offset < 0 || s.End.Offset > len(file.Source) || s.End.Offset < s.Start.Offset {
+		return ""
+	}
+
+	return file.Source[s.Start.Offset:s.End.Offset]
+}
+
+// Source line containing the start of the span, with carets under the span
+// Spans covering multiple lines are underlined until the end of the first line
+func (s Span) Excerpt() string {
+	file := s.Start.File
+	if file == nil || s.Start.Offset > len(file.Source) {
+		return ""
+	}
+
+	lineStart := s.Start.Offset - (s.Start.Column - 1)
+	if lineStart < 0 {
+		return ""
+	}
+
+	lineEnd := strings.IndexByte(file.Source[lineStart:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(file.Source)
+	} else {
+		lineEnd += lineStart
+	}
+	line := strings.TrimRight(file.Source[lineStart:lineEnd], "\r")
+
+	end := s.End.Offset
+	if s.End.Line != s.Start.Line || end > lineStart+len(line) {
+		end = lineStart + len(line)
+	}
+
+	// Keep tabs in the padding so carets line up with the source line
+	var padding strings.Builder
+	for _, ch := range []byte(file.Source[lineStart:s.Start.Offset]) {
+		if ch == '\t' {
+			padding.WriteByte('\t')
+		} else {
+			padding.WriteByte(' ')
+		}
+	}
+
+	width := end - s.Start.Offset
+	if width < 1 {
+		width = 1
+	}
+
+	return "  " + line + "\n  " + padding.String() + strings.Repeat("^", width)
 }
 
 // Special identifiers
 var specialIdentifiers = map[string]TokenType{
-	"fn":     FUNCTION,
-	"let":    LET,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"fn":       FUNCTION,
+	"let":      LET,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
 }
 
 func GetIdentifier(input string) TokenType {
@@ -0,0 +1,339 @@
+package toy
+
+import (
+	"context"
+	"fmt"
+	"go_interpreter/ast"
+	"go_interpreter/compiler"
+	"go_interpreter/evaluator"
+	"go_interpreter/lexer"
+	"go_interpreter/object"
+	"go_interpreter/parser"
+	"go_interpreter/regvm"
+	"go_interpreter/trace"
+	"go_interpreter/vm"
+	"sort"
+	"strings"
+)
+
+// Engine that runs scripts
+type Engine string
+
+const (
+	VM          Engine = "vm"    // Compiles to bytecode for the stack VM
+	REGISTER_VM Engine = "regvm" // Compiles to bytecode for the register VM
+	EVALUATOR   Engine = "eval"  // Walks the syntax tree
+)
+
+type Options struct {
+	Engine   Engine                            // VM if empty
+	Globals  map[string]object.Object          // Defined in every session and run, with arrays and hashes copied for each
+	Builtins map[string]object.BuiltInFunction // Host functions added to (or replacing) the language's builtins
+	Limits   object.Limits                     // Budget of each call to Eval
+	Tracer   trace.Tracer                      // Told about every step of every script, nil for none
+	Checked  bool                              // Report int64 overflow of + - * / as an error instead of wrapping around
+	Optimize bool                              // Optimize the bytecode of the VM engine (the others ignore it)
+}
+
+// Configuration shared by sessions
+// Runtimes don't share builtins, so each can have its own host functions
+// Safe to use from many goroutines at once, unlike the sessions it builds
+type Runtime struct {
+	options  Options
+	builtins *object.BuiltinRegistry
+}
+
+func BuildRuntime(options Options) (*Runtime, error) {
+	if options.Engine == "" {
+		options.Engine = VM
+	}
+
+	if options.Engine != VM && options.Engine != REGISTER_VM && options.Engine != EVALUATOR {
+		return nil, fmt.Errorf("unknown engine %q", options.Engine)
+	}
+
+	// Register in a fixed order, so builtins get the same indexes every time
+	names := []string{}
+	for name := range options.Builtins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builtins := object.BuildBuiltinRegistry()
+	for _, name := range names {
+		err := builtins.Register(name, options.Builtins[name])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Runtime{options: options, builtins: builtins}, nil
+}
+
+// Runs one script in a new session
+func (r *Runtime) Eval(src string) (object.Object, error) {
+	return r.BuildSession().Eval(src)
+}
+
+// Scripts run one after another, like lines typed into the REPL: each sees the globals of the ones before
+// Use a session from one goroutine at a time, or compile a Program to run a script in many at once
+type Session struct {
+	runtime *Runtime
+
+	// Compiled engines
+	symbolTable *compiler.SymbolTable
+	constants   []object.Object
+	globals     []object.Object
+
+	// Evaluator
+	env *object.Environment
+}
+
+func (r *Runtime) BuildSession() *Session {
+	s := &Session{runtime: r}
+
+	if r.options.Engine == EVALUATOR {
+		s.env = object.BuildEnvironment()
+		s.env.SetBuiltins(r.builtins)
+		s.env.SetTracer(r.options.Tracer)
+		s.env.SetCheckOverflow(r.options.Checked)
+	} else {
+		s.symbolTable = compiler.BuildBuiltinSymbolTable(r.builtins)
+		s.constants = []object.Object{}
+		s.globals = make([]object.Object, vm.GlobalCapacity)
+	}
+
+	// Copied so scripts assigning into them don't change them for other sessions
+	names := []string{}
+	values := []object.Object{}
+	for name, value := range r.options.Globals {
+		names = append(names, name)
+		values = append(values, value)
+	}
+	for i, value := range object.Copy(values...) {
+		s.Set(names[i], value)
+	}
+
+	return s
+}
+
+// Source code that failed to parse, with one message per problem
+type ParseError struct {
+	Messages []string
+}
+
+func (e *ParseError) Error() string {
+	return strings.Join(e.Messages, "\n")
+}
+
+// Runs a script, returning the value of its last statement if that's an expression or return statement, or null
+// Errors are *ParseError, compile-time errors, or *object.Error for run-time errors
+func (s *Session) Eval(src string) (object.Object, error) {
+	return s.EvalContext(context.Background(), src)
+}
+
+// Like Eval, but stops with an error once ctx is done
+func (s *Session) EvalContext(ctx context.Context, src string) (object.Object, error) {
+	prog, err := s.runtime.parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	program, err := s.compile(prog)
+	if err != nil {
+		return nil, err
+	}
+
+	return program.run(ctx, s.globals, s.env)
+}
+
+// Script parsed and compiled once, which any number of goroutines can run at the same time
+// Every run starts from the runtime's globals, and doesn't see the globals of other runs
+type Program struct {
+	runtime *Runtime
+	prog    *ast.Program
+
+	// Compiled engines, with the globals the bytecode expects before it runs
+	bytecode         *compiler.Bytecode
+	registerBytecode *regvm.Bytecode
+	globals          []object.Object
+}
+
+func (r *Runtime) Compile(src string) (*Program, error) {
+	prog, err := r.parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	s := r.BuildSession()
+	program, err := s.compile(prog)
+	if err != nil {
+		return nil, err
+	}
+
+	program.globals = s.globals
+	return program, nil
+}
+
+// Runs the program in a fresh set of globals, like Session.Eval
+func (p *Program) Run() (object.Object, error) {
+	return p.RunContext(context.Background())
+}
+
+// Like Run, but stops with an error once ctx is done
+func (p *Program) RunContext(ctx context.Context) (object.Object, error) {
+	if p.runtime.options.Engine == EVALUATOR {
+		return p.run(ctx, nil, p.runtime.BuildSession().env)
+	}
+
+	return p.run(ctx, object.Copy(p.globals...), nil)
+}
+
+// Helper method to parse a script
+func (r *Runtime) parse(src string) (*ast.Program, error) {
+	l := lexer.BuildLexer(src)
+	l.SetTracer(r.options.Tracer)
+	p := parser.BuildParser(l)
+	p.SetTracer(r.options.Tracer)
+	prog := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, &ParseError{Messages: p.Errors()}
+	}
+	return prog, nil
+}
+
+// Helper method to compile a script against the globals of the session, for the compiled engines
+// A script that fails to compile leaves the session as it was: its names aren't defined, and its constants aren't kept
+func (s *Session) compile(prog *ast.Program) (*Program, error) {
+	program := &Program{runtime: s.runtime, prog: prog}
+	if s.runtime.options.Engine == EVALUATOR {
+		return program, nil
+	}
+	symbolTable := s.symbolTable.Copy()
+
+	var err error
+	switch s.runtime.options.Engine {
+	case VM:
+		c := compiler.BuildStatefulCompiler(symbolTable, s.constants)
+		c.SetTracer(s.runtime.options.Tracer)
+		c.SetOptimize(s.runtime.options.Optimize)
+		err = c.Compile(prog)
+		if err == nil {
+			program.bytecode = c.Bytecode()
+			s.constants = program.bytecode.Constants
+		}
+	case REGISTER_VM:
+		c := regvm.BuildStatefulCompiler(symbolTable, s.constants)
+		c.SetTracer(s.runtime.options.Tracer)
+		err = c.Compile(prog)
+		if err == nil {
+			program.registerBytecode = c.Bytecode()
+			s.constants = program.registerBytecode.Constants
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.symbolTable = symbolTable
+	return program, nil
+}
+
+// Helper method to run the program with globals (compiled engines) or env (evaluator)
+func (p *Program) run(ctx context.Context, globals []object.Object, env *object.Environment) (object.Object, error) {
+	var result object.Object
+	var err error
+
+	switch p.runtime.options.Engine {
+	case VM:
+		result, err = p.runVM(ctx, globals)
+	case REGISTER_VM:
+		result, err = p.runRegisterVM(ctx, globals)
+	default:
+		result, err = p.runEvaluator(ctx, env)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// What's left behind by other statements differs between engines
+	statements := p.prog.Statements
+	if len(statements) == 0 || !hasValue(statements[len(statements)-1]) || result == nil {
+		return vm.Null, nil
+	}
+	return result, nil
+}
+
+// Helper method to check if a statement leaves the same value behind in every engine
+func hasValue(statement ast.Statement) bool {
+	switch statement.(type) {
+	case *ast.ExpressionStatement, *ast.ReturnStatement:
+		return true
+	default:
+		return false
+	}
+}
+
+// Helper method to run the program on the stack VM
+func (p *Program) runVM(ctx context.Context, globals []object.Object) (object.Object, error) {
+	machine := vm.BuildStatefulVM(p.bytecode, globals)
+	machine.SetBuiltins(p.runtime.builtins)
+	machine.SetTracer(p.runtime.options.Tracer)
+	machine.SetCheckOverflow(p.runtime.options.Checked)
+	err := machine.RunContext(ctx, p.runtime.options.Limits)
+	if err != nil {
+		return nil, err
+	}
+	return machine.LastPopped(), nil
+}
+
+// Helper method to run the program on the register VM
+func (p *Program) runRegisterVM(ctx context.Context, globals []object.Object) (object.Object, error) {
+	machine := regvm.BuildStatefulVM(p.registerBytecode, globals)
+	machine.SetBuiltins(p.runtime.builtins)
+	machine.SetTracer(p.runtime.options.Tracer)
+	machine.SetCheckOverflow(p.runtime.options.Checked)
+	err := machine.RunContext(ctx, p.runtime.options.Limits)
+	if err != nil {
+		return nil, err
+	}
+	return machine.LastPopped(), nil
+}
+
+// Helper method to evaluate the program, turning error objects into errors
+func (p *Program) runEvaluator(ctx context.Context, env *object.Environment) (object.Object, error) {
+	result := evaluator.EvalContext(ctx, p.prog, env, p.runtime.options.Limits)
+	if err, ok := result.(*object.Error); ok {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Defines or replaces a global visible to later scripts
+func (s *Session) Set(name string, value object.Object) {
+	if s.env != nil {
+		s.env.Set(name, value)
+		return
+	}
+
+	symbol, ok := s.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope {
+		symbol = s.symbolTable.Define(name)
+	}
+	s.globals[symbol.Index] = value
+}
+
+// Value of a global defined by a script or by Set
+func (s *Session) Get(name string) (object.Object, bool) {
+	if s.env != nil {
+		return s.env.Get(name)
+	}
+
+	symbol, ok := s.symbolTable.Resolve(name)
+	if !ok || symbol.Scope != compiler.GlobalScope || s.globals[symbol.Index] == nil {
+		return nil, false
+	}
+	return s.globals[symbol.Index], true
+}
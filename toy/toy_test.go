@@ -0,0 +1,526 @@
+package toy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/ast"
+	"go_interpreter/object"
+	"go_interpreter/token"
+	"go_interpreter/trace"
+	"sync"
+	"testing"
+)
+
+var engines = []Engine{VM, REGISTER_VM, EVALUATOR}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2 * 3", "7"},
+		{`"a" + "b"`, "ab"},
+		{"let x = 5; x * 2", "10"},
+		{"let f = fn(x) { x + 1 }; f(2)", "3"},
+		{"[1, 2, 3][1]", "2"},
+		{"return 5; 6", "5"},
+		{"if (1 > 2) { 1 }", "null"},
+		// Statements without a value give null in every engine
+		{"", "null"},
+		{"let x = 1", "null"},
+		{"let i = 0; while (i < 3) { i = i + 1 }", "null"},
+		{"for (x in [1, 2]) { x }", "null"},
+	}
+
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{Engine: engine})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		for _, test := range tests {
+			result, err := runtime.Eval(test.input)
+			assert.Nil(t, err, "%s: %s", engine, test.input)
+			if result != nil {
+				assert.Equal(t, test.expected, result.Inspect(), "%s: %s", engine, test.input)
+			}
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{
+			Engine:  engine,
+			Globals: map[string]object.Object{"limit": &object.Integer{Value: 10}},
+		})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		session := runtime.BuildSession()
+		session.Set("name", &object.String{Value: "toy"})
+
+		// Later scripts see the globals of earlier ones
+		_, err = session.Eval("let double = fn(x) { x * 2 }; let total = double(limit);")
+		assert.Nil(t, err, engine)
+
+		result, err := session.Eval(`total + len(name)`)
+		assert.Nil(t, err, engine)
+		assert.Equal(t, "23", result.Inspect(), engine)
+
+		total, ok := session.Get("total")
+		assert.True(t, ok, engine)
+		assert.Equal(t, "20", total.Inspect(), engine)
+
+		_, ok = session.Get("missing")
+		assert.False(t, ok, engine)
+
+		// Sessions don't share globals
+		_, err = runtime.BuildSession().Eval("name")
+		assert.NotNil(t, err, engine)
+	}
+}
+
+func TestSessionAfterFailure(t *testing.T) {
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{Engine: engine})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		// Scripts that don't compile leave no names behind in the compiled engines,
+		// while the evaluator keeps what ran before the failure
+		session := runtime.BuildSession()
+		_, err = session.Eval("let a = 1; let b = nope;")
+		assert.NotNil(t, err, engine)
+
+		result, err := session.Eval("a + 1")
+		if engine == EVALUATOR {
+			assert.Nil(t, err, engine)
+			assert.Equal(t, "2", result.Inspect(), engine)
+		} else if assert.NotNil(t, err, engine) {
+			assert.Contains(t, err.Error(), "identifier not found: a", engine)
+		}
+
+		result, err = session.Eval("let a = 5; let b = 6; a + b")
+		assert.Nil(t, err, engine)
+		if result != nil {
+			assert.Equal(t, "11", result.Inspect(), engine)
+		}
+
+		// Names whose let didn't run are undefined rather than broken
+		session = runtime.BuildSession()
+		_, err = session.Eval("let b = 1 / 0;")
+		assert.NotNil(t, err, engine)
+
+		_, err = session.Eval("b + 1")
+		var runtimeError *object.Error
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.NAME_ERROR, runtimeError.Kind, engine)
+			assert.Equal(t, "identifier not found: b", runtimeError.Message, engine)
+		}
+
+		result, err = session.Eval("let b = 2; b + 1")
+		assert.Nil(t, err, engine)
+		if result != nil {
+			assert.Equal(t, "3", result.Inspect(), engine)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	input := "let max = 9223372036854775807; max + 1"
+
+	for _, engine := range engines {
+		for _, optimize := range []bool{false, true} {
+			// Runtimes with different settings run side by side
+			wrapping, err := BuildRuntime(Options{Engine: engine, Optimize: optimize})
+			if err != nil {
+				t.Fatalf("Runtime error: %s", err)
+			}
+			checked, err := BuildRuntime(Options{Engine: engine, Optimize: optimize, Checked: true})
+			if err != nil {
+				t.Fatalf("Runtime error: %s", err)
+			}
+
+			result, err := wrapping.Eval(input)
+			assert.Nil(t, err, engine, optimize)
+			if result != nil {
+				assert.Equal(t, "-9223372036854775808", result.Inspect(), engine, optimize)
+			}
+
+			_, err = checked.Eval(input)
+			var runtimeError *object.Error
+			if assert.True(t, errors.As(err, &runtimeError), engine, optimize) {
+				assert.Equal(t, object.OVERFLOW_ERROR, runtimeError.Kind, engine, optimize)
+			}
+
+			result, err = checked.Eval("let f = fn(x) { x * 2 }; f(1 + 2)")
+			assert.Nil(t, err, engine, optimize)
+			if result != nil {
+				assert.Equal(t, "6", result.Inspect(), engine, optimize)
+			}
+		}
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	greet := func(args ...object.Object) object.Object {
+		if len(args) != 1 {
+			return object.BuildError(object.ARITY_ERROR, "wrong number of arguments: expected=1, actual=%d", len(args))
+		}
+		return &object.String{Value: "hello " + args[0].Inspect()}
+	}
+	shout := func(args ...object.Object) object.Object {
+		return &object.String{Value: "LEN"}
+	}
+
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{
+			Engine:   engine,
+			Builtins: map[string]object.BuiltInFunction{"greet": greet, "len": shout},
+		})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		result, err := runtime.Eval(`let f = fn(name) { greet(name) }; f("toy") + " " + len([1])`)
+		assert.Nil(t, err, engine)
+		if result != nil {
+			assert.Equal(t, "hello toy LEN", result.Inspect(), engine)
+		}
+
+		_, err = runtime.Eval("greet()")
+		var runtimeError *object.Error
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.ARITY_ERROR, runtimeError.Kind, engine)
+		}
+
+		// Other runtimes only have the language's builtins
+		other, _ := BuildRuntime(Options{Engine: engine})
+		_, err = other.Eval(`greet("toy")`)
+		assert.NotNil(t, err, engine)
+		result, err = other.Eval("len([1])")
+		assert.Nil(t, err, engine)
+		if result != nil {
+			assert.Equal(t, "1", result.Inspect(), engine)
+		}
+	}
+}
+
+func TestConversion(t *testing.T) {
+	type item struct {
+		Name  string `toy:"name"`
+		Price int    `toy:"price"`
+	}
+
+	// Scripts get items as hashes, and return them the same way
+	discount, err := object.WrapFunction(func(i item, percent int) item {
+		i.Price -= i.Price * percent / 100
+		return i
+	})
+	if err != nil {
+		t.Fatalf("Wrap error: %s", err)
+	}
+
+	items, err := object.FromGo([]item{{"pen", 200}, {"ink", 50}})
+	if err != nil {
+		t.Fatalf("Conversion error: %s", err)
+	}
+
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{
+			Engine:   engine,
+			Globals:  map[string]object.Object{"items": items},
+			Builtins: map[string]object.BuiltInFunction{"discount": discount},
+		})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		result, err := runtime.Eval(`[discount(items[0], 10), discount(items[1], 50)]`)
+		assert.Nil(t, err, engine)
+
+		var sale []item
+		if assert.Nil(t, object.ToGo(result, &sale), engine) {
+			assert.Equal(t, []item{{"pen", 180}, {"ink", 25}}, sale, engine)
+		}
+
+		_, err = runtime.Eval(`discount(items[0], "all")`)
+		var runtimeError *object.Error
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.TYPE_ERROR, runtimeError.Kind, engine)
+		}
+
+		// Booleans from Go are the ones scripts compare against
+		flag, _ := object.FromGo(true)
+		session := runtime.BuildSession()
+		session.Set("flag", flag)
+		result, err = session.Eval(`[flag == true, !flag]`)
+		assert.Nil(t, err, engine)
+		if result != nil {
+			assert.Equal(t, "[true, false]", result.Inspect(), engine)
+		}
+	}
+}
+
+// Run with -race to check that nothing is shared between runs that it shouldn't be
+func TestConcurrency(t *testing.T) {
+	const goroutines = 100
+
+	script := `
+		let fib = fn(n) { if (n < 2) { return n }; fib(n - 1) + fib(n - 2) };
+		let counter = fn() { let count = 0; fn() { count = count + 1; count } };
+		let next = counter();
+		let words = [];
+		for (word in ["a", "b", "c"]) { words = push(words, word + "!"); next() };
+		let table = {"fib": fib(15), "words": words, "count": next(), "scale": scale};
+		[table["fib"] * table["scale"], len(table["words"]), table["count"], double(21), items[0]["name"]]
+	`
+	expected := "[1220, 3, 4, 42, pen]"
+
+	double := func(args ...object.Object) object.Object {
+		return &object.Integer{Value: args[0].(*object.Integer).Value * 2}
+	}
+	items, _ := object.FromGo([]map[string]string{{"name": "pen"}})
+
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{
+			Engine:   engine,
+			Globals:  map[string]object.Object{"scale": &object.Integer{Value: 2}, "items": items},
+			Builtins: map[string]object.BuiltInFunction{"double": double},
+			Limits:   object.Limits{MaxSteps: 1000000},
+		})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		// One compiled program run by every goroutine
+		program, err := runtime.Compile(script)
+		if err != nil {
+			t.Fatalf("Compile error: %s", err)
+		}
+
+		var wg sync.WaitGroup
+		results := make([]string, goroutines)
+		errs := make([]error, goroutines)
+
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				var result object.Object
+				switch i % 3 {
+				case 0:
+					result, errs[i] = program.Run()
+				case 1:
+					result, errs[i] = runtime.Eval(script)
+				default:
+					// Sessions of their own, with globals that differ between goroutines
+					session := runtime.BuildSession()
+					_, errs[i] = session.Eval(script)
+					if errs[i] == nil {
+						session.Set("scale", &object.Integer{Value: int64(i)})
+						result, errs[i] = session.Eval(`table["fib"] * scale`)
+					}
+				}
+
+				if result != nil {
+					results[i] = result.Inspect()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 0; i < goroutines; i++ {
+			assert.Nil(t, errs[i], "%s: %d", engine, i)
+			if i%3 == 2 {
+				assert.Equal(t, fmt.Sprint(610*i), results[i], "%s: %d", engine, i)
+			} else {
+				assert.Equal(t, expected, results[i], "%s: %d", engine, i)
+			}
+		}
+
+		// Runs assigning into the same global array and hash each change a copy of their own
+		program, err = runtime.Compile(`items[0]["name"] = "run"; items[0] = 0; items`)
+		if assert.Nil(t, err, engine) {
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					result, err := program.Run()
+					if assert.Nil(t, err, engine) {
+						assert.Equal(t, "[0]", result.Inspect(), engine)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		assert.Equal(t, "[{name: pen}]", items.Inspect(), engine)
+
+		// Runs don't see each other's globals
+		program, err = runtime.Compile("let seen = scale; scale = 7; seen")
+		if assert.Nil(t, err, engine) {
+			for i := 0; i < 2; i++ {
+				result, err := program.Run()
+				if assert.Nil(t, err, engine) {
+					assert.Equal(t, "2", result.Inspect(), engine)
+				}
+			}
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	_, err := BuildRuntime(Options{Engine: "jit"})
+	assert.NotNil(t, err)
+
+	for _, engine := range engines {
+		runtime, err := BuildRuntime(Options{Engine: engine, Limits: object.Limits{MaxSteps: 1000}})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		_, err = runtime.Eval("let = 5")
+		var parseError *ParseError
+		assert.True(t, errors.As(err, &parseError), engine)
+
+		_, err = runtime.Eval("1 / 0")
+		var runtimeError *object.Error
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.DIVISION_BY_ZERO_ERROR, runtimeError.Kind, engine)
+		}
+
+		_, err = runtime.Eval("while (true) { }")
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.STEP_LIMIT_ERROR, runtimeError.Kind, engine)
+		}
+
+		// Every engine words its errors the same way
+		messages := map[string]string{
+			"1 + true":              "type mismatch: INTEGER + BOOLEAN",
+			`1 < "a"`:               "type mismatch: INTEGER < STRING",
+			`"a" > "b"`:             "unknown operator: STRING > STRING",
+			`"a" < "b"`:             "unknown operator: STRING < STRING",
+			"[1] > [2]":             "unknown operator: ARRAY > ARRAY",
+			"true + false":          "unknown operator: BOOLEAN + BOOLEAN",
+			`"a" - "b"`:             "unknown operator: STRING - STRING",
+			"-true":                 "unknown operator: -BOOLEAN",
+			"1 / 0":                 "division by zero",
+			"let a = [1]; a[5] = 2": "index out of range: 5",
+			"{}[[]]":                "unusable as hash key: ARRAY",
+			"1[0]":                  "index operator not supported: INTEGER",
+			"5()":                   "not a function: INTEGER",
+			"fn(x) { x }()":         "wrong number of arguments: expected=1, actual=0",
+			"len(1, 2)":             "wrong number of arguments: expected=1, actual=2",
+			"let f = fn() { let r = g(); let g = fn() { 1 }; r }; f()": "identifier not found: g",
+		}
+		for input, message := range messages {
+			_, err = runtime.Eval(input)
+			if assert.True(t, errors.As(err, &runtimeError), engine) {
+				assert.Equal(t, message, runtimeError.Message, input, engine)
+			}
+		}
+
+		// and compares values of any types the same way
+		comparisons := map[string]string{
+			`1 == "a"`:                             "false",
+			`1 != "a"`:                             "true",
+			"true == 1":                            "false",
+			`"a" == "a"`:                           "true",
+			`"a" != "a"`:                           "false",
+			"1 == 1.0":                             "true",
+			"[1] == [1]":                           "false",
+			"let a = {}; a == a":                   "true",
+			`if (false) { 1 } == if (false) { 2 }`: "true",
+		}
+		for input, expected := range comparisons {
+			result, err := runtime.Eval(input)
+			if assert.Nil(t, err, input, engine) {
+				assert.Equal(t, expected, result.Inspect(), input, engine)
+			}
+		}
+
+		// Compile-time errors have the kind the evaluator reports at run time
+		_, err = runtime.Eval("nope + 1")
+		if assert.True(t, errors.As(err, &runtimeError), engine) {
+			assert.Equal(t, object.NAME_ERROR, runtimeError.Kind, engine)
+			assert.Equal(t, "identifier not found: nope", runtimeError.Message, engine)
+		}
+	}
+}
+
+type recorder struct {
+	trace.NopTracer
+	mutex  sync.Mutex
+	events map[string]int
+	frames []string
+}
+
+func (r *recorder) record(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events[event]++
+}
+
+func (r *recorder) TokenScanned(tok token.Token)               { r.record(trace.TOKEN_EVENT) }
+func (r *recorder) NodeParsed(node ast.Node)                   { r.record(trace.PARSE_EVENT) }
+func (r *recorder) NodeCompiled(node ast.Node)                 { r.record(trace.COMPILE_EVENT) }
+func (r *recorder) EvalEnter(node ast.Node)                    { r.record(trace.EVAL_ENTER_EVENT) }
+func (r *recorder) EvalExit(node ast.Node, result trace.Value) { r.record(trace.EVAL_EXIT_EVENT) }
+
+func (r *recorder) InstructionEmitted(position int, name string, operands []int) {
+	r.record(trace.EMIT_EVENT)
+}
+
+func (r *recorder) InstructionExecuted(depth int, ip int, name string, operands []int) {
+	r.record(trace.EXECUTE_EVENT)
+}
+
+func (r *recorder) FramePushed(depth int, function string) {
+	r.record(trace.PUSH_FRAME_EVENT)
+	r.frames = append(r.frames, fmt.Sprintf("push %d %s", depth, function))
+}
+
+func (r *recorder) FramePopped(depth int, function string) {
+	r.record(trace.POP_FRAME_EVENT)
+	r.frames = append(r.frames, fmt.Sprintf("pop %d %s", depth, function))
+}
+
+func TestTracer(t *testing.T) {
+	expected := map[Engine][]string{
+		VM:          {trace.TOKEN_EVENT, trace.PARSE_EVENT, trace.COMPILE_EVENT, trace.EMIT_EVENT, trace.EXECUTE_EVENT},
+		REGISTER_VM: {trace.TOKEN_EVENT, trace.PARSE_EVENT, trace.COMPILE_EVENT, trace.EMIT_EVENT, trace.EXECUTE_EVENT},
+		EVALUATOR:   {trace.TOKEN_EVENT, trace.PARSE_EVENT, trace.EVAL_ENTER_EVENT, trace.EVAL_EXIT_EVENT},
+	}
+
+	for _, engine := range engines {
+		tracer := &recorder{events: map[string]int{}}
+		runtime, err := BuildRuntime(Options{Engine: engine, Tracer: tracer})
+		if err != nil {
+			t.Fatalf("Runtime error: %s", err)
+		}
+
+		result, err := runtime.Eval("let double = fn(x) { x * 2 }; double(double(1))")
+		assert.Nil(t, err, engine)
+		assert.Equal(t, "4", result.Inspect(), engine)
+
+		for _, event := range expected[engine] {
+			assert.Greater(t, tracer.events[event], 0, "%s: %s", engine, event)
+		}
+		assert.Equal(t, []string{"push 2 double", "pop 2 double", "push 2 double", "pop 2 double"}, tracer.frames, engine)
+
+		// Tail calls reuse the caller's frame, which is popped under the name of the function that returns
+		tracer.frames = nil
+		result, err = runtime.Eval(`let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } };
+let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } };
+even(3)`)
+		assert.Nil(t, err, engine)
+		assert.Equal(t, "false", result.Inspect(), engine)
+		assert.Equal(t, []string{"push 2 even", "pop 2 odd"}, tracer.frames, engine)
+	}
+}
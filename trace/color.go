@@ -0,0 +1,82 @@
+package trace
+
+import (
+	"github.com/fatih/color"
+	"go_interpreter/ast"
+	"go_interpreter/token"
+	"io"
+	"sync"
+)
+
+// Prints every event as a line of colour-coded text, e.g.
+//
+//	Current token: INT "5" (1:9)
+//	Compile *ast.IntegerLiteral: 5
+//	Emit opcode OpConstant [0]
+type ColorTracer struct {
+	out   io.Writer
+	mutex sync.Mutex // Keeps lines whole when scripts share the tracer
+}
+
+var (
+	red    = color.New(color.FgRed)
+	green  = color.New(color.FgGreen)
+	yellow = color.New(color.FgYellow)
+	blue   = color.New(color.FgBlue)
+	cyan   = color.New(color.FgCyan)
+)
+
+func BuildColorTracer(out io.Writer) *ColorTracer {
+	return &ColorTracer{out: out}
+}
+
+func (t *ColorTracer) TokenScanned(tok token.Token) {
+	t.print(red, "Current token: %s %q (%s)\n", tok.Type, tok.Literal, tok.Span.Start)
+}
+
+func (t *ColorTracer) NodeParsed(node ast.Node) {
+	t.print(blue, "Parsed %T: %s\n", node, node.String())
+}
+
+func (t *ColorTracer) NodeCompiled(node ast.Node) {
+	t.print(green, "Compile %T: %s\n", node, node.String())
+}
+
+func (t *ColorTracer) InstructionEmitted(position int, name string, operands []int) {
+	t.print(red, "Emit opcode %s %v\n", name, operands)
+}
+
+func (t *ColorTracer) InstructionExecuted(depth int, ip int, name string, operands []int) {
+	t.print(cyan, "On frame %d, ip %d: current opcode %s %v\n", depth-1, ip, name, operands)
+}
+
+func (t *ColorTracer) FramePushed(depth int, function string) {
+	t.print(yellow, "Push frame %d: %s\n", depth-1, function)
+}
+
+func (t *ColorTracer) FramePopped(depth int, function string) {
+	t.print(yellow, "Pop frame %d: %s\n", depth-1, function)
+}
+
+func (t *ColorTracer) EvalEnter(node ast.Node) {
+	t.print(green, "EVAL %T: evaluator.Eval(%s)\n", node, node.String())
+}
+
+func (t *ColorTracer) EvalExit(node ast.Node, result Value) {
+	t.print(blue, "RET %T: %s\n", node, inspect(result))
+}
+
+// Helper method to write one line
+func (t *ColorTracer) print(c *color.Color, format string, a ...interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c.Fprintf(t.out, format, a...)
+}
+
+// Helper method to show a result that might be missing
+func inspect(result Value) string {
+	if result == nil {
+		return "<none>"
+	}
+	return result.Inspect()
+}
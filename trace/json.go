@@ -0,0 +1,129 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_interpreter/ast"
+	"go_interpreter/token"
+	"io"
+	"sync"
+)
+
+// Names of events in JSON-lines traces
+const (
+	TOKEN_EVENT      = "token"
+	PARSE_EVENT      = "parse"
+	COMPILE_EVENT    = "compile"
+	EMIT_EVENT       = "emit"
+	EXECUTE_EVENT    = "execute"
+	PUSH_FRAME_EVENT = "push_frame"
+	POP_FRAME_EVENT  = "pop_frame"
+	EVAL_ENTER_EVENT = "eval_enter"
+	EVAL_EXIT_EVENT  = "eval_exit"
+)
+
+// One line of a JSON-lines trace; fields that don't apply to the event are left out
+type Event struct {
+	Event    string `json:"event"`
+	Token    string `json:"token,omitempty"`    // Type of a scanned token
+	Literal  string `json:"literal,omitempty"`  // Text of a scanned token
+	Node     string `json:"node,omitempty"`     // Go type of a node, e.g. "*ast.Infix"
+	Source   string `json:"source,omitempty"`   // A node printed as source code
+	Line     int    `json:"line,omitempty"`     // Where a token or node starts
+	Column   int    `json:"column,omitempty"`   // Column of Line
+	Op       string `json:"op,omitempty"`       // Opcode of an instruction
+	Operands []int  `json:"operands,omitempty"` // Operands of the instruction
+	Position *int   `json:"position,omitempty"` // Offset of an emitted instruction
+	Depth    int    `json:"depth,omitempty"`    // Frames on the stack
+	IP       *int   `json:"ip,omitempty"`       // Offset of an executed instruction
+	Function string `json:"function,omitempty"` // Function of a pushed or popped frame
+	Result   string `json:"result,omitempty"`   // Value of an evaluated node
+}
+
+// Writes every event as a JSON object on a line of its own, for tools to read back, e.g.
+//
+//	{"event":"execute","op":"OpConstant","operands":[0],"depth":1,"ip":0}
+type JSONTracer struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex // Keeps lines whole when scripts share the tracer
+	err     error
+}
+
+func BuildJSONTracer(out io.Writer) *JSONTracer {
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false) // Keep "<" in e.g. "(a < b)" readable
+	return &JSONTracer{encoder: encoder}
+}
+
+// First error writing the trace, if any; events after it are dropped
+func (t *JSONTracer) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+func (t *JSONTracer) TokenScanned(tok token.Token) {
+	t.write(Event{
+		Event:   TOKEN_EVENT,
+		Token:   string(tok.Type),
+		Literal: tok.Literal,
+		Line:    tok.Span.Start.Line,
+		Column:  tok.Span.Start.Column,
+	})
+}
+
+func (t *JSONTracer) NodeParsed(node ast.Node) {
+	t.write(nodeEvent(PARSE_EVENT, node))
+}
+
+func (t *JSONTracer) NodeCompiled(node ast.Node) {
+	t.write(nodeEvent(COMPILE_EVENT, node))
+}
+
+func (t *JSONTracer) InstructionEmitted(position int, name string, operands []int) {
+	t.write(Event{Event: EMIT_EVENT, Position: &position, Op: name, Operands: operands})
+}
+
+func (t *JSONTracer) InstructionExecuted(depth int, ip int, name string, operands []int) {
+	t.write(Event{Event: EXECUTE_EVENT, Depth: depth, IP: &ip, Op: name, Operands: operands})
+}
+
+func (t *JSONTracer) FramePushed(depth int, function string) {
+	t.write(Event{Event: PUSH_FRAME_EVENT, Depth: depth, Function: function})
+}
+
+func (t *JSONTracer) FramePopped(depth int, function string) {
+	t.write(Event{Event: POP_FRAME_EVENT, Depth: depth, Function: function})
+}
+
+func (t *JSONTracer) EvalEnter(node ast.Node) {
+	t.write(nodeEvent(EVAL_ENTER_EVENT, node))
+}
+
+func (t *JSONTracer) EvalExit(node ast.Node, result Value) {
+	event := nodeEvent(EVAL_EXIT_EVENT, node)
+	event.Result = inspect(result)
+	t.write(event)
+}
+
+// Helper method to describe a node
+func nodeEvent(name string, node ast.Node) Event {
+	span := node.Span()
+	return Event{
+		Event:  name,
+		Node:   fmt.Sprintf("%T", node),
+		Source: node.String(),
+		Line:   span.Start.Line,
+		Column: span.Start.Column,
+	}
+}
+
+// Helper method to write one line, unless an earlier one failed
+func (t *JSONTracer) write(event Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.err == nil {
+		t.err = t.encoder.Encode(event)
+	}
+}
@@ -0,0 +1,46 @@
+package trace
+
+import (
+	"go_interpreter/ast"
+	"go_interpreter/token"
+)
+
+// Hooks into every stage of running a script, from scanning tokens to executing instructions
+// Each stage calls its tracer as it goes, so tracing slows it down; a nil Tracer traces nothing
+// A tracer shared by scripts running at the same time must be safe to call from all of them
+type Tracer interface {
+	TokenScanned(tok token.Token)
+
+	// Called once a node and everything inside it has been parsed, so inner nodes come first
+	NodeParsed(node ast.Node)
+
+	NodeCompiled(node ast.Node)
+	InstructionEmitted(position int, name string, operands []int)
+
+	// depth counts the frames on the stack, 1 for the main program
+	InstructionExecuted(depth int, ip int, name string, operands []int)
+	FramePushed(depth int, function string)
+	FramePopped(depth int, function string)
+
+	// Evaluator only; result is nil if evaluating the node gave no value
+	EvalEnter(node ast.Node)
+	EvalExit(node ast.Node, result Value)
+}
+
+// Result of evaluating a node (object.Object satisfies this)
+type Value interface {
+	Inspect() string
+}
+
+// Tracer that ignores everything, to embed in tracers that only need a few hooks
+type NopTracer struct{}
+
+func (NopTracer) TokenScanned(tok token.Token)                                       {}
+func (NopTracer) NodeParsed(node ast.Node)                                           {}
+func (NopTracer) NodeCompiled(node ast.Node)                                         {}
+func (NopTracer) InstructionEmitted(position int, name string, operands []int)       {}
+func (NopTracer) InstructionExecuted(depth int, ip int, name string, operands []int) {}
+func (NopTracer) FramePushed(depth int, function string)                             {}
+func (NopTracer) FramePopped(depth int, function string)                             {}
+func (NopTracer) EvalEnter(node ast.Node)                                            {}
+func (NopTracer) EvalExit(node ast.Node, result Value)                               {}
@@ -0,0 +1,110 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/ast"
+	"go_interpreter/token"
+	"strings"
+	"testing"
+)
+
+type value string
+
+func (v value) Inspect() string {
+	return string(v)
+}
+
+type failingWriter struct {
+	writes int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("disk full")
+}
+
+var (
+	tok = token.Token{
+		Type:    token.INT,
+		Literal: "5",
+		Span:    token.Span{Start: token.Position{Line: 2, Column: 9}},
+	}
+	node = &ast.IntegerLiteral{Token: tok, Value: 5}
+)
+
+// Helper method to send one of each event to a tracer
+func traceAll(tracer Tracer) {
+	tracer.TokenScanned(tok)
+	tracer.NodeParsed(node)
+	tracer.NodeCompiled(node)
+	tracer.InstructionEmitted(0, "OpConstant", []int{0})
+	tracer.FramePushed(2, "fib")
+	tracer.InstructionExecuted(2, 0, "OpConstant", []int{0})
+	tracer.FramePopped(2, "fib")
+	tracer.EvalEnter(node)
+	tracer.EvalExit(node, value("5"))
+	tracer.EvalExit(node, nil)
+}
+
+func TestJSONTracer(t *testing.T) {
+	var out bytes.Buffer
+	tracer := BuildJSONTracer(&out)
+	traceAll(tracer)
+	assert.Nil(t, tracer.Err())
+
+	expected := []string{
+		`{"event":"token","token":"INT","literal":"5","line":2,"column":9}`,
+		`{"event":"parse","node":"*ast.IntegerLiteral","source":"5","line":2,"column":9}`,
+		`{"event":"compile","node":"*ast.IntegerLiteral","source":"5","line":2,"column":9}`,
+		`{"event":"emit","op":"OpConstant","operands":[0],"position":0}`,
+		`{"event":"push_frame","depth":2,"function":"fib"}`,
+		`{"event":"execute","op":"OpConstant","operands":[0],"depth":2,"ip":0}`,
+		`{"event":"pop_frame","depth":2,"function":"fib"}`,
+		`{"event":"eval_enter","node":"*ast.IntegerLiteral","source":"5","line":2,"column":9}`,
+		`{"event":"eval_exit","node":"*ast.IntegerLiteral","source":"5","line":2,"column":9,"result":"5"}`,
+		`{"event":"eval_exit","node":"*ast.IntegerLiteral","source":"5","line":2,"column":9,"result":"<none>"}`,
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, expected, lines)
+
+	// Lines can be read back as events
+	var event Event
+	assert.Nil(t, json.Unmarshal([]byte(lines[5]), &event))
+	assert.Equal(t, EXECUTE_EVENT, event.Event)
+	if assert.NotNil(t, event.IP) {
+		assert.Equal(t, 0, *event.IP)
+	}
+
+	// Stops writing after the first error
+	writer := &failingWriter{}
+	tracer = BuildJSONTracer(writer)
+	traceAll(tracer)
+	assert.NotNil(t, tracer.Err())
+	assert.Equal(t, 1, writer.writes)
+}
+
+func TestColorTracer(t *testing.T) {
+	noColor := color.NoColor
+	color.NoColor = true
+	defer func() { color.NoColor = noColor }()
+
+	var out bytes.Buffer
+	traceAll(BuildColorTracer(&out))
+
+	expected := `Current token: INT "5" (2:9)
+Parsed *ast.IntegerLiteral: 5
+Compile *ast.IntegerLiteral: 5
+Emit opcode OpConstant [0]
+Push frame 1: fib
+On frame 1, ip 0: current opcode OpConstant [0]
+Pop frame 1: fib
+EVAL *ast.IntegerLiteral: evaluator.Eval(5)
+RET *ast.IntegerLiteral: 5
+RET *ast.IntegerLiteral: <none>
+`
+	assert.Equal(t, expected, out.String())
+}
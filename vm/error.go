@@ -0,0 +1,45 @@
+package vm
+
+import (
+	"go_interpreter/object"
+)
+
+// Helper method to attach the frame stack to an error from the instruction cycle
+// Source code comes from the line table of each frame's function
+func (vm *VM) buildRuntimeError(err error) *object.Error {
+	runtimeError, ok := err.(*object.Error)
+	if !ok {
+		runtimeError = object.BuildError(object.RUNTIME_ERROR, "%s", err)
+	}
+
+	stack := []object.StackFrame{}
+
+	// May run after a panic, so don't trust framesIndex
+	top := vm.framesIndex - 1
+	if top >= len(vm.frames) {
+		top = len(vm.frames) - 1
+	}
+
+	for i := top; i >= 0; i-- {
+		frame := vm.frames[i]
+		stack = append(stack, object.StackFrame{Function: vm.functionName(i), Span: frame.cl.Fn.Lines.Lookup(frame.ip)})
+	}
+
+	if len(stack) > 0 {
+		runtimeError.Span = stack[0].Span
+		runtimeError.Stack = stack
+	}
+
+	return runtimeError
+}
+
+// Helper method to build the error for a variable that was never set
+// e.g. a global defined by a script that failed before its let ran, or a function called before its let
+func (vm *VM) undefinedVariable() *object.Error {
+	frame := vm.currentFrame()
+	name := frame.cl.Fn.Lines.Lookup(frame.ip).Text()
+	if name == "" {
+		return object.BuildError(object.NAME_ERROR, "identifier not found")
+	}
+	return object.BuildError(object.NAME_ERROR, "identifier not found: %s", name)
+}
@@ -7,15 +7,16 @@ import (
 
 // Holds data relevant to execution
 type Frame struct {
-	fn          *object.CompiledFunction // Compiled function referenced by frame
-	ip          int                      // Instruction pointer to the compiled function
-	basePointer int                      // Bottom of stack of current call frame
+	cl          *object.Closure // Closure referenced by frame
+	ip          int             // Instruction pointer to the compiled function
+	basePointer int             // Bottom of stack of current call frame
 }
 
-func BuildFrame(fn *object.CompiledFunction, basePointer int) *Frame {
-	return &Frame{fn, -1, basePointer}
+// Frames are stored by value in the VM's frame stack, so calls don't allocate
+func BuildFrame(cl *object.Closure, basePointer int) Frame {
+	return Frame{cl, -1, basePointer}
 }
 
 func (f *Frame) Instructions() bytecode.Instructions {
-	return f.fn.Instructions
+	return f.cl.Fn.Instructions
 }
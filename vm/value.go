@@ -0,0 +1,147 @@
+package vm
+
+import (
+	"go_interpreter/object"
+	"math"
+)
+
+// How a Value is stored
+type valueKind uint8
+
+const (
+	objectValue  valueKind = iota // Heap object, or one of the True, False and Null singletons
+	integerValue                  // int64 in bits
+	floatValue                    // float64 in bits
+)
+
+// Value on the VM's stack
+// Numbers are stored inline, so arithmetic and comparisons don't allocate, and booleans and null are shared singletons
+// Values become object.Object when they leave the stack: globals, captured variables, arrays, hashes, builtins and LastPopped
+type Value struct {
+	kind valueKind
+	bits uint64        // Integer or float value
+	obj  object.Object // Object value (nil for unset locals)
+}
+
+// Integers with a preallocated object, so common values leaving the stack don't allocate either
+const smallIntegerMin = -128
+const smallIntegerMax = 1023
+
+var smallIntegers = buildSmallIntegers()
+
+func buildSmallIntegers() []*object.Integer {
+	integers := make([]*object.Integer, smallIntegerMax-smallIntegerMin+1)
+	for i := range integers {
+		integers[i] = &object.Integer{Value: int64(i + smallIntegerMin)}
+	}
+	return integers
+}
+
+func fromInteger(i int64) Value {
+	return Value{kind: integerValue, bits: uint64(i)}
+}
+
+func fromFloat(f float64) Value {
+	return Value{kind: floatValue, bits: math.Float64bits(f)}
+}
+
+func fromBool(b bool) Value {
+	if b {
+		return Value{obj: True}
+	}
+	return Value{obj: False}
+}
+
+// Unboxes numbers, so objects from constants, globals and builtins take part in arithmetic without allocating
+func fromObject(obj object.Object) Value {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return fromInteger(obj.Value)
+	case *object.Float:
+		return fromFloat(obj.Value)
+	default:
+		return Value{obj: obj}
+	}
+}
+
+func (v Value) integer() int64 {
+	return int64(v.bits)
+}
+
+func (v Value) float() float64 {
+	return math.Float64frombits(v.bits)
+}
+
+// Boxes numbers into objects
+func (v Value) toObject() object.Object {
+	switch v.kind {
+	case integerValue:
+		i := v.integer()
+		if i >= smallIntegerMin && i <= smallIntegerMax {
+			return smallIntegers[i-smallIntegerMin]
+		}
+		return &object.Integer{Value: i}
+	case floatValue:
+		return &object.Float{Value: v.float()}
+	default:
+		return v.obj
+	}
+}
+
+func (v Value) Type() object.ObjectType {
+	switch v.kind {
+	case integerValue:
+		return object.INTEGER_OBJECT
+	case floatValue:
+		return object.FLOAT_OBJECT
+	default:
+		return v.obj.Type()
+	}
+}
+
+// Helper method for checking for a local whose let hasn't run yet
+func (v Value) isUnset() bool {
+	return v.kind == objectValue && v.obj == nil
+}
+
+// Helper method for checking numeric values
+func (v Value) isNumber() bool {
+	return v.kind == integerValue || v.kind == floatValue
+}
+
+// Helper method for widening numeric values to float64
+func (v Value) toFloat() float64 {
+	switch v.kind {
+	case integerValue:
+		return float64(v.integer())
+	case floatValue:
+		return v.float()
+	default:
+		return 0
+	}
+}
+
+// Hash key of a value, without boxing numbers
+func (v Value) hashKey() (object.HashKey, bool) {
+	switch v.kind {
+	case integerValue:
+		return object.HashKey{Type: object.INTEGER_OBJECT, Value: v.bits}, true
+	case floatValue:
+		return (&object.Float{Value: v.float()}).HashKey(), true
+	default:
+		key, ok := v.obj.(object.Hashable)
+		if !ok {
+			return object.HashKey{}, false
+		}
+		return key.HashKey(), true
+	}
+}
+
+// Helper method to box a run of stack values
+func toObjects(values []Value) []object.Object {
+	objects := make([]object.Object, len(values))
+	for i, v := range values {
+		objects[i] = v.toObject()
+	}
+	return objects
+}
@@ -1,45 +1,57 @@
 package vm
 
 import (
-	"fmt"
-	"github.com/fatih/color"
+	"context"
 	"go_interpreter/bytecode"
 	"go_interpreter/compiler"
 	"go_interpreter/object"
+	"go_interpreter/trace"
 )
 
-var PRINT_VM = false
-
 const stackCapacity = 2048
 const GlobalCapacity = 65536 // Upper limit on number of global bindings
 const frameCapacity = 1024   // Upper limit on number of frames
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+// Builtins of VMs that aren't given a registry
+var defaultBuiltins = object.BuildBuiltinRegistry()
+
+var True = object.TRUE
+var False = object.FALSE
+var Null = object.NULL
 
 type VM struct {
-	constants    []object.Object // Constants generated by compiler
-	stack        []object.Object // Stack for operands
+	constants    []Value         // Constants generated by compiler
+	stack        []Value         // Stack for operands
 	stackPointer int             // stack[stackPointer-1] is top of stack
 	globals      []object.Object // Globals
-	frames       []*Frame        // Stack of frames
+	frames       []Frame         // Stack of frames
 	framesIndex  int             // Top of stack of frames
+	budget       *object.Budget  // Limits of the current run
+	builtins     *object.BuiltinRegistry
+	tracer       trace.Tracer // Told about every instruction and call, nil for none
+	checked      bool         // Report int64 overflow of + - * / as an error instead of wrapping around
 }
 
 func BuildVM(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
-	mainFrame := BuildFrame(mainFn, 0)
-	frames := make([]*Frame, frameCapacity)
+	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions, Lines: bytecode.Lines}
+	mainClosure := &object.Closure{Fn: mainFn}
+	mainFrame := BuildFrame(mainClosure, 0)
+	frames := make([]Frame, frameCapacity)
 	frames[0] = mainFrame
 
+	constants := make([]Value, len(bytecode.Constants))
+	for i, constant := range bytecode.Constants {
+		constants[i] = fromObject(constant)
+	}
+
 	return &VM{
-		constants:    bytecode.Constants,
-		stack:        make([]object.Object, stackCapacity),
+		constants:    constants,
+		stack:        make([]Value, stackCapacity),
 		stackPointer: 0,
 		globals:      make([]object.Object, GlobalCapacity),
 		frames:       frames,
 		framesIndex:  1, // Since mainFrame is already on the frame stack
+		builtins:     defaultBuiltins,
 	}
 }
 
@@ -49,49 +61,164 @@ func BuildStatefulVM(bytecode *compiler.Bytecode, g []object.Object) *VM {
 	return vm
 }
 
+// Runs the program with the builtins of registry, which it must have been compiled with
+func (vm *VM) SetBuiltins(registry *object.BuiltinRegistry) {
+	vm.builtins = registry
+}
+
+// Reports every instruction run and every call made from now on to tracer
+func (vm *VM) SetTracer(tracer trace.Tracer) {
+	vm.tracer = tracer
+}
+
+// Reports int64 overflow of + - * / as an error instead of wrapping around
+func (vm *VM) SetCheckOverflow(checked bool) {
+	vm.checked = checked
+}
+
 func (vm *VM) currentFrame() *Frame {
-	return vm.frames[vm.framesIndex-1]
+	return &vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f Frame) error {
+	if vm.framesIndex >= frameCapacity {
+		return object.BuildError(object.STACK_OVERFLOW_ERROR, "stack overflow")
+	}
+
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+
+	if vm.tracer != nil {
+		vm.tracer.FramePushed(vm.framesIndex, vm.functionName(vm.framesIndex-1))
+	}
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
+	if vm.tracer != nil {
+		vm.tracer.FramePopped(vm.framesIndex, vm.functionName(vm.framesIndex-1))
+	}
+
 	vm.framesIndex--
-	return vm.frames[vm.framesIndex]
+	return &vm.frames[vm.framesIndex]
 }
 
-// Fetch-decode-execute cycle (instruction cycle)
+// Helper method to name the function running in the frame at index, as stack traces show it
+func (vm *VM) functionName(index int) string {
+	name := vm.frames[index].cl.Fn.Name
+	if index == 0 {
+		name = "<main>"
+	} else if name == "" {
+		name = "<anonymous>"
+	}
+	return name
+}
+
+// Helper method to report the instruction at ip of the current frame
+func (vm *VM) traceInstruction(ip int, instructions bytecode.Instructions) {
+	definition, err := bytecode.Lookup(instructions[ip])
+	if err != nil {
+		return
+	}
+
+	operands, _ := bytecode.ReadOperands(definition, instructions[ip+1:])
+	vm.tracer.InstructionExecuted(vm.framesIndex, ip, definition.Name, operands)
+}
+
+// Runs the program
+// Errors are *object.Error, pointing at the failing instruction's source code
+// Bugs in the VM become INTERNAL_ERROR instead of crashing the host
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background(), object.Limits{})
+}
+
+// Like Run, but stops with an error once ctx is done or the program goes over limits
+func (vm *VM) RunContext(ctx context.Context, limits object.Limits) (err error) {
+	vm.budget = object.BuildBudget(ctx, limits)
+
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = vm.buildRuntimeError(object.BuildError(object.INTERNAL_ERROR, "internal error: %v", r))
+		}
+	}()
+
+	err = vm.run()
+	if err != nil {
+		return vm.buildRuntimeError(err)
+	}
+
+	return nil
+}
+
+// Fetch-decode-execute cycle (instruction cycle)
+func (vm *VM) run() error {
 	var ip int
 	var instructions bytecode.Instructions
 	var op bytecode.Opcode
 
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
-		if PRINT_VM {
-			color.Red("On frame %v", vm.framesIndex-1)
-		}
-
 		// Fetch
 		vm.currentFrame().ip++
 		ip = vm.currentFrame().ip
 		instructions = vm.currentFrame().Instructions()
 		op = bytecode.Opcode(instructions[ip])
 
-		if PRINT_VM {
-			def, _ := bytecode.Lookup(byte(op))
-			color.Cyan("Current opcode: %s", def.Name)
+		if err := vm.budget.Step(); err != nil {
+			return err
+		}
+
+		if vm.tracer != nil {
+			vm.traceInstruction(ip, instructions)
 		}
 
 		// Decode & Execute
 		switch op {
+		case bytecode.OpClosure:
+			constIndex := bytecode.ReadUint16(instructions[ip+1:])
+			numFree := bytecode.ReadUint8(instructions[ip+3:])
+			vm.currentFrame().ip += 3
+
+			err := vm.pushClosure(int(constIndex), int(numFree))
+			if err != nil {
+				return err
+			}
+		case bytecode.OpGetFree:
+			freeIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			value := currentClosure.Free[freeIndex].Value
+			if value == nil {
+				return vm.undefinedVariable()
+			}
+			err := vm.push(fromObject(value))
+			if err != nil {
+				return err
+			}
+		case bytecode.OpSetFree:
+			freeIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			currentClosure.Free[freeIndex].Value = vm.pop().toObject()
+		case bytecode.OpCaptureFree:
+			freeIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(Value{obj: currentClosure.Free[freeIndex]})
+			if err != nil {
+				return err
+			}
 		case bytecode.OpGetBuiltin:
 			builtinIndex := bytecode.ReadUint8(instructions[ip+1:])
 			vm.currentFrame().ip += 1
-			definition := object.Builtins[builtinIndex]
-			err := vm.push(definition.Builtin)
+			builtin := vm.builtins.Get(int(builtinIndex))
+			if builtin == nil {
+				return object.BuildError(object.NAME_ERROR, "undefined builtin: %d", builtinIndex)
+			}
+			err := vm.push(Value{obj: builtin})
 			if err != nil {
 				return err
 			}
@@ -99,7 +226,21 @@ func (vm *VM) Run() error {
 			localIndex := bytecode.ReadUint8(instructions[ip+1:])
 			vm.currentFrame().ip += 1
 			frame := vm.currentFrame()
-			err := vm.push(vm.stack[frame.basePointer+int(localIndex)])
+			local := vm.stack[frame.basePointer+int(localIndex)]
+			if local.isUnset() {
+				return vm.undefinedVariable()
+			}
+			err := vm.push(local)
+			if err != nil {
+				return err
+			}
+		case bytecode.OpGetLocal0, bytecode.OpGetLocal1, bytecode.OpGetLocal2:
+			frame := vm.currentFrame()
+			local := vm.stack[frame.basePointer+int(op-bytecode.OpGetLocal0)]
+			if local.isUnset() {
+				return vm.undefinedVariable()
+			}
+			err := vm.push(local)
 			if err != nil {
 				return err
 			}
@@ -111,15 +252,46 @@ func (vm *VM) Run() error {
 			frame := vm.currentFrame()
 			// Save the binding to the location on the stack
 			vm.stack[frame.basePointer+int(localIndex)] = vm.pop()
+		case bytecode.OpGetCell:
+			localIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			value := vm.localCell(int(localIndex)).Value
+			if value == nil {
+				return vm.undefinedVariable()
+			}
+			err := vm.push(fromObject(value))
+			if err != nil {
+				return err
+			}
+		case bytecode.OpSetCell:
+			localIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			vm.localCell(int(localIndex)).Value = vm.pop().toObject()
+		case bytecode.OpCaptureLocal:
+			localIndex := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(Value{obj: vm.localCell(int(localIndex))})
+			if err != nil {
+				return err
+			}
 		case bytecode.OpReturnNothing:
 			frame := vm.popFrame()
 			vm.stackPointer = frame.basePointer - 1 // Reset back to base pointer and also pop function
-			err := vm.push(Null)
+			err := vm.push(Value{obj: Null})
 			if err != nil {
 				return err
 			}
 		case bytecode.OpReturnValue:
 			returnValue := vm.pop() // Pop return value off of stack
+
+			// Top level return ends the program, leaving its value as the last popped
+			if vm.framesIndex == 1 {
+				return nil
+			}
+
 			frame := vm.popFrame()
 			vm.stackPointer = frame.basePointer - 1 // Reset back to base pointer and also pop function
 			err := vm.push(returnValue)
@@ -135,6 +307,14 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case bytecode.OpTailCall:
+			numArgs := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.tailCallFunction(int(numArgs))
+			if err != nil {
+				return err
+			}
 		case bytecode.OpIndex:
 			index := vm.pop()
 			left := vm.pop()
@@ -143,6 +323,15 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case bytecode.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+
+			err := vm.executeSetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
 		case bytecode.OpHash:
 			numElements := int(bytecode.ReadUint16(instructions[ip+1:]))
 			vm.currentFrame().ip += 2
@@ -151,9 +340,12 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+			if err := vm.budget.Allocate(hash); err != nil {
+				return err
+			}
 			vm.stackPointer -= numElements
 
-			err = vm.push(hash)
+			err = vm.push(Value{obj: hash})
 			if err != nil {
 				return err
 			}
@@ -162,9 +354,12 @@ func (vm *VM) Run() error {
 			vm.currentFrame().ip += 2
 
 			array := vm.buildArray(vm.stackPointer-numElements, vm.stackPointer)
+			if err := vm.budget.Allocate(array); err != nil {
+				return err
+			}
 			vm.stackPointer -= numElements
 
-			err := vm.push(array)
+			err := vm.push(Value{obj: array})
 			if err != nil {
 				return err
 			}
@@ -172,16 +367,20 @@ func (vm *VM) Run() error {
 			globalIndex := bytecode.ReadUint16(instructions[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIndex])
+			global := vm.globals[globalIndex]
+			if global == nil {
+				return vm.undefinedVariable()
+			}
+			err := vm.push(fromObject(global))
 			if err != nil {
 				return err
 			}
 		case bytecode.OpSetGlobal:
 			globalIndex := bytecode.ReadUint16(instructions[ip+1:])
 			vm.currentFrame().ip += 2
-			vm.globals[globalIndex] = vm.pop()
+			vm.globals[globalIndex] = vm.pop().toObject()
 		case bytecode.OpNull:
-			err := vm.push(Null)
+			err := vm.push(Value{obj: Null})
 			if err != nil {
 				return err
 			}
@@ -194,6 +393,35 @@ func (vm *VM) Run() error {
 			if !isTruthy(condition) {
 				vm.currentFrame().ip = position - 1
 			}
+		case bytecode.OpIter:
+			iterable := vm.pop()
+
+			iterator, ok := object.BuildIterator(iterable.obj)
+			if !ok {
+				return object.BuildError(object.TYPE_ERROR, "cannot iterate over %s", iterable.Type())
+			}
+
+			err := vm.push(Value{obj: iterator})
+			if err != nil {
+				return err
+			}
+		case bytecode.OpIterNext:
+			position := int(bytecode.ReadUint16(instructions[ip+1:]))
+			// Skip over operand
+			vm.currentFrame().ip += 2
+
+			iterator := vm.stack[vm.stackPointer-1].obj.(*object.Iterator)
+			item, ok := iterator.Next()
+			if !ok {
+				// Drop exhausted iterator and leave loop
+				vm.pop()
+				vm.currentFrame().ip = position - 1
+			} else {
+				err := vm.push(fromObject(item))
+				if err != nil {
+					return err
+				}
+			}
 		case bytecode.OpJump:
 			position := int(bytecode.ReadUint16(instructions[ip+1:]))
 			// -1 because loop increments ip
@@ -207,6 +435,33 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case bytecode.OpSmallInteger:
+			value := bytecode.ReadUint8(instructions[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.push(fromInteger(int64(value)))
+			if err != nil {
+				return err
+			}
+		case bytecode.OpAddConstant, bytecode.OpSubConstant:
+			constIndex := bytecode.ReadUint16(instructions[ip+1:])
+			vm.currentFrame().ip += 2
+
+			err := vm.executeConstantOperation(op, vm.constants[constIndex])
+			if err != nil {
+				return err
+			}
+		case bytecode.OpGreaterJumpNotTruthy, bytecode.OpLessJumpNotTruthy, bytecode.OpEqualJumpNotTruthy, bytecode.OpNotEqualJumpNotTruthy:
+			position := int(bytecode.ReadUint16(instructions[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			condition, err := vm.executeFusedComparison(op)
+			if err != nil {
+				return err
+			}
+			if !condition {
+				vm.currentFrame().ip = position - 1
+			}
 		case bytecode.OpAdd, bytecode.OpSub, bytecode.OpMul, bytecode.OpDiv:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
@@ -215,16 +470,16 @@ func (vm *VM) Run() error {
 		case bytecode.OpPop:
 			vm.pop()
 		case bytecode.OpTrue:
-			err := vm.push(True)
+			err := vm.push(Value{obj: True})
 			if err != nil {
 				return err
 			}
 		case bytecode.OpFalse:
-			err := vm.push(False)
+			err := vm.push(Value{obj: False})
 			if err != nil {
 				return err
 			}
-		case bytecode.OpEqual, bytecode.OpNotEqual, bytecode.OpGreater:
+		case bytecode.OpEqual, bytecode.OpNotEqual, bytecode.OpGreater, bytecode.OpLess:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -247,73 +502,197 @@ func (vm *VM) Run() error {
 
 // Helper method for call
 func (vm *VM) callFunction(numArgs int) error {
-	fn := vm.stack[vm.stackPointer-1-numArgs]
-	switch fn := fn.(type) {
-	case *object.CompiledFunction:
-		if numArgs != fn.NumParameters {
-			return fmt.Errorf(
-				"Wrong number of arguments. Expected=%d, Actual=%d",
-				fn.NumParameters,
+	callee := vm.stack[vm.stackPointer-1-numArgs]
+	switch fn := callee.obj.(type) {
+	case *object.Closure:
+		if numArgs != fn.Fn.NumParameters {
+			return object.BuildError(object.ARITY_ERROR,
+				"wrong number of arguments: expected=%d, actual=%d",
+				fn.Fn.NumParameters,
 				numArgs)
 		}
+		if err := vm.budget.Call(vm.framesIndex); err != nil {
+			return err
+		}
+
 		// basePointer is vm.stackPointer - numArgs
 		frame := BuildFrame(fn, vm.stackPointer-numArgs)
-		vm.pushFrame(frame)
-		vm.stackPointer = frame.basePointer + fn.NumLocals
+		err := vm.pushFrame(frame)
+		if err != nil {
+			return err
+		}
+		vm.stackPointer = frame.basePointer + fn.Fn.NumLocals
+		vm.clearLocals(frame.basePointer, fn.Fn)
 		return nil
 	case *object.BuiltIn:
-		args := vm.stack[vm.stackPointer-numArgs : vm.stackPointer]
+		args := toObjects(vm.stack[vm.stackPointer-numArgs : vm.stackPointer])
 		result := fn.Function(args...)
 		vm.stackPointer = vm.stackPointer - numArgs - 1
+
+		// Builtins report errors as values, like in the evaluator; they stop the program
+		builtinError, ok := result.(*object.Error)
+		if ok {
+			return builtinError
+		}
+
+		if result != nil && fn.Allocates {
+			if err := vm.budget.Allocate(result); err != nil {
+				return err
+			}
+		}
+
 		if result != nil {
-			vm.push(result)
+			vm.push(fromObject(result))
 		} else {
-			vm.push(Null)
+			vm.push(Value{obj: Null})
 		}
 		return nil
 	default:
-		return fmt.Errorf("Calling non-function")
+		return object.BuildError(object.TYPE_ERROR, "not a function: %s", callee.Type())
+	}
+
+}
+
+// Like callFunction, but a closure replaces the current frame instead of pushing a new one
+// Other callees are called normally, and the OpReturnValue after the call returns their result
+func (vm *VM) tailCallFunction(numArgs int) error {
+	fn, ok := vm.stack[vm.stackPointer-1-numArgs].obj.(*object.Closure)
+	if !ok || vm.framesIndex == 1 {
+		return vm.callFunction(numArgs)
 	}
 
+	if numArgs != fn.Fn.NumParameters {
+		return object.BuildError(object.ARITY_ERROR,
+			"wrong number of arguments: expected=%d, actual=%d",
+			fn.Fn.NumParameters,
+			numArgs)
+	}
+
+	// Move callee and arguments down to where the current function and its arguments are
+	frame := vm.currentFrame()
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.stackPointer-1-numArgs:vm.stackPointer])
+
+	frame.cl = fn
+	frame.ip = -1
+	vm.stackPointer = frame.basePointer + fn.Fn.NumLocals
+	vm.clearLocals(frame.basePointer, fn.Fn)
+	return nil
+}
+
+// Helper method to unset the locals of a new frame that aren't parameters
+// so OpSetCell doesn't mistake a cell left behind by an earlier frame for its own
+func (vm *VM) clearLocals(basePointer int, fn *object.CompiledFunction) {
+	for i := basePointer + fn.NumParameters; i < basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = Value{}
+	}
+}
+
+// Helper method to get the cell of a local that closures capture
+// Locals start out as plain values (parameters) or unset, and move into a cell the first time one is needed
+func (vm *VM) localCell(localIndex int) *object.Cell {
+	local := &vm.stack[vm.currentFrame().basePointer+localIndex]
+
+	cell, ok := local.obj.(*object.Cell)
+	if !ok {
+		cell = &object.Cell{Value: local.toObject()}
+		*local = Value{obj: cell}
+	}
+	return cell
+}
+
+// Helper method for closures
+func (vm *VM) pushClosure(constIndex int, numFree int) error {
+	constant := vm.constants[constIndex].obj
+	function, ok := constant.(*object.CompiledFunction)
+	if !ok {
+		return object.BuildError(object.RUNTIME_ERROR, "not a function: %+v", constant)
+	}
+
+	// Cells of captured variables sit on top of the stack
+	free := make([]*object.Cell, numFree)
+	for i := 0; i < numFree; i++ {
+		value := vm.stack[vm.stackPointer-numFree+i]
+		cell, ok := value.obj.(*object.Cell)
+		if !ok {
+			return object.BuildError(object.RUNTIME_ERROR, "captured value is not a cell")
+		}
+		free[i] = cell
+	}
+	vm.stackPointer -= numFree
+
+	return vm.push(Value{obj: &object.Closure{Fn: function, Free: free}})
 }
 
 // Helper method for index
-func (vm *VM) executeIndex(left, index object.Object) error {
-	if left.Type() == object.ARRAY_OBJECT && index.Type() == object.INTEGER_OBJECT {
+func (vm *VM) executeIndex(left, index Value) error {
+	if left.Type() == object.ARRAY_OBJECT && index.kind == integerValue {
 		return vm.executeArrayIndex(left, index)
 	} else if left.Type() == object.HASH_OBJECT {
 		return vm.executeHashIndex(left, index)
 	} else {
-		return fmt.Errorf("Index operator not supported for %s", left.Type())
+		return object.BuildError(object.TYPE_ERROR, "index operator not supported: %s", left.Type())
 	}
 }
 
 // Helper method for array index
-func (vm *VM) executeArrayIndex(array, index object.Object) error {
-	arrayObject := array.(*object.Array)
-	i := index.(*object.Integer).Value
+func (vm *VM) executeArrayIndex(array, index Value) error {
+	arrayObject := array.obj.(*object.Array)
+	i := index.integer()
 
 	if i < 0 || i > int64(len(arrayObject.Elements)-1) {
-		return vm.push(Null)
+		return vm.push(Value{obj: Null})
 	} else {
-		return vm.push(arrayObject.Elements[i])
+		return vm.push(fromObject(arrayObject.Elements[i]))
 	}
 }
 
 // Helper method for hash index
-func (vm *VM) executeHashIndex(hash, index object.Object) error {
-	hashObject := hash.(*object.Hash)
-	key, ok := index.(object.Hashable)
+func (vm *VM) executeHashIndex(hash, index Value) error {
+	hashObject := hash.obj.(*object.Hash)
+	key, ok := index.hashKey()
 	if !ok {
-		return fmt.Errorf("Unusable as hash key")
+		return object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
 	}
 
-	pair, ok := hashObject.Pairs[key.HashKey()]
+	pair, ok := hashObject.Pairs[key]
 	if !ok {
-		return vm.push(Null)
+		return vm.push(Value{obj: Null})
 	} else {
-		return vm.push(pair.Value)
+		return vm.push(fromObject(pair.Value))
+	}
+}
+
+// Helper method for index assignment
+func (vm *VM) executeSetIndex(left, index, value Value) error {
+	switch {
+	case left.Type() == object.ARRAY_OBJECT && index.kind == integerValue:
+		arrayObject := left.obj.(*object.Array)
+		i := index.integer()
+
+		if i < 0 || i > int64(len(arrayObject.Elements)-1) {
+			return object.BuildError(object.INDEX_ERROR, "index out of range: %d", i)
+		}
+
+		arrayObject.Elements[i] = value.toObject()
+	case left.Type() == object.HASH_OBJECT:
+		hashObject := left.obj.(*object.Hash)
+		key, ok := index.hashKey()
+		if !ok {
+			return object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", index.Type())
+		}
+
+		if _, ok := hashObject.Pairs[key]; !ok {
+			if err := vm.budget.AllocateHashPair(); err != nil {
+				return err
+			}
+		}
+
+		hashObject.Pairs[key] = object.HashPair{Key: index.toObject(), Value: value.toObject()}
+	default:
+		return object.BuildError(object.TYPE_ERROR, "index assignment not supported: %s", left.Type())
 	}
+
+	return vm.push(value)
 }
 
 // Helper method for hashmaps
@@ -323,16 +702,15 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 		// Get key and value, and create a pair
 		key := vm.stack[i]
 		value := vm.stack[i+1]
-		pair := object.HashPair{Key: key, Value: value}
+		pair := object.HashPair{Key: key.toObject(), Value: value.toObject()}
 
-		// Check if key is hashable
-		hashKey, ok := key.(object.Hashable)
+		// Check if key is hashable, and hash it
+		hashKey, ok := key.hashKey()
 		if !ok {
-			return nil, fmt.Errorf("Key is unhashable")
+			return nil, object.BuildError(object.TYPE_ERROR, "unusable as hash key: %s", key.Type())
 		}
 
-		// Hash the key
-		hashedPairs[hashKey.HashKey()] = pair
+		hashedPairs[hashKey] = pair
 	}
 
 	return &object.Hash{Pairs: hashedPairs}, nil
@@ -340,17 +718,12 @@ func (vm *VM) buildHash(startIndex, endIndex int) (object.Object, error) {
 
 // Helper method for arrays
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
-	array := make([]object.Object, endIndex-startIndex)
-	for i := startIndex; i < endIndex; i++ {
-		array[i-startIndex] = vm.stack[i]
-	}
-
-	return &object.Array{Elements: array}
+	return &object.Array{Elements: toObjects(vm.stack[startIndex:endIndex])}
 }
 
 // Helper method for conditionals
-func isTruthy(obj object.Object) bool {
-	switch obj := obj.(type) {
+func isTruthy(v Value) bool {
+	switch obj := v.obj.(type) {
 	case *object.Boolean:
 		return obj.Value
 	case *object.Null:
@@ -364,85 +737,209 @@ func isTruthy(obj object.Object) bool {
 func (vm *VM) executeMinus() error {
 	value := vm.pop()
 
-	if value.Type() != object.INTEGER_OBJECT {
-		return fmt.Errorf("Unsupported type: %s", value.Type())
+	switch value.kind {
+	case integerValue:
+		result, ok := object.CheckedNeg(value.integer())
+		if !ok && vm.checked {
+			return object.BuildError(object.OVERFLOW_ERROR, "integer overflow: -%d", value.integer())
+		}
+		return vm.push(fromInteger(result))
+	case floatValue:
+		return vm.push(fromFloat(-value.float()))
+	default:
+		return object.BuildError(object.TYPE_ERROR, "unknown operator: -%s", value.Type())
 	}
-
-	return vm.push(&object.Integer{Value: -value.(*object.Integer).Value})
 }
 
 // Helper method to execute !
 func (vm *VM) executeBang() error {
 	value := vm.pop()
 
-	switch value {
+	switch value.obj {
 	case True:
-		return vm.push(False)
+		return vm.push(fromBool(false))
 	case False:
-		return vm.push(True)
+		return vm.push(fromBool(true))
 	case Null:
-		return vm.push(True)
+		return vm.push(fromBool(true))
 	default:
-		return vm.push(False)
+		return vm.push(fromBool(false))
+	}
+}
+
+// Helper method to execute a comparison fused with OpJumpNotTruthy, returning whether the condition held
+// Integers are compared in place, anything else goes through executeComparison for the same results and errors
+func (vm *VM) executeFusedComparison(op bytecode.Opcode) (bool, error) {
+	var comparison bytecode.Opcode
+	switch op {
+	case bytecode.OpGreaterJumpNotTruthy:
+		comparison = bytecode.OpGreater
+	case bytecode.OpLessJumpNotTruthy:
+		comparison = bytecode.OpLess
+	case bytecode.OpEqualJumpNotTruthy:
+		comparison = bytecode.OpEqual
+	default:
+		comparison = bytecode.OpNotEqual
+	}
+
+	right := vm.stack[vm.stackPointer-1]
+	left := vm.stack[vm.stackPointer-2]
+
+	if left.kind == integerValue && right.kind == integerValue {
+		var result bool
+		switch comparison {
+		case bytecode.OpGreater:
+			result = left.integer() > right.integer()
+		case bytecode.OpLess:
+			result = left.integer() < right.integer()
+		case bytecode.OpEqual:
+			result = left.integer() == right.integer()
+		default:
+			result = left.integer() != right.integer()
+		}
+
+		// Leave the condition where OpJumpNotTruthy would have popped it from
+		vm.stackPointer -= 2
+		vm.stack[vm.stackPointer] = fromBool(result)
+		return result, nil
 	}
+
+	err := vm.executeComparison(comparison)
+	if err != nil {
+		return false, err
+	}
+	return isTruthy(vm.pop()), nil
 }
 
-// Helper method to execute !=, >, ==
+// Helper method to execute ==, !=, >, <
+// == and != take any two values: numbers and strings are equal by value, other values by identity,
+// and values of different types are never equal
 func (vm *VM) executeComparison(op bytecode.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJECT || right.Type() == object.INTEGER_OBJECT {
-		return vm.executeIntegerComparison(left, op, right)
+	if left.kind == integerValue && right.kind == integerValue {
+		return vm.executeIntegerComparison(left.integer(), op, right.integer())
+	}
+
+	if left.isNumber() && right.isNumber() {
+		return vm.executeFloatComparison(left.toFloat(), op, right.toFloat())
+	}
+
+	// Compare strings by value, so sharing constants doesn't change the result
+	if left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT {
+		equal := left.obj.(*object.String).Value == right.obj.(*object.String).Value
+		switch op {
+		case bytecode.OpEqual:
+			return vm.push(fromBool(equal))
+		case bytecode.OpNotEqual:
+			return vm.push(fromBool(!equal))
+		}
 	}
 
 	switch op {
 	case bytecode.OpEqual:
-		return vm.push(toBooleanObject(right == left))
+		return vm.push(fromBool(right == left))
 	case bytecode.OpNotEqual:
-		return vm.push(toBooleanObject(right != left))
+		return vm.push(fromBool(right != left))
 	default:
-		return fmt.Errorf("Unknown operator: %s %d %s", left.Type(), op, right.Type())
+		return operatorError(left.Type(), op, right.Type())
 	}
 }
 
-// Helper method to execute !=, >, == for integers
-func (vm *VM) executeIntegerComparison(
-	left object.Object, op bytecode.Opcode, right object.Object) error {
-	leftValue := left.(*object.Integer).Value
-	rightValue := right.(*object.Integer).Value
+// Helper method to execute ==, !=, >, < for integers
+func (vm *VM) executeIntegerComparison(leftValue int64, op bytecode.Opcode, rightValue int64) error {
+	switch op {
+	case bytecode.OpEqual:
+		return vm.push(fromBool(leftValue == rightValue))
+	case bytecode.OpNotEqual:
+		return vm.push(fromBool(leftValue != rightValue))
+	case bytecode.OpGreater:
+		return vm.push(fromBool(leftValue > rightValue))
+	case bytecode.OpLess:
+		return vm.push(fromBool(leftValue < rightValue))
+	default:
+		return operatorError(object.INTEGER_OBJECT, op, object.INTEGER_OBJECT)
+	}
+}
 
+// Helper method to execute ==, !=, >, < for floats (either side may have been an integer)
+func (vm *VM) executeFloatComparison(leftValue float64, op bytecode.Opcode, rightValue float64) error {
 	switch op {
 	case bytecode.OpEqual:
-		return vm.push(toBooleanObject(leftValue == rightValue))
+		return vm.push(fromBool(leftValue == rightValue))
 	case bytecode.OpNotEqual:
-		return vm.push(toBooleanObject(leftValue != rightValue))
+		return vm.push(fromBool(leftValue != rightValue))
 	case bytecode.OpGreater:
-		return vm.push(toBooleanObject(leftValue > rightValue))
+		return vm.push(fromBool(leftValue > rightValue))
+	case bytecode.OpLess:
+		return vm.push(fromBool(leftValue < rightValue))
 	default:
-		return fmt.Errorf("Unknown operator: %d", op)
+		return operatorError(object.FLOAT_OBJECT, op, object.FLOAT_OBJECT)
 	}
 }
 
-// Helper method to convert bool to boolean objects
-func toBooleanObject(input bool) *object.Boolean {
-	if input {
-		return True
-	} else {
-		return False
+// Source operators of arithmetic and comparison opcodes, for error messages
+var operatorSymbols = map[bytecode.Opcode]string{
+	bytecode.OpAdd:      "+",
+	bytecode.OpSub:      "-",
+	bytecode.OpMul:      "*",
+	bytecode.OpDiv:      "/",
+	bytecode.OpEqual:    "==",
+	bytecode.OpNotEqual: "!=",
+	bytecode.OpGreater:  ">",
+	bytecode.OpLess:     "<",
+}
+
+// Helper method to build the error for operands an operator doesn't support, worded like the evaluator's
+func operatorError(left object.ObjectType, op bytecode.Opcode, right object.ObjectType) *object.Error {
+	if left != right {
+		return object.BuildError(object.TYPE_ERROR, "type mismatch: %s %s %s", left, operatorSymbols[op], right)
 	}
+	return object.BuildError(object.TYPE_ERROR, "unknown operator: %s %s %s", left, operatorSymbols[op], right)
 }
 
 // Helper method to execute +,-,*,/
+// Numbers stay inline, so only string concatenation allocates
 func (vm *VM) executeBinaryOperation(op bytecode.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJECT && right.Type() == object.INTEGER_OBJECT {
-		leftValue := left.(*object.Integer).Value
-		rightValue := right.(*object.Integer).Value
+	if left.kind == integerValue && right.kind == integerValue {
+		leftValue := left.integer()
+		rightValue := right.integer()
 
 		var result int64
+		var ok bool
+
+		switch op {
+		case bytecode.OpAdd:
+			result, ok = object.CheckedAdd(leftValue, rightValue)
+		case bytecode.OpSub:
+			result, ok = object.CheckedSub(leftValue, rightValue)
+		case bytecode.OpMul:
+			result, ok = object.CheckedMul(leftValue, rightValue)
+		case bytecode.OpDiv:
+			if rightValue == 0 {
+				return object.BuildError(object.DIVISION_BY_ZERO_ERROR, "division by zero")
+			}
+			result, ok = object.CheckedDiv(leftValue, rightValue)
+		default:
+			return operatorError(object.INTEGER_OBJECT, op, object.INTEGER_OBJECT)
+		}
+
+		// Wrap around like Go unless checked arithmetic is on
+		if !ok && vm.checked {
+			return object.BuildError(object.OVERFLOW_ERROR, "integer overflow: %d %s %d",
+				leftValue, operatorSymbols[op], rightValue)
+		}
+
+		return vm.push(fromInteger(result))
+	} else if left.isNumber() && right.isNumber() {
+		leftValue := left.toFloat()
+		rightValue := right.toFloat()
+
+		var result float64
 
 		switch op {
 		case bytecode.OpAdd:
@@ -454,43 +951,79 @@ func (vm *VM) executeBinaryOperation(op bytecode.Opcode) error {
 		case bytecode.OpDiv:
 			result = leftValue / rightValue
 		default:
-			return fmt.Errorf("Unsupported operator for integer: %s", op)
+			return operatorError(object.FLOAT_OBJECT, op, object.FLOAT_OBJECT)
 		}
 
-		return vm.push(&object.Integer{Value: result})
+		return vm.push(fromFloat(result))
 	} else if left.Type() == object.STRING_OBJECT && right.Type() == object.STRING_OBJECT {
 		if op != bytecode.OpAdd {
-			return fmt.Errorf("Unsupported operator for string: %s", op)
+			return operatorError(object.STRING_OBJECT, op, object.STRING_OBJECT)
 		}
 
-		leftValue := left.(*object.String).Value
-		rightValue := right.(*object.String).Value
+		leftValue := left.obj.(*object.String).Value
+		rightValue := right.obj.(*object.String).Value
 
-		return vm.push(&object.String{Value: leftValue + rightValue})
+		result := &object.String{Value: leftValue + rightValue}
+		if err := vm.budget.Allocate(result); err != nil {
+			return err
+		}
+		return vm.push(Value{obj: result})
 	} else {
-		return fmt.Errorf("Unsupported types for binary operation: %s %s", left.Type(), right.Type())
+		return operatorError(left.Type(), op, right.Type())
+	}
+}
+
+// Helper method to execute + and - with a constant right operand
+// Integers are computed in place, anything else goes through executeBinaryOperation for the same results and errors
+func (vm *VM) executeConstantOperation(op bytecode.Opcode, constant Value) error {
+	left := &vm.stack[vm.stackPointer-1]
+
+	operation := bytecode.OpSub
+	if op == bytecode.OpAddConstant {
+		operation = bytecode.OpAdd
+	}
+
+	if left.kind == integerValue && constant.kind == integerValue {
+		var result int64
+		var ok bool
+		if operation == bytecode.OpAdd {
+			result, ok = object.CheckedAdd(left.integer(), constant.integer())
+		} else {
+			result, ok = object.CheckedSub(left.integer(), constant.integer())
+		}
+
+		if ok || !vm.checked {
+			*left = fromInteger(result)
+			return nil
+		}
+	}
+
+	err := vm.push(constant)
+	if err != nil {
+		return err
 	}
+	return vm.executeBinaryOperation(operation)
 }
 
 // Get last popped element (for debugging)
 func (vm *VM) LastPopped() object.Object {
-	return vm.stack[vm.stackPointer]
+	return vm.stack[vm.stackPointer].toObject()
 }
 
 // Push to stack
-func (vm *VM) push(o object.Object) error {
+func (vm *VM) push(v Value) error {
 	if vm.stackPointer >= stackCapacity {
-		return fmt.Errorf("Stack overflow")
+		return object.BuildError(object.STACK_OVERFLOW_ERROR, "stack overflow")
 	}
 
-	vm.stack[vm.stackPointer] = o
+	vm.stack[vm.stackPointer] = v
 	vm.stackPointer++
 	return nil
 }
 
 // Pop from stack
-func (vm *VM) pop() object.Object {
-	o := vm.stack[vm.stackPointer-1]
+func (vm *VM) pop() Value {
+	v := vm.stack[vm.stackPointer-1]
 	vm.stackPointer--
-	return o
+	return v
 }
@@ -1,268 +1,320 @@
 package vm
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"go_interpreter/ast"
 	"go_interpreter/compiler"
+	"go_interpreter/evaluator"
 	"go_interpreter/lexer"
 	"go_interpreter/object"
 	"go_interpreter/parser"
+	"go_interpreter/regvm"
+	"go_interpreter/vmtest"
+	"strings"
+	"sync"
 	"testing"
 )
 
-type testCase struct {
-	input    string
-	expected interface{}
+func TestVM(t *testing.T) {
+	// Optimized bytecode must give the same results and errors
+	for _, optimize := range []bool{false, true} {
+		t.Run(fmt.Sprintf("optimize=%t", optimize), func(t *testing.T) {
+			vmtest.Run(t, runner(optimize))
+
+			// Strings joined from constants are made at run time, so they count against the memory limit too
+			input := `"` + strings.Repeat("a", 600) + `" + "` + strings.Repeat("b", 600) + `"`
+			_, err := runner(optimize)(context.Background(), input, object.Limits{MaxMemory: 1000}, false)
+			var runtimeError *object.Error
+			if assert.True(t, errors.As(err, &runtimeError)) {
+				assert.Equal(t, object.MEMORY_LIMIT_ERROR, runtimeError.Kind)
+			}
+		})
+	}
 }
 
-func TestIntegerArithmetic(t *testing.T) {
-	tests := []testCase{
-		{"1", 1},
-		{"2", 2},
-		{"1+2", 3},
-		{"3-5", -2},
-		{"8*9", 72},
-		{"4/3", 1},
-		{"(3 + 9)*2", 24},
-		{"2 * (3 + 9)", 24},
-		{"3 + 9 * 2", 21},
-		{"-5", -5},
-		{"-3 + 9", 6},
-		{"(15/-3) + 7", 2},
+func TestSpecializedOpcodes(t *testing.T) {
+	// Opcodes specialised by -O give the general opcodes' results for anything but integers
+	tests := []vmtest.Case{
+		{Input: "let f = fn(a, b, c) { a + b + c - 1 }; f(1, 2, 3)", Expected: 5},
+		{Input: "let f = fn(x) { x + 1 }; f(1.5)", Expected: 2.5},
+		{Input: `let f = fn(x) { if (x == "a") { 1 } else { 2 } }; f("a") + f("b")`, Expected: 3},
+		{Input: "let f = fn(x) { if (x > 1.5) { 1 } else { 2 } }; f(2)", Expected: 1},
+		{Input: "let f = fn(x) { if (x != true) { 1 } else { 2 } }; f(true)", Expected: 2},
+		{Input: "let i = 0; while (i != 300) { i = i + 1 }; i", Expected: 300},
 	}
 
-	testVM(t, tests)
-}
+	for _, optimize := range []bool{false, true} {
+		vmtest.RunCases(t, runner(optimize), tests)
+	}
 
-func TestBoolean(t *testing.T) {
-	tests := []testCase{
-		{"true", true},
-		{"false", false},
-		{"1 < 2", true},
-		{"1 > 2", false},
-		{"1 == 1", true},
-		{"2 != 3", true},
-		{"true == true", true},
-		{"true != false", true},
-		{"!5", false},
-		{"!!true", true},
-		{"!!false", false},
-		{"!(if (false) { 5; })", true},
+	// Errors point at the operator, like without -O
+	input := `let f = fn(x) {
+  x - 1
+};
+f("a")`
+
+	errs := []string{}
+	for _, optimize := range []bool{false, true} {
+		_, err := runner(optimize)(context.Background(), input, object.Limits{}, false)
+		assert.NotNil(t, err)
+		errs = append(errs, err.Error())
 	}
 
-	testVM(t, tests)
+	assert.Equal(t, errs[0], errs[1])
+	assert.Contains(t, errs[1], "at f (2:3)")
 }
 
-func TestConditional(t *testing.T) {
-	tests := []testCase{
-		{"if (true) { 10 }", 10},
-		{"if (true) { 10 } else { 20 }", 10},
-		{"if (1 < 2) { 10 } else { 20 }", 10},
-		{"if (1 > 2) { 10 } else { 20 }", 20},
-		{"if (1 > 2) { 10 }", Null},
-		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+func TestConcurrentVMs(t *testing.T) {
+	// Bytecode is never changed by running it, so many VMs can share it (run with -race)
+	input := `let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } };
+let fibs = [];
+let i = 0; while (i != 10) { fibs = push(fibs, fib(i)); i = i + 1 };
+[fib(15), "s" + "t", fibs]`
+
+	c := compiler.BuildCompiler()
+	c.SetOptimize(true)
+	err := c.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("Compiler error: %s", err)
+	}
+	bytecode := c.Bytecode()
+
+	results := make([]string, 50)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vm := BuildVM(bytecode)
+			err := vm.Run()
+			if err == nil {
+				results[i] = vm.LastPopped().Inspect()
+			}
+		}(i)
 	}
+	wg.Wait()
 
-	testVM(t, tests)
+	for _, result := range results {
+		assert.Equal(t, "[610, st, [0, 1, 1, 2, 3, 5, 8, 13, 21, 34]]", result)
+	}
 }
 
-func TestGlobalLet(t *testing.T) {
-	tests := []testCase{
-		{"let one = 1; one", 1},
-		{"let one = 1; let two = 2; one + two", 3},
-		{"let one = 1; let two = one + one; one + two", 3},
-	}
+func TestNumbersDoNotAllocate(t *testing.T) {
+	// Allocations come from building the VM, so they don't grow with the number of operations and calls
+	allocations := func(n int) float64 {
+		input := fmt.Sprintf(`let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } };
+let f = fn(n) { let i = 0; let sum = 0.5; while (i < n) { i = i + 1; let sum = sum * 1.0 + 1; } -sum };
+fib(%d) + f(%d) == 0`, n, n)
 
-	testVM(t, tests)
-}
+		c := compiler.BuildCompiler()
+		err := c.Compile(parse(input))
+		if err != nil {
+			t.Fatalf("Compiler error: %s", err)
+		}
+		bytecode := c.Bytecode()
 
-func TestString(t *testing.T) {
-	tests := []testCase{
-		{`"foo"`, "foo"},
-		{`"foo" + "bar"`, "foobar"},
+		return testing.AllocsPerRun(5, func() {
+			BuildVM(bytecode).Run()
+		})
 	}
 
-	testVM(t, tests)
+	// fib(20) makes thousands more calls than fib(5); allow for the runtime's own bookkeeping
+	assert.InDelta(t, allocations(5), allocations(20), 1)
 }
 
-func TestArray(t *testing.T) {
-	tests := []testCase{
-		{"[]", []int{}},
-		{"[1,2,3]", []int{1, 2, 3}},
-		{"[1 + 2, 3 * 4, 5 - 6]", []int{3, 12, -1}},
-	}
+func TestDecodedBytecode(t *testing.T) {
+	input := `let f = fn(x) { x / 0 };
+let g = fn(xs) { f(first(xs)) + 0 };
+g([1, 2]);`
 
-	testVM(t, tests)
-}
+	c := compiler.BuildCompiler()
+	err := c.Compile(parser.BuildParser(lexer.BuildFileLexer("div.mk", input)).ParseProgram())
+	if err != nil {
+		t.Fatalf("Compiler error: %s", err)
+	}
 
-func TestHash(t *testing.T) {
-	tests := []testCase{
-		{
-			"{}",
-			map[object.HashKey]int64{}},
-		{
-			"{1: 2, 3+4:5*6}",
-			map[object.HashKey]int64{
-				(&object.Integer{Value: 1}).HashKey(): 2,
-				(&object.Integer{Value: 7}).HashKey(): 30,
-			},
-		},
+	data, err := c.Bytecode().Encode()
+	assert.Nil(t, err)
+	decoded, err := compiler.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode error: %s", err)
 	}
 
-	testVM(t, tests)
+	// Same error and stack trace as the bytecode that was never written out
+	expected := BuildVM(c.Bytecode()).Run()
+	actual := BuildVM(decoded).Run()
+	assert.NotNil(t, actual)
+	assert.Equal(t, expected.Error(), actual.Error())
+	assert.Contains(t, actual.Error(), "at g (div.mk:2:18)")
 }
 
-func TestIndex(t *testing.T) {
-	tests := []testCase{
-		{"[1,2,3][1]", 2},
-		{"[1,2,3][10-9]", 2},
-		{"[[1,1,1]][0][0]", 1},
-		{"[1,2,3][9*11]", Null},
-	}
+// Helper method to build a vmtest.Runner for the VM, optimizing the bytecode if asked
+func runner(optimize bool) vmtest.Runner {
+	return func(ctx context.Context, input string, limits object.Limits, checked bool) (object.Object, error) {
+		c := compiler.BuildCompiler()
+		c.SetOptimize(optimize)
+		err := c.Compile(parse(input))
+		if err != nil {
+			return nil, err
+		}
 
-	testVM(t, tests)
-}
+		// Everything the compiler makes must pass the checks bytecode files get
+		bytecode := c.Bytecode()
+		err = bytecode.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid bytecode: %w", err)
+		}
 
-func TestCallFunction(t *testing.T) {
-	tests := []testCase{
-		{
-			"let foo = fn() { 5 + 10;}; foo();",
-			15,
-		},
-		{
-			"let foo = fn() {return 99; 100;}; foo();",
-			99,
-		},
-		{
-			"let foo = fn() {}; foo();",
-			Null,
-		},
-		{
-			"let foo = fn() {1;}; let bar = fn() {foo;}; bar()();",
-			1,
-		},
-		{
-			"let foo = fn() { let one = 1; let two = 2; one + two; }; foo();",
-			3,
-		},
-		{
-			"let sum = fn(a, b) { a + b; }; sum(1,2);",
-			3,
-		},
+		vm := BuildVM(bytecode)
+		vm.SetCheckOverflow(checked)
+		err = vm.RunContext(ctx, limits)
+		if err != nil {
+			return nil, err
+		}
+		return vm.LastPopped(), nil
 	}
-
-	testVM(t, tests)
 }
 
-func TestBuiltin(t *testing.T) {
-	tests := []testCase{
-		{`len("four")`, 4},
-		{"len([1,2,3])", 3},
+// Invalid programs must produce errors, never Go panics, in the parser and every engine
+// Programs that run to the end must give the same results and errors in every engine
+// Run with: go test ./vm -fuzz FuzzRun
+func FuzzRun(f *testing.F) {
+	seeds := []string{
+		"1 + 2 * 3",
+		`let a = [1, "two", 3.0]; a[1] = {true: fn(x) { x }}; a`,
+		"let f = fn(x) { if (x > 1) { f(x - 1) } else { x } }; f(10)",
+		"for (x in {1: 2, 3: 4}) { if (x == 3) { break; } }",
+		`1 == "a"`,
+		"[1, 2][true]",
+		"first([]) + 1",
+		"let x = if (true) { let y = 1 }; x + 1",
+		"return 5; 6",
+		"let f = fn() { return; }; f()",
+		"fn(a, b) { a }(1)",
+		"(-9223372036854775807 - 1) / -1",
+		"let = 5; x[",
+		"{[]: 1}",
+		"len(first)",
+		`let f = fn(n, s) { if (n == 0) { s } else { f(n - 1, s + "a") } }; f(3, "")`,
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
 	}
 
-	testVM(t, tests)
-}
+	f.Fuzz(func(t *testing.T, input string) {
+		p := parser.BuildParser(lexer.BuildLexer(input))
+		prog := p.ParseProgram()
+		if len(p.Errors()) != 0 {
+			return
+		}
 
-func testVM(t *testing.T, tests []testCase) {
-	for _, test := range tests {
-		prog := parse(test.input)
+		// Programs can loop forever, so stop them after a while
+		evaluated := evaluator.EvalContext(context.Background(), prog, object.BuildEnvironment(), fuzzLimits)
+		evalErr, ok := evaluated.(*object.Error)
+		if ok && evalErr.Kind == object.INTERNAL_ERROR {
+			t.Fatalf("Evaluator bug for %q: %s", input, evalErr.Message)
+		}
 
 		c := compiler.BuildCompiler()
-		err := c.Compile(prog)
-		if err != nil {
-			t.Fatalf("Compiler error: %s", err)
+		if c.Compile(prog) != nil {
+			return
 		}
 
 		vm := BuildVM(c.Bytecode())
-		err = vm.Run()
-		if err != nil {
-			t.Fatalf("VM error: %s", err)
+		err := vm.RunContext(context.Background(), fuzzLimits)
+		var errObj *object.Error
+		if errors.As(err, &errObj) && errObj.Kind == object.INTERNAL_ERROR {
+			t.Fatalf("VM bug for %q: %s", input, errObj.Message)
 		}
 
-		lastPopped := vm.LastPopped()
-		testExpectedObject(t, test.expected, lastPopped)
-	}
-}
+		// Optimized bytecode has to behave the same
+		optimizedCompiler := compiler.BuildCompiler()
+		optimizedCompiler.SetOptimize(true)
+		if optimizedCompiler.Compile(prog) != nil {
+			t.Fatalf("Only optimized compile failed for %q", input)
+		}
 
-func parse(input string) *ast.Program {
-	l := lexer.BuildLexer(input)
-	p := parser.BuildParser(l)
-	return p.ParseProgram()
-}
+		optimizedVM := BuildVM(optimizedCompiler.Bytecode())
+		optimizedErr := optimizedVM.RunContext(context.Background(), fuzzLimits)
+		expected := lastPopped(vm, err)
+		compareRuns(t, input, "Optimized run", expected, err, lastPopped(optimizedVM, optimizedErr), optimizedErr)
 
-func testExpectedObject(t *testing.T, expected interface{}, actual object.Object) {
-	switch expected := expected.(type) {
-	case int:
-		testIntegerObject(t, int64(expected), actual)
-	case bool:
-		testBooleanObject(t, bool(expected), actual)
-	case string:
-		testStringObject(t, string(expected), actual)
-	case []int:
-		testArrayObject(t, expected, actual)
-	case map[object.HashKey]int64:
-		testHashObject(t, expected, actual)
-	case *object.Null:
-		if actual != Null {
-			t.Fatalf("Expected null, but actual is not")
+		// So does the register VM
+		registerCompiler := regvm.BuildCompiler()
+		if registerCompiler.Compile(prog) != nil {
+			t.Fatalf("Only register compile failed for %q", input)
 		}
-	}
-}
 
-func testIntegerObject(t *testing.T, expected int64, actual object.Object) {
-	result, ok := actual.(*object.Integer)
-	if !ok {
-		t.Fatalf("Object is not an integer %s", actual)
-	}
+		registerVM := regvm.BuildVM(registerCompiler.Bytecode())
+		registerErr := registerVM.RunContext(context.Background(), fuzzLimits)
+		if errors.As(registerErr, &errObj) && errObj.Kind == object.INTERNAL_ERROR {
+			t.Fatalf("Register VM bug for %q: %s", input, errObj.Message)
+		}
+		compareRuns(t, input, "Register VM run", expected, err, lastPopped(registerVM, registerErr), registerErr)
 
-	assert.Equal(t, result.Value, expected)
+		// And the evaluator, which returns errors as values
+		if evalErr != nil {
+			compareRuns(t, input, "Evaluator run", expected, err, nil, evalErr)
+		} else {
+			compareRuns(t, input, "Evaluator run", expected, err, evaluated, nil)
+		}
+	})
 }
 
-func testBooleanObject(t *testing.T, expected bool, actual object.Object) {
-	result, ok := actual.(*object.Boolean)
-	if !ok {
-		t.Fatalf("Object is not a boolean")
+// Helper method to check that a run gives the result or error expected from the stack VM
+// Engines run different numbers of steps, so a run that hit the step limit is compared with nothing
+func compareRuns(t *testing.T, input string, name string, expected object.Object, expectedErr error, actual object.Object, actualErr error) {
+	if isStepLimit(expectedErr) || isStepLimit(actualErr) {
+		return
+	}
+	if (expectedErr == nil) != (actualErr == nil) {
+		t.Fatalf("%s of %q: error %v, expected %v", name, input, actualErr, expectedErr)
+	}
+	if expectedErr != nil {
+		assert.Equal(t, expectedErr.(*object.Error).Message, actualErr.(*object.Error).Message, input)
+		return
 	}
 
-	assert.Equal(t, result.Value, expected)
+	// Engines leave different things behind after statements, so only scalar results are compared
+	if isScalar(expected) && isScalar(actual) {
+		assert.Equal(t, expected.Inspect(), actual.Inspect(), input)
+	}
 }
 
-func testStringObject(t *testing.T, expected string, actual object.Object) {
-	result, ok := actual.(*object.String)
-	if !ok {
-		t.Fatalf("Object is not a string")
+// Helper method to get what a VM left behind, which is only there if it ran without errors
+func lastPopped(vm interface{ LastPopped() object.Object }, err error) object.Object {
+	if err != nil {
+		return nil
 	}
-
-	assert.Equal(t, result.Value, expected)
+	return vm.LastPopped()
 }
 
-func testArrayObject(t *testing.T, expected []int, actual object.Object) {
-	result, ok := actual.(*object.Array)
-	if !ok {
-		t.Fatalf("Object is not an array")
+func isScalar(obj object.Object) bool {
+	if obj == nil {
+		return false
 	}
 
-	assert.Equal(t, len(result.Elements), len(expected))
-
-	for i, e := range expected {
-		testIntegerObject(t, int64(e), result.Elements[i])
+	switch obj.Type() {
+	case object.INTEGER_OBJECT, object.FLOAT_OBJECT, object.STRING_OBJECT, object.BOOLEAN_OBJECT, object.NULL_OBJECT:
+		return true
+	default:
+		return false
 	}
 }
 
-func testHashObject(t *testing.T, expected map[object.HashKey]int64, actual object.Object) {
-	result, ok := actual.(*object.Hash)
-	if !ok {
-		t.Fatalf("Object is not a hashmap")
-	}
-
-	assert.Equal(t, len(result.Pairs), len(expected))
+// Limits for fuzzed programs, which can loop forever
+var fuzzLimits = object.Limits{MaxSteps: 100000}
 
-	for expectedKey, expectedValue := range expected {
-		pair, ok := result.Pairs[expectedKey]
-		if !ok {
-			t.Fatalf("Key record doesn't exist in hashmap")
-		}
+func isStepLimit(err error) bool {
+	var runtimeError *object.Error
+	return errors.As(err, &runtimeError) && runtimeError.Kind == object.STEP_LIMIT_ERROR
+}
 
-		testIntegerObject(t, expectedValue, pair.Value)
-	}
+func parse(input string) *ast.Program {
+	l := lexer.BuildLexer(input)
+	p := parser.BuildParser(l)
+	return p.ParseProgram()
 }
@@ -0,0 +1,717 @@
+// Test cases shared by the stack VM (vm) and the register VM (regvm), which must give the same results and errors
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"go_interpreter/object"
+	"math"
+	"testing"
+	"time"
+)
+
+// Compiles and runs input on one VM, returning the value it left behind
+// checked turns on checked arithmetic for the run
+type Runner func(ctx context.Context, input string, limits object.Limits, checked bool) (object.Object, error)
+
+// Program and the value it should leave behind
+type Case struct {
+	Input    string
+	Expected interface{}
+}
+
+// Runs every shared test against a VM
+func Run(t *testing.T, run Runner) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, run Runner)
+	}{
+		{"IntegerArithmetic", testIntegerArithmetic},
+		{"FloatArithmetic", testFloatArithmetic},
+		{"Boolean", testBoolean},
+		{"Conditional", testConditional},
+		{"TopLevelReturn", testTopLevelReturn},
+		{"InvalidOperands", testInvalidOperands},
+		{"GlobalLet", testGlobalLet},
+		{"String", testString},
+		{"Array", testArray},
+		{"Hash", testHash},
+		{"Index", testIndex},
+		{"CallFunction", testCallFunction},
+		{"Closure", testClosure},
+		{"RecursiveFunction", testRecursiveFunction},
+		{"While", testWhile},
+		{"For", testFor},
+		{"Assign", testAssign},
+		{"RuntimeError", testRuntimeError},
+		{"ErrorKinds", testErrorKinds},
+		{"ErrorMessages", testErrorMessages},
+		{"CheckedArithmetic", testCheckedArithmetic},
+		{"Builtin", testBuiltin},
+		{"TailCall", testTailCall},
+		{"Limits", testLimits},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) { test.test(t, run) })
+	}
+}
+
+func testIntegerArithmetic(t *testing.T, run Runner) {
+	tests := []Case{
+		{"1", 1},
+		{"2", 2},
+		{"1+2", 3},
+		{"3-5", -2},
+		{"8*9", 72},
+		{"4/3", 1},
+		{"(3 + 9)*2", 24},
+		{"2 * (3 + 9)", 24},
+		{"3 + 9 * 2", 21},
+		{"-5", -5},
+		{"-3 + 9", 6},
+		{"(15/-3) + 7", 2},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testFloatArithmetic(t *testing.T, run Runner) {
+	tests := []Case{
+		{"3.14", 3.14},
+		{"1e-9", 1e-9},
+		{"1.5 + 1.5", 3.0},
+		{"1.5 * 2", 3.0},
+		{"2 - 0.5", 1.5},
+		{"7 / 2.0", 3.5},
+		{"-2.5", -2.5},
+		{"-2.5 + 1", -1.5},
+		{"1.0 / 0", math.Inf(1)},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testBoolean(t *testing.T, run Runner) {
+	tests := []Case{
+		{"true", true},
+		{"false", false},
+		{"1 < 2", true},
+		{"1 > 2", false},
+		{"1 == 1", true},
+		{"2 != 3", true},
+		{"true == true", true},
+		{"true != false", true},
+		{"!5", false},
+		{"!!true", true},
+		{"!!false", false},
+		{"!(if (false) { 5; })", true},
+		{"1.5 < 2", true},
+		{"2 > 1.5", true},
+		{"1 == 1.0", true},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.5 != 2.5", false},
+		{"1 == true", false},
+		// == and != take any two values, comparing numbers and strings by value and anything else by identity
+		{`"a" == "a"`, true},
+		{`"a" != "b"`, true},
+		{`1 == "a"`, false},
+		{`1 != "a"`, true},
+		{"true == 1", false},
+		{"[1] == [1]", false},
+		{"let a = [1]; a == a", true},
+		// Operands are evaluated left to right
+		{"let x = 0; let f = fn() { x = x + 1; x }; let g = fn() { x = x * 10; x }; f() < g()", true},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testConditional(t *testing.T, run Runner) {
+	tests := []Case{
+		{"if (true) { 10 }", 10},
+		{"if (true) { 10 } else { 20 }", 10},
+		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (1 > 2) { 10 } else { 20 }", 20},
+		{"if (1 > 2) { 10 }", object.NULL},
+		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testTopLevelReturn(t *testing.T, run Runner) {
+	tests := []Case{
+		{"return 10;", 10},
+		{"return 10; 9;", 10},
+		{"9; return 2*5; 8;", 10},
+		{"if (10 > 1) { if (10 > 1) { return 10; } return 1; }", 10},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testInvalidOperands(t *testing.T, run Runner) {
+	tests := []Case{
+		{`1 == "a"`, false},
+		{`"a" != 1`, true},
+		{"first([])", object.NULL},
+		{"let x = if (true) { let y = 1 }; x", object.NULL},
+	}
+
+	RunCases(t, run, tests)
+
+	testError(t, run, "[1, 2][true]", object.TYPE_ERROR)
+	testError(t, run, "first([]) + 1", object.TYPE_ERROR)
+}
+
+func testGlobalLet(t *testing.T, run Runner) {
+	tests := []Case{
+		{"let one = 1; one", 1},
+		{"let one = 1; let two = 2; one + two", 3},
+		{"let one = 1; let two = one + one; one + two", 3},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testString(t *testing.T, run Runner) {
+	tests := []Case{
+		{`"foo"`, "foo"},
+		{`"foo" + "bar"`, "foobar"},
+		{`"foo" == "fo" + "o"`, true},
+		{`let a = "x"; let b = "x"; a != b`, false},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testArray(t *testing.T, run Runner) {
+	tests := []Case{
+		{"[]", []int{}},
+		{"[1,2,3]", []int{1, 2, 3}},
+		{"[1 + 2, 3 * 4, 5 - 6]", []int{3, 12, -1}},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testHash(t *testing.T, run Runner) {
+	tests := []Case{
+		{
+			"{}",
+			map[object.HashKey]int64{}},
+		{
+			"{1: 2, 3+4:5*6}",
+			map[object.HashKey]int64{
+				(&object.Integer{Value: 1}).HashKey(): 2,
+				(&object.Integer{Value: 7}).HashKey(): 30,
+			},
+		},
+		{
+			"{1.5: 1, 0.5 + 0.5: 2}",
+			map[object.HashKey]int64{
+				(&object.Float{Value: 1.5}).HashKey(): 1,
+				(&object.Float{Value: 1}).HashKey():   2,
+			},
+		},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testIndex(t *testing.T, run Runner) {
+	tests := []Case{
+		{"[1,2,3][1]", 2},
+		{"[1,2,3][10-9]", 2},
+		{"[[1,1,1]][0][0]", 1},
+		{"[1,2,3][9*11]", object.NULL},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testCallFunction(t *testing.T, run Runner) {
+	tests := []Case{
+		{
+			"let foo = fn() { 5 + 10;}; foo();",
+			15,
+		},
+		{
+			"let foo = fn() {return 99; 100;}; foo();",
+			99,
+		},
+		{
+			"let foo = fn() {}; foo();",
+			object.NULL,
+		},
+		{
+			"let foo = fn() {1;}; let bar = fn() {foo;}; bar()();",
+			1,
+		},
+		{
+			"let foo = fn() { let one = 1; let two = 2; one + two; }; foo();",
+			3,
+		},
+		{
+			"let sum = fn(a, b) { a + b; }; sum(1,2);",
+			3,
+		},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testClosure(t *testing.T, run Runner) {
+	tests := []Case{
+		{
+			"let adder = fn(a) { fn(b) { a + b } }; let addTwo = adder(2); addTwo(3);",
+			5,
+		},
+		{
+			"let f = fn(a) { fn(b) { fn(c) { a + b + c } } }; f(1)(2)(3);",
+			6,
+		},
+		{
+			"let g = 10; let f = fn() { let a = 1; fn(b) { let c = 3; g + a + b + c } }; f()(2);",
+			16,
+		},
+		{
+			"let f = fn(a, b) { let one = fn() { a }; let two = fn() { b }; fn() { one() + two() } }; f(4, 5)();",
+			9,
+		},
+		{
+			"let counters = fn(x) { [fn() { x }, fn() { x + 1 }] }; let c = counters(7); c[0]() + c[1]();",
+			15,
+		},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testRecursiveFunction(t *testing.T, run Runner) {
+	tests := []Case{
+		{
+			"let countDown = fn(x) { if (x == 0) { return 0; } else { countDown(x - 1); } }; countDown(3);",
+			0,
+		},
+		{
+			`let wrapper = fn() {
+				let fib = fn(x) { if (x < 2) { x } else { fib(x - 1) + fib(x - 2) } };
+				fib(15)
+			};
+			wrapper();`,
+			610,
+		},
+		{
+			`let parity = fn(n) {
+				let isEven = fn(x) { if (x == 0) { true } else { isOdd(x - 1) } };
+				let isOdd = fn(x) { if (x == 0) { false } else { isEven(x - 1) } };
+				[isEven(n), isOdd(n)]
+			};
+			let result = parity(7);
+			if (result[0]) { 0 } else { if (result[1]) { 1 } else { 2 } }`,
+			1,
+		},
+		{
+			`let outer = fn(n) {
+				let ping = fn(x) { let step = fn() { pong(x - 1) }; if (x == 0) { 0 } else { step() } };
+				let pong = fn(x) { if (x == 0) { 1 } else { ping(x - 1) } };
+				ping(n)
+			};
+			outer(5) + outer(4);`,
+			1,
+		},
+		// Functions can call functions defined later in the block, whatever comes between them
+		{
+			"let a = fn(n) { if (n == 0) { 0 } else { b(n - 1) } }; let x = 1; let b = fn(n) { a(n) + x }; a(3);",
+			3,
+		},
+		{
+			`let wrapper = fn() {
+				let a = fn(n) { if (n == 0) { 0 } else { b(n - 1) } };
+				let x = 1;
+				let b = fn(n) { a(n) + x };
+				a(3)
+			};
+			wrapper();`,
+			3,
+		},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testWhile(t *testing.T, run Runner) {
+	tests := []Case{
+		{"let f = fn() { while (false) { 1 } }; f();", object.NULL},
+		{"let f = fn(n) { let i = 0; while (i < n) { let i = i + 1; } i }; f(5000);", 5000},
+		{"let f = fn() { let i = 0; while (true) { let i = i + 1; if (i > 9) { break; } } i }; f();", 10},
+		{
+			`let f = fn() {
+				let i = 0; let sum = 0;
+				while (i < 10) {
+					let i = i + 1;
+					if (i == 5) { continue; }
+					let sum = sum + i;
+				}
+				sum
+			};
+			f();`,
+			50,
+		},
+		{"let i = 0; while (i < 3) { let i = i + 1; } i;", 3},
+		{"let f = fn() { while (true) { return 7; } }; f();", 7},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testFor(t *testing.T, run Runner) {
+	tests := []Case{
+		{"let sum = 0; for (x in [1, 2, 3]) { let sum = sum + x; } sum;", 6},
+		{"let keys = []; for (k in {3: 0, 1: 0, 2: 0}) { let keys = push(keys, k); } keys;", []int{1, 2, 3}},
+		{"let last = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { break; } let last = x; } last;", 2},
+		{"let sum = 0; for (x in [1, 2, 3, 4]) { if (x == 3) { continue; } let sum = sum + x; } sum;", 7},
+		{
+			`let count = 0;
+			for (x in [1, 2, 3]) {
+				for (y in [1, 2, 3]) {
+					if (y > x) { break; }
+					let count = count + 1;
+				}
+			}
+			count;`,
+			6,
+		},
+		{
+			`let f = fn(xs) {
+				for (x in xs) {
+					let g = fn() { x * 10 };
+					if (x == 2) { return g(); }
+				}
+			};
+			f([1, 2, 3]);`,
+			20,
+		},
+		{"let f = fn() { for (x in []) { x } }; f();", object.NULL},
+		// The loop variable is one binding per function, so every closure sees its last value
+		{"let f = fn() { let fs = []; for (i in [1, 2, 3]) { let fs = push(fs, fn() { i * 10 }); } fs[0]() + fs[1]() + fs[2](); }; f();", 90},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testAssign(t *testing.T, run Runner) {
+	tests := []Case{
+		{"let x = 1; x = x + 1; x;", 2},
+		{"let x = 1; let y = 1; x = y = 5; x + y;", 10},
+		{"let f = fn() { let i = 0; while (i < 10) { i = i + 1; } i }; f();", 10},
+		{"let total = 0; let add = fn(n) { total = total + n; }; add(3); add(4); total;", 7},
+		{"let make = fn() { let c = 0; fn() { c = c + 1; c } }; let inc = make(); inc(); inc(); inc();", 3},
+		{"let arr = [1, 2, 3]; arr[1] = 20; arr;", []int{1, 20, 3}},
+		{"let arr = [1, 2, 3]; let f = fn(a) { a[0] = 9; }; f(arr); arr[0];", 9},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"];`, 5},
+		{"let arr = [0, 0]; (arr[0] = 4) + 1;", 5},
+		{"let u = fn() { let x = 1; let f = fn() { x }; x = 2; f() }; u();", 2},
+		{"let g = fn() { let c = 0; let inc = fn() { c = c + 1 }; inc(); inc(); c }; g();", 2},
+		// A function calls itself through its variable, so it sees the variable reassigned
+		{"let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; let g = f; f = fn(n) { 99 }; g(2);", 99},
+		{"let w = fn() { let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) } }; let g = f; f = fn(n) { 99 }; g(2) }; w();", 99},
+		{"let f = fn() { f = 1; 2 }; f() + f;", 3},
+		{"let w = fn() { let f = fn() { f = 1; 2 }; f() + f }; w();", 3},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testRuntimeError(t *testing.T, run Runner) {
+	input := `let f = fn(x) {
+  x + "a"
+};
+let g = fn() { f(1) + 0 };
+g();`
+
+	_, err := run(context.Background(), input, object.Limits{}, false)
+
+	var runtimeError *object.Error
+	if !errors.As(err, &runtimeError) {
+		t.Fatalf("Expected object.Error, actual: %T", err)
+	}
+
+	assert.Equal(t, object.TYPE_ERROR, runtimeError.Kind)
+	assert.Equal(t, "type mismatch: INTEGER + STRING", runtimeError.Message)
+	assert.Equal(t, 3, len(runtimeError.Stack))
+
+	expected := "2:3: type mismatch: INTEGER + STRING\n" +
+		"    x + \"a\"\n" +
+		"    ^^^^^^^\n" +
+		"stack trace:\n" +
+		"  at f (2:3)\n" +
+		"  at g (4:16)\n" +
+		"  at <main> (5:1)"
+	assert.Equal(t, expected, err.Error())
+}
+
+func testErrorKinds(t *testing.T, run Runner) {
+	tests := []struct {
+		input        string
+		expectedKind object.ErrorKind
+	}{
+		{"1 + true", object.TYPE_ERROR},
+		{"5()", object.TYPE_ERROR},
+		{"fn(x) { x }()", object.ARITY_ERROR},
+		{`len(1, 2)`, object.ARITY_ERROR},
+		{"let a = [1]; a[5] = 2", object.INDEX_ERROR},
+		{"let f = fn(x) { 1 + f(x) }; f(1)", object.STACK_OVERFLOW_ERROR},
+		{"1 / 0", object.DIVISION_BY_ZERO_ERROR},
+		{"let f = fn(x) { 10 / x }; f(0)", object.DIVISION_BY_ZERO_ERROR},
+		{"if (false) { let b = 1; }; b", object.NAME_ERROR},
+	}
+
+	for _, test := range tests {
+		testError(t, run, test.input, test.expectedKind)
+	}
+}
+
+func testErrorMessages(t *testing.T, run Runner) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+	}{
+		{`"a" > "b"`, "unknown operator: STRING > STRING"},
+		{"(1 == 1) > false", "unknown operator: BOOLEAN > BOOLEAN"},
+		{`"a" - "b"`, "unknown operator: STRING - STRING"},
+		{"true + false", "unknown operator: BOOLEAN + BOOLEAN"},
+		{"1 + true", "type mismatch: INTEGER + BOOLEAN"},
+		{`2.5 * "a"`, "type mismatch: FLOAT * STRING"},
+		{`"a" < "b"`, "unknown operator: STRING < STRING"},
+		{`1 < "a"`, "type mismatch: INTEGER < STRING"},
+		{"-true", "unknown operator: -BOOLEAN"},
+		{"1 / 0", "division by zero"},
+		{"let a = [1]; a[5] = 2", "index out of range: 5"},
+		{"{}[[]]", "unusable as hash key: ARRAY"},
+		{"1[0]", "index operator not supported: INTEGER"},
+		{"5()", "not a function: INTEGER"},
+		{"fn(x) { x }()", "wrong number of arguments: expected=1, actual=0"},
+		{"len(1, 2)", "wrong number of arguments: expected=1, actual=2"},
+		{"if (false) { let b = 1; }; b", "identifier not found: b"},
+		{"let f = fn() { if (false) { let b = 1; }; b }; f()", "identifier not found: b"},
+		{"let f = fn() { let r = g(); let g = fn() { 1 }; r }; f()", "identifier not found: g"},
+		{"let f = fn() { let h = fn() { g() }; let r = h(); let g = fn() { 1 }; r }; f()", "identifier not found: g"},
+		{"let r = g(); let g = fn() { 1 };", "identifier not found: g"},
+	}
+
+	for _, test := range tests {
+		_, err := run(context.Background(), test.input, object.Limits{}, false)
+
+		var runtimeError *object.Error
+		if !errors.As(err, &runtimeError) {
+			t.Fatalf("Expected object.Error for %q, actual: %T", test.input, err)
+		}
+
+		assert.Equal(t, test.expectedMessage, runtimeError.Message, test.input)
+	}
+}
+
+func testCheckedArithmetic(t *testing.T, run Runner) {
+	// Wraps around by default
+	RunCases(t, run, []Case{{"9223372036854775807 + 1", math.MinInt64}})
+
+	checked := func(ctx context.Context, input string, limits object.Limits, _ bool) (object.Object, error) {
+		return run(ctx, input, limits, true)
+	}
+
+	inputs := []string{
+		"9223372036854775807 + 1",
+		"-9223372036854775807 - 2",
+		"4611686018427387904 * 2",
+		"-(-9223372036854775807 - 1)",
+		"(-9223372036854775807 - 1) / -1",
+	}
+
+	for _, input := range inputs {
+		testError(t, checked, input, object.OVERFLOW_ERROR)
+	}
+
+	RunCases(t, checked, []Case{{"9223372036854775806 + 1", math.MaxInt64}})
+}
+
+func testBuiltin(t *testing.T, run Runner) {
+	tests := []Case{
+		{`len("four")`, 4},
+		{"len([1,2,3])", 3},
+	}
+
+	RunCases(t, run, tests)
+}
+
+func testTailCall(t *testing.T, run Runner) {
+	tests := []Case{
+		{"let loop = fn(n) { if (n == 0) { 0 } else { loop(n - 1) } }; loop(1000000)", 0},
+		{"let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; sum(1000000, 0)", 500000500000},
+		{
+			"let even = fn(n) { if (n == 0) { true } else { odd(n - 1) } }; " +
+				"let odd = fn(n) { if (n == 0) { false } else { even(n - 1) } }; even(1000001)",
+			false,
+		},
+		{"let f = fn(xs) { len(xs) }; f([1, 2])", 2},
+		{"let f = fn(x) { x * 2 }; let g = fn(x) { f(x + 1) }; g(2) + 1", 7},
+	}
+
+	RunCases(t, run, tests)
+
+	// Tail calls still check their arguments
+	testError(t, run, "let f = fn(x) { x }; let g = fn() { f() }; g()", object.ARITY_ERROR)
+}
+
+func testLimits(t *testing.T, run Runner) {
+	loop := "while (true) { }"
+	tailRecursion := "let f = fn(n) { f(n + 1) }; f(0)"
+	recursion := "let f = fn(n) { 1 + f(n + 1) }; f(0)"
+
+	testLimitError(t, run, context.Background(), loop, object.Limits{MaxSteps: 1000}, object.STEP_LIMIT_ERROR)
+	testLimitError(t, run, context.Background(), tailRecursion, object.Limits{Timeout: 10 * time.Millisecond}, object.TIMEOUT_ERROR)
+	testLimitError(t, run, context.Background(), recursion, object.Limits{MaxCallDepth: 10}, object.CALL_DEPTH_ERROR)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	testLimitError(t, run, ctx, loop, object.Limits{}, object.CANCELLED_ERROR)
+
+	// Strings, arrays and hashes count against the memory limit
+	memory := object.Limits{MaxMemory: 1 << 20}
+	testLimitError(t, run, context.Background(), `let s = "ab"; while (true) { s = s + s }`, memory, object.MEMORY_LIMIT_ERROR)
+	testLimitError(t, run, context.Background(), "let a = []; while (true) { a = push(a, 1) }", memory, object.MEMORY_LIMIT_ERROR)
+	testLimitError(t, run, context.Background(), "while (true) { [1, 2, 3]; {1: 2} }", memory, object.MEMORY_LIMIT_ERROR)
+	testLimitError(t, run, context.Background(), "let h = {}; let i = 0; while (true) { h[i] = i; i = i + 1; }", memory, object.MEMORY_LIMIT_ERROR)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	testLimitError(t, run, ctx, tailRecursion, object.Limits{}, object.TIMEOUT_ERROR)
+
+	// Programs within their limits run as usual
+	input := `let f = fn(n) { if (n == 0) { 0 } else { 1 + f(n - 1) } }; f(len("a" + "b") * 5)`
+	limits := object.Limits{MaxSteps: 1000, MaxCallDepth: 11, Timeout: time.Minute, MaxMemory: 1000}
+	result, err := run(context.Background(), input, limits, false)
+	assert.Nil(t, err)
+	ExpectObject(t, 10, result)
+}
+
+// Runs programs that should succeed and checks the values they leave behind
+func RunCases(t *testing.T, run Runner, tests []Case) {
+	for _, test := range tests {
+		result, err := run(context.Background(), test.Input, object.Limits{}, false)
+		if err != nil {
+			t.Fatalf("VM error for %q: %s", test.Input, err)
+		}
+
+		ExpectObject(t, test.Expected, result)
+	}
+}
+
+// Helper method to run a program that should fail with an error of the given kind
+func testError(t *testing.T, run Runner, input string, expectedKind object.ErrorKind) {
+	testLimitError(t, run, context.Background(), input, object.Limits{}, expectedKind)
+}
+
+func testLimitError(t *testing.T, run Runner, ctx context.Context, input string, limits object.Limits, expectedKind object.ErrorKind) {
+	_, err := run(ctx, input, limits, false)
+
+	var runtimeError *object.Error
+	if !errors.As(err, &runtimeError) {
+		t.Fatalf("Expected object.Error for %q, actual: %T", input, err)
+	}
+
+	assert.Equal(t, expectedKind, runtimeError.Kind, input)
+}
+
+// Checks a value left behind by a program
+// expected is an int, float64, bool, string, []int of integers, map of hash keys to integers or object.NULL
+func ExpectObject(t *testing.T, expected interface{}, actual object.Object) {
+	switch expected := expected.(type) {
+	case int:
+		testIntegerObject(t, int64(expected), actual)
+	case float64:
+		testFloatObject(t, expected, actual)
+	case bool:
+		testBooleanObject(t, bool(expected), actual)
+	case string:
+		testStringObject(t, string(expected), actual)
+	case []int:
+		testArrayObject(t, expected, actual)
+	case map[object.HashKey]int64:
+		testHashObject(t, expected, actual)
+	case *object.Null:
+		if actual != object.NULL {
+			t.Fatalf("Expected null, but actual is not")
+		}
+	}
+}
+
+func testIntegerObject(t *testing.T, expected int64, actual object.Object) {
+	result, ok := actual.(*object.Integer)
+	if !ok {
+		t.Fatalf("Object is not an integer %s", actual)
+	}
+
+	assert.Equal(t, result.Value, expected)
+}
+
+func testFloatObject(t *testing.T, expected float64, actual object.Object) {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		t.Fatalf("Object is not a float %s", actual)
+	}
+
+	assert.Equal(t, result.Value, expected)
+}
+
+func testBooleanObject(t *testing.T, expected bool, actual object.Object) {
+	result, ok := actual.(*object.Boolean)
+	if !ok {
+		t.Fatalf("Object is not a boolean")
+	}
+
+	assert.Equal(t, result.Value, expected)
+}
+
+func testStringObject(t *testing.T, expected string, actual object.Object) {
+	result, ok := actual.(*object.String)
+	if !ok {
+		t.Fatalf("Object is not a string")
+	}
+
+	assert.Equal(t, result.Value, expected)
+}
+
+func testArrayObject(t *testing.T, expected []int, actual object.Object) {
+	result, ok := actual.(*object.Array)
+	if !ok {
+		t.Fatalf("Object is not an array")
+	}
+
+	assert.Equal(t, len(result.Elements), len(expected))
+
+	for i, e := range expected {
+		testIntegerObject(t, int64(e), result.Elements[i])
+	}
+}
+
+func testHashObject(t *testing.T, expected map[object.HashKey]int64, actual object.Object) {
+	result, ok := actual.(*object.Hash)
+	if !ok {
+		t.Fatalf("Object is not a hashmap")
+	}
+
+	assert.Equal(t, len(result.Pairs), len(expected))
+
+	for expectedKey, expectedValue := range expected {
+		pair, ok := result.Pairs[expectedKey]
+		if !ok {
+			t.Fatalf("Key record doesn't exist in hashmap")
+		}
+
+		testIntegerObject(t, expectedValue, pair.Value)
+	}
+}